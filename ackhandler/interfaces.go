@@ -3,6 +3,7 @@ package ackhandler
 import (
 	"time"
 
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
 )
@@ -22,6 +23,22 @@ type SentPacketHandler interface {
 	CheckForError() error
 
 	TimeOfFirstRTO() time.Time
+	RetransmissionTimeout() time.Duration
+	ShouldSendProbe() bool
+
+	SetConnectionOptions(options [][4]byte)
+	SetInitialPacketNumber(p protocol.PacketNumber)
+	SetPacketThreshold(threshold uint32)
+	SetMinRetransmissionTime(min time.Duration)
+	SetTimerJitter(fraction float64)
+	SetMaxConsecutiveRTOs(max uint32)
+	SetCongestionWindowObserver(observer congestion.CongestionWindowObserver)
+	SetPacketAckedObserver(observer PacketAckedObserver)
+}
+
+// A PacketAckedObserver is notified of every packet the peer acked, including packets that were already queued for retransmission
+type PacketAckedObserver interface {
+	OnPacketAcked(packet *Packet)
 }
 
 // ReceivedPacketHandler handles ACKs needed to send for incoming packets
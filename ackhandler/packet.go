@@ -43,7 +43,8 @@ func (p *Packet) GetControlFramesForRetransmission() []frames.Frame {
 
 		_, isAck := frame.(*frames.AckFrame)
 		_, isStopWaiting := frame.(*frames.StopWaitingFrame)
-		if !isAck && !isStopWaiting {
+		_, isDatagram := frame.(*frames.DatagramFrame) // datagrams are unreliable
+		if !isAck && !isStopWaiting && !isDatagram {
 			controlFrames = append(controlFrames, frame)
 		}
 	}
@@ -74,6 +74,15 @@ var _ = Describe("Packet", func() {
 			Expect(controlFrames).ToNot(ContainElement(stopWaitingFrame))
 		})
 
+		It("does not return any DatagramFrames", func() {
+			datagramFrame := &frames.DatagramFrame{Data: []byte("foobar")}
+			packet := Packet{
+				PacketNumber: 1337,
+				Frames:       []frames.Frame{datagramFrame, rstStreamFrame},
+			}
+			Expect(packet.GetControlFramesForRetransmission()).To(Equal([]frames.Frame{rstStreamFrame}))
+		})
+
 		It("returns an empty slice of StreamFrames if no StreamFrames are queued", func() {
 			// overwrite the globally defined packet here
 			packet := Packet{
@@ -27,12 +27,14 @@ type receivedPacketHandler struct {
 
 	packetHistory           map[protocol.PacketNumber]packetHistoryEntry
 	smallestInPacketHistory protocol.PacketNumber
+	receivedPacketHistory   *receivedPacketHistory
 }
 
 // NewReceivedPacketHandler creates a new receivedPacketHandler
 func NewReceivedPacketHandler() ReceivedPacketHandler {
 	return &receivedPacketHandler{
-		packetHistory: make(map[protocol.PacketNumber]packetHistoryEntry),
+		packetHistory:         make(map[protocol.PacketNumber]packetHistoryEntry),
+		receivedPacketHistory: newReceivedPacketHistory(),
 	}
 }
 
@@ -40,8 +42,7 @@ func (h *receivedPacketHandler) ReceivedPacket(packetNumber protocol.PacketNumbe
 	if packetNumber == 0 {
 		return errInvalidPacketNumber
 	}
-	_, ok := h.packetHistory[packetNumber]
-	if packetNumber <= h.highestInOrderObserved || ok {
+	if packetNumber <= h.highestInOrderObserved || !h.receivedPacketHistory.ReceivedPacket(packetNumber) {
 		return ErrDuplicatePacket
 	}
 
@@ -82,31 +83,50 @@ func (h *receivedPacketHandler) ReceivedStopWaiting(f *frames.StopWaitingFrame)
 	return nil
 }
 
-// getNackRanges gets all the NACK ranges
+// getNackRanges gets all the NACK ranges, which are the gaps between the ranges of received packets above the highestInOrderObserved
 func (h *receivedPacketHandler) getNackRanges() ([]frames.NackRange, EntropyAccumulator) {
-	// TODO: use a better data structure here
 	var ranges []frames.NackRange
-	inRange := false
+	ackRanges := h.receivedPacketHistory.GetAckRanges()
+	for i, r := range ackRanges {
+		if r.End <= h.highestInOrderObserved {
+			break
+		}
+		lower := h.highestInOrderObserved
+		if i+1 < len(ackRanges) && ackRanges[i+1].End > lower {
+			lower = ackRanges[i+1].End
+		}
+		if r.Start > lower+1 {
+			ranges = append(ranges, frames.NackRange{
+				FirstPacketNumber: lower + 1,
+				LastPacketNumber:  r.Start - 1,
+			})
+		}
+	}
+	return ranges, h.getEntropy(h.largestObserved)
+}
+
+// getEntropy gets the entropy of all packets up to largestObserved
+func (h *receivedPacketHandler) getEntropy(largestObserved protocol.PacketNumber) EntropyAccumulator {
 	entropy := h.highestInOrderObservedEntropy
-	for i := h.largestObserved; i > h.highestInOrderObserved; i-- {
-		p, ok := h.packetHistory[i]
-		if !ok {
-			if !inRange {
-				r := frames.NackRange{
-					FirstPacketNumber: i,
-					LastPacketNumber:  i,
-				}
-				ranges = append(ranges, r)
-				inRange = true
-			} else {
-				ranges[len(ranges)-1].FirstPacketNumber--
-			}
-		} else {
-			inRange = false
+	for i, p := range h.packetHistory {
+		if i > h.highestInOrderObserved && i <= largestObserved {
 			entropy.Add(i, p.EntropyBit)
 		}
 	}
-	return ranges, entropy
+	return entropy
+}
+
+// truncateNackRanges drops the highest NACK ranges, if they don't fit into an ACK frame
+// It returns the remaining NACK ranges, and the LargestObserved of the truncated ACK frame, which is the highest received packet below the dropped NACK ranges.
+func truncateNackRanges(ranges []frames.NackRange, largestObserved protocol.PacketNumber) ([]frames.NackRange, protocol.PacketNumber, bool) {
+	var numRanges uint64
+	for i := len(ranges) - 1; i >= 0; i-- {
+		numRanges += ranges[i].NumWrittenRanges()
+		if numRanges > frames.MaxNackRanges {
+			return ranges[i+1:], ranges[i].FirstPacketNumber - 1, true
+		}
+	}
+	return ranges, largestObserved, false
 }
 
 func (h *receivedPacketHandler) GetAckFrame(dequeue bool) (*frames.AckFrame, error) {
@@ -122,17 +142,23 @@ func (h *receivedPacketHandler) GetAckFrame(dequeue bool) (*frames.AckFrame, err
 		return h.currentAckFrame, nil
 	}
 
-	p, ok := h.packetHistory[h.largestObserved]
+	nackRanges, entropy := h.getNackRanges()
+	nackRanges, largestObserved, truncated := truncateNackRanges(nackRanges, h.largestObserved)
+	if truncated {
+		entropy = h.getEntropy(largestObserved)
+	}
+
+	p, ok := h.packetHistory[largestObserved]
 	if !ok {
 		return nil, ErrMapAccess
 	}
 	packetReceivedTime := p.TimeReceived
 
-	nackRanges, entropy := h.getNackRanges()
 	h.currentAckFrame = &frames.AckFrame{
-		LargestObserved:    h.largestObserved,
+		LargestObserved:    largestObserved,
 		Entropy:            byte(entropy),
 		NackRanges:         nackRanges,
+		Truncated:          truncated,
 		PacketReceivedTime: packetReceivedTime,
 	}
 	return h.currentAckFrame, nil
@@ -143,4 +169,5 @@ func (h *receivedPacketHandler) garbageCollect() {
 		delete(h.packetHistory, i)
 	}
 	h.smallestInPacketHistory = h.highestInOrderObserved
+	h.receivedPacketHistory.DeleteBelow(h.highestInOrderObserved)
 }
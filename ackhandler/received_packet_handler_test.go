@@ -1,10 +1,12 @@
 package ackhandler
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -196,6 +198,22 @@ var _ = Describe("receivedPacketHandler", func() {
 			Expect(handler.highestInOrderObserved).To(Equal(protocol.PacketNumber(1)))
 			Expect(entropy).To(Equal(expectedEntropy))
 		})
+
+		It("handles reordered packets that fill the gaps", func() {
+			for _, i := range []protocol.PacketNumber{1, 5, 9, 3, 4, 8, 7} {
+				err := handler.ReceivedPacket(i, true)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			nackRanges, _ := handler.getNackRanges()
+			Expect(nackRanges).To(Equal([]frames.NackRange{
+				{FirstPacketNumber: 6, LastPacketNumber: 6},
+				{FirstPacketNumber: 2, LastPacketNumber: 2},
+			}))
+			err := handler.ReceivedPacket(2, true)
+			Expect(err).ToNot(HaveOccurred())
+			nackRanges, _ = handler.getNackRanges()
+			Expect(nackRanges).To(Equal([]frames.NackRange{{FirstPacketNumber: 6, LastPacketNumber: 6}}))
+		})
 	})
 
 	Context("handling STOP_WAITING frames", func() {
@@ -267,6 +285,59 @@ var _ = Describe("receivedPacketHandler", func() {
 			Expect(ack.NackRanges).To(Equal([]frames.NackRange{{FirstPacketNumber: 2, LastPacketNumber: 3}}))
 		})
 
+		It("generates an ACK frame for several disjoint ranges of received packets", func() {
+			entropy := EntropyAccumulator(0)
+			for _, i := range []protocol.PacketNumber{1, 2, 20, 21, 22, 5, 9, 8, 400} {
+				entropyBit := i%3 == 0
+				entropy.Add(i, entropyBit)
+				err := handler.ReceivedPacket(i, entropyBit)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			ack, err := handler.GetAckFrame(true)
+			Expect(err).ToNot(HaveOccurred())
+			b := &bytes.Buffer{}
+			err = ack.Write(b, 32)
+			Expect(err).ToNot(HaveOccurred())
+			frame, err := frames.ParseAckFrame(bytes.NewReader(b.Bytes()), 32)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.LargestObserved).To(Equal(protocol.PacketNumber(400)))
+			Expect(frame.Entropy).To(Equal(byte(entropy)))
+			Expect(frame.Truncated).To(BeFalse())
+			Expect(frame.NackRanges).To(Equal([]frames.NackRange{
+				{FirstPacketNumber: 23, LastPacketNumber: 399},
+				{FirstPacketNumber: 10, LastPacketNumber: 19},
+				{FirstPacketNumber: 6, LastPacketNumber: 7},
+				{FirstPacketNumber: 3, LastPacketNumber: 4},
+			}))
+		})
+
+		It("truncates ACK frames with too many NACK ranges", func() {
+			// receive every other packet, so that every missing packet is a NACK range
+			const numRanges = frames.MaxNackRanges + 10
+			entropy := EntropyAccumulator(0)
+			for i := protocol.PacketNumber(1); i <= 2*numRanges+1; i += 2 {
+				if i <= 2*frames.MaxNackRanges+1 {
+					entropy.Add(i, true)
+				}
+				err := handler.ReceivedPacket(i, true)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			ack, err := handler.GetAckFrame(true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ack.Truncated).To(BeTrue())
+			Expect(ack.LargestObserved).To(Equal(protocol.PacketNumber(2*frames.MaxNackRanges + 1)))
+			Expect(ack.Entropy).To(Equal(byte(entropy)))
+			Expect(ack.NackRanges).To(HaveLen(frames.MaxNackRanges))
+			Expect(ack.NackRanges[0]).To(Equal(frames.NackRange{FirstPacketNumber: 2 * frames.MaxNackRanges, LastPacketNumber: 2 * frames.MaxNackRanges}))
+			Expect(ack.NackRanges[frames.MaxNackRanges-1]).To(Equal(frames.NackRange{FirstPacketNumber: 2, LastPacketNumber: 2}))
+			b := &bytes.Buffer{}
+			err = ack.Write(b, 32)
+			Expect(err).ToNot(HaveOccurred())
+			frame, err := frames.ParseAckFrame(bytes.NewReader(b.Bytes()), 32)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.NackRanges).To(Equal(ack.NackRanges))
+		})
+
 		It("does not generate an ACK if an ACK has already been sent for the largest Packet", func() {
 			err := handler.ReceivedPacket(protocol.PacketNumber(1), false)
 			Expect(err).ToNot(HaveOccurred())
@@ -355,5 +426,15 @@ var _ = Describe("receivedPacketHandler", func() {
 			Expect(handler.packetHistory).ToNot(HaveKey(protocol.PacketNumber(2)))
 			Expect(handler.packetHistory).To(HaveKey(protocol.PacketNumber(4)))
 		})
+
+		It("garbage collects the receivedPacketHistory", func() {
+			handler.ReceivedPacket(1, true)
+			handler.ReceivedPacket(2, true)
+			handler.ReceivedPacket(4, true)
+			handler.ReceivedPacket(6, true)
+			swf := frames.StopWaitingFrame{LeastUnacked: 6}
+			handler.ReceivedStopWaiting(&swf)
+			Expect(handler.receivedPacketHistory.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 6, End: 6}}))
+		})
 	})
 })
@@ -0,0 +1,74 @@
+package ackhandler
+
+import (
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// receivedPacketHistory stores the packet numbers of received packets as contiguous ranges
+// The ranges are sorted by packet number, and two ranges never touch or overlap.
+type receivedPacketHistory struct {
+	ranges *utils.PacketIntervalList
+}
+
+func newReceivedPacketHistory() *receivedPacketHistory {
+	return &receivedPacketHistory{
+		ranges: utils.NewPacketIntervalList(),
+	}
+}
+
+// ReceivedPacket registers a packet with packet number p
+// It returns false if the packet was already registered before.
+func (h *receivedPacketHistory) ReceivedPacket(p protocol.PacketNumber) bool {
+	// iterate backwards, since new packets usually extend the last range
+	for el := h.ranges.Back(); el != nil; el = el.Prev() {
+		r := &el.Value
+		if p > r.End+1 {
+			h.ranges.InsertAfter(utils.PacketInterval{Start: p, End: p}, el)
+			return true
+		}
+		if p == r.End+1 {
+			r.End = p
+			return true
+		}
+		if p >= r.Start {
+			return false
+		}
+		if p == r.Start-1 {
+			r.Start = p
+			// merge with the previous range, if the gap between them was just closed
+			if prev := el.Prev(); prev != nil && prev.Value.End+1 == p {
+				r.Start = prev.Value.Start
+				h.ranges.Remove(prev)
+			}
+			return true
+		}
+	}
+	h.ranges.PushFront(utils.PacketInterval{Start: p, End: p})
+	return true
+}
+
+// DeleteBelow deletes all packet numbers smaller than p
+func (h *receivedPacketHistory) DeleteBelow(p protocol.PacketNumber) {
+	var next *utils.PacketIntervalElement
+	for el := h.ranges.Front(); el != nil; el = next {
+		next = el.Next()
+		if el.Value.End < p {
+			h.ranges.Remove(el)
+			continue
+		}
+		if el.Value.Start < p {
+			el.Value.Start = p
+		}
+		return
+	}
+}
+
+// GetAckRanges returns the ranges of received packets, the range with the highest packet numbers first
+func (h *receivedPacketHistory) GetAckRanges() []utils.PacketInterval {
+	ranges := make([]utils.PacketInterval, 0, h.ranges.Len())
+	for el := h.ranges.Back(); el != nil; el = el.Prev() {
+		ranges = append(ranges, el.Value)
+	}
+	return ranges
+}
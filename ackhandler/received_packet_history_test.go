@@ -0,0 +1,113 @@
+package ackhandler
+
+import (
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("receivedPacketHistory", func() {
+	var hist *receivedPacketHistory
+
+	BeforeEach(func() {
+		hist = newReceivedPacketHistory()
+	})
+
+	receive := func(packetNumbers ...protocol.PacketNumber) {
+		for _, p := range packetNumbers {
+			Expect(hist.ReceivedPacket(p)).To(BeTrue())
+		}
+	}
+
+	Context("ranges", func() {
+		It("adds the first packet", func() {
+			receive(4)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 4, End: 4}}))
+		})
+
+		It("extends a range at the end", func() {
+			receive(4, 5, 6)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 4, End: 6}}))
+		})
+
+		It("extends a range at the front", func() {
+			receive(4, 3)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 3, End: 4}}))
+		})
+
+		It("creates new ranges, the highest range first", func() {
+			receive(4, 10, 7, 1)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{
+				{Start: 10, End: 10},
+				{Start: 7, End: 7},
+				{Start: 4, End: 4},
+				{Start: 1, End: 1},
+			}))
+		})
+
+		It("merges two ranges when a packet closes the gap between them", func() {
+			receive(4, 6)
+			receive(5)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 4, End: 6}}))
+			Expect(hist.ranges.Len()).To(Equal(1))
+		})
+
+		It("handles reordered packets", func() {
+			receive(1, 2, 9, 6, 3, 8, 5, 12)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{
+				{Start: 12, End: 12},
+				{Start: 8, End: 9},
+				{Start: 5, End: 6},
+				{Start: 1, End: 3},
+			}))
+			receive(4, 7, 10, 11)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{{Start: 1, End: 12}}))
+		})
+
+		It("detects duplicate packets", func() {
+			receive(1, 2, 3, 7, 8, 12)
+			for _, p := range []protocol.PacketNumber{1, 2, 3, 7, 8, 12} {
+				Expect(hist.ReceivedPacket(p)).To(BeFalse())
+			}
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{
+				{Start: 12, End: 12},
+				{Start: 7, End: 8},
+				{Start: 1, End: 3},
+			}))
+		})
+	})
+
+	Context("deleting", func() {
+		BeforeEach(func() {
+			receive(1, 2, 3, 6, 7, 10)
+		})
+
+		It("deletes whole ranges", func() {
+			hist.DeleteBelow(6)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{
+				{Start: 10, End: 10},
+				{Start: 6, End: 7},
+			}))
+		})
+
+		It("deletes a part of a range", func() {
+			hist.DeleteBelow(7)
+			Expect(hist.GetAckRanges()).To(Equal([]utils.PacketInterval{
+				{Start: 10, End: 10},
+				{Start: 7, End: 7},
+			}))
+		})
+
+		It("deletes all ranges", func() {
+			hist.DeleteBelow(11)
+			Expect(hist.GetAckRanges()).To(BeEmpty())
+		})
+
+		It("does nothing when all packets are larger", func() {
+			hist.DeleteBelow(1)
+			Expect(hist.GetAckRanges()).To(HaveLen(3))
+		})
+	})
+})
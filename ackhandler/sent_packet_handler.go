@@ -2,6 +2,8 @@ package ackhandler
 
 import (
 	"errors"
+	"math"
+	"math/rand"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/congestion"
@@ -21,8 +23,15 @@ var (
 	// ErrTooManyTrackedSentPackets occurs when the sentPacketHandler has to keep track of too many packets
 	ErrTooManyTrackedSentPackets = errors.New("Too many outstanding non-acked and non-retransmitted packets")
 	errAckForUnsentPacket        = qerr.Error(qerr.InvalidAckData, "Received ACK for an unsent package")
+	// ErrPacketNumberSpaceExhausted occurs when the packet numbers are about to wrap around
+	ErrPacketNumberSpaceExhausted = qerr.Error(qerr.InternalError, "packet number space exhausted")
+	// ErrTooManyRTOs occurs when the peer didn't ack anything for more consecutive RTOs than allowed, i.e. when it is probably unreachable
+	ErrTooManyRTOs = qerr.Error(qerr.TooManyRtos, "no ACK received for too many consecutive RTOs")
 )
 
+// timeThreshold is the maximum time a packet may be outstanding, in multiples of the RTT, before it is considered lost when a later packet is acked
+const timeThreshold = 9.0 / 8
+
 var (
 	errDuplicatePacketNumber      = errors.New("Packet number already exists in Packet History")
 	errWrongPacketNumberIncrement = errors.New("Packet number must be increased by exactly 1")
@@ -44,16 +53,38 @@ type sentPacketHandler struct {
 
 	bytesInFlight protocol.ByteCount
 
+	// packetThreshold is the number of later packets that have to be acked, so that a NACKed packet is considered lost.
+	// If 0, packets are only retransmitted after protocol.RetransmissionThreshold NACKs or an RTO.
+	packetThreshold uint32
+
+	// minRetransmissionTime is the lower bound for the RTO, before the exponential backoff
+	minRetransmissionTime time.Duration
+
+	rtoCount  uint32 // number of consecutive RTOs without receiving an ACK, used for the exponential backoff
+	sendProbe bool   // set when an RTO fires, until a probe packet is sent
+	// maxConsecutiveRTOs is the number of consecutive RTOs without receiving an ACK after which CheckForError fails. If 0, there is no limit.
+	maxConsecutiveRTOs uint32
+
+	// rtoJitterFraction is the maximum jitter applied to the RTO timer, as a fraction of the RTO
+	rtoJitterFraction float64
+	// rtoJitter is the jitter of the currently armed RTO timer, as a fraction of the RTO. It is drawn from rand whenever the timer is armed.
+	rtoJitter float64
+	rand      *rand.Rand
+
 	rttStats   *congestion.RTTStats
 	congestion congestion.SendAlgorithm
+	clock      congestion.Clock
+
+	ackedObserver PacketAckedObserver
 }
 
 // NewSentPacketHandler creates a new sentPacketHandler
 func NewSentPacketHandler(stopWaitingManager StopWaitingManager) SentPacketHandler {
 	rttStats := &congestion.RTTStats{}
+	clock := congestion.DefaultClock{}
 
 	congestion := congestion.NewCubicSender(
-		congestion.DefaultClock{},
+		clock,
 		rttStats,
 		false, /* don't use reno since chromium doesn't (why?) */
 		protocol.InitialCongestionWindow,
@@ -65,6 +96,11 @@ func NewSentPacketHandler(stopWaitingManager StopWaitingManager) SentPacketHandl
 		stopWaitingManager: stopWaitingManager,
 		rttStats:           rttStats,
 		congestion:         congestion,
+		packetThreshold:    protocol.DefaultPacketThreshold,
+		clock:              clock,
+
+		minRetransmissionTime: protocol.DefaultMinRetransmissionTime,
+		rand:                  rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
@@ -77,6 +113,10 @@ func (h *sentPacketHandler) ackPacket(packetNumber protocol.PacketNumber) *Packe
 
 	h.stopWaitingManager.ReceivedAckForPacketNumber(packetNumber)
 
+	if ok && h.ackedObserver != nil {
+		h.ackedObserver.OnPacketAcked(packet)
+	}
+
 	return packet
 }
 
@@ -102,6 +142,27 @@ func (h *sentPacketHandler) nackPacket(packetNumber protocol.PacketNumber) (*Pac
 	return nil, nil
 }
 
+// maybeDeclarePacketLost retransmits a NACKed packet if enough later packets were acked, or if it was sent too long ago
+func (h *sentPacketHandler) maybeDeclarePacketLost(packetNumber protocol.PacketNumber, numAckedLater uint32, now time.Time) *Packet {
+	packet, ok := h.packetHistory[packetNumber]
+	if !ok || packet.Retransmitted {
+		return nil
+	}
+	exceedsPacketThreshold := h.packetThreshold != 0 && numAckedLater >= h.packetThreshold
+	exceedsTimeThreshold := now.Sub(packet.sendTime) > h.lossDelay()
+	if !exceedsPacketThreshold && !exceedsTimeThreshold {
+		return nil
+	}
+	h.queuePacketForRetransmission(packet)
+	return packet
+}
+
+// lossDelay is the time after which a packet is considered lost, if a later packet was acked
+func (h *sentPacketHandler) lossDelay() time.Duration {
+	rtt := utils.MaxDuration(h.rttStats.SmoothedRTT(), h.rttStats.LatestRTT())
+	return time.Duration(timeThreshold * float64(rtt))
+}
+
 func (h *sentPacketHandler) queuePacketForRetransmission(packet *Packet) {
 	h.bytesInFlight -= packet.Length
 	h.retransmissionQueue = append(h.retransmissionQueue, packet)
@@ -118,9 +179,13 @@ func (h *sentPacketHandler) SentPacket(packet *Packet) error {
 	if h.lastSentPacketNumber+1 != packet.PacketNumber {
 		return errWrongPacketNumberIncrement
 	}
-	now := time.Now()
+	if packet.PacketNumber > protocol.MaxPacketNumber {
+		return ErrPacketNumberSpaceExhausted
+	}
+	now := h.clock.Now()
 	h.lastSentPacketTime = now
 	packet.sendTime = now
+	h.drawRTOJitter()
 	if packet.Length == 0 {
 		return errors.New("SentPacketHandler: packet cannot be empty")
 	}
@@ -132,7 +197,7 @@ func (h *sentPacketHandler) SentPacket(packet *Packet) error {
 	h.packetHistory[packet.PacketNumber] = packet
 
 	h.congestion.OnPacketSent(
-		time.Now(),
+		now,
 		h.BytesInFlight(),
 		packet.PacketNumber,
 		packet.Length,
@@ -192,12 +257,15 @@ func (h *sentPacketHandler) ReceivedAck(ackFrame *frames.AckFrame) error {
 
 	// Entropy ok. Now actually process the ACK packet
 	h.LargestObserved = ackFrame.LargestObserved
+	h.rtoCount = 0
 	highestInOrderAckedPacketNumber := ackFrame.GetHighestInOrderPacketNumber()
 
 	// Update the RTT
-	timeDelta := time.Now().Sub(h.packetHistory[h.LargestObserved].sendTime)
+	now := h.clock.Now()
+	timeDelta := now.Sub(h.packetHistory[h.LargestObserved].sendTime)
 	// TODO: Don't always update RTT
-	h.rttStats.UpdateRTT(timeDelta, ackFrame.DelayTime, time.Now())
+	// The peer shouldn't delay acks by more than the max ack delay, so a larger DelayTime would underestimate the RTT
+	h.rttStats.UpdateRTT(timeDelta, utils.MinDuration(ackFrame.DelayTime, protocol.MaxAckDelay), now)
 	utils.Debugf("\tEstimated RTT: %dms", h.rttStats.SmoothedRTT()/time.Millisecond)
 
 	var ackedPackets congestion.PacketVector
@@ -214,6 +282,7 @@ func (h *sentPacketHandler) ReceivedAck(ackFrame *frames.AckFrame) error {
 	if ackFrame.HasNACK() {
 		nackRangeIndex := 0
 		nackRange := ackFrame.NackRanges[nackRangeIndex]
+		var numAckedLater uint32
 		for i := ackFrame.LargestObserved; i > ackFrame.GetHighestInOrderPacketNumber(); i-- {
 			if i < nackRange.FirstPacketNumber {
 				nackRangeIndex++
@@ -226,10 +295,14 @@ func (h *sentPacketHandler) ReceivedAck(ackFrame *frames.AckFrame) error {
 				if err != nil {
 					return err
 				}
+				if p == nil {
+					p = h.maybeDeclarePacketLost(i, numAckedLater, now)
+				}
 				if p != nil {
 					lostPackets = append(lostPackets, congestion.PacketInfo{Number: p.PacketNumber, Length: p.Length})
 				}
 			} else {
+				numAckedLater++
 				p := h.ackPacket(i)
 				if p != nil {
 					ackedPackets = append(ackedPackets, congestion.PacketInfo{Number: p.PacketNumber, Length: p.Length})
@@ -299,11 +372,17 @@ func (h *sentPacketHandler) CheckForError() error {
 	if uint32(length) > protocol.MaxTrackedSentPackets {
 		return ErrTooManyTrackedSentPackets
 	}
+	if h.lastSentPacketNumber >= protocol.MaxPacketNumber-protocol.PacketNumberExhaustionMargin {
+		return ErrPacketNumberSpaceExhausted
+	}
+	if h.maxConsecutiveRTOs > 0 && h.rtoCount > h.maxConsecutiveRTOs {
+		return ErrTooManyRTOs
+	}
 	return nil
 }
 
 func (h *sentPacketHandler) maybeQueuePacketsRTO() {
-	if time.Now().Before(h.TimeOfFirstRTO()) {
+	if h.clock.Now().Before(h.TimeOfFirstRTO()) {
 		return
 	}
 	for p := h.highestInOrderAckedPacketNumber + 1; p <= h.lastSentPacketNumber; p++ {
@@ -311,6 +390,9 @@ func (h *sentPacketHandler) maybeQueuePacketsRTO() {
 		if packet != nil && !packet.Retransmitted {
 			h.queuePacketForRetransmission(packet)
 			h.congestion.OnRetransmissionTimeout(true)
+			h.rtoCount++
+			h.sendProbe = true
+			h.drawRTOJitter()
 			return
 		}
 	}
@@ -321,12 +403,103 @@ func (h *sentPacketHandler) getRTO() time.Duration {
 	if rto == 0 {
 		rto = protocol.DefaultRetransmissionTime
 	}
-	return utils.MaxDuration(rto, protocol.MinRetransmissionTime)
+	rto = utils.MaxDuration(rto, h.minRetransmissionTime)
+	// exponential backoff
+	for i := uint32(0); i < h.rtoCount && rto < protocol.MaxRetransmissionTime; i++ {
+		rto *= 2
+	}
+	return utils.MinDuration(rto, protocol.MaxRetransmissionTime)
+}
+
+// drawRTOJitter draws the jitter for the RTO timer that is armed next, uniformly distributed in [-rtoJitterFraction, rtoJitterFraction]
+func (h *sentPacketHandler) drawRTOJitter() {
+	if h.rtoJitterFraction == 0 {
+		return
+	}
+	h.rtoJitter = (2*h.rand.Float64() - 1) * h.rtoJitterFraction
+}
+
+// SetConnectionOptions applies the connection options relevant for congestion control.
+// Unknown options are ignored.
+func (h *sentPacketHandler) SetConnectionOptions(options [][4]byte) {
+	for _, o := range options {
+		switch o {
+		case [4]byte{'1', 'C', 'O', 'N'}:
+			// emulate a single TCP connection instead of the default of 2
+			h.congestion.SetNumEmulatedConnections(1)
+		case [4]byte{'S', 'S', 'L', 'R'}:
+			h.congestion.SetSlowStartLargeReduction(true)
+		}
+	}
+}
+
+// SetPacketThreshold sets the number of later packets that have to be acked, so that a NACKed packet is considered lost.
+// 0 disables this loss detection.
+func (h *sentPacketHandler) SetPacketThreshold(threshold uint32) {
+	h.packetThreshold = threshold
+}
+
+// SetMinRetransmissionTime sets the lower bound for the RTO.
+// If 0, protocol.DefaultMinRetransmissionTime is used.
+func (h *sentPacketHandler) SetMinRetransmissionTime(min time.Duration) {
+	if min == 0 {
+		min = protocol.DefaultMinRetransmissionTime
+	}
+	h.minRetransmissionTime = min
+}
+
+// SetTimerJitter sets the maximum random jitter applied to the RTO timer, as a fraction of the RTO.
+// It avoids retransmissions of many connections firing at the same time. Values are capped to [0, protocol.MaxTimerJitter].
+func (h *sentPacketHandler) SetTimerJitter(fraction float64) {
+	h.rtoJitterFraction = math.Max(0, math.Min(fraction, protocol.MaxTimerJitter))
+	h.rtoJitter = 0
+	h.drawRTOJitter()
+}
+
+// SetInitialPacketNumber sets the packet number of the first packet that is sent. It must be called before any packet is sent.
+func (h *sentPacketHandler) SetInitialPacketNumber(p protocol.PacketNumber) {
+	h.lastSentPacketNumber = p - 1
+	h.highestInOrderAckedPacketNumber = p - 1
+	h.LargestObserved = p - 1
+}
+
+// SetMaxConsecutiveRTOs sets the number of probes sent after consecutive RTOs without receiving an ACK.
+// When the next RTO fires, CheckForError returns ErrTooManyRTOs. If 0, there is no limit.
+func (h *sentPacketHandler) SetMaxConsecutiveRTOs(max uint32) {
+	h.maxConsecutiveRTOs = max
+}
+
+// SetCongestionWindowObserver sets an observer that is notified of all changes to the congestion window
+func (h *sentPacketHandler) SetCongestionWindowObserver(observer congestion.CongestionWindowObserver) {
+	h.congestion.SetCongestionWindowObserver(observer)
+}
+
+// SetPacketAckedObserver sets an observer that is notified of every acked packet
+func (h *sentPacketHandler) SetPacketAckedObserver(observer PacketAckedObserver) {
+	h.ackedObserver = observer
+}
+
+// ShouldSendProbe returns true once after an RTO fired.
+// The next packet sent should then be retransmittable, to elicit an ACK from the peer.
+func (h *sentPacketHandler) ShouldSendProbe() bool {
+	sendProbe := h.sendProbe
+	h.sendProbe = false
+	return sendProbe
+}
+
+// RetransmissionTimeout returns the current RTO, including the exponential backoff
+func (h *sentPacketHandler) RetransmissionTimeout() time.Duration {
+	return h.getRTO()
 }
 
+// TimeOfFirstRTO returns the time the RTO timer fires, including the jitter.
+// The jittered RTO stays within [minRetransmissionTime, protocol.MaxRetransmissionTime].
 func (h *sentPacketHandler) TimeOfFirstRTO() time.Time {
 	if h.lastSentPacketTime.IsZero() {
 		return time.Time{}
 	}
-	return h.lastSentPacketTime.Add(h.getRTO())
+	rto := h.getRTO()
+	rto += time.Duration(h.rtoJitter * float64(rto))
+	rto = utils.MinDuration(utils.MaxDuration(rto, h.minRetransmissionTime), protocol.MaxRetransmissionTime)
+	return h.lastSentPacketTime.Add(rto)
 }
@@ -1,6 +1,7 @@
 package ackhandler
 
 import (
+	"math/rand"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/congestion"
@@ -15,6 +16,7 @@ type mockCongestion struct {
 	argsOnPacketSent        []interface{}
 	argsOnCongestionEvent   []interface{}
 	onRetransmissionTimeout bool
+	observer                congestion.CongestionWindowObserver
 }
 
 func (m *mockCongestion) TimeUntilSend(now time.Time, bytesInFlight protocol.ByteCount) time.Duration {
@@ -49,6 +51,22 @@ func (m *mockCongestion) RetransmissionDelay() time.Duration {
 func (m *mockCongestion) SetNumEmulatedConnections(n int)         { panic("not implemented") }
 func (m *mockCongestion) OnConnectionMigration()                  { panic("not implemented") }
 func (m *mockCongestion) SetSlowStartLargeReduction(enabled bool) { panic("not implemented") }
+func (m *mockCongestion) SetCongestionWindowObserver(observer congestion.CongestionWindowObserver) {
+	m.observer = observer
+}
+
+type mockCongestionWindowObserver struct{}
+
+func (*mockCongestionWindowObserver) OnCongestionWindowChange(protocol.ByteCount, protocol.ByteCount) {
+}
+
+type mockPacketAckedObserver struct {
+	acked []protocol.PacketNumber
+}
+
+func (o *mockPacketAckedObserver) OnPacketAcked(packet *Packet) {
+	o.acked = append(o.acked, packet.PacketNumber)
+}
 
 type mockStopWaiting struct {
 	receivedAckForPacketNumber protocol.PacketNumber
@@ -63,15 +81,26 @@ func (m *mockStopWaiting) ReceivedAckForPacketNumber(packetNumber protocol.Packe
 	m.receivedAckForPacketNumber = packetNumber
 }
 
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time { return c.now }
+
+func (c *mockClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
 var _ = Describe("SentPacketHandler", func() {
 	var (
 		handler     *sentPacketHandler
+		clock       *mockClock
 		streamFrame frames.StreamFrame
 	)
 
 	BeforeEach(func() {
 		stopWaitingManager := &mockStopWaiting{}
 		handler = NewSentPacketHandler(stopWaitingManager).(*sentPacketHandler)
+		clock = &mockClock{now: time.Now()}
+		handler.clock = clock
 		streamFrame = frames.StreamFrame{
 			StreamID: 5,
 			Data:     []byte{0x13, 0x37},
@@ -153,6 +182,20 @@ var _ = Describe("SentPacketHandler", func() {
 			Expect(handler.packetHistory[2].Entropy).To(Equal(entropy))
 		})
 
+		It("starts at the initial packet number", func() {
+			handler.SetInitialPacketNumber(1000)
+			err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{&streamFrame}, Length: 1})
+			Expect(err).To(MatchError(errWrongPacketNumberIncrement))
+			packet := Packet{PacketNumber: 1000, Frames: []frames.Frame{&streamFrame}, EntropyBit: true, Length: 1}
+			err = handler.SentPacket(&packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.lastSentPacketNumber).To(Equal(protocol.PacketNumber(1000)))
+			err = handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1000, Entropy: byte(packet.Entropy)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.BytesInFlight()).To(BeZero())
+			Expect(handler.highestInOrderAckedPacketNumber).To(Equal(protocol.PacketNumber(1000)))
+		})
+
 		It("stores the sent time", func() {
 			packet := Packet{PacketNumber: 1, Frames: []frames.Frame{&streamFrame}, EntropyBit: true, Length: 1}
 			err := handler.SentPacket(&packet)
@@ -179,6 +222,27 @@ var _ = Describe("SentPacketHandler", func() {
 			Expect(err).To(MatchError(ErrTooManyTrackedSentPackets))
 		})
 
+		It("closes the connection before the packet numbers wrap around", func() {
+			start := protocol.MaxPacketNumber - protocol.PacketNumberExhaustionMargin - 2
+			handler.lastSentPacketNumber = start
+			packet := Packet{PacketNumber: start + 1, Frames: []frames.Frame{&streamFrame}, Length: 1}
+			err := handler.SentPacket(&packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.CheckForError()).ToNot(HaveOccurred())
+			packet = Packet{PacketNumber: start + 2, Frames: []frames.Frame{&streamFrame}, Length: 1}
+			err = handler.SentPacket(&packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.CheckForError()).To(MatchError(ErrPacketNumberSpaceExhausted))
+		})
+
+		It("rejects packet numbers that can't be encoded", func() {
+			handler.lastSentPacketNumber = protocol.MaxPacketNumber
+			packet := Packet{PacketNumber: protocol.MaxPacketNumber + 1, Frames: []frames.Frame{&streamFrame}, Length: 1}
+			err := handler.SentPacket(&packet)
+			Expect(err).To(MatchError(ErrPacketNumberSpaceExhausted))
+			Expect(handler.packetHistory).To(BeEmpty())
+		})
+
 		// TODO: add a test that the length of the retransmission queue is considered, even if packets have already been ACKed. Relevant once we drop support for QUIC 33 and earlier
 	})
 
@@ -327,6 +391,26 @@ var _ = Describe("SentPacketHandler", func() {
 			Expect(handler.packetHistory).To(HaveKey(protocol.PacketNumber(5)))
 			Expect(handler.packetHistory).ToNot(HaveKey(protocol.PacketNumber(6)))
 		})
+
+		It("notifies the observer of acked packets", func() {
+			observer := &mockPacketAckedObserver{}
+			handler.SetPacketAckedObserver(observer)
+			entropy := EntropyAccumulator(0)
+			for i := 0; i < 4; i++ {
+				if i == 2 { // Packet Number 3 missing
+					continue
+				}
+				entropy.Add(packets[i].PacketNumber, packets[i].EntropyBit)
+			}
+			ack := frames.AckFrame{
+				LargestObserved: 4,
+				Entropy:         byte(entropy),
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 3, LastPacketNumber: 3}},
+			}
+			err := handler.ReceivedAck(&ack)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(observer.acked).To(ConsistOf(protocol.PacketNumber(1), protocol.PacketNumber(2), protocol.PacketNumber(4)))
+		})
 	})
 
 	Context("ACK processing", func() { // in all these tests, the EntropyBit of each Packet is set to false, so that the resulting EntropyByte will always be 0
@@ -407,11 +491,17 @@ var _ = Describe("SentPacketHandler", func() {
 			})
 
 			It("uses the DelayTime in the ack frame", func() {
-				now := time.Now()
-				handler.packetHistory[1].sendTime = now.Add(-10 * time.Minute)
-				err := handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1, DelayTime: 5 * time.Minute})
+				handler.packetHistory[1].sendTime = clock.Now().Add(-100 * time.Millisecond)
+				err := handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1, DelayTime: 20 * time.Millisecond})
 				Expect(err).NotTo(HaveOccurred())
-				Expect(handler.rttStats.LatestRTT()).To(BeNumerically("~", 5*time.Minute, 1*time.Second))
+				Expect(handler.rttStats.LatestRTT()).To(Equal(80 * time.Millisecond))
+			})
+
+			It("doesn't subtract more than the max ack delay", func() {
+				handler.packetHistory[1].sendTime = clock.Now().Add(-100 * time.Millisecond)
+				err := handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1, DelayTime: 80 * time.Millisecond})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handler.rttStats.LatestRTT()).To(Equal(100*time.Millisecond - protocol.MaxAckDelay))
 			})
 		})
 	})
@@ -522,6 +612,106 @@ var _ = Describe("SentPacketHandler", func() {
 		})
 	})
 
+	Context("packet threshold loss detection", func() {
+		BeforeEach(func() {
+			for i := protocol.PacketNumber(1); i <= 5; i++ {
+				err := handler.SentPacket(&Packet{PacketNumber: i, Frames: []frames.Frame{&streamFrame}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("retransmits a packet after three later packets were acked", func() {
+			err := handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 3,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+			err = handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 4,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.DequeuePacketForRetransmission().PacketNumber).To(Equal(protocol.PacketNumber(1)))
+			Expect(handler.BytesInFlight()).To(Equal(protocol.ByteCount(1)))
+		})
+
+		It("doesn't count NACKed packets as acked", func() {
+			err := handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 5,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 3, LastPacketNumber: 4}, {FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			// only 2 and 5 were acked
+			Expect(handler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+			Expect(handler.packetHistory[1].MissingReports).To(Equal(uint8(1)))
+		})
+
+		Context("time threshold", func() {
+			BeforeEach(func() {
+				handler.SetPacketThreshold(0)
+				// get an RTT sample of 100ms
+				clock.Advance(100 * time.Millisecond)
+				err := handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handler.rttStats.SmoothedRTT()).To(Equal(100 * time.Millisecond))
+			})
+
+			sendAndAck := func() {
+				err := handler.SentPacket(&Packet{PacketNumber: 6, Frames: []frames.Frame{&streamFrame}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+				clock.Advance(100 * time.Millisecond)
+				err = handler.ReceivedAck(&frames.AckFrame{
+					LargestObserved: 6,
+					NackRanges:      []frames.NackRange{{FirstPacketNumber: 2, LastPacketNumber: 5}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			It("declares packets lost that were sent more than 9/8 RTT before an acked packet", func() {
+				// packets 2 to 5 were sent 200ms ago, which is more than 9/8 * 100ms
+				sendAndAck()
+				Expect(handler.DequeuePacketForRetransmission()).ToNot(BeNil())
+				Expect(handler.packetHistory[2].Retransmitted).To(BeTrue())
+				Expect(handler.packetHistory[5].Retransmitted).To(BeTrue())
+			})
+
+			It("doesn't declare packets lost before the threshold", func() {
+				for i := protocol.PacketNumber(2); i <= 5; i++ {
+					handler.packetHistory[i].sendTime = clock.Now()
+				}
+				// packets 2 to 5 were sent 100ms ago, which is less than 9/8 * 100ms
+				sendAndAck()
+				Expect(handler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+			})
+		})
+
+		It("uses the configured threshold", func() {
+			handler.SetPacketThreshold(1)
+			err := handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 2,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.DequeuePacketForRetransmission().PacketNumber).To(Equal(protocol.PacketNumber(1)))
+		})
+
+		It("doesn't retransmit a packet twice", func() {
+			err := handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 4,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.DequeuePacketForRetransmission()).ToNot(BeNil())
+			err = handler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 5,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 1, LastPacketNumber: 1}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+		})
+	})
+
 	Context("calculating bytes in flight", func() {
 		It("works in a typical retransmission scenarios", func() {
 			packet1 := Packet{PacketNumber: 1, Frames: []frames.Frame{&streamFrame}, EntropyBit: false, Length: 1}
@@ -590,6 +780,7 @@ var _ = Describe("SentPacketHandler", func() {
 		})
 
 		It("should call OnCongestionEvent", func() {
+			handler.SetPacketThreshold(0) // only lose the packet after enough NACKs
 			handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
 			handler.SentPacket(&Packet{PacketNumber: 2, Frames: []frames.Frame{}, Length: 2})
 			handler.SentPacket(&Packet{PacketNumber: 3, Frames: []frames.Frame{}, Length: 3})
@@ -637,6 +828,29 @@ var _ = Describe("SentPacketHandler", func() {
 		})
 	})
 
+	It("passes the congestion window observer to the congestion controller", func() {
+		cong := &mockCongestion{}
+		handler.congestion = cong
+		observer := &mockCongestionWindowObserver{}
+		handler.SetCongestionWindowObserver(observer)
+		Expect(cong.observer).To(Equal(observer))
+	})
+
+	Context("connection options", func() {
+		It("emulates a single connection with 1CON", func() {
+			cong := handler.congestion.(congestion.SendAlgorithmWithDebugInfo)
+			Expect(cong.RenoBeta()).To(BeNumerically("~", 0.85, 0.001)) // 2 emulated connections
+			handler.SetConnectionOptions([][4]byte{{'1', 'C', 'O', 'N'}})
+			Expect(cong.RenoBeta()).To(BeNumerically("~", 0.7, 0.001))
+		})
+
+		It("ignores unknown options", func() {
+			cong := handler.congestion.(congestion.SendAlgorithmWithDebugInfo)
+			handler.SetConnectionOptions([][4]byte{{'T', 'B', 'B', 'R'}})
+			Expect(cong.RenoBeta()).To(BeNumerically("~", 0.85, 0.001))
+		})
+	})
+
 	Context("calculating RTO", func() {
 		It("uses default RTO", func() {
 			Expect(handler.getRTO()).To(Equal(protocol.DefaultRetransmissionTime))
@@ -652,7 +866,28 @@ var _ = Describe("SentPacketHandler", func() {
 		It("limits RTO min", func() {
 			rtt := time.Millisecond
 			handler.rttStats.UpdateRTT(rtt, 0, time.Now())
-			Expect(handler.getRTO()).To(Equal(protocol.MinRetransmissionTime))
+			Expect(handler.getRTO()).To(Equal(protocol.DefaultMinRetransmissionTime))
+		})
+
+		It("uses the configured minimum RTO", func() {
+			handler.SetMinRetransmissionTime(time.Second)
+			handler.rttStats.UpdateRTT(time.Microsecond, 0, time.Now())
+			Expect(handler.getRTO()).To(Equal(time.Second))
+			handler.rtoCount = 1
+			Expect(handler.getRTO()).To(Equal(2 * time.Second))
+		})
+
+		It("uses the default minimum RTO if set to 0", func() {
+			handler.SetMinRetransmissionTime(time.Second)
+			handler.SetMinRetransmissionTime(0)
+			handler.rttStats.UpdateRTT(time.Microsecond, 0, time.Now())
+			Expect(handler.getRTO()).To(Equal(protocol.DefaultMinRetransmissionTime))
+		})
+
+		It("returns the RTO", func() {
+			handler.rtoCount = 1
+			Expect(handler.RetransmissionTimeout()).To(Equal(handler.getRTO()))
+			Expect(handler.RetransmissionTimeout()).To(Equal(2 * protocol.DefaultRetransmissionTime))
 		})
 	})
 
@@ -668,6 +903,96 @@ var _ = Describe("SentPacketHandler", func() {
 				Expect(handler.TimeOfFirstRTO().Sub(time.Now())).To(BeNumerically("~", protocol.DefaultRetransmissionTime, time.Millisecond))
 			})
 
+			It("never fires before the minimum RTO, even with a tiny RTT", func() {
+				handler.SetMinRetransmissionTime(300 * time.Millisecond)
+				handler.rttStats.UpdateRTT(time.Microsecond, 0, time.Now())
+				err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)).To(Equal(300 * time.Millisecond))
+				handler.lastSentPacketTime = time.Now().Add(-250 * time.Millisecond)
+				handler.maybeQueuePacketsRTO()
+				Expect(handler.retransmissionQueue).To(BeEmpty())
+				handler.lastSentPacketTime = time.Now().Add(-350 * time.Millisecond)
+				handler.maybeQueuePacketsRTO()
+				Expect(handler.retransmissionQueue).To(HaveLen(1))
+			})
+
+			Context("jitter", func() {
+				BeforeEach(func() {
+					handler.rand = rand.New(rand.NewSource(42))
+				})
+
+				It("doesn't jitter by default", func() {
+					for i := 1; i <= 10; i++ {
+						err := handler.SentPacket(&Packet{PacketNumber: protocol.PacketNumber(i), Frames: []frames.Frame{}, Length: 1})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)).To(Equal(protocol.DefaultRetransmissionTime))
+					}
+				})
+
+				It("keeps the RTO within the jittered band", func() {
+					handler.SetTimerJitter(0.1)
+					rto := protocol.DefaultRetransmissionTime
+					var values []time.Duration
+					for i := 1; i <= 100; i++ {
+						err := handler.SentPacket(&Packet{PacketNumber: protocol.PacketNumber(i), Frames: []frames.Frame{}, Length: 1})
+						Expect(err).NotTo(HaveOccurred())
+						d := handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)
+						Expect(d).To(BeNumerically(">=", rto-rto/10))
+						Expect(d).To(BeNumerically("<=", rto+rto/10))
+						values = append(values, d)
+					}
+					Expect(values).To(ContainElement(BeNumerically("<", rto)))
+					Expect(values).To(ContainElement(BeNumerically(">", rto)))
+				})
+
+				It("keeps the jitter while the timer is armed", func() {
+					handler.SetTimerJitter(0.1)
+					err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+					Expect(err).NotTo(HaveOccurred())
+					rtoTime := handler.TimeOfFirstRTO()
+					Expect(handler.TimeOfFirstRTO()).To(Equal(rtoTime))
+				})
+
+				It("jitters the RTO after an RTO fired", func() {
+					handler.SetTimerJitter(0.1)
+					err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+					Expect(err).NotTo(HaveOccurred())
+					handler.lastSentPacketTime = clock.Now().Add(-time.Hour)
+					handler.maybeQueuePacketsRTO()
+					Expect(handler.rtoCount).To(Equal(uint32(1)))
+					rto := 2 * protocol.DefaultRetransmissionTime
+					d := handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)
+					Expect(d).To(BeNumerically(">=", rto-rto/10))
+					Expect(d).To(BeNumerically("<=", rto+rto/10))
+				})
+
+				It("doesn't jitter the RTO below the minimum RTO", func() {
+					handler.SetMinRetransmissionTime(400 * time.Millisecond)
+					handler.SetTimerJitter(protocol.MaxTimerJitter)
+					err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+					Expect(err).NotTo(HaveOccurred())
+					handler.rtoJitter = -protocol.MaxTimerJitter
+					Expect(handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)).To(Equal(400 * time.Millisecond))
+				})
+
+				It("doesn't jitter the RTO above the maximum RTO", func() {
+					handler.SetTimerJitter(protocol.MaxTimerJitter)
+					handler.rtoCount = 20
+					err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+					Expect(err).NotTo(HaveOccurred())
+					handler.rtoJitter = protocol.MaxTimerJitter
+					Expect(handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)).To(Equal(protocol.MaxRetransmissionTime))
+				})
+
+				It("caps the jitter", func() {
+					handler.SetTimerJitter(3)
+					Expect(handler.rtoJitterFraction).To(Equal(protocol.MaxTimerJitter))
+					handler.SetTimerJitter(-1)
+					Expect(handler.rtoJitterFraction).To(BeZero())
+				})
+			})
+
 			It("ignores nil packets", func() {
 				handler.packetHistory[1] = nil
 				handler.maybeQueuePacketsRTO()
@@ -702,6 +1027,20 @@ var _ = Describe("SentPacketHandler", func() {
 				Expect(handler.retransmissionQueue).To(BeEmpty())
 			})
 
+			It("never fires before the minimum RTO, even with a tiny RTT", func() {
+				handler.SetMinRetransmissionTime(300 * time.Millisecond)
+				handler.rttStats.UpdateRTT(time.Microsecond, 0, time.Now())
+				err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handler.TimeOfFirstRTO().Sub(handler.lastSentPacketTime)).To(Equal(300 * time.Millisecond))
+				handler.lastSentPacketTime = time.Now().Add(-250 * time.Millisecond)
+				handler.maybeQueuePacketsRTO()
+				Expect(handler.retransmissionQueue).To(BeEmpty())
+				handler.lastSentPacketTime = time.Now().Add(-350 * time.Millisecond)
+				handler.maybeQueuePacketsRTO()
+				Expect(handler.retransmissionQueue).To(HaveLen(1))
+			})
+
 			It("ignores nil packets", func() {
 				handler.packetHistory[1] = nil
 				handler.maybeQueuePacketsRTO()
@@ -709,6 +1048,56 @@ var _ = Describe("SentPacketHandler", func() {
 			})
 		})
 
+		Context("limiting the number of consecutive RTOs", func() {
+			// fireRTO advances the clock to the RTO, and sends the retransmission of the lost packet as a probe
+			fireRTO := func(probe protocol.PacketNumber) {
+				clock.now = handler.TimeOfFirstRTO()
+				Expect(handler.DequeuePacketForRetransmission()).ToNot(BeNil())
+				Expect(handler.CheckForError()).To(Succeed())
+				err := handler.SentPacket(&Packet{PacketNumber: probe, Frames: []frames.Frame{&streamFrame}, Length: 1})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			BeforeEach(func() {
+				err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{&streamFrame}, Length: 1})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("detects an unreachable peer before the idle timeout", func() {
+				handler.SetMaxConsecutiveRTOs(3)
+				start := clock.Now()
+				fireRTO(2)
+				fireRTO(3)
+				fireRTO(4)
+				clock.now = handler.TimeOfFirstRTO()
+				Expect(handler.ProbablyHasPacketForRetransmission()).To(BeTrue())
+				Expect(handler.CheckForError()).To(MatchError(ErrTooManyRTOs))
+				Expect(clock.Now().Sub(start)).To(BeNumerically("<", protocol.InitialIdleConnectionStateLifetime))
+			})
+
+			It("starts counting again when an ACK is received", func() {
+				handler.SetMaxConsecutiveRTOs(1)
+				fireRTO(2)
+				entropy := EntropyAccumulator(0)
+				entropy.Add(1, false)
+				entropy.Add(2, false)
+				err := handler.ReceivedAck(&frames.AckFrame{LargestObserved: 2, Entropy: byte(entropy)})
+				Expect(err).ToNot(HaveOccurred())
+				err = handler.SentPacket(&Packet{PacketNumber: 3, Frames: []frames.Frame{&streamFrame}, Length: 1})
+				Expect(err).ToNot(HaveOccurred())
+				fireRTO(4)
+				clock.now = handler.TimeOfFirstRTO()
+				Expect(handler.ProbablyHasPacketForRetransmission()).To(BeTrue())
+				Expect(handler.CheckForError()).To(MatchError(ErrTooManyRTOs))
+			})
+
+			It("doesn't limit the number of RTOs by default", func() {
+				for i := 2; i < 10; i++ {
+					fireRTO(protocol.PacketNumber(i))
+				}
+			})
+		})
+
 		It("works with HasPacketForRetransmission", func() {
 			p := &Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1}
 			err := handler.SentPacket(p)
@@ -724,5 +1113,54 @@ var _ = Describe("SentPacketHandler", func() {
 			handler.lastSentPacketTime = time.Now().Add(-time.Second)
 			Expect(handler.DequeuePacketForRetransmission()).To(Equal(p))
 		})
+
+		It("recovers a tail-lost packet with a probe", func() {
+			p1 := &Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1}
+			p2 := &Packet{PacketNumber: 2, Frames: []frames.Frame{}, Length: 1}
+			err := handler.SentPacket(p1)
+			Expect(err).NotTo(HaveOccurred())
+			err = handler.SentPacket(p2)
+			Expect(err).NotTo(HaveOccurred())
+			err = handler.ReceivedAck(&frames.AckFrame{LargestObserved: 1})
+			Expect(err).NotTo(HaveOccurred())
+			// packet 2 is lost, but since no later packet is acked, it is never NACKed
+			Expect(handler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+			Expect(handler.ShouldSendProbe()).To(BeFalse())
+			handler.lastSentPacketTime = time.Now().Add(-time.Second)
+			Expect(handler.DequeuePacketForRetransmission()).To(Equal(p2))
+			Expect(handler.ShouldSendProbe()).To(BeTrue())
+			Expect(handler.ShouldSendProbe()).To(BeFalse())
+		})
+
+		Context("exponential backoff", func() {
+			It("doubles the RTO for every RTO without an ACK", func() {
+				for i := 1; i <= 3; i++ {
+					p := &Packet{PacketNumber: protocol.PacketNumber(i), Frames: []frames.Frame{}, Length: 1}
+					err := handler.SentPacket(p)
+					Expect(err).NotTo(HaveOccurred())
+					handler.lastSentPacketTime = time.Now().Add(-time.Hour)
+					handler.maybeQueuePacketsRTO()
+					Expect(handler.getRTO()).To(Equal(protocol.DefaultRetransmissionTime << uint(i)))
+				}
+			})
+
+			It("limits the RTO", func() {
+				handler.rtoCount = 100
+				Expect(handler.getRTO()).To(Equal(protocol.MaxRetransmissionTime))
+			})
+
+			It("resets the backoff when an ACK is received", func() {
+				err := handler.SentPacket(&Packet{PacketNumber: 1, Frames: []frames.Frame{}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+				handler.lastSentPacketTime = time.Now().Add(-time.Hour)
+				handler.maybeQueuePacketsRTO()
+				Expect(handler.getRTO()).To(Equal(2 * protocol.DefaultRetransmissionTime))
+				err = handler.SentPacket(&Packet{PacketNumber: 2, Frames: []frames.Frame{}, Length: 1})
+				Expect(err).NotTo(HaveOccurred())
+				err = handler.ReceivedAck(&frames.AckFrame{LargestObserved: 2})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(handler.rtoCount).To(BeZero())
+			})
+		})
 	})
 })
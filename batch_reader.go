@@ -0,0 +1,25 @@
+package quic
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// A datagram is a single packet read from the connection
+type datagram struct {
+	data       []byte
+	remoteAddr net.Addr
+}
+
+// readOne is used when the connection doesn't support reading batches
+func (r *batchReader) readOne() ([]datagram, error) {
+	data := make([]byte, protocol.MaxPacketSize)
+	n, remoteAddr, err := r.conn.ReadFrom(data)
+	r.readCalls++
+	if err != nil {
+		return nil, err
+	}
+	r.datagrams = append(r.datagrams[:0], datagram{data: data[:n], remoteAddr: remoteAddr})
+	return r.datagrams, nil
+}
@@ -0,0 +1,65 @@
+// +build linux
+
+package quic
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// batchReader reads multiple packets with a single recvmmsg syscall if the connection is a *net.UDPConn
+type batchReader struct {
+	conn      net.PacketConn
+	mmsgConn  *ipv4.PacketConn
+	msgs      []ipv4.Message
+	datagrams []datagram
+
+	readCalls uint64 // number of syscalls, used in the benchmarks
+}
+
+func newBatchReader(conn net.PacketConn, batchSize int) *batchReader {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return &batchReader{conn: conn, datagrams: make([]datagram, 0, 1)}
+	}
+	if batchSize <= 0 {
+		batchSize = protocol.DefaultReceiveBatchSize
+	}
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, protocol.MaxPacketSize)}
+	}
+	return &batchReader{
+		conn:      conn,
+		mmsgConn:  ipv4.NewPacketConn(udpConn),
+		msgs:      msgs,
+		datagrams: make([]datagram, 0, batchSize),
+	}
+}
+
+// readBatch blocks until at least one packet was received.
+// The returned slice is only valid until the next call.
+func (r *batchReader) readBatch() ([]datagram, error) {
+	if r.mmsgConn == nil {
+		return r.readOne()
+	}
+	n, err := r.mmsgConn.ReadBatch(r.msgs, 0)
+	r.readCalls++
+	if err != nil {
+		return nil, err
+	}
+	r.datagrams = r.datagrams[:0]
+	for i := 0; i < n; i++ {
+		msg := &r.msgs[i]
+		r.datagrams = append(r.datagrams, datagram{
+			data:       msg.Buffers[0][:msg.N],
+			remoteAddr: msg.Addr,
+		})
+		// the data is handed to the sessions, so we need a new buffer
+		msg.Buffers[0] = make([]byte, protocol.MaxPacketSize)
+	}
+	return r.datagrams, nil
+}
@@ -0,0 +1,23 @@
+// +build !linux
+
+package quic
+
+import "net"
+
+// batchReader reads the packets one by one on platforms that don't support recvmmsg
+type batchReader struct {
+	conn      net.PacketConn
+	datagrams []datagram
+
+	readCalls uint64 // number of syscalls, used in the benchmarks
+}
+
+func newBatchReader(conn net.PacketConn, batchSize int) *batchReader {
+	return &batchReader{conn: conn, datagrams: make([]datagram, 0, 1)}
+}
+
+// readBatch blocks until a packet was received.
+// The returned slice is only valid until the next call.
+func (r *batchReader) readBatch() ([]datagram, error) {
+	return r.readOne()
+}
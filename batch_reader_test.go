@@ -0,0 +1,121 @@
+package quic
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batch reader", func() {
+	var (
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+	)
+
+	BeforeEach(func() {
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err = net.ListenUDP("udp", addr)
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err = net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	It("reads all packets in order", func() {
+		r := newBatchReader(serverConn, 4)
+		packets := []string{"foo", "bar", "foobar"}
+		for _, p := range packets {
+			_, err := clientConn.Write([]byte(p))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		var received []string
+		for len(received) < len(packets) {
+			datagrams, err := r.readBatch()
+			Expect(err).ToNot(HaveOccurred())
+			for _, d := range datagrams {
+				Expect(d.remoteAddr.String()).To(Equal(clientConn.LocalAddr().String()))
+				received = append(received, string(d.data))
+			}
+		}
+		Expect(received).To(Equal(packets))
+	})
+
+	It("doesn't reuse buffers of packets that were already returned", func() {
+		r := newBatchReader(serverConn, 4)
+		_, err := clientConn.Write([]byte("foo"))
+		Expect(err).ToNot(HaveOccurred())
+		datagrams, err := r.readBatch()
+		Expect(err).ToNot(HaveOccurred())
+		first := datagrams[0].data
+		_, err = clientConn.Write([]byte("bar"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = r.readBatch()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(first).To(Equal([]byte("foo")))
+	})
+
+	It("returns an error when the connection is closed", func() {
+		r := newBatchReader(serverConn, 4)
+		serverConn.Close()
+		_, err := r.readBatch()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func benchmarkRead(b *testing.B, batched bool) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	serverConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	const numPackets = 10
+	packet := make([]byte, 1350)
+	r := newBatchReader(serverConn, numPackets)
+	buf := make([]byte, 1500)
+	var readCalls uint64
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < numPackets; j++ {
+			if _, err := clientConn.Write(packet); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for received := 0; received < numPackets; {
+			if batched {
+				datagrams, err := r.readBatch()
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += len(datagrams)
+				continue
+			}
+			if _, _, err := serverConn.ReadFromUDP(buf); err != nil {
+				b.Fatal(err)
+			}
+			readCalls++
+			received++
+		}
+	}
+	if batched {
+		readCalls = r.readCalls
+	}
+	b.ReportMetric(float64(readCalls)/float64(b.N*numPackets), "syscalls/packet")
+}
+
+func BenchmarkReadPerPacket(b *testing.B) { benchmarkRead(b, false) }
+func BenchmarkReadBatched(b *testing.B)   { benchmarkRead(b, true) }
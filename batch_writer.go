@@ -0,0 +1,15 @@
+package quic
+
+import "net"
+
+// writeOneByOne is used when the connection doesn't support writing batches
+func (w *batchWriter) writeOneByOne(packets [][]byte, addr net.Addr) error {
+	for _, p := range packets {
+		_, err := w.conn.WriteTo(p, addr)
+		w.writeCalls++
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
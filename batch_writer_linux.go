@@ -0,0 +1,46 @@
+// +build linux
+
+package quic
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// batchWriter sends multiple packets with a single sendmmsg syscall if the connection is a *net.UDPConn
+type batchWriter struct {
+	conn     net.PacketConn
+	mmsgConn *ipv4.PacketConn
+	msgs     []ipv4.Message
+
+	writeCalls uint64 // number of syscalls, used in the benchmarks
+}
+
+func newBatchWriter(conn net.PacketConn) *batchWriter {
+	w := &batchWriter{conn: conn}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		w.mmsgConn = ipv4.NewPacketConn(udpConn)
+	}
+	return w
+}
+
+func (w *batchWriter) writeBatch(packets [][]byte, addr net.Addr) error {
+	if w.mmsgConn == nil {
+		return w.writeOneByOne(packets, addr)
+	}
+	for len(packets) > 0 {
+		w.msgs = w.msgs[:0]
+		for _, p := range packets {
+			w.msgs = append(w.msgs, ipv4.Message{Buffers: [][]byte{p}, Addr: addr})
+		}
+		n, err := w.mmsgConn.WriteBatch(w.msgs, 0)
+		w.writeCalls++
+		if err != nil {
+			return err
+		}
+		// sendmmsg may send fewer messages than requested
+		packets = packets[n:]
+	}
+	return nil
+}
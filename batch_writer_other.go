@@ -0,0 +1,20 @@
+// +build !linux
+
+package quic
+
+import "net"
+
+// batchWriter sends the packets one by one on platforms that don't support sendmmsg
+type batchWriter struct {
+	conn net.PacketConn
+
+	writeCalls uint64 // number of syscalls, used in the benchmarks
+}
+
+func newBatchWriter(conn net.PacketConn) *batchWriter {
+	return &batchWriter{conn: conn}
+}
+
+func (w *batchWriter) writeBatch(packets [][]byte, addr net.Addr) error {
+	return w.writeOneByOne(packets, addr)
+}
@@ -0,0 +1,95 @@
+package quic
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batch writer", func() {
+	var (
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		w          *batchWriter
+	)
+
+	BeforeEach(func() {
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err = net.ListenUDP("udp", addr)
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err = net.ListenUDP("udp", addr)
+		Expect(err).ToNot(HaveOccurred())
+		w = newBatchWriter(serverConn)
+	})
+
+	AfterEach(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	It("writes all packets in order", func() {
+		packets := [][]byte{[]byte("foo"), []byte("bar"), []byte("foobar")}
+		err := w.writeBatch(packets, clientConn.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 10)
+		for _, p := range packets {
+			n, _, err := clientConn.ReadFromUDP(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b[:n]).To(Equal(p))
+		}
+	})
+
+	It("writes an empty batch", func() {
+		err := w.writeBatch(nil, clientConn.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.writeCalls).To(BeZero())
+	})
+})
+
+func benchmarkWrite(b *testing.B, batched bool) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	serverConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientConn.Close()
+	remoteAddr := clientConn.LocalAddr().(*net.UDPAddr)
+
+	packets := make([][]byte, 10)
+	for i := range packets {
+		packets[i] = make([]byte, 1350)
+	}
+	w := newBatchWriter(serverConn)
+	var writeCalls uint64
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			if err := w.writeBatch(packets, remoteAddr); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, p := range packets {
+			if _, err := serverConn.WriteToUDP(p, remoteAddr); err != nil {
+				b.Fatal(err)
+			}
+			writeCalls++
+		}
+	}
+	if batched {
+		writeCalls = w.writeCalls
+	}
+	b.ReportMetric(float64(writeCalls)/float64(b.N*len(packets)), "syscalls/packet")
+}
+
+func BenchmarkWritePerPacket(b *testing.B) { benchmarkWrite(b, false) }
+func BenchmarkWriteBatched(b *testing.B)   { benchmarkWrite(b, true) }
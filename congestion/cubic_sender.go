@@ -14,6 +14,7 @@ const (
 )
 
 type cubicSender struct {
+	clock           Clock
 	hybridSlowStart HybridSlowStart
 	prr             PrrSender
 	rttStats        *RTTStats
@@ -58,11 +59,17 @@ type cubicSender struct {
 
 	initialCongestionWindow    protocol.PacketNumber
 	initialMaxCongestionWindow protocol.PacketNumber
+
+	observer CongestionWindowObserver
+	// The values last reported to the observer
+	observedCongestionWindow   protocol.PacketNumber
+	observedSlowstartThreshold protocol.PacketNumber
 }
 
 // NewCubicSender makes a new cubic sender
 func NewCubicSender(clock Clock, rttStats *RTTStats, reno bool, initialCongestionWindow, initialMaxCongestionWindow protocol.PacketNumber) SendAlgorithmWithDebugInfo {
 	return &cubicSender{
+		clock:                      clock,
 		rttStats:                   rttStats,
 		initialCongestionWindow:    initialCongestionWindow,
 		initialMaxCongestionWindow: initialMaxCongestionWindow,
@@ -73,6 +80,8 @@ func NewCubicSender(clock Clock, rttStats *RTTStats, reno bool, initialCongestio
 		numConnections:             defaultNumConnections,
 		cubic:                      NewCubic(clock),
 		reno:                       reno,
+		observedCongestionWindow:   initialCongestionWindow,
+		observedSlowstartThreshold: initialMaxCongestionWindow,
 	}
 }
 
@@ -119,6 +128,7 @@ func (c *cubicSender) GetSlowStartThreshold() protocol.ByteCount {
 
 func (c *cubicSender) ExitSlowstart() {
 	c.slowstartThreshold = c.congestionWindow
+	c.maybeNotifyObserver()
 }
 
 func (c *cubicSender) SlowstartThreshold() protocol.PacketNumber {
@@ -131,6 +141,9 @@ func (c *cubicSender) SlowstartThreshold() protocol.PacketNumber {
 // prior to the congestion event.  |ackedPackets| and |lostPackets| are
 // any packets considered acked or lost as a result of the congestion event.
 func (c *cubicSender) OnCongestionEvent(rttUpdated bool, bytesInFlight protocol.ByteCount, ackedPackets PacketVector, lostPackets PacketVector) {
+	if rttUpdated && c.InSlowStart() {
+		c.hybridSlowStart.OnAckReceived(c.clock.Now(), c.rttStats.MinRTT())
+	}
 	if rttUpdated && c.InSlowStart() && c.hybridSlowStart.ShouldExitSlowStart(c.rttStats.LatestRTT(), c.rttStats.MinRTT(), c.GetCongestionWindow()/protocol.DefaultTCPMSS) {
 		c.ExitSlowstart()
 	}
@@ -140,6 +153,7 @@ func (c *cubicSender) OnCongestionEvent(rttUpdated bool, bytesInFlight protocol.
 	for _, i := range ackedPackets {
 		c.onPacketAcked(i.Number, i.Length, bytesInFlight)
 	}
+	c.maybeNotifyObserver()
 }
 
 func (c *cubicSender) onPacketAcked(ackedPacketNumber protocol.PacketNumber, ackedBytes protocol.ByteCount, bytesInFlight protocol.ByteCount) {
@@ -278,6 +292,7 @@ func (c *cubicSender) OnRetransmissionTimeout(packetsRetransmitted bool) {
 	c.cubic.Reset()
 	c.slowstartThreshold = c.congestionWindow / 2
 	c.congestionWindow = c.minCongestionWindow
+	c.maybeNotifyObserver()
 }
 
 // OnConnectionMigration is called when the connection is migrated (?)
@@ -293,6 +308,7 @@ func (c *cubicSender) OnConnectionMigration() {
 	c.congestionWindow = c.initialCongestionWindow
 	c.slowstartThreshold = c.initialMaxCongestionWindow
 	c.maxTCPCongestionWindow = c.initialMaxCongestionWindow
+	c.maybeNotifyObserver()
 }
 
 // SetSlowStartLargeReduction allows enabling the SSLR experiment
@@ -300,6 +316,22 @@ func (c *cubicSender) SetSlowStartLargeReduction(enabled bool) {
 	c.slowStartLargeReduction = enabled
 }
 
+// SetCongestionWindowObserver sets an observer that is notified of all changes to the congestion window and the slow start threshold
+func (c *cubicSender) SetCongestionWindowObserver(observer CongestionWindowObserver) {
+	c.observer = observer
+}
+
+func (c *cubicSender) maybeNotifyObserver() {
+	if c.congestionWindow == c.observedCongestionWindow && c.slowstartThreshold == c.observedSlowstartThreshold {
+		return
+	}
+	c.observedCongestionWindow = c.congestionWindow
+	c.observedSlowstartThreshold = c.slowstartThreshold
+	if c.observer != nil {
+		c.observer.OnCongestionWindowChange(c.GetCongestionWindow(), c.GetSlowStartThreshold())
+	}
+}
+
 // RetransmissionDelay gives the time to retransmission
 func (c *cubicSender) RetransmissionDelay() time.Duration {
 	if c.rttStats.SmoothedRTT() == 0 {
@@ -15,6 +15,23 @@ const renoBeta float32 = 0.7 // Reno backoff factor.
 
 type mockClock time.Time
 
+type congestionWindowChange struct {
+	congestionWindow   protocol.ByteCount
+	slowStartThreshold protocol.ByteCount
+}
+
+type mockCongestionWindowObserver struct {
+	changes []congestionWindowChange
+}
+
+func (o *mockCongestionWindowObserver) OnCongestionWindowChange(congestionWindow, slowStartThreshold protocol.ByteCount) {
+	o.changes = append(o.changes, congestionWindowChange{congestionWindow, slowStartThreshold})
+}
+
+func (o *mockCongestionWindowObserver) last() congestionWindowChange {
+	return o.changes[len(o.changes)-1]
+}
+
 func (c *mockClock) Now() time.Time {
 	return time.Time(*c)
 }
@@ -380,6 +397,54 @@ var _ = Describe("Cubic Sender", func() {
 		}
 	})
 
+	Context("hybrid slow start", func() {
+		ackPacket := func(rtt time.Duration, spacing time.Duration) {
+			rttStats.UpdateRTT(rtt, 0, clock.Now())
+			ackedPacketNumber++
+			ackedPackets := congestion.PacketVector{{Number: ackedPacketNumber, Length: protocol.DefaultTCPMSS}}
+			sender.OnCongestionEvent(true, bytesInFlight, ackedPackets, nil)
+			bytesInFlight -= protocol.DefaultTCPMSS
+			clock.Advance(spacing)
+		}
+
+		It("exits slow start when the RTT increases", func() {
+			// first round, establishing the min RTT
+			SendAvailableSendWindow()
+			for ackedPacketNumber < packetNumber-1 {
+				ackPacket(60*time.Millisecond, 5*time.Millisecond)
+			}
+			Expect(sender.SlowstartThreshold()).To(Equal(protocol.MaxCongestionWindow))
+			// second round, with an increased RTT
+			SendAvailableSendWindow()
+			for i := 0; i < 10; i++ {
+				ackPacket(80*time.Millisecond, 5*time.Millisecond)
+			}
+			Expect(sender.SlowstartThreshold()).To(BeNumerically("<", protocol.MaxCongestionWindow))
+			Expect(protocol.ByteCount(sender.SlowstartThreshold()) * protocol.DefaultTCPMSS).To(Equal(sender.GetCongestionWindow()))
+		})
+
+		It("exits slow start on long ack trains", func() {
+			// the acks of a round have to arrive within 2ms of each other for more than half the min RTT
+			for i := 0; i < 3; i++ {
+				SendAvailableSendWindow()
+				for ackedPacketNumber < packetNumber-1 {
+					ackPacket(60*time.Millisecond, 2*time.Millisecond)
+				}
+			}
+			Expect(sender.SlowstartThreshold()).To(BeNumerically("<", protocol.MaxCongestionWindow))
+		})
+
+		It("stays in slow start if the RTT and the ack spacing don't indicate congestion", func() {
+			for i := 0; i < 3; i++ {
+				SendAvailableSendWindow()
+				for ackedPacketNumber < packetNumber-1 {
+					ackPacket(60*time.Millisecond, 5*time.Millisecond)
+				}
+			}
+			Expect(sender.SlowstartThreshold()).To(Equal(protocol.MaxCongestionWindow))
+		})
+	})
+
 	It("RTO congestion window", func() {
 		Expect(sender.GetCongestionWindow()).To(Equal(defaultWindowTCP))
 		Expect(sender.SlowstartThreshold()).To(Equal(protocol.MaxCongestionWindow))
@@ -820,4 +885,56 @@ var _ = Describe("Cubic Sender", func() {
 		Expect(sender.SlowstartThreshold()).To(Equal(protocol.MaxCongestionWindow))
 		Expect(sender.HybridSlowStart().Started()).To(BeFalse())
 	})
+
+	Context("observing the congestion window", func() {
+		var observer *mockCongestionWindowObserver
+
+		BeforeEach(func() {
+			observer = &mockCongestionWindowObserver{}
+			sender.SetCongestionWindowObserver(observer)
+			sender.SetNumEmulatedConnections(1)
+		})
+
+		It("reports slow start growth", func() {
+			SendAvailableSendWindow()
+			AckNPackets(2)
+			Expect(observer.changes).To(Equal([]congestionWindowChange{{
+				congestionWindow:   defaultWindowTCP + 2*protocol.DefaultTCPMSS,
+				slowStartThreshold: protocol.ByteCount(protocol.MaxCongestionWindow) * protocol.DefaultTCPMSS,
+			}}))
+		})
+
+		It("doesn't report if the window doesn't change", func() {
+			// not congestion window limited
+			AckNPackets(1)
+			Expect(observer.changes).To(BeEmpty())
+		})
+
+		It("reports loss-induced reductions and congestion avoidance", func() {
+			for i := 0; i < 10; i++ {
+				SendAvailableSendWindow()
+				AckNPackets(2)
+			}
+			SendAvailableSendWindow()
+			windowBeforeLoss := sender.GetCongestionWindow()
+			Expect(observer.last().congestionWindow).To(Equal(windowBeforeLoss))
+
+			LoseNPackets(1)
+			windowAfterLoss := protocol.ByteCount(float32(windowBeforeLoss) * renoBeta)
+			Expect(observer.last()).To(Equal(congestionWindowChange{windowAfterLoss, windowAfterLoss}))
+
+			// ack the recovery window, and a full window in congestion avoidance
+			numChanges := len(observer.changes)
+			AckNPackets(int(windowBeforeLoss / protocol.DefaultTCPMSS))
+			SendAvailableSendWindow()
+			AckNPackets(int(windowAfterLoss / protocol.DefaultTCPMSS))
+			Expect(observer.changes).To(HaveLen(numChanges + 1))
+			Expect(observer.last()).To(Equal(congestionWindowChange{windowAfterLoss + protocol.DefaultTCPMSS, windowAfterLoss}))
+		})
+
+		It("reports RTOs", func() {
+			sender.OnRetransmissionTimeout(true)
+			Expect(observer.last()).To(Equal(congestionWindowChange{2 * protocol.DefaultTCPMSS, defaultWindowTCP / 2}))
+		})
+	})
 })
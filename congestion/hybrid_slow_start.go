@@ -20,6 +20,9 @@ const hybridStartDelayFactorExp = 3 // 2^3 = 8
 const hybridStartDelayMinThresholdUs = int64(4000)
 const hybridStartDelayMaxThresholdUs = int64(16000)
 
+// Acks that arrive at most this far apart belong to the same ack train.
+const hybridStartAckDelta = 2 * time.Millisecond
+
 // HybridSlowStart implements the TCP hybrid slow start algorithm
 type HybridSlowStart struct {
 	endPacketNumber      protocol.PacketNumber
@@ -28,6 +31,10 @@ type HybridSlowStart struct {
 	currentMinRTT        time.Duration
 	rttSampleCount       uint32
 	hystartFound         bool
+
+	// used for the ack train detection
+	roundStart  time.Time
+	lastAckTime time.Time
 }
 
 // StartReceiveRound is called for the start of each receive round (burst) in the slow start phase.
@@ -35,6 +42,7 @@ func (s *HybridSlowStart) StartReceiveRound(lastSent protocol.PacketNumber) {
 	s.endPacketNumber = lastSent
 	s.currentMinRTT = 0
 	s.rttSampleCount = 0
+	s.roundStart = time.Time{}
 	s.started = true
 }
 
@@ -85,6 +93,28 @@ func (s *HybridSlowStart) ShouldExitSlowStart(latestRTT time.Duration, minRTT ti
 	return congestionWindow >= hybridStartLowWindow && s.hystartFound
 }
 
+// OnAckReceived should be called on every new ack frame, before ShouldExitSlowStart.
+// It implements the first detection parameter, the ack train length:
+// if the acks of a round keep arriving closely spaced for more than half the min RTT, the bottleneck is saturated.
+func (s *HybridSlowStart) OnAckReceived(now time.Time, minRTT time.Duration) {
+	if !s.started {
+		s.StartReceiveRound(s.lastSentPacketNumber)
+	}
+	if s.roundStart.IsZero() {
+		s.roundStart = now
+		s.lastAckTime = now
+		return
+	}
+	if now.Sub(s.lastAckTime) > hybridStartAckDelta {
+		// the train is broken, the rest of this round can't be used for the detection
+		return
+	}
+	s.lastAckTime = now
+	if minRTT != 0 && now.Sub(s.roundStart) > minRTT/2 {
+		s.hystartFound = true
+	}
+}
+
 // OnPacketSent is called when a packet was sent
 func (s *HybridSlowStart) OnPacketSent(packetNumber protocol.PacketNumber) {
 	s.lastSentPacketNumber = packetNumber
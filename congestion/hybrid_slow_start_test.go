@@ -73,4 +73,45 @@ var _ = Describe("Hybrid slow start", func() {
 		Expect(slowStart.ShouldExitSlowStart(rtt+10*time.Millisecond, rtt, 100)).To(BeTrue())
 	})
 
+	Context("ack train detection", func() {
+		const minRTT = 10 * time.Millisecond
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			slowStart.OnPacketSent(100)
+		})
+
+		It("exits slow start after a long ack train", func() {
+			for i := 0; i <= 5; i++ {
+				slowStart.OnAckReceived(now, minRTT)
+				Expect(slowStart.ShouldExitSlowStart(minRTT, minRTT, 100)).To(BeFalse())
+				now = now.Add(time.Millisecond)
+			}
+			slowStart.OnAckReceived(now, minRTT)
+			Expect(slowStart.ShouldExitSlowStart(minRTT, minRTT, 100)).To(BeTrue())
+		})
+
+		It("ignores acks that are spaced too far apart", func() {
+			for i := 0; i < 10; i++ {
+				slowStart.OnAckReceived(now, minRTT)
+				Expect(slowStart.ShouldExitSlowStart(minRTT, minRTT, 100)).To(BeFalse())
+				now = now.Add(3 * time.Millisecond)
+			}
+		})
+
+		It("starts a new train every round", func() {
+			slowStart.StartReceiveRound(100)
+			for i := 0; i < 4; i++ {
+				slowStart.OnAckReceived(now, minRTT)
+				now = now.Add(time.Millisecond)
+			}
+			slowStart.StartReceiveRound(200)
+			for i := 0; i < 4; i++ {
+				slowStart.OnAckReceived(now, minRTT)
+				now = now.Add(time.Millisecond)
+			}
+			Expect(slowStart.ShouldExitSlowStart(minRTT, minRTT, 100)).To(BeFalse())
+		})
+	})
 })
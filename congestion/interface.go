@@ -6,6 +6,11 @@ import (
 	"github.com/lucas-clemente/quic-go/protocol"
 )
 
+// A CongestionWindowObserver is notified whenever the congestion window or the slow start threshold changes
+type CongestionWindowObserver interface {
+	OnCongestionWindowChange(congestionWindow protocol.ByteCount, slowStartThreshold protocol.ByteCount)
+}
+
 // A SendAlgorithm performs congestion control and calculates the congestion window
 type SendAlgorithm interface {
 	TimeUntilSend(now time.Time, bytesInFlight protocol.ByteCount) time.Duration
@@ -16,6 +21,7 @@ type SendAlgorithm interface {
 	OnRetransmissionTimeout(packetsRetransmitted bool)
 	OnConnectionMigration()
 	RetransmissionDelay() time.Duration
+	SetCongestionWindowObserver(observer CongestionWindowObserver)
 
 	// Experiments
 	SetSlowStartLargeReduction(enabled bool)
@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+var (
+	errInvalidChannelIDKey       = errors.New("invalid channel ID key")
+	errInvalidChannelIDSignature = errors.New("channel ID signature invalid")
+)
+
+// channelIDHash is the hash of the data signed with the channel ID key
+func channelIDHash(signedData []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("QUIC ChannelID\x00"))
+	hash.Write([]byte("client -> server\x00"))
+	hash.Write(signedData)
+	return hash.Sum(nil)
+}
+
+// SignChannelID signs the data with a P-256 channel ID key.
+// It returns the public key as sent in the CIDK tag (the x and y coordinates), and the signature as sent in the CIDS tag (r and s), each value encoded as 32 bytes.
+func SignChannelID(key *ecdsa.PrivateKey, signedData []byte) ([]byte, []byte, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, nil, errInvalidChannelIDKey
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, channelIDHash(signedData))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeP256Pair(key.X, key.Y), encodeP256Pair(r, s), nil
+}
+
+// VerifyChannelID verifies the signature of the data with the channel ID key, both encoded as by SignChannelID
+func VerifyChannelID(publicKey, signedData, signature []byte) error {
+	if len(publicKey) != 64 {
+		return errInvalidChannelIDKey
+	}
+	x, y := new(big.Int).SetBytes(publicKey[:32]), new(big.Int).SetBytes(publicKey[32:])
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return errInvalidChannelIDKey
+	}
+	if len(signature) != 64 {
+		return errInvalidChannelIDSignature
+	}
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !ecdsa.Verify(key, channelIDHash(signedData), r, s) {
+		return errInvalidChannelIDSignature
+	}
+	return nil
+}
+
+func encodeP256Pair(a, b *big.Int) []byte {
+	res := make([]byte, 64)
+	a.FillBytes(res[:32])
+	b.FillBytes(res[32:])
+	return res
+}
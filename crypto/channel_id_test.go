@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Channel ID", func() {
+	var key *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("verifies signatures", func() {
+		publicKey, signature, err := SignChannelID(key, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(publicKey).To(HaveLen(64))
+		Expect(signature).To(HaveLen(64))
+		Expect(VerifyChannelID(publicKey, []byte("foobar"), signature)).To(Succeed())
+	})
+
+	It("rejects signatures of different data", func() {
+		publicKey, signature, err := SignChannelID(key, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyChannelID(publicKey, []byte("raboof"), signature)).To(MatchError(errInvalidChannelIDSignature))
+	})
+
+	It("rejects signatures made with a different key", func() {
+		_, signature, err := SignChannelID(key, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		otherPublicKey, _, err := SignChannelID(otherKey, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyChannelID(otherPublicKey, []byte("foobar"), signature)).To(MatchError(errInvalidChannelIDSignature))
+	})
+
+	It("rejects keys that are not on the curve", func() {
+		_, signature, err := SignChannelID(key, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyChannelID(make([]byte, 64), []byte("foobar"), signature)).To(MatchError(errInvalidChannelIDKey))
+	})
+
+	It("rejects malformed signatures", func() {
+		publicKey, _, err := SignChannelID(key, []byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyChannelID(publicKey, []byte("foobar"), make([]byte, 63))).To(MatchError(errInvalidChannelIDSignature))
+	})
+
+	It("only signs with P-256 keys", func() {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = SignChannelID(otherKey, []byte("foobar"))
+		Expect(err).To(MatchError(errInvalidChannelIDKey))
+	})
+})
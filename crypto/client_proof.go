@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+var (
+	errInvalidClientProof       = errors.New("client proof invalid")
+	errUnsupportedClientKeyType = errors.New("unsupported client certificate key type")
+)
+
+// clientProofHash is the hash of the data signed in the client proof.
+// It binds the proof to the server config, the client nonce and the client's key exchange value, so it can't be used in another handshake.
+func clientProofHash(serverConfigID, clientNonce, clientPublicValue []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("QUIC client proof\x00"))
+	hash.Write(serverConfigID)
+	hash.Write(clientNonce)
+	hash.Write(clientPublicValue)
+	return hash.Sum(nil)
+}
+
+// SignClientProof creates the client proof with the private key of the client certificate.
+// RSA keys use PSS, just like the server proof.
+func SignClientProof(key crypto.Signer, serverConfigID, clientNonce, clientPublicValue []byte) ([]byte, error) {
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		opts = &rsa.PSSOptions{SaltLength: 32, Hash: crypto.SHA256}
+	}
+	return key.Sign(rand.Reader, clientProofHash(serverConfigID, clientNonce, clientPublicValue), opts)
+}
+
+// VerifyClientProof verifies the client proof using the public key of the client certificate
+func VerifyClientProof(cert *x509.Certificate, serverConfigID, clientNonce, clientPublicValue, proof []byte) error {
+	hash := clientProofHash(serverConfigID, clientNonce, clientPublicValue)
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPSS(key, crypto.SHA256, hash, proof, &rsa.PSSOptions{SaltLength: 32}); err != nil {
+			return errInvalidClientProof
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash, proof) {
+			return errInvalidClientProof
+		}
+	default:
+		return errUnsupportedClientKeyType
+	}
+	return nil
+}
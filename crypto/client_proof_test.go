@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client proof", func() {
+	var (
+		scid  = []byte("scid")
+		nonce = []byte("nonce")
+		pubs  = []byte("pubs")
+	)
+
+	It("verifies ECDSA proofs", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		cert := &x509.Certificate{PublicKey: &key.PublicKey}
+		proof, err := SignClientProof(key, scid, nonce, pubs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyClientProof(cert, scid, nonce, pubs, proof)).To(Succeed())
+	})
+
+	It("verifies RSA proofs", func() {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).ToNot(HaveOccurred())
+		cert := &x509.Certificate{PublicKey: &key.PublicKey}
+		proof, err := SignClientProof(key, scid, nonce, pubs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyClientProof(cert, scid, nonce, pubs, proof)).To(Succeed())
+	})
+
+	It("rejects proofs for a different handshake", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		cert := &x509.Certificate{PublicKey: &key.PublicKey}
+		proof, err := SignClientProof(key, scid, nonce, pubs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyClientProof(cert, scid, []byte("other nonce"), pubs, proof)).To(MatchError(errInvalidClientProof))
+	})
+
+	It("rejects proofs signed with a different key", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		cert := &x509.Certificate{PublicKey: &otherKey.PublicKey}
+		proof, err := SignClientProof(key, scid, nonce, pubs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyClientProof(cert, scid, nonce, pubs, proof)).To(MatchError(errInvalidClientProof))
+	})
+
+	It("rejects unsupported key types", func() {
+		cert := &x509.Certificate{PublicKey: "foobar"}
+		Expect(VerifyClientProof(cert, scid, nonce, pubs, []byte("proof"))).To(MatchError(errUnsupportedClientKeyType))
+	})
+})
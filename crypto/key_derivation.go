@@ -13,6 +13,16 @@ import (
 
 // DeriveKeysChacha20 derives the client and server keys and creates a matching chacha20poly1305 instance
 func DeriveKeysChacha20(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	return deriveKeys(NewAEADChacha20Poly1305, version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce)
+}
+
+// DeriveKeysAESGCM256 derives the client and server keys and creates a matching AES-256-GCM instance
+func DeriveKeysAESGCM256(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
+	return deriveKeys(NewAEADAESGCM256, version, forwardSecure, sharedSecret, nonces, connID, chlo, scfg, cert, divNonce)
+}
+
+// deriveKeys derives 32 byte keys and 4 byte IVs and passes them to newAEAD
+func deriveKeys(newAEAD func(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte) (AEAD, error), version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (AEAD, error) {
 	var info bytes.Buffer
 	if forwardSecure {
 		info.Write([]byte("QUIC forward secure key expansion\x00"))
@@ -26,23 +36,11 @@ func DeriveKeysChacha20(version protocol.VersionNumber, forwardSecure bool, shar
 
 	r := hkdf.New(sha256.New, sharedSecret, nonces, info.Bytes())
 
-	otherKey := make([]byte, 32)
-	myKey := make([]byte, 32)
-	otherIV := make([]byte, 4)
-	myIV := make([]byte, 4)
-
-	if _, err := io.ReadFull(r, otherKey); err != nil {
-		return nil, err
-	}
-	if _, err := io.ReadFull(r, myKey); err != nil {
-		return nil, err
-	}
-	if _, err := io.ReadFull(r, otherIV); err != nil {
-		return nil, err
-	}
-	if _, err := io.ReadFull(r, myIV); err != nil {
+	keys, err := hkdfExpand(r, 32, 32, 4, 4)
+	if err != nil {
 		return nil, err
 	}
+	otherKey, myKey, otherIV, myIV := keys[0], keys[1], keys[2], keys[3]
 
 	if !forwardSecure && version >= protocol.VersionNumber(33) {
 		if err := diversify(myKey, myIV, divNonce); err != nil {
@@ -50,7 +48,38 @@ func DeriveKeysChacha20(version protocol.VersionNumber, forwardSecure bool, shar
 		}
 	}
 
-	return NewAEADChacha20Poly1305(otherKey, myKey, otherIV, myIV)
+	return newAEAD(otherKey, myKey, otherIV, myIV)
+}
+
+// CETVHKDFInput is the HKDF info for the keys of the client encrypted tag-values (CETV) of a CHLO.
+// The chlo is the serialized CHLO without the CETV and PAD tags. The channel ID signs the same data.
+func CETVHKDFInput(connID protocol.ConnectionID, chlo []byte, scfg []byte) []byte {
+	var info bytes.Buffer
+	info.Write([]byte("QUIC CETV block\x00"))
+	utils.WriteUint64(&info, uint64(connID))
+	info.Write(chlo)
+	info.Write(scfg)
+	return info.Bytes()
+}
+
+// DeriveCETVKeysChacha20 derives the keys for decrypting the CETV and creates a matching chacha20poly1305 instance
+func DeriveCETVKeysChacha20(sharedSecret, nonces, hkdfInput []byte) (AEAD, error) {
+	return deriveCETVKeys(NewAEADChacha20Poly1305, sharedSecret, nonces, hkdfInput)
+}
+
+// DeriveCETVKeysAESGCM256 derives the keys for decrypting the CETV and creates a matching AES-256-GCM instance
+func DeriveCETVKeysAESGCM256(sharedSecret, nonces, hkdfInput []byte) (AEAD, error) {
+	return deriveCETVKeys(NewAEADAESGCM256, sharedSecret, nonces, hkdfInput)
+}
+
+// deriveCETVKeys derives the CETV keys from the initial shared secret. They are never diversified.
+func deriveCETVKeys(newAEAD func(otherKey []byte, myKey []byte, otherIV []byte, myIV []byte) (AEAD, error), sharedSecret, nonces, hkdfInput []byte) (AEAD, error) {
+	r := hkdf.New(sha256.New, sharedSecret, nonces, hkdfInput)
+	keys, err := hkdfExpand(r, 32, 32, 4, 4)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(keys[0], keys[1], keys[2], keys[3])
 }
 
 func diversify(key, iv, divNonce []byte) error {
@@ -60,12 +89,23 @@ func diversify(key, iv, divNonce []byte) error {
 
 	r := hkdf.New(sha256.New, secret, divNonce, []byte("QUIC key diversification"))
 
-	if _, err := io.ReadFull(r, key); err != nil {
+	res, err := hkdfExpand(r, len(key), len(iv))
+	if err != nil {
 		return err
 	}
-	if _, err := io.ReadFull(r, iv); err != nil {
-		return err
-	}
-
+	copy(key, res[0])
+	copy(iv, res[1])
 	return nil
 }
+
+// hkdfExpand reads consecutive slices of the given lengths from the HKDF reader
+func hkdfExpand(reader io.Reader, lengths ...int) ([][]byte, error) {
+	res := make([][]byte, len(lengths))
+	for i, l := range lengths {
+		res[i] = make([]byte, l)
+		if _, err := io.ReadFull(reader, res[i]); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
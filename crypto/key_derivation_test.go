@@ -1,7 +1,12 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
 	"github.com/lucas-clemente/quic-go/protocol"
+	"golang.org/x/crypto/hkdf"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -83,4 +88,75 @@ var _ = Describe("KeyDerivation", func() {
 		Expect(chacha.myIV).To(Equal([]byte{0xc4, 0x12, 0x25, 0x64}))
 		Expect(chacha.otherIV).To(Equal([]byte{0x75, 0xd8, 0xa2, 0x8d}))
 	})
+
+	It("derives AES-256-GCM fs keys", func() {
+		aead, err := DeriveKeysAESGCM256(
+			32,
+			true,
+			[]byte("0123456789012345678901"),
+			[]byte("nonce"),
+			protocol.ConnectionID(42),
+			[]byte("chlo"),
+			[]byte("scfg"),
+			[]byte("cert"),
+			nil,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		aesgcm := aead.(*aeadAESGCM)
+		// the same key material as for chacha20poly1305 is derived
+		Expect(aesgcm.myIV).To(Equal([]byte{0xf5, 0x73, 0x11, 0x79}))
+		Expect(aesgcm.otherIV).To(Equal([]byte{0xf7, 0x26, 0x4d, 0x2c}))
+	})
+
+	Context("CETV keys", func() {
+		It("builds the HKDF input from the connection ID, the CHLO and the server config", func() {
+			info := CETVHKDFInput(protocol.ConnectionID(42), []byte("chlo"), []byte("scfg"))
+			Expect(info).To(Equal(append([]byte("QUIC CETV block\x00\x2a\x00\x00\x00\x00\x00\x00\x00"), []byte("chloscfg")...)))
+		})
+
+		It("derives keys that the client can encrypt to", func() {
+			info := CETVHKDFInput(protocol.ConnectionID(42), []byte("chlo"), []byte("scfg"))
+			aead, err := DeriveCETVKeysChacha20([]byte("0123456789012345678901"), []byte("nonce"), info)
+			Expect(err).ToNot(HaveOccurred())
+			keys, err := hkdfExpand(hkdf.New(sha256.New, []byte("0123456789012345678901"), []byte("nonce"), info), 32, 32, 4, 4)
+			Expect(err).ToNot(HaveOccurred())
+			// the client has the keys the other way round
+			client, err := NewAEADChacha20Poly1305(keys[1], keys[0], keys[3], keys[2])
+			Expect(err).ToNot(HaveOccurred())
+			plaintext, err := aead.Open(0, nil, client.Seal(0, nil, []byte("foobar")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plaintext).To(Equal([]byte("foobar")))
+		})
+
+		It("derives AES-256-GCM keys", func() {
+			info := CETVHKDFInput(protocol.ConnectionID(42), []byte("chlo"), []byte("scfg"))
+			aead, err := DeriveCETVKeysAESGCM256([]byte("0123456789012345678901"), []byte("nonce"), info)
+			Expect(err).ToNot(HaveOccurred())
+			chacha, err := DeriveCETVKeysChacha20([]byte("0123456789012345678901"), []byte("nonce"), info)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aead.(*aeadAESGCM).myIV).To(Equal(chacha.(*aeadChacha20Poly1305).myIV))
+			Expect(aead.(*aeadAESGCM).otherIV).To(Equal(chacha.(*aeadChacha20Poly1305).otherIV))
+		})
+	})
+
+	Context("expanding", func() {
+		It("splits the HKDF output into slices of the given lengths", func() {
+			res, err := hkdfExpand(hkdf.New(sha256.New, []byte("secret"), []byte("salt"), []byte("info")), 32, 32, 4, 4)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(4))
+			Expect(res[0]).To(HaveLen(32))
+			Expect(res[1]).To(HaveLen(32))
+			Expect(res[2]).To(HaveLen(4))
+			Expect(res[3]).To(HaveLen(4))
+			all := make([]byte, 72)
+			_, err = io.ReadFull(hkdf.New(sha256.New, []byte("secret"), []byte("salt"), []byte("info")), all)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Join(res, nil)).To(Equal(all))
+		})
+
+		It("errors if the reader doesn't return enough data", func() {
+			_, err := hkdfExpand(bytes.NewReader([]byte("foobar")), 4, 4)
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		})
+	})
 })
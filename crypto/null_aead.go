@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 
@@ -8,42 +9,41 @@ import (
 	"github.com/lucas-clemente/quic-go/protocol"
 )
 
+// NullAEADHashSize is the size of the hash prepended to null-encrypted packets
+const NullAEADHashSize = 12
+
 // NullAEAD handles not-yet encrypted packets
 type NullAEAD struct{}
 
 var _ AEAD = &NullAEAD{}
 
+// NullAEADHash calculates the hash used by the NullAEAD.
+// It is the FNV-128a hash of the associated data and the plaintext, truncated to its lower 96 bits and written in little endian.
+func NullAEADHash(associatedData []byte, plaintext []byte) []byte {
+	hash := fnv128a.New()
+	hash.Write(associatedData)
+	hash.Write(plaintext)
+	high, low := hash.Sum128()
+
+	res := make([]byte, NullAEADHashSize)
+	binary.LittleEndian.PutUint64(res, low)
+	binary.LittleEndian.PutUint32(res[8:], uint32(high))
+	return res
+}
+
 // Open and verify the ciphertext
 func (NullAEAD) Open(packetNumber protocol.PacketNumber, associatedData []byte, ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < 12 {
+	if len(ciphertext) < NullAEADHashSize {
 		return nil, errors.New("NullAEAD: ciphertext cannot be less than 12 bytes long")
 	}
 
-	hash := fnv128a.New()
-	hash.Write(associatedData)
-	hash.Write(ciphertext[12:])
-	testHigh, testLow := hash.Sum128()
-
-	low := binary.LittleEndian.Uint64(ciphertext)
-	high := binary.LittleEndian.Uint32(ciphertext[8:])
-
-	if uint32(testHigh&0xffffffff) != high || testLow != low {
+	if !bytes.Equal(NullAEADHash(associatedData, ciphertext[NullAEADHashSize:]), ciphertext[:NullAEADHashSize]) {
 		return nil, errors.New("NullAEAD: failed to authenticate received data")
 	}
-	return ciphertext[12:], nil
+	return ciphertext[NullAEADHashSize:], nil
 }
 
 // Seal writes hash and ciphertext to the buffer
 func (NullAEAD) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
-	res := make([]byte, 12+len(plaintext))
-
-	hash := fnv128a.New()
-	hash.Write(associatedData)
-	hash.Write(plaintext)
-	high, low := hash.Sum128()
-
-	binary.LittleEndian.PutUint64(res, low)
-	binary.LittleEndian.PutUint32(res[8:], uint32(high))
-	copy(res[12:], plaintext)
-	return res
+	return append(NullAEADHash(associatedData, plaintext), plaintext...)
 }
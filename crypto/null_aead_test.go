@@ -34,6 +34,24 @@ var _ = Describe("Crypto/NullAEAD", func() {
 		Expect(aead.Seal(0, aad, plainText)).To(Equal(append([]byte{0x98, 0x9b, 0x33, 0x3f, 0xe8, 0xde, 0x32, 0x5c, 0xa6, 0x7f, 0x9c, 0xf7}, []byte("They are endowed with reason and conscience and should act towards one another in a spirit of brotherhood.")...)))
 	})
 
+	Context("hashing", func() {
+		It("hashes", func() {
+			aad := []byte("All human beings are born free and equal in dignity and rights.")
+			plainText := []byte("They are endowed with reason and conscience and should act towards one another in a spirit of brotherhood.")
+			Expect(NullAEADHash(aad, plainText)).To(Equal([]byte{0x98, 0x9b, 0x33, 0x3f, 0xe8, 0xde, 0x32, 0x5c, 0xa6, 0x7f, 0x9c, 0xf7}))
+		})
+
+		It("hashes foobar", func() {
+			Expect(NullAEADHash(nil, []byte("foobar"))).To(Equal([]byte{0x18, 0x6f, 0x44, 0xba, 0x97, 0x35, 0xd, 0x6f, 0xbf, 0x64, 0x3c, 0x79}))
+		})
+
+		It("is the prefix of sealed data", func() {
+			sealed := NullAEAD{}.Seal(0, []byte("aad"), []byte("foobar"))
+			Expect(sealed).To(HaveLen(NullAEADHashSize + 6))
+			Expect(sealed[:NullAEADHashSize]).To(Equal(NullAEADHash([]byte("aad"), []byte("foobar"))))
+		})
+	})
+
 	It("rejects short ciphertexts", func() {
 		_, err := NullAEAD{}.Open(0, nil, nil)
 		Expect(err).To(MatchError("NullAEAD: ciphertext cannot be less than 12 bytes long"))
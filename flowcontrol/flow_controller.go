@@ -87,6 +87,17 @@ func (c *flowController) SendWindowSize() protocol.ByteCount {
 	return sendFlowControlWindow - c.bytesSent
 }
 
+// ReceiveWindowSize is the number of bytes the peer can still send before violating flow control
+func (c *flowController) ReceiveWindowSize() protocol.ByteCount {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.highestReceived > c.receiveFlowControlWindow { // flow control violation, the session will be closed
+		return 0
+	}
+	return c.receiveFlowControlWindow - c.highestReceived
+}
+
 // UpdateHighestReceived updates the highestReceived value, if the byteOffset is higher
 // Should **only** be used for the stream-level FlowController
 func (c *flowController) UpdateHighestReceived(byteOffset protocol.ByteCount) protocol.ByteCount {
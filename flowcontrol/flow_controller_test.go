@@ -213,5 +213,15 @@ var _ = Describe("Flow controller", func() {
 			controller.UpdateHighestReceived(receiveFlowControlWindow)
 			Expect(controller.CheckFlowControlViolation()).To(BeFalse())
 		})
+
+		It("gets the size of the remaining receive window", func() {
+			controller.UpdateHighestReceived(1337)
+			Expect(controller.ReceiveWindowSize()).To(Equal(receiveFlowControlWindow - 1337))
+		})
+
+		It("reports an empty receive window after a flow control violation", func() {
+			controller.UpdateHighestReceived(receiveFlowControlWindow + 1)
+			Expect(controller.ReceiveWindowSize()).To(BeZero())
+		})
 	})
 })
@@ -7,6 +7,7 @@ type FlowController interface {
 	AddBytesSent(n protocol.ByteCount)
 	UpdateSendWindow(newOffset protocol.ByteCount) bool
 	SendWindowSize() protocol.ByteCount
+	ReceiveWindowSize() protocol.ByteCount
 	UpdateHighestReceived(byteOffset protocol.ByteCount) protocol.ByteCount
 	IncrementHighestReceived(increment protocol.ByteCount)
 	AddBytesRead(n protocol.ByteCount)
@@ -9,14 +9,20 @@ import (
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
-var errInvalidNackRanges = errors.New("AckFrame: ACK frame contains invalid NACK ranges")
+// MaxNackRanges is the maximum number of NACK ranges that can be written in an ACK frame, counting contiguous NACK ranges separately
+const MaxNackRanges = 0xFF
+
+var (
+	errInvalidNackRanges = errors.New("AckFrame: ACK frame contains invalid NACK ranges")
+	errTooManyNackRanges = errors.New("AckFrame: too many NACK ranges")
+)
 
 // An AckFrame in QUIC
 type AckFrame struct {
 	LargestObserved protocol.PacketNumber
 	Entropy         byte
 	NackRanges      []NackRange // has to be ordered. The NACK range with the highest FirstPacketNumber goes first, the NACK range with the lowest FirstPacketNumber goes last
-	Truncated       bool
+	Truncated       bool        // truncated ACK frames don't contain timestamps
 
 	DelayTime          time.Duration
 	PacketReceivedTime time.Time // only for received packets. Will not be modified for received ACKs frames
@@ -35,6 +41,9 @@ func (f *AckFrame) Write(b *bytes.Buffer, version protocol.VersionNumber) error
 	if f.HasNACK() {
 		typeByte |= (0x20 | 0x03)
 	}
+	if f.Truncated {
+		typeByte |= 0x10
+	}
 
 	f.DelayTime = time.Now().Sub(f.PacketReceivedTime)
 
@@ -53,23 +62,18 @@ func (f *AckFrame) Write(b *bytes.Buffer, version protocol.VersionNumber) error
 	}
 
 	utils.WriteUfloat16(b, uint64(f.DelayTime/time.Microsecond))
-	b.WriteByte(0x01)       // Just one timestamp
-	b.WriteByte(0x00)       // Delta Largest observed
-	utils.WriteUint32(b, 0) // First timestamp
+	if !f.Truncated {
+		b.WriteByte(0x01)       // Just one timestamp
+		b.WriteByte(0x00)       // Delta Largest observed
+		utils.WriteUint32(b, 0) // First timestamp
+	}
 
 	if f.HasNACK() {
-		numRanges := uint64(0)
 		// calculate the number of NackRanges that are about to be written
 		// this number is different from len(f.NackRanges) for the case of contiguous NACK ranges
-		for _, nackRange := range f.NackRanges {
-			rangeLength := nackRange.Len()
-			numRanges += rangeLength/0xFF + 1
-			if rangeLength > 0 && rangeLength%0xFF == 0 {
-				numRanges--
-			}
-		}
-		if numRanges > 0xFF {
-			panic("Too many NACK ranges. Truncating not yet implemented.")
+		numRanges := f.NumWrittenNackRanges()
+		if numRanges > MaxNackRanges {
+			return errTooManyNackRanges
 		}
 
 		b.WriteByte(uint8(numRanges))
@@ -116,11 +120,14 @@ func (f *AckFrame) Write(b *bytes.Buffer, version protocol.VersionNumber) error
 
 // MinLength of a written frame
 func (f *AckFrame) MinLength() (protocol.ByteCount, error) {
-	l := 1 + 1 + 2 + 1 + 1 + 4 // 1 TypeByte, 1 Entropy, 2 ACK delay time, 1 Num Timestamp, 1 Delta Largest Observed, 4 FirstTimestamp
+	l := 1 + 1 + 2 // 1 TypeByte, 1 Entropy, 2 ACK delay time
+	if !f.Truncated {
+		l += 1 + 1 + 4 // 1 Num Timestamp, 1 Delta Largest Observed, 4 FirstTimestamp
+	}
 	l += int(protocol.GetPacketNumberLength(f.LargestObserved))
 	l += (1 + 2) * 0 /* TODO: num_timestamps */
 	if f.HasNACK() {
-		l += 1 + (6+1)*len(f.NackRanges)
+		l += 1 + (6+1)*int(f.NumWrittenNackRanges())
 		l++ // TODO: Remove once we drop support for <32
 	}
 	return protocol.ByteCount(l), nil
@@ -134,6 +141,15 @@ func (f *AckFrame) HasNACK() bool {
 	return false
 }
 
+// NumWrittenNackRanges gets the number of NACK ranges that are written for the frame, including contiguous NACK ranges
+func (f *AckFrame) NumWrittenNackRanges() uint64 {
+	var numRanges uint64
+	for _, nackRange := range f.NackRanges {
+		numRanges += nackRange.NumWrittenRanges()
+	}
+	return numRanges
+}
+
 // GetHighestInOrderPacketNumber gets the highest in order packet number that is confirmed by this ACK
 func (f *AckFrame) GetHighestInOrderPacketNumber() protocol.PacketNumber {
 	if f.HasNACK() {
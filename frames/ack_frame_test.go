@@ -429,6 +429,22 @@ var _ = Describe("AckFrame", func() {
 				Expect(missingPacketBytes[28]).To(Equal(uint8(0xFF)))                 // rangeLength #4
 			})
 
+			It("writes a frame with a NACK range that completely fills two NACK ranges", func() {
+				frame := AckFrame{
+					Entropy:         2,
+					LargestObserved: 514,
+					NackRanges:      []NackRange{{FirstPacketNumber: 2, LastPacketNumber: 513}},
+				}
+				err := frame.Write(b, 32)
+				Expect(err).ToNot(HaveOccurred())
+				missingPacketBytes := b.Bytes()[b.Len()-(1+2*7):]
+				Expect(missingPacketBytes[0]).To(Equal(uint8(2)))                    // numRanges
+				Expect(missingPacketBytes[1:7]).To(Equal([]byte{1, 0, 0, 0, 0, 0}))  // missingPacketSequenceNumberDelta #1
+				Expect(missingPacketBytes[7]).To(Equal(uint8(0xFF)))                 // rangeLength #1
+				Expect(missingPacketBytes[8:14]).To(Equal([]byte{0, 0, 0, 0, 0, 0})) // missingPacketSequenceNumberDelta #2
+				Expect(missingPacketBytes[14]).To(Equal(uint8(0xFF)))                // rangeLength #2
+			})
+
 			Context("LargestObserved length", func() {
 				It("writes a 1 byte LargestObserved value", func() {
 					frame := AckFrame{
@@ -472,6 +488,27 @@ var _ = Describe("AckFrame", func() {
 			})
 		})
 
+		It("writes truncated frames without timestamps", func() {
+			frame := AckFrame{
+				Entropy:         2,
+				LargestObserved: 1,
+				Truncated:       true,
+			}
+			err := frame.Write(b, 32)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b.Bytes()[0] & 0x10).To(Equal(uint8(0x10)))
+			Expect(b.Len()).To(Equal(1 + 1 + 1 + 2)) // type byte, entropy, LargestObserved, ACK delay time
+		})
+
+		It("refuses to write frames with too many NACK ranges", func() {
+			frame := AckFrame{LargestObserved: 2*(MaxNackRanges+1) + 1}
+			for i := MaxNackRanges + 1; i > 0; i-- {
+				frame.NackRanges = append(frame.NackRanges, NackRange{FirstPacketNumber: protocol.PacketNumber(2 * i), LastPacketNumber: protocol.PacketNumber(2 * i)})
+			}
+			err := frame.Write(b, 32)
+			Expect(err).To(MatchError(errTooManyNackRanges))
+		})
+
 		Context("min length", func() {
 			It("has proper min length", func() {
 				f := &AckFrame{
@@ -501,6 +538,29 @@ var _ = Describe("AckFrame", func() {
 				Expect(err).ToNot(HaveOccurred())
 				Expect(f.MinLength()).To(Equal(protocol.ByteCount(b.Len())))
 			})
+
+			It("has proper min length with contiguous nack ranges", func() {
+				f := &AckFrame{
+					Entropy:         2,
+					LargestObserved: 1000,
+					NackRanges:      []NackRange{{FirstPacketNumber: 2, LastPacketNumber: 999}},
+				}
+				err := f.Write(b, 31)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.MinLength()).To(Equal(protocol.ByteCount(b.Len())))
+			})
+
+			It("has proper min length for truncated frames", func() {
+				f := &AckFrame{
+					Entropy:         2,
+					LargestObserved: 4,
+					NackRanges:      []NackRange{{FirstPacketNumber: 2, LastPacketNumber: 2}},
+					Truncated:       true,
+				}
+				err := f.Write(b, 31)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.MinLength()).To(Equal(protocol.ByteCount(b.Len())))
+			})
 		})
 	})
 
@@ -562,5 +622,37 @@ var _ = Describe("AckFrame", func() {
 			Expect(frame.NackRanges).To(HaveLen(len(frameOrig.NackRanges)))
 			Expect(frame.NackRanges).To(Equal(frameOrig.NackRanges))
 		})
+
+		It("is self-consistent for ACK frames with the maximum number of NACK ranges", func() {
+			frameOrig := &AckFrame{LargestObserved: 2*MaxNackRanges + 1}
+			for i := MaxNackRanges; i > 0; i-- {
+				frameOrig.NackRanges = append(frameOrig.NackRanges, NackRange{FirstPacketNumber: protocol.PacketNumber(2 * i), LastPacketNumber: protocol.PacketNumber(2 * i)})
+			}
+			err := frameOrig.Write(b, 32)
+			Expect(err).ToNot(HaveOccurred())
+			frame, err := ParseAckFrame(bytes.NewReader(b.Bytes()), 32)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.LargestObserved).To(Equal(frameOrig.LargestObserved))
+			Expect(frame.NackRanges).To(Equal(frameOrig.NackRanges))
+		})
+
+		It("is self-consistent for truncated ACK frames", func() {
+			frameOrig := &AckFrame{
+				Entropy:         0x42,
+				LargestObserved: 15,
+				NackRanges:      []NackRange{{FirstPacketNumber: 7, LastPacketNumber: 9}},
+				Truncated:       true,
+			}
+			err := frameOrig.Write(b, 32)
+			Expect(err).ToNot(HaveOccurred())
+			r := bytes.NewReader(b.Bytes())
+			frame, err := ParseAckFrame(r, 32)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Len()).To(BeZero())
+			Expect(frame.Truncated).To(BeTrue())
+			Expect(frame.Entropy).To(Equal(frameOrig.Entropy))
+			Expect(frame.LargestObserved).To(Equal(frameOrig.LargestObserved))
+			Expect(frame.NackRanges).To(Equal(frameOrig.NackRanges))
+		})
 	})
 })
@@ -0,0 +1,56 @@
+package frames
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// A DatagramFrame carries an unreliable message.
+// It is never retransmitted.
+type DatagramFrame struct {
+	Data []byte
+}
+
+// ParseDatagramFrame reads a DATAGRAM frame
+func ParseDatagramFrame(r *bytes.Reader) (*DatagramFrame, error) {
+	frame := &DatagramFrame{}
+
+	// read the TypeByte
+	_, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	dataLen, err := utils.ReadUint16(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if protocol.ByteCount(dataLen) > protocol.MaxDatagramFrameSize {
+		return nil, qerr.Error(qerr.InvalidFrameData, "datagram too large")
+	}
+
+	frame.Data = make([]byte, dataLen)
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Write writes a DATAGRAM frame
+func (f *DatagramFrame) Write(b *bytes.Buffer, version protocol.VersionNumber) error {
+	b.WriteByte(0x08)
+	utils.WriteUint16(b, uint16(len(f.Data)))
+	b.Write(f.Data)
+	return nil
+}
+
+// MinLength of a written frame
+func (f *DatagramFrame) MinLength() (protocol.ByteCount, error) {
+	return 1 + 2 + protocol.ByteCount(len(f.Data)), nil
+}
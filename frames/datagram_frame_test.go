@@ -0,0 +1,60 @@
+package frames
+
+import (
+	"bytes"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DatagramFrame", func() {
+	Context("when parsing", func() {
+		It("accepts sample frame", func() {
+			b := bytes.NewReader([]byte{0x08, 0x3, 0x0, 'f', 'o', 'o'})
+			frame, err := ParseDatagramFrame(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.Data).To(Equal([]byte("foo")))
+			Expect(b.Len()).To(Equal(0))
+		})
+
+		It("accepts an empty datagram", func() {
+			b := bytes.NewReader([]byte{0x08, 0x0, 0x0})
+			frame, err := ParseDatagramFrame(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.Data).To(BeEmpty())
+		})
+
+		It("rejects datagrams that are too large", func() {
+			b := &bytes.Buffer{}
+			(&DatagramFrame{Data: make([]byte, protocol.MaxDatagramFrameSize+1)}).Write(b, 0)
+			_, err := ParseDatagramFrame(bytes.NewReader(b.Bytes()))
+			Expect(err).To(MatchError(qerr.Error(qerr.InvalidFrameData, "datagram too large")))
+		})
+
+		It("errors on EOFs", func() {
+			data := []byte{0x08, 0x3, 0x0, 'f', 'o', 'o'}
+			_, err := ParseDatagramFrame(bytes.NewReader(data))
+			Expect(err).NotTo(HaveOccurred())
+			for i := range data {
+				_, err := ParseDatagramFrame(bytes.NewReader(data[0:i]))
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Context("when writing", func() {
+		It("writes a sample frame", func() {
+			b := &bytes.Buffer{}
+			frame := DatagramFrame{Data: []byte("foo")}
+			frame.Write(b, 0)
+			Expect(b.Bytes()).To(Equal([]byte{0x08, 0x3, 0x0, 'f', 'o', 'o'}))
+		})
+
+		It("has the correct min length", func() {
+			frame := DatagramFrame{Data: []byte("foo")}
+			Expect(frame.MinLength()).To(Equal(protocol.ByteCount(6)))
+		})
+	})
+})
@@ -13,6 +13,12 @@ func (n *NackRange) Len() uint64 {
 	return uint64(n.LastPacketNumber) - uint64(n.FirstPacketNumber)
 }
 
+// NumWrittenRanges gets the number of NACK ranges needed to write the NackRange in an ACK frame
+// Every written NACK range covers up to 256 packet numbers, longer NackRanges are continued in contiguous NACK ranges.
+func (n *NackRange) NumWrittenRanges() uint64 {
+	return n.Len()/0x100 + 1
+}
+
 // ContainsPacketNumber checks if a packetNumber is contained in a NACK range
 func (n *NackRange) ContainsPacketNumber(packetNumber protocol.PacketNumber) bool {
 	if packetNumber >= n.FirstPacketNumber && packetNumber <= n.LastPacketNumber {
@@ -19,6 +19,19 @@ var _ = Describe("NackRange", func() {
 		})
 	})
 
+	Context("number of written NACK ranges", func() {
+		It("writes a NACK range with up to 256 packets in one NACK range", func() {
+			Expect((&NackRange{FirstPacketNumber: 2, LastPacketNumber: 2}).NumWrittenRanges()).To(Equal(uint64(1)))
+			Expect((&NackRange{FirstPacketNumber: 2, LastPacketNumber: 257}).NumWrittenRanges()).To(Equal(uint64(1)))
+		})
+
+		It("writes longer NACK ranges in contiguous NACK ranges", func() {
+			Expect((&NackRange{FirstPacketNumber: 2, LastPacketNumber: 258}).NumWrittenRanges()).To(Equal(uint64(2)))
+			Expect((&NackRange{FirstPacketNumber: 2, LastPacketNumber: 513}).NumWrittenRanges()).To(Equal(uint64(2)))
+			Expect((&NackRange{FirstPacketNumber: 2, LastPacketNumber: 514}).NumWrittenRanges()).To(Equal(uint64(3)))
+		})
+	})
+
 	Context("ContainsPacketNumber", func() {
 		It("determines if a packet is in a NACK range with only one packet", func() {
 			nackRange := NackRange{FirstPacketNumber: 2, LastPacketNumber: 2}
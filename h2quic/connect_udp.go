@@ -0,0 +1,280 @@
+package h2quic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// connectUDPPathPrefix is the prefix of the default URI template for UDP proxying, /.well-known/masque/udp/{target_host}/{target_port}/
+const connectUDPPathPrefix = "/.well-known/masque/udp/"
+
+// maxProxiedDatagramsQueueLen is the number of datagrams queued for a single proxied flow, further datagrams are dropped
+const maxProxiedDatagramsQueueLen = 32
+
+var (
+	errInvalidDatagram    = errors.New("h2quic: invalid HTTP datagram")
+	errInvalidConnectPath = errors.New("h2quic: invalid connect-udp path")
+)
+
+// datagramSession is implemented by sessions that can send and receive unreliable datagrams
+type datagramSession interface {
+	SupportsDatagrams() bool
+	SendMessage([]byte) error
+	ReceiveMessage() ([]byte, error)
+}
+
+// isConnectUDP checks if a request is an extended CONNECT request for proxying UDP
+func isConnectUDP(req *http.Request) bool {
+	proto, _ := req.Context().Value(ProtocolContextKey).(string)
+	return req.Method == "CONNECT" && proto == "connect-udp"
+}
+
+// nonPublicIPv4Nets are the IPv4 ranges that are not public, but not covered by the net.IP methods
+var nonPublicIPv4Nets = []net.IPNet{
+	{IP: net.IP{0, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},          // this network
+	{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)},      // shared address space (carrier-grade NAT)
+	{IP: net.IP{255, 255, 255, 255}, Mask: net.CIDRMask(32, 32)}, // limited broadcast
+}
+
+// isPublicIP checks if an IP address may be used as a connect-udp target by default.
+// Loopback, private, link-local, unspecified, shared, broadcast and multicast addresses are not.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublicIPv4Nets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// connectUDPAllowed checks if the resolved target of a connect-udp request may be proxied to
+func (s *Server) connectUDPAllowed(req *http.Request, target *net.UDPAddr) bool {
+	if s.ConnectUDPAllowed != nil {
+		return s.ConnectUDPAllowed(req, target.String())
+	}
+	return isPublicIP(target.IP)
+}
+
+// parseConnectUDPTarget gets the target address from the path of a connect-udp request
+func parseConnectUDPTarget(path string) (string, error) {
+	if !strings.HasPrefix(path, connectUDPPathPrefix) {
+		return "", errInvalidConnectPath
+	}
+	parts := strings.Split(strings.TrimSuffix(path[len(connectUDPPathPrefix):], "/"), "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", errInvalidConnectPath
+	}
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+// A datagramMux distributes the datagrams of a session to the proxied flows.
+// Every datagram starts with the flow ID, which is the stream ID of the CONNECT request, followed by a context ID, which is 0 for UDP payloads.
+type datagramMux struct {
+	session datagramSession
+
+	mutex sync.Mutex
+	flows map[uint64]chan []byte
+}
+
+func newDatagramMux(session datagramSession) *datagramMux {
+	return &datagramMux{
+		session: session,
+		flows:   make(map[uint64]chan []byte),
+	}
+}
+
+func (m *datagramMux) register(flowID uint64) <-chan []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := make(chan []byte, maxProxiedDatagramsQueueLen)
+	m.flows[flowID] = c
+	return c
+}
+
+func (m *datagramMux) unregister(flowID uint64) {
+	m.mutex.Lock()
+	delete(m.flows, flowID)
+	m.mutex.Unlock()
+}
+
+func (m *datagramMux) send(flowID uint64, payload []byte) error {
+	b := &bytes.Buffer{}
+	writeVarInt(b, flowID)
+	writeVarInt(b, 0)
+	b.Write(payload)
+	return m.session.SendMessage(b.Bytes())
+}
+
+// run dispatches received datagrams until the session is closed
+func (m *datagramMux) run() {
+	for {
+		data, err := m.session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(data)
+		flowID, err := readVarInt(r)
+		if err != nil {
+			continue
+		}
+		contextID, err := readVarInt(r)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		m.mutex.Lock()
+		c, ok := m.flows[flowID]
+		m.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case c <- data[len(data)-r.Len():]:
+		default:
+			utils.Debugf("Dropping proxied datagram for flow %d, the queue is full", flowID)
+		}
+	}
+}
+
+// getDatagramMux returns the datagramMux of a session, and starts it if necessary
+func (s *Server) getDatagramMux(session datagramSession) *datagramMux {
+	s.datagramMuxesMutex.Lock()
+	defer s.datagramMuxesMutex.Unlock()
+	if s.datagramMuxes == nil {
+		s.datagramMuxes = make(map[datagramSession]*datagramMux)
+	}
+	mux, ok := s.datagramMuxes[session]
+	if !ok {
+		mux = newDatagramMux(session)
+		s.datagramMuxes[session] = mux
+		go func() {
+			mux.run()
+			s.datagramMuxesMutex.Lock()
+			delete(s.datagramMuxes, session)
+			s.datagramMuxesMutex.Unlock()
+		}()
+	}
+	return mux
+}
+
+// proxyUDP relays datagrams between the client and the target of a connect-udp request.
+// It returns when the client closes the request stream, or the request context is canceled.
+func (s *Server) proxyUDP(ctx context.Context, sess streamCreator, w *responseWriter, req *http.Request) {
+	session, ok := sess.(datagramSession)
+	if !ok || !session.SupportsDatagrams() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target, err := parseConnectUDPTarget(req.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the target is resolved only once, so that the address that was checked is the one that is dialed
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		utils.Errorf("could not resolve UDP proxy target %s: %s", target, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if !s.connectUDPAllowed(req, addr) {
+		utils.Infof("Rejecting connect-udp request for %s", addr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		utils.Errorf("could not connect to UDP proxy target %s: %s", target, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	flowID := uint64(w.dataStreamID)
+	mux := s.getDatagramMux(session)
+	datagrams := mux.register(flowID)
+	defer mux.unregister(flowID)
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	if w.headerErr != nil {
+		return
+	}
+
+	// the proxied flow ends when the client closes the request stream
+	streamClosed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, req.Body)
+		close(streamClosed)
+	}()
+
+	go func() {
+		b := make([]byte, protocol.MaxPacketSize)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			if err := mux.send(flowID, b[:n]); err != nil {
+				utils.Debugf("could not send proxied datagram: %s", err.Error())
+			}
+		}
+	}()
+
+	for {
+		select {
+		case data := <-datagrams:
+			if _, err := conn.Write(data); err != nil {
+				utils.Debugf("could not write proxied datagram: %s", err.Error())
+			}
+		case <-streamClosed:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeVarInt writes a variable-length integer, using the encoding of IETF QUIC
+func writeVarInt(b *bytes.Buffer, i uint64) {
+	switch {
+	case i < 1<<6:
+		b.WriteByte(uint8(i))
+	case i < 1<<14:
+		b.Write([]byte{uint8(i>>8) | 0x40, uint8(i)})
+	case i < 1<<30:
+		b.Write([]byte{uint8(i>>24) | 0x80, uint8(i >> 16), uint8(i >> 8), uint8(i)})
+	default:
+		b.Write([]byte{uint8(i>>56) | 0xc0, uint8(i >> 48), uint8(i >> 40), uint8(i >> 32), uint8(i >> 24), uint8(i >> 16), uint8(i >> 8), uint8(i)})
+	}
+}
+
+// readVarInt reads a variable-length integer, using the encoding of IETF QUIC
+func readVarInt(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, errInvalidDatagram
+	}
+	length := 1 << (first >> 6)
+	i := uint64(first & 0x3f)
+	for j := 1; j < length; j++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errInvalidDatagram
+		}
+		i = i<<8 | uint64(b)
+	}
+	return i, nil
+}
@@ -0,0 +1,250 @@
+package h2quic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type mockDatagramSession struct {
+	mockSession
+	stream            utils.Stream
+	datagramsSent     chan []byte
+	datagramsToRead   chan []byte
+	supportsDatagrams bool
+}
+
+func (s *mockDatagramSession) GetOrOpenStream(protocol.StreamID) (utils.Stream, error) {
+	return s.stream, nil
+}
+
+func (s *mockDatagramSession) SupportsDatagrams() bool { return s.supportsDatagrams }
+
+func (s *mockDatagramSession) SendMessage(b []byte) error {
+	s.datagramsSent <- append([]byte{}, b...)
+	return nil
+}
+
+func (s *mockDatagramSession) ReceiveMessage() ([]byte, error) {
+	b, ok := <-s.datagramsToRead
+	if !ok {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+// openStream is a data stream that blocks reads until it is closed by the client
+type openStream struct {
+	mockStream
+	remoteClose chan struct{}
+}
+
+func (s *openStream) Read(p []byte) (int, error) {
+	<-s.remoteClose
+	return 0, io.EOF
+}
+
+var _ = Describe("CONNECT-UDP", func() {
+	It("writes and reads varints", func() {
+		for _, i := range []uint64{0, 37, 15293, 494878333, 151288809941952652} {
+			b := &bytes.Buffer{}
+			writeVarInt(b, i)
+			val, err := readVarInt(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(val).To(Equal(i))
+			Expect(b.Len()).To(BeZero())
+		}
+	})
+
+	It("errors on truncated varints", func() {
+		_, err := readVarInt(bytes.NewReader([]byte{0x7b}))
+		Expect(err).To(MatchError(errInvalidDatagram))
+	})
+
+	It("parses the target", func() {
+		target, err := parseConnectUDPTarget("/.well-known/masque/udp/192.0.2.6/443/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("192.0.2.6:443"))
+		target, err = parseConnectUDPTarget("/.well-known/masque/udp/2001:db8::42/443/")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("[2001:db8::42]:443"))
+	})
+
+	It("rejects invalid paths", func() {
+		for _, path := range []string{"/", "/.well-known/masque/udp/192.0.2.6/", "/.well-known/masque/udp//443/", "/.well-known/masque/udp/a/b/c/"} {
+			_, err := parseConnectUDPTarget(path)
+			Expect(err).To(MatchError(errInvalidConnectPath))
+		}
+	})
+
+	It("only allows public addresses by default", func() {
+		Expect(isPublicIP(net.ParseIP("192.0.2.6"))).To(BeTrue())
+		Expect(isPublicIP(net.ParseIP("2001:db8::1"))).To(BeTrue())
+		Expect(isPublicIP(net.ParseIP("100.128.0.1"))).To(BeTrue())
+		for _, ip := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "fd00::1", "169.254.169.254", "fe80::1", "0.0.0.0", "::",
+			"0.1.2.3", "100.64.0.1", "100.127.255.254", "255.255.255.255", "224.0.0.1", "233.252.0.1", "ff0e::1"} {
+			Expect(isPublicIP(net.ParseIP(ip))).To(BeFalse(), ip)
+		}
+	})
+
+	Context("proxying", func() {
+		var (
+			s            *Server
+			session      *mockDatagramSession
+			headerStream *mockStream
+			dataStream   *openStream
+			target       *net.UDPConn
+		)
+
+		BeforeEach(func() {
+			s = &Server{
+				Server:           &http.Server{},
+				EnableConnectUDP: true,
+				// the target listens on a loopback address
+				ConnectUDPAllowed: func(*http.Request, string) bool { return true },
+			}
+			dataStream = &openStream{remoteClose: make(chan struct{})}
+			session = &mockDatagramSession{
+				stream:            dataStream,
+				datagramsSent:     make(chan []byte, 10),
+				datagramsToRead:   make(chan []byte, 10),
+				supportsDatagrams: true,
+			}
+			headerStream = &mockStream{}
+			var err error
+			target, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			target.Close()
+			close(session.datagramsToRead)
+		})
+
+		// connect sends a connect-udp request for the target and returns the response status
+		connect := func(sess streamCreator) string {
+			port := strconv.Itoa(target.LocalAddr().(*net.UDPAddr).Port)
+			var headers bytes.Buffer
+			enc := hpack.NewEncoder(&headers)
+			enc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
+			enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: "connect-udp"})
+			enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+			enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "proxy.example.com"})
+			enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/.well-known/masque/udp/127.0.0.1/" + port + "/"})
+			err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      5,
+				EndHeaders:    true,
+				BlockFragment: headers.Bytes(),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			h2framer := http2.NewFramer(nil, headerStream)
+			err = s.handleRequest(context.Background(), sess, headerStream, &sync.Mutex{}, hpack.NewDecoder(4096, nil), h2framer, &clientSettings{headerTableSize: defaultHeaderTableSize})
+			Expect(err).ToNot(HaveOccurred())
+			// the response was written to the same mockStream
+			var frame http2.Frame
+			Eventually(func() error {
+				frame, err = h2framer.ReadFrame()
+				return err
+			}).ShouldNot(HaveOccurred())
+			fields, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+			Expect(err).ToNot(HaveOccurred())
+			return fields[0].Value
+		}
+
+		It("relays datagrams both ways", func() {
+			Expect(connect(session)).To(Equal("200"))
+
+			// from the client to the target
+			session.datagramsToRead <- append([]byte{5, 0}, []byte("foobar")...)
+			b := make([]byte, 100)
+			target.SetReadDeadline(time.Now().Add(time.Second))
+			n, proxyAddr, err := target.ReadFrom(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b[:n]).To(Equal([]byte("foobar")))
+
+			// from the target to the client
+			_, err = target.WriteTo([]byte("raboof"), proxyAddr)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(session.datagramsSent).Should(Receive(Equal(append([]byte{5, 0}, []byte("raboof")...))))
+
+			close(dataStream.remoteClose)
+			Eventually(func() bool { return dataStream.closed }).Should(BeTrue())
+		})
+
+		It("drops datagrams of other flows", func() {
+			Expect(connect(session)).To(Equal("200"))
+			session.datagramsToRead <- append([]byte{7, 0}, []byte("foobar")...)
+			session.datagramsToRead <- append([]byte{5, 1}, []byte("foobar")...)
+			b := make([]byte, 100)
+			target.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _, err := target.ReadFrom(b)
+			Expect(err).To(HaveOccurred())
+			close(dataStream.remoteClose)
+		})
+
+		It("rejects the request if the client doesn't support datagrams", func() {
+			session.supportsDatagrams = false
+			Expect(connect(session)).To(Equal("400"))
+			close(dataStream.remoteClose)
+		})
+
+		It("rejects loopback targets by default", func() {
+			s.ConnectUDPAllowed = nil
+			Expect(connect(session)).To(Equal("403"))
+			b := make([]byte, 100)
+			target.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			session.datagramsToRead <- append([]byte{5, 0}, []byte("foobar")...)
+			_, _, err := target.ReadFrom(b)
+			Expect(err).To(HaveOccurred())
+			close(dataStream.remoteClose)
+		})
+
+		It("passes the resolved target to the policy", func() {
+			var allowedTarget string
+			s.ConnectUDPAllowed = func(r *http.Request, target string) bool {
+				allowedTarget = target
+				return false
+			}
+			Expect(connect(session)).To(Equal("403"))
+			Expect(allowedTarget).To(Equal(target.LocalAddr().String()))
+			close(dataStream.remoteClose)
+		})
+
+		It("passes connect-udp requests to the handler if proxying is disabled", func() {
+			s.EnableConnectUDP = false
+			var protocol string
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				protocol, _ = r.Context().Value(ProtocolContextKey).(string)
+				w.WriteHeader(http.StatusTeapot)
+			})
+			Expect(connect(session)).To(Equal("418"))
+			Expect(protocol).To(Equal("connect-udp"))
+			close(dataStream.remoteClose)
+		})
+
+		It("announces support for extended CONNECT", func() {
+			err := s.writeSettings(headerStream, &sync.Mutex{})
+			Expect(err).ToNot(HaveOccurred())
+			frame, err := http2.NewFramer(nil, headerStream).ReadFrame()
+			Expect(err).ToNot(HaveOccurred())
+			val, ok := frame.(*http2.SettingsFrame).Value(http2.SettingEnableConnectProtocol)
+			Expect(ok).To(BeTrue())
+			Expect(val).To(Equal(uint32(1)))
+			close(dataStream.remoteClose)
+		})
+	})
+})
@@ -0,0 +1,170 @@
+package h2quic
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// GzipHandler wraps a handler and gzip-compresses its responses if the client accepts gzip.
+// Responses that already have a Content-Encoding, responses to HEAD requests, and responses that can't have a body are passed through unchanged.
+func GzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r.Header) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == "HEAD"}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip checks if the Accept-Encoding header lists gzip with a q-value larger than 0
+func acceptsGzip(hdr http.Header) bool {
+	for _, v := range hdr["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			params := strings.Split(enc, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if len(param) < 2 || !strings.EqualFold(param[:2], "q=") {
+					continue
+				}
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || q <= 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// bodyAllowed checks if a response with this status can have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	head          bool // the response to a HEAD request has no body
+	gz            *gzip.Writer
+	headerWritten bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.headerWritten {
+		return
+	}
+	// informational responses are followed by the final response
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.headerWritten = true
+	hdr := w.Header()
+	hdr.Add("Vary", "Accept-Encoding")
+	// don't compress twice
+	if hdr.Get("Content-Encoding") == "" && !w.head && bodyAllowed(status) {
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(200)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+// DataStream hands out the underlying data stream, bypassing compression.
+// It returns nil if the wrapped ResponseWriter is not a DataStreamer, or if the response is already being compressed.
+func (w *gzipResponseWriter) DataStream() utils.Stream {
+	if w.gz != nil {
+		return nil
+	}
+	ds, ok := w.ResponseWriter.(DataStreamer)
+	if !ok {
+		return nil
+	}
+	w.headerWritten = true
+	return ds.DataStream()
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	if err := w.gz.Close(); err != nil {
+		utils.Errorf("could not finish gzip response: %s", err.Error())
+	}
+}
+
+// GzipTransport wraps a RoundTripper, like net/http's Transport does: it asks for gzip-compressed responses, and transparently decompresses them.
+// HEAD requests and requests that already have an Accept-Encoding or a Range header are passed through unchanged, and their responses are not decompressed.
+// Decompressed responses have no Content-Encoding and Content-Length, and Uncompressed is set.
+func GzipTransport(rt http.RoundTripper) http.RoundTripper {
+	return gzipTransport{rt}
+}
+
+type gzipTransport struct {
+	http.RoundTripper
+}
+
+func (t gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" || req.Method == "HEAD" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	// the RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip")
+	rsp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(rsp.Header.Get("Content-Encoding"), "gzip") {
+		return rsp, nil
+	}
+	rsp.Body = &gzipReader{body: rsp.Body}
+	rsp.Header.Del("Content-Encoding")
+	rsp.Header.Del("Content-Length")
+	rsp.ContentLength = -1
+	rsp.Uncompressed = true
+	return rsp, nil
+}
+
+// gzipReader decompresses a response body. The gzip header is only read on the first Read.
+type gzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	if r.zr == nil && r.err == nil {
+		r.zr, r.err = gzip.NewReader(r.body)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.zr.Read(p)
+}
+
+func (r *gzipReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,246 @@
+package h2quic
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/lucas-clemente/quic-go/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// dataStreamRecorder is a ResponseRecorder that is a DataStreamer
+type dataStreamRecorder struct {
+	*httptest.ResponseRecorder
+	stream utils.Stream
+}
+
+func (r *dataStreamRecorder) DataStream() utils.Stream { return r.stream }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+var _ = Describe("Gzip handler", func() {
+	var (
+		handler http.Handler
+		req     *http.Request
+		rec     *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("foobar"))
+		}))
+		var err error
+		req, err = http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rec = httptest.NewRecorder()
+	})
+
+	It("compresses if the client accepts gzip", func() {
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(200))
+		Expect(rec.Header().Get("Content-Encoding")).To(Equal("gzip"))
+		Expect(rec.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+		r, err := gzip.NewReader(rec.Body)
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal([]byte("foobar")))
+	})
+
+	It("doesn't compress if the client doesn't accept gzip", func() {
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(rec.Body.Bytes()).To(Equal([]byte("foobar")))
+	})
+
+	It("doesn't compress twice", func() {
+		handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("already compressed"))
+		}))
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Header().Get("Content-Encoding")).To(Equal("gzip"))
+		Expect(rec.Body.Bytes()).To(Equal([]byte("already compressed")))
+	})
+
+	It("removes the Content-Length of the uncompressed body", func() {
+		handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "6")
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte("foobar"))
+		}))
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusTeapot))
+		Expect(rec.Header().Get("Content-Length")).To(BeEmpty())
+	})
+
+	It("doesn't compress if gzip has a q-value of 0", func() {
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=0")
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(rec.Body.Bytes()).To(Equal([]byte("foobar")))
+		Expect(acceptsGzip(http.Header{"Accept-Encoding": {"gzip; q=0.000"}})).To(BeFalse())
+		Expect(acceptsGzip(http.Header{"Accept-Encoding": {"gzip;Q=0.5"}})).To(BeTrue())
+	})
+
+	It("doesn't compress responses to HEAD requests", func() {
+		req.Method = "HEAD"
+		req.Header.Set("Accept-Encoding", "gzip")
+		handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "6")
+		}))
+		handler.ServeHTTP(rec, req)
+		Expect(rec.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(rec.Header().Get("Content-Length")).To(Equal("6"))
+		Expect(rec.Body.Len()).To(BeZero())
+	})
+
+	It("doesn't compress responses without a body", func() {
+		for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+			rec = httptest.NewRecorder()
+			handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			}))
+			req.Header.Set("Accept-Encoding", "gzip")
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(status))
+			Expect(rec.Header().Get("Content-Encoding")).To(BeEmpty())
+			Expect(rec.Body.Len()).To(BeZero())
+		}
+	})
+
+	It("compresses the final response after an informational response", func() {
+		w := &gzipResponseWriter{ResponseWriter: rec}
+		w.WriteHeader(http.StatusEarlyHints)
+		Expect(w.headerWritten).To(BeFalse())
+		Expect(w.Header().Get("Content-Encoding")).To(BeEmpty())
+		w.WriteHeader(http.StatusOK)
+		Expect(w.gz).ToNot(BeNil())
+		Expect(w.Header().Get("Content-Encoding")).To(Equal("gzip"))
+	})
+
+	Context("taking over the data stream", func() {
+		var dataStream *mockStream
+
+		BeforeEach(func() {
+			dataStream = &mockStream{}
+			req.Header.Set("Accept-Encoding", "gzip")
+		})
+
+		It("hands out the data stream before the response is compressed", func() {
+			var str utils.Stream
+			handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				str = w.(DataStreamer).DataStream()
+			}))
+			handler.ServeHTTP(&dataStreamRecorder{ResponseRecorder: rec, stream: dataStream}, req)
+			Expect(str).To(Equal(dataStream))
+		})
+
+		It("doesn't hand out the data stream once the response is compressed", func() {
+			var str utils.Stream
+			handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("foobar"))
+				str = w.(DataStreamer).DataStream()
+			}))
+			handler.ServeHTTP(&dataStreamRecorder{ResponseRecorder: rec, stream: dataStream}, req)
+			Expect(str).To(BeNil())
+		})
+	})
+})
+
+var _ = Describe("Gzip transport", func() {
+	var (
+		transport http.RoundTripper
+		received  *http.Request
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("foobar"))
+		}))
+		transport = GzipTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			received = req
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Result(), nil
+		}))
+	})
+
+	It("asks for gzip and decompresses the response", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rsp, err := transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received.Header.Get("Accept-Encoding")).To(Equal("gzip"))
+		Expect(req.Header.Get("Accept-Encoding")).To(BeEmpty())
+		Expect(rsp.Uncompressed).To(BeTrue())
+		Expect(rsp.ContentLength).To(Equal(int64(-1)))
+		Expect(rsp.Header.Get("Content-Encoding")).To(BeEmpty())
+		body, err := ioutil.ReadAll(rsp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal([]byte("foobar")))
+		Expect(rsp.Body.Close()).To(Succeed())
+	})
+
+	It("doesn't decompress uncompressed responses", func() {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("foobar"))
+		})
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rsp, err := transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rsp.Uncompressed).To(BeFalse())
+		body, err := ioutil.ReadAll(rsp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal([]byte("foobar")))
+	})
+
+	It("doesn't decompress if the caller asked for an encoding", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Accept-Encoding", "gzip")
+		rsp, err := transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(req))
+		Expect(rsp.Uncompressed).To(BeFalse())
+		Expect(rsp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+		r, err := gzip.NewReader(rsp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body).To(Equal([]byte("foobar")))
+	})
+
+	It("doesn't ask for gzip for range requests", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Range", "bytes=0-2")
+		_, err = transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received.Header.Get("Accept-Encoding")).To(BeEmpty())
+	})
+
+	It("returns an error for a malformed gzip body", func() {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("foobar"))
+		})
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rsp, err := transport.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ioutil.ReadAll(rsp.Body)
+		Expect(err).To(HaveOccurred())
+	})
+})
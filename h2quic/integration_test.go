@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -16,6 +17,7 @@ import (
 	"github.com/lucas-clemente/quic-go/h2quic"
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/testdata"
+	"github.com/lucas-clemente/quic-go/testutil"
 
 	_ "github.com/lucas-clemente/quic-clients" // download clients
 
@@ -29,12 +31,15 @@ var _ = Describe("Integration tests", func() {
 	const port = "6729"
 	const host = "127.0.0.1"
 	const addr = host + ":" + port
+	// the server on lossyPort drops 10% of the packets it sends
+	const lossyPort = "6730"
 
 	const dataLen = 50 * 1024
 
 	var (
-		server     *h2quic.Server
-		clientPath string
+		server      *h2quic.Server
+		lossyServer *h2quic.Server
+		clientPath  string
 		data       []byte
 	)
 
@@ -70,12 +75,26 @@ var _ = Describe("Integration tests", func() {
 			defer GinkgoRecover()
 			server.ListenAndServe()
 		}()
+
+		udpAddr, err := net.ResolveUDPAddr("udp", host+":"+lossyPort)
+		Expect(err).NotTo(HaveOccurred())
+		conn, err := net.ListenUDP("udp", udpAddr)
+		Expect(err).NotTo(HaveOccurred())
+		lossyServer = &h2quic.Server{
+			Server: &http.Server{TLSConfig: testdata.GetTLSConfig()},
+		}
+		go func() {
+			defer GinkgoRecover()
+			lossyServer.ServePacketConn(testutil.NewPacketConn(conn, testutil.Config{LossRate: 0.1, Seed: 1}))
+		}()
 		time.Sleep(10 * time.Millisecond)
 	})
 
 	AfterSuite(func() {
 		err := server.Close()
 		Expect(err).NotTo(HaveOccurred())
+		err = lossyServer.Close()
+		Expect(err).NotTo(HaveOccurred())
 	})
 
 	for i := range protocol.SupportedVersions {
@@ -125,6 +144,20 @@ var _ = Describe("Integration tests", func() {
 				Expect(bytes.Contains(session.Out.Contents(), data)).To(BeTrue())
 			})
 
+			It("gets a large file over 10% loss", func() {
+				command := exec.Command(
+					clientPath,
+					"--quic-version="+strconv.Itoa(int(version)),
+					"--host="+host,
+					"--port="+lossyPort,
+					"https://quic.clemente.io/data",
+				)
+				session, err := Start(command, nil, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session, 10).Should(Exit(0))
+				Expect(bytes.Contains(session.Out.Contents(), data)).To(BeTrue())
+			})
+
 			It("gets many large files in parallel", func() {
 				wg := sync.WaitGroup{}
 				for i := 0; i < 10; i++ {
@@ -1,6 +1,7 @@
 package h2quic
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/url"
@@ -9,7 +10,7 @@ import (
 )
 
 func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
-	var path, authority, method string
+	var path, authority, method, protocol string
 	httpHeaders := http.Header{}
 
 	for _, h := range headers {
@@ -20,6 +21,8 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 			method = h.Value
 		case ":authority":
 			authority = h.Value
+		case ":protocol":
+			protocol = h.Value
 		default:
 			if !h.IsPseudo() {
 				httpHeaders.Add(h.Name, h.Value)
@@ -27,6 +30,28 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 		}
 	}
 
+	// extended CONNECT requests carry a :path like other requests, the :protocol is passed on in the request context
+	if len(protocol) > 0 && method != "CONNECT" {
+		return nil, errors.New(":protocol is only allowed for CONNECT")
+	}
+
+	// CONNECT requests only carry the :authority they want to be connected to
+	if method == "CONNECT" && len(protocol) == 0 {
+		if len(authority) == 0 {
+			return nil, errors.New(":authority must not be empty for CONNECT")
+		}
+		return &http.Request{
+			Method:     method,
+			URL:        &url.URL{Host: authority},
+			Proto:      "HTTP/2.0",
+			ProtoMajor: 2,
+			ProtoMinor: 0,
+			Header:     httpHeaders,
+			Host:       authority,
+			RequestURI: authority,
+		}, nil
+	}
+
 	if len(path) == 0 || len(authority) == 0 || len(method) == 0 {
 		return nil, errors.New(":path, :authority and :method must not be empty")
 	}
@@ -36,7 +61,7 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 		return nil, err
 	}
 
-	return &http.Request{
+	req := &http.Request{
 		Method:     method,
 		URL:        u,
 		Proto:      "HTTP/2.0",
@@ -47,5 +72,9 @@ func requestFromHeaders(headers []hpack.HeaderField) (*http.Request, error) {
 		// ContentLength: -1,
 		Host:       authority,
 		RequestURI: path,
-	}, nil
+	}
+	if len(protocol) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), ProtocolContextKey, protocol))
+	}
+	return req, nil
 }
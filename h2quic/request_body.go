@@ -0,0 +1,39 @@
+package h2quic
+
+import (
+	"context"
+	"io"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// requestBody reads the request body directly from the data stream, without buffering it.
+// The stream only grants the client more flow control credit as the handler reads,
+// so a slow handler throttles the upload.
+type requestBody struct {
+	dataStream utils.Stream
+	cancel     context.CancelFunc
+}
+
+var _ io.ReadCloser = &requestBody{}
+
+func newRequestBody(dataStream utils.Stream, cancel context.CancelFunc) *requestBody {
+	return &requestBody{
+		dataStream: dataStream,
+		cancel:     cancel,
+	}
+}
+
+// Read reads from the data stream. If the stream fails, e.g. because it was reset, the request context is canceled.
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.dataStream.Read(p)
+	if err != nil && err != io.EOF {
+		b.cancel()
+	}
+	return n, err
+}
+
+// Close is a no-op: the stream's Close() closes the write side, not the read side
+func (b *requestBody) Close() error {
+	return nil
+}
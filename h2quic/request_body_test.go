@@ -0,0 +1,59 @@
+package h2quic
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type erroringStream struct {
+	mockStream
+	err error
+}
+
+func (s *erroringStream) Read([]byte) (int, error) { return 0, s.err }
+
+var _ = Describe("Request body", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	It("reads from the data stream", func() {
+		dataStream := &mockStream{}
+		dataStream.Write([]byte("foobar"))
+		body := newRequestBody(dataStream, cancel)
+		b := make([]byte, 6)
+		_, err := io.ReadFull(body, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(Equal([]byte("foobar")))
+	})
+
+	It("doesn't cancel the context on EOF", func() {
+		body := newRequestBody(&mockStream{}, cancel)
+		_, err := body.Read([]byte{0})
+		Expect(err).To(MatchError(io.EOF))
+		Expect(ctx.Err()).ToNot(HaveOccurred())
+	})
+
+	It("cancels the context when the stream is reset", func() {
+		testErr := errors.New("RST_STREAM received with code 42")
+		body := newRequestBody(&erroringStream{err: testErr}, cancel)
+		_, err := body.Read([]byte{0})
+		Expect(err).To(MatchError(testErr))
+		Expect(ctx.Err()).To(MatchError(context.Canceled))
+	})
+
+	It("doesn't close the data stream", func() {
+		dataStream := &mockStream{}
+		body := newRequestBody(dataStream, cancel)
+		Expect(body.Close()).To(Succeed())
+	})
+})
@@ -72,4 +72,55 @@ var _ = Describe("Request", func() {
 		_, err := requestFromHeaders(headers)
 		Expect(err).To(MatchError(":path, :authority and :method must not be empty"))
 	})
+
+	Context("CONNECT requests", func() {
+		It("populates the request", func() {
+			headers := []hpack.HeaderField{
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "CONNECT", false},
+			}
+			req, err := requestFromHeaders(headers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Method).To(Equal("CONNECT"))
+			Expect(req.URL.Host).To(Equal("quic.clemente.io:443"))
+			Expect(req.Host).To(Equal("quic.clemente.io:443"))
+			Expect(req.RequestURI).To(Equal("quic.clemente.io:443"))
+		})
+
+		It("errors with missing authority", func() {
+			headers := []hpack.HeaderField{
+				{":method", "CONNECT", false},
+			}
+			_, err := requestFromHeaders(headers)
+			Expect(err).To(MatchError(":authority must not be empty for CONNECT"))
+		})
+
+		It("populates extended CONNECT requests", func() {
+			headers := []hpack.HeaderField{
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "CONNECT", false},
+				{":protocol", "connect-udp", false},
+				{":scheme", "https", false},
+				{":path", "/.well-known/masque/udp/192.0.2.6/443/", false},
+			}
+			req, err := requestFromHeaders(headers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(req.Method).To(Equal("CONNECT"))
+			Expect(req.Context().Value(ProtocolContextKey)).To(Equal("connect-udp"))
+			Expect(req.Header).ToNot(HaveKey(":protocol"))
+			Expect(req.URL.Path).To(Equal("/.well-known/masque/udp/192.0.2.6/443/"))
+			Expect(req.Host).To(Equal("quic.clemente.io:443"))
+		})
+
+		It("errors with :protocol for other methods", func() {
+			headers := []hpack.HeaderField{
+				{":authority", "quic.clemente.io:443", false},
+				{":method", "GET", false},
+				{":protocol", "connect-udp", false},
+				{":path", "/", false},
+			}
+			_, err := requestFromHeaders(headers)
+			Expect(err).To(MatchError(":protocol is only allowed for CONNECT"))
+		})
+	})
 })
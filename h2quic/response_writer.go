@@ -2,9 +2,12 @@ package h2quic
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/utils"
@@ -12,22 +15,44 @@ import (
 	"golang.org/x/net/http2/hpack"
 )
 
+// A DataStreamer lets a handler take over the data stream of a request, e.g. to tunnel a CONNECT request.
+// The handler is responsible for closing the stream after calling DataStream().
+type DataStreamer interface {
+	DataStream() utils.Stream
+}
+
+var (
+	errHeaderWriteTimeout = errors.New("h2quic: timeout writing the response headers")
+	errHeaderListTooLarge = errors.New("h2quic: response header list larger than the client's SETTINGS_MAX_HEADER_LIST_SIZE")
+)
+
 type responseWriter struct {
-	dataStreamID protocol.StreamID
-	dataStream   utils.Stream
+	dataStreamID    protocol.StreamID
+	dataStream      utils.Stream
+	dataStreamTaken bool
 
-	headerStream      utils.Stream
-	headerStreamMutex *sync.Mutex
+	headerStream       utils.Stream
+	headerStreamMutex  *sync.Mutex
+	headerWriteTimeout time.Duration // 0 means no timeout
+	session            streamCreator // closed when writing the headers times out
+	headerTableSize    uint32        // the size of the HPACK dynamic table used for the response headers
+	maxHeaderListSize  uint32        // the maximum header list size the client accepts, 0 means unlimited
 
 	header        http.Header
 	headerWritten bool
+	headerErr     error // set if the headers couldn't be written
 }
 
+var _ DataStreamer = &responseWriter{}
+var _ io.ReaderFrom = &responseWriter{}
+var _ http.Flusher = &responseWriter{}
+
 func newResponseWriter(headerStream utils.Stream, headerStreamMutex *sync.Mutex, dataStream utils.Stream, dataStreamID protocol.StreamID) *responseWriter {
 	return &responseWriter{
 		header:            http.Header{},
 		headerStream:      headerStream,
 		headerStreamMutex: headerStreamMutex,
+		headerTableSize:   defaultHeaderTableSize,
 		dataStream:        dataStream,
 		dataStreamID:      dataStreamID,
 	}
@@ -42,29 +67,102 @@ func (w *responseWriter) WriteHeader(status int) {
 
 	var headers bytes.Buffer
 	enc := hpack.NewEncoder(&headers)
-	enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
-
+	if w.headerTableSize != defaultHeaderTableSize {
+		// starts the header block with a dynamic table size update
+		enc.SetMaxDynamicTableSizeLimit(w.headerTableSize)
+		enc.SetMaxDynamicTableSize(w.headerTableSize)
+	}
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(status)}}
 	for k, v := range w.header {
-		enc.WriteField(hpack.HeaderField{Name: k, Value: v[0]})
+		fields = append(fields, hpack.HeaderField{Name: k, Value: v[0]})
+	}
+	if w.maxHeaderListSize != 0 && headerListSize(fields) > w.maxHeaderListSize {
+		w.headerErr = errHeaderListTooLarge
+		utils.Errorf("could not write h2 header: %s", w.headerErr.Error())
+		return
+	}
+	for _, f := range fields {
+		enc.WriteField(f)
 	}
 
 	utils.Infof("Responding with %d", status)
-	w.headerStreamMutex.Lock()
-	defer w.headerStreamMutex.Unlock()
-	h2framer := http2.NewFramer(w.headerStream, nil)
-	err := h2framer.WriteHeaders(http2.HeadersFrameParam{
+	err := w.writeHeaders(http2.HeadersFrameParam{
 		StreamID:      uint32(w.dataStreamID),
 		EndHeaders:    true,
 		BlockFragment: headers.Bytes(),
 	})
 	if err != nil {
+		w.headerErr = err
 		utils.Errorf("could not write h2 header: %s", err.Error())
 	}
 }
 
+// writeHeaders writes a HEADERS frame on the header stream, which is shared by all requests of a session.
+// If the write (or waiting for another request's write) takes longer than the headerWriteTimeout, the header stream is stuck for all requests.
+// The session is closed then, which makes the pending write fail instead of sending the HEADERS frame later.
+func (w *responseWriter) writeHeaders(p http2.HeadersFrameParam) error {
+	if w.headerWriteTimeout == 0 {
+		w.headerStreamMutex.Lock()
+		defer w.headerStreamMutex.Unlock()
+		return http2.NewFramer(w.headerStream, nil).WriteHeaders(p)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		w.headerStreamMutex.Lock()
+		defer w.headerStreamMutex.Unlock()
+		done <- http2.NewFramer(w.headerStream, nil).WriteHeaders(p)
+	}()
+	timer := time.NewTimer(w.headerWriteTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		w.session.Close(errHeaderWriteTimeout)
+		<-done
+		return errHeaderWriteTimeout
+	}
+}
+
+// DataStream writes a 200 response header, if no header was written yet, and hands out the data stream
+func (w *responseWriter) DataStream() utils.Stream {
+	if !w.headerWritten {
+		w.WriteHeader(200)
+	}
+	w.dataStreamTaken = true
+	return w.dataStream
+}
+
 func (w *responseWriter) Write(p []byte) (int, error) {
 	if !w.headerWritten {
 		w.WriteHeader(200)
 	}
+	if w.headerErr != nil {
+		return 0, w.headerErr
+	}
 	return w.dataStream.Write(p)
 }
+
+// Flush writes the headers, if they weren't written yet, and sends the data written so far without waiting for more data
+func (w *responseWriter) Flush() {
+	if !w.headerWritten {
+		w.WriteHeader(200)
+	}
+	if w.headerErr != nil {
+		return
+	}
+	w.dataStream.Flush()
+}
+
+// ReadFrom copies from r directly onto the data stream.
+// io.Copy uses it, e.g. when http.ServeContent sends a file, so large responses are streamed without extra buffering.
+func (w *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.headerWritten {
+		w.WriteHeader(200)
+	}
+	if w.headerErr != nil {
+		return 0, w.headerErr
+	}
+	return io.Copy(w.dataStream, r)
+}
@@ -2,10 +2,20 @@ package h2quic
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -14,11 +24,55 @@ type mockStream struct {
 	id protocol.StreamID
 	bytes.Buffer
 	remoteClosed bool
+	closed       bool
+	reset        bool
+	resetCode    uint32
+	flushed      bool
+	ctx          context.Context // if nil, the stream never fails
 }
 
-func (mockStream) Close() error                             { return nil }
+func (s *mockStream) Close() error                          { s.closed = true; return nil }
 func (s *mockStream) CloseRemote(offset protocol.ByteCount) { s.remoteClosed = true }
+func (s *mockStream) Flush() error                          { s.flushed = true; return nil }
+func (s *mockStream) SetNoDelay(bool)                       {}
+func (s *mockStream) Reset(code uint32)                     { s.reset = true; s.resetCode = code }
 func (s mockStream) StreamID() protocol.StreamID            { return s.id }
+func (s *mockStream) Stats() utils.StreamStats              { return utils.StreamStats{Reset: s.reset} }
+
+func (s *mockStream) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// stalledStream blocks writes until unblock is closed, like a stream the peer doesn't read from
+type stalledStream struct {
+	mockStream
+	unblock chan struct{}
+	err     error // returned by blocked writes after unblocking
+}
+
+func (s *stalledStream) Write(p []byte) (int, error) {
+	<-s.unblock
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.mockStream.Write(p)
+}
+
+// stallingSession fails the writes on a stalled stream when it is closed, like a session closing its streams
+type stallingSession struct {
+	mockSession
+	stream *stalledStream
+}
+
+func (s *stallingSession) Close(e error) error {
+	s.mockSession.Close(e)
+	s.stream.err = e
+	close(s.stream.unblock)
+	return nil
+}
 
 var _ = Describe("Response Writer", func() {
 	var (
@@ -64,6 +118,24 @@ var _ = Describe("Response Writer", func() {
 		}))
 	})
 
+	It("doesn't write headers larger than the client's maximum header list size", func() {
+		w.maxHeaderListSize = 100
+		w.Header().Set("x-foo", strings.Repeat("a", 100))
+		n, err := w.Write([]byte("foobar"))
+		Expect(n).To(BeZero())
+		Expect(err).To(MatchError(errHeaderListTooLarge))
+		Expect(headerStream.Len()).To(BeZero())
+		Expect(dataStream.Len()).To(BeZero())
+	})
+
+	It("writes headers within the client's maximum header list size", func() {
+		w.maxHeaderListSize = 100
+		w.Header().Set("x-foo", "bar")
+		_, err := w.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headerStream.Len()).ToNot(BeZero())
+	})
+
 	It("writes data after WriteHeader is called", func() {
 		w.WriteHeader(http.StatusTeapot)
 		n, err := w.Write([]byte("foobar"))
@@ -78,4 +150,169 @@ var _ = Describe("Response Writer", func() {
 			0x66, 0x6f, 0x6f, 0x62, 0x61, 0x72,
 		}))
 	})
+
+	It("hands out the data stream", func() {
+		str := w.DataStream()
+		Expect(str).To(Equal(dataStream))
+		Expect(w.dataStreamTaken).To(BeTrue())
+		// Should have written 200 on the header stream
+		Expect(headerStream.Bytes()).To(Equal([]byte{
+			0x0, 0x0, 0x1, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5, 0x88,
+		}))
+	})
+	It("copies from a reader onto the data stream", func() {
+		n, err := w.ReadFrom(bytes.NewReader([]byte("foobar")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(int64(6)))
+		// Should have written 200 on the header stream
+		Expect(headerStream.Bytes()).To(Equal([]byte{
+			0x0, 0x0, 0x1, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5, 0x88,
+		}))
+		Expect(dataStream.Bytes()).To(Equal([]byte("foobar")))
+	})
+	It("flushes the data stream", func() {
+		w.Write([]byte("foobar"))
+		w.Flush()
+		Expect(dataStream.flushed).To(BeTrue())
+	})
+
+	It("writes the headers when flushing", func() {
+		w.Flush()
+		Expect(headerStream.Len()).ToNot(BeZero())
+		Expect(dataStream.flushed).To(BeTrue())
+	})
+
+	Context("header write timeout", func() {
+		var (
+			stalledHeaderStream *stalledStream
+			session             *stallingSession
+		)
+
+		BeforeEach(func() {
+			stalledHeaderStream = &stalledStream{unblock: make(chan struct{})}
+			session = &stallingSession{stream: stalledHeaderStream}
+			w = newResponseWriter(stalledHeaderStream, &sync.Mutex{}, dataStream, 5)
+			w.headerWriteTimeout = 10 * time.Millisecond
+			w.session = session
+		})
+
+		AfterEach(func() {
+			select {
+			case <-stalledHeaderStream.unblock:
+			default:
+				close(stalledHeaderStream.unblock)
+			}
+		})
+
+		It("fails the request and closes the session if the header stream is stalled", func() {
+			_, err := w.Write([]byte("foobar"))
+			Expect(err).To(MatchError(errHeaderWriteTimeout))
+			Expect(dataStream.Len()).To(BeZero())
+			Expect(session.closed).To(BeTrue())
+			Expect(session.closeErr).To(MatchError(errHeaderWriteTimeout))
+			Expect(stalledHeaderStream.Len()).To(BeZero())
+		})
+
+		It("fails other requests waiting for the stalled header stream", func() {
+			w.headerWriteTimeout = time.Hour
+			headersDone := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				w.WriteHeader(200)
+				close(headersDone)
+			}()
+			w2 := newResponseWriter(stalledHeaderStream, w.headerStreamMutex, &mockStream{}, 7)
+			w2.headerWriteTimeout = 10 * time.Millisecond
+			w2.session = session
+			_, err := w2.ReadFrom(bytes.NewReader([]byte("foobar")))
+			Expect(err).To(MatchError(errHeaderWriteTimeout))
+			Eventually(headersDone).Should(BeClosed())
+			Expect(w.headerErr).To(MatchError(errHeaderWriteTimeout))
+			Expect(stalledHeaderStream.Len()).To(BeZero())
+		})
+
+		It("writes the headers before the timeout expires", func() {
+			w.headerWriteTimeout = time.Hour
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				close(stalledHeaderStream.unblock)
+			}()
+			_, err := w.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stalledHeaderStream.Bytes()).To(Equal([]byte{
+				0x0, 0x0, 0x1, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5, 0x88,
+			}))
+			Expect(dataStream.Bytes()).To(Equal([]byte("foobar")))
+			Expect(session.closed).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("Response writer serving files", func() {
+	var (
+		dir          string
+		content      []byte
+		w            *responseWriter
+		headerStream *mockStream
+		dataStream   *mockStream
+	)
+
+	// decodeHeaders reads the response headers written on the header stream
+	decodeHeaders := func() map[string]string {
+		frame, err := http2.NewFramer(nil, headerStream).ReadFrame()
+		Expect(err).ToNot(HaveOccurred())
+		fields, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+		Expect(err).ToNot(HaveOccurred())
+		headers := make(map[string]string)
+		for _, f := range fields {
+			headers[f.Name] = f.Value
+		}
+		return headers
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "h2quic")
+		Expect(err).ToNot(HaveOccurred())
+		content = bytes.Repeat([]byte("0123456789"), 10000)
+		err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), content, 0644)
+		Expect(err).ToNot(HaveOccurred())
+		headerStream = &mockStream{}
+		dataStream = &mockStream{}
+		w = newResponseWriter(headerStream, &sync.Mutex{}, dataStream, 5)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("serves files", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/file.txt", nil)
+		Expect(err).ToNot(HaveOccurred())
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, req)
+		headers := decodeHeaders()
+		Expect(headers[":status"]).To(Equal("200"))
+		Expect(headers["Content-Length"]).To(Equal("100000"))
+		Expect(dataStream.Bytes()).To(Equal(content))
+	})
+
+	It("serves byte ranges", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/file.txt", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Range", "bytes=1000-50999")
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, req)
+		headers := decodeHeaders()
+		Expect(headers[":status"]).To(Equal("206"))
+		Expect(headers["Content-Range"]).To(Equal("bytes 1000-50999/100000"))
+		Expect(headers["Content-Length"]).To(Equal("50000"))
+		Expect(dataStream.Bytes()).To(Equal(content[1000:51000]))
+	})
+
+	It("rejects unsatisfiable ranges", func() {
+		req, err := http.NewRequest("GET", "https://quic.clemente.io/file.txt", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Range", "bytes=200000-")
+		http.FileServer(http.Dir(dir)).ServeHTTP(w, req)
+		Expect(decodeHeaders()[":status"]).To(Equal("416"))
+	})
 })
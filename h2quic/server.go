@@ -1,63 +1,165 @@
 package h2quic
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/utils"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 )
 
+var (
+	errHeaderStreamReset    = qerr.Error(qerr.InvalidHeadersStreamData, "header stream reset")
+	errExpectedContinuation = qerr.Error(qerr.InvalidHeadersStreamData, "expected CONTINUATION frame")
+	errHeaderBlockTooLarge  = qerr.Error(qerr.InvalidHeadersStreamData, "header block too large")
+	errNoSupportedVersions  = errors.New("h2quic: none of the configured versions is supported")
+)
+
+// defaultAltSvcMaxAge is the max-age of the Alt-Svc header, if not configured
+const defaultAltSvcMaxAge = 30 * 24 * time.Hour
+
+// ServerNameContextKey is a context key. It can be used in HTTP handlers with
+// context.Value to access the SNI the client sent in the QUIC handshake. The associated value is a string.
+var ServerNameContextKey = &contextKey{"quic-server-name"}
+
+// ChannelIDContextKey is a context key. It can be used in HTTP handlers with
+// context.Value to access the channel ID the client proved possession of in the QUIC handshake.
+// The associated value is a []byte, an opaque identifier of the client. It is only set if the client sent a channel ID.
+var ChannelIDContextKey = &contextKey{"quic-channel-id"}
+
+// ProtocolContextKey is a context key. It can be used in HTTP handlers with
+// context.Value to access the :protocol pseudo-header of an extended CONNECT request. The associated value is a string.
+// It is only set for extended CONNECT requests.
+var ProtocolContextKey = &contextKey{"quic-extended-connect-protocol"}
+
+// contextKey is a value for use with context.WithValue, like in net/http
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "h2quic context value " + k.name }
+
+// defaultHeaderTableSize is the initial size of the HPACK dynamic tables, as defined by HTTP/2
+const defaultHeaderTableSize = 4096
+
+// clientSettings are the values the client sent in SETTINGS frames on the header stream
+type clientSettings struct {
+	headerTableSize   uint32 // the size of the client's HPACK decoder table
+	maxHeaderListSize uint32 // the maximum size of response header lists the client accepts, 0 means unlimited
+	// initialWindowSize and maxConcurrentStreams are only recorded.
+	// Flow control and the number of streams are handled by QUIC, and the server doesn't open streams.
+	initialWindowSize    uint32
+	maxConcurrentStreams uint32
+}
+
 type streamCreator interface {
 	GetOrOpenStream(protocol.StreamID) (utils.Stream, error)
 	Close(error) error
 }
 
+// contextStream is implemented by streams with a context that is canceled when the stream fails
+type contextStream interface {
+	Context() context.Context
+}
+
+// peerCertificatesSession is implemented by sessions that know the client's certificate chain
+type peerCertificatesSession interface {
+	PeerCertificates() []*x509.Certificate
+}
+
+// serverNameSession is implemented by sessions that know the SNI the client sent
+type serverNameSession interface {
+	ServerName() string
+}
+
+// channelIDSession is implemented by sessions that know the client's channel ID
+type channelIDSession interface {
+	ChannelID() []byte
+}
+
 // Server is a HTTP2 server listening for QUIC connections.
 type Server struct {
 	*http.Server
 
+	// Addresses are the UDP addresses to listen on concurrently, e.g. an IPv4 and an IPv6 address.
+	// If set, ListenAndServe and ListenAndServeTLS listen on these instead of s.Server.Addr.
+	Addresses []string
+
+	// SocketReceiveBufferSize and SocketSendBufferSize are the sizes of the UDP socket buffers.
+	// If 0, the OS defaults are used.
+	SocketReceiveBufferSize int
+	SocketSendBufferSize    int
+
+	// HeaderWriteTimeout limits the time writing the response headers of a request may take.
+	// All requests of a session share the header stream, so a client that doesn't read its headers would otherwise block all responses.
+	// If the timeout expires, the session is closed and writing the response body fails. If 0, there's no timeout.
+	HeaderWriteTimeout time.Duration
+
+	// MaxDecoderHeaderTableSize is the size of the HPACK dynamic table used to decode request headers.
+	// It is announced to the client in a SETTINGS frame. If 0, the HTTP/2 default of 4096 bytes is used.
+	MaxDecoderHeaderTableSize uint32
+	// MaxEncoderHeaderTableSize limits the size of the HPACK dynamic table used to encode response headers.
+	// A smaller size sent by the client in a SETTINGS frame is honored. If 0, the HTTP/2 default of 4096 bytes is used.
+	MaxEncoderHeaderTableSize uint32
+
+	// EnableConnectUDP makes the server proxy UDP for extended CONNECT requests with the connect-udp protocol (MASQUE).
+	// The UDP payloads are sent as datagrams, so the client has to support them.
+	// Other CONNECT requests are still passed to the Handler.
+	EnableConnectUDP bool
+	// ConnectUDPAllowed decides if a connect-udp request may be proxied to the target, which is the resolved IP address and port.
+	// If nil, targets with loopback, private, link-local and unspecified addresses are rejected.
+	ConnectUDPAllowed func(req *http.Request, target string) bool
+
+	// AltSvcMaxAge is the time clients may cache the QUIC alternative service announced by SetQuicHeaders.
+	// It is sent in seconds. If 0, 30 days are used.
+	AltSvcMaxAge time.Duration
+	// Versions are the QUIC versions the server accepts, see quic.Server.Versions. SetQuicHeaders announces the same versions.
+	// Versions that are not supported are left out. If nil, all versions in protocol.SupportedVersions are used.
+	Versions []protocol.VersionNumber
+	// DisableAlternateProtocol makes SetQuicHeaders omit the legacy Alternate-Protocol header, and only set Alt-Svc.
+	DisableAlternateProtocol bool
+
+	// OnNewSession is called for every accepted QUIC session, before any request on it is handled, see quic.Server.OnNewSession.
+	// If it returns false, the session is closed. It must not block.
+	OnNewSession func(*quic.Session) bool
+
 	// Private flag for demo, do not use
 	CloseAfterFirstRequest bool
 
-	port uint32 // used atomically
+	port uint32 // the port the server is listening on, used atomically
 
-	server      *quic.Server
+	servers     []*quic.Server // one for every address the server is listening on
 	serverMutex sync.Mutex
+
+	datagramMuxes      map[datagramSession]*datagramMux
+	datagramMuxesMutex sync.Mutex
 }
 
-// ListenAndServe listens on the UDP address s.Addr and calls s.Handler to handle HTTP/2 requests on incoming connections.
+// ListenAndServe listens on the UDP address s.Addr, or on all s.Addresses, and calls s.Handler to handle HTTP/2 requests on incoming connections.
 func (s *Server) ListenAndServe() error {
 	if s.Server == nil {
 		return errors.New("use of h2quic.Server without http.Server")
 	}
-	s.serverMutex.Lock()
-	if s.server != nil {
-		s.serverMutex.Unlock()
-		return errors.New("ListenAndServe may only be called once")
-	}
-	var err error
-	server, err := quic.NewServer(s.Addr, s.TLSConfig, s.handleStreamCb)
-	if err != nil {
-		s.serverMutex.Unlock()
-		return err
-	}
-	s.server = server
-	s.serverMutex.Unlock()
-	return server.ListenAndServe()
+	return s.serveImpl(s.TLSConfig, nil)
 }
 
-// ListenAndServeTLS listens on the UDP address s.Addr and calls s.Handler to handle HTTP/2 requests on incoming connections.
+// ListenAndServeTLS listens on the UDP address s.Addr, or on all s.Addresses, and calls s.Handler to handle HTTP/2 requests on incoming connections.
 func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if s.Server == nil {
 		return errors.New("use of h2quic.Server without http.Server")
@@ -73,19 +175,81 @@ func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	config := &tls.Config{
 		Certificates: certs,
 	}
+	return s.serveImpl(config, nil)
+}
+
+// ServePacketConn serves HTTP/2 requests on incoming QUIC connections on an existing net.PacketConn, using s.TLSConfig.
+func (s *Server) ServePacketConn(conn net.PacketConn) error {
+	if s.Server == nil {
+		return errors.New("use of h2quic.Server without http.Server")
+	}
+	return s.serveImpl(s.TLSConfig, conn)
+}
+
+func (s *Server) serveImpl(tlsConfig *tls.Config, conn net.PacketConn) error {
+	if conn == nil && len(s.Addresses) > 0 {
+		return s.serveAddresses(tlsConfig)
+	}
 	s.serverMutex.Lock()
-	if s.server != nil {
+	if s.servers != nil {
 		s.serverMutex.Unlock()
 		return errors.New("ListenAndServe may only be called once")
 	}
-	server, err := quic.NewServer(s.Addr, config, s.handleStreamCb)
+	server, err := quic.NewServer(s.Addr, tlsConfig, s.handleStreamCb)
 	if err != nil {
 		s.serverMutex.Unlock()
 		return err
 	}
-	s.server = server
+	server.SocketReceiveBufferSize = s.SocketReceiveBufferSize
+	server.SocketSendBufferSize = s.SocketSendBufferSize
+	server.OnNewSession = s.OnNewSession
+	server.Versions = s.Versions
+	s.servers = []*quic.Server{server}
+	s.serverMutex.Unlock()
+	if conn == nil {
+		return server.ListenAndServe()
+	}
+	return server.Serve(conn)
+}
+
+// serveAddresses listens on all s.Addresses and serves until all listeners are closed.
+// If one of the listeners fails, all of them are closed, and the error is returned.
+func (s *Server) serveAddresses(tlsConfig *tls.Config) error {
+	s.serverMutex.Lock()
+	if s.servers != nil {
+		s.serverMutex.Unlock()
+		return errors.New("ListenAndServe may only be called once")
+	}
+	servers := make([]*quic.Server, len(s.Addresses))
+	for i, addr := range s.Addresses {
+		server, err := quic.NewServer(addr, tlsConfig, s.handleStreamCb)
+		if err != nil {
+			s.serverMutex.Unlock()
+			return err
+		}
+		server.SocketReceiveBufferSize = s.SocketReceiveBufferSize
+		server.SocketSendBufferSize = s.SocketSendBufferSize
+		server.OnNewSession = s.OnNewSession
+		server.Versions = s.Versions
+		servers[i] = server
+	}
+	s.servers = servers
 	s.serverMutex.Unlock()
-	return server.ListenAndServe()
+
+	errChan := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *quic.Server) {
+			errChan <- server.ListenAndServe()
+		}(server)
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errChan; err != nil && firstErr == nil {
+			firstErr = err
+			s.Close()
+		}
+	}
+	return firstErr
 }
 
 // Serve should not be called, since it only works properly for TCP listeners.
@@ -102,40 +266,149 @@ func (s *Server) handleStream(session streamCreator, stream utils.Stream) {
 		return
 	}
 
-	hpackDecoder := hpack.NewDecoder(4096, nil)
+	hpackDecoder := hpack.NewDecoder(s.decoderHeaderTableSize(), nil)
 	h2framer := http2.NewFramer(nil, stream)
+	settings := &clientSettings{headerTableSize: defaultHeaderTableSize}
 
 	go func() {
+		// The header stream lives as long as the session, so the requests of this
+		// session are canceled once it fails.
+		sessionCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
 		var headerStreamMutex sync.Mutex // Protects concurrent calls to Write()
+		if err := s.writeSettings(stream, &headerStreamMutex); err != nil {
+			utils.Errorf("could not write h2 settings: %s", err.Error())
+			return
+		}
 		for {
-			if err := s.handleRequest(session, stream, &headerStreamMutex, hpackDecoder, h2framer); err != nil {
+			if err := s.handleRequest(sessionCtx, session, stream, &headerStreamMutex, hpackDecoder, h2framer, settings); err != nil {
 				utils.Errorf("error handling h2 request: %s", err.Error())
+				if err == errHeaderStreamReset {
+					// like the HTTP/2 control stream, the header stream must not be reset
+					session.Close(err)
+				}
 				return
 			}
 		}
 	}()
 }
 
-func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream, headerStreamMutex *sync.Mutex, hpackDecoder *hpack.Decoder, h2framer *http2.Framer) error {
+// writeSettings announces the size of the HPACK decoder table, if it differs from the HTTP/2 default, support for extended CONNECT, and the maximum header list size, if configured
+func (s *Server) writeSettings(headerStream utils.Stream, headerStreamMutex *sync.Mutex) error {
+	var settings []http2.Setting
+	if size := s.decoderHeaderTableSize(); size != defaultHeaderTableSize {
+		settings = append(settings, http2.Setting{ID: http2.SettingHeaderTableSize, Val: size})
+	}
+	if s.EnableConnectUDP {
+		settings = append(settings, http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1})
+	}
+	if s.MaxHeaderBytes > 0 {
+		settings = append(settings, http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: s.maxHeaderListSize()})
+	}
+	if len(settings) == 0 {
+		return nil
+	}
+	headerStreamMutex.Lock()
+	defer headerStreamMutex.Unlock()
+	return http2.NewFramer(headerStream, nil).WriteSettings(settings...)
+}
+
+// readHeaderBlock returns the complete header block of a HEADERS frame, reading the CONTINUATION frames that follow it until END_HEADERS.
+// No other frames may be interleaved. The header block may be at most maxSize bytes.
+func readHeaderBlock(h2framer *http2.Framer, h2headersFrame *http2.HeadersFrame, maxSize uint32) ([]byte, error) {
+	if len(h2headersFrame.HeaderBlockFragment()) > int(maxSize) {
+		return nil, errHeaderBlockTooLarge
+	}
+	if h2headersFrame.HeadersEnded() {
+		return h2headersFrame.HeaderBlockFragment(), nil
+	}
+	// the framer reuses its buffer for the next frame
+	headerBlock := append([]byte(nil), h2headersFrame.HeaderBlockFragment()...)
+	for {
+		h2frame, err := h2framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		frame, ok := h2frame.(*http2.ContinuationFrame)
+		if !ok || frame.StreamID != h2headersFrame.StreamID {
+			return nil, errExpectedContinuation
+		}
+		headerBlock = append(headerBlock, frame.HeaderBlockFragment()...)
+		if len(headerBlock) > int(maxSize) {
+			return nil, errHeaderBlockTooLarge
+		}
+		if frame.HeadersEnded() {
+			return headerBlock, nil
+		}
+	}
+}
+
+func (s *Server) handleRequest(sessionCtx context.Context, session streamCreator, headerStream utils.Stream, headerStreamMutex *sync.Mutex, hpackDecoder *hpack.Decoder, h2framer *http2.Framer, settings *clientSettings) error {
 	h2frame, err := h2framer.ReadFrame()
 	if err != nil {
+		if headerStream.Stats().Reset {
+			return errHeaderStreamReset
+		}
 		return err
 	}
-	h2headersFrame := h2frame.(*http2.HeadersFrame)
-	if !h2headersFrame.HeadersEnded() {
-		return errors.New("http2 header continuation not implemented")
+	var h2headersFrame *http2.HeadersFrame
+	switch frame := h2frame.(type) {
+	case *http2.HeadersFrame:
+		h2headersFrame = frame
+	case *http2.SettingsFrame:
+		return frame.ForeachSetting(func(setting http2.Setting) error {
+			switch setting.ID {
+			case http2.SettingHeaderTableSize:
+				settings.headerTableSize = setting.Val
+			case http2.SettingMaxHeaderListSize:
+				settings.maxHeaderListSize = setting.Val
+			case http2.SettingInitialWindowSize:
+				settings.initialWindowSize = setting.Val
+			case http2.SettingMaxConcurrentStreams:
+				settings.maxConcurrentStreams = setting.Val
+			}
+			return nil
+		})
+	default:
+		utils.Debugf("ignoring unexpected h2 frame on the header stream: %s", frame.Header().Type)
+		return nil
+	}
+	headerBlock, err := readHeaderBlock(h2framer, h2headersFrame, s.maxHeaderListSize())
+	if err != nil {
+		return err
 	}
-	headers, err := hpackDecoder.DecodeFull(h2headersFrame.HeaderBlockFragment())
+	headers, tooLarge, err := decodeHeaderBlock(hpackDecoder, headerBlock, s.maxHeaderListSize())
 	if err != nil {
 		utils.Errorf("invalid http2 headers encoding: %s", err.Error())
 		return err
 	}
+	if tooLarge {
+		utils.Infof("Rejecting request with a header list larger than %d bytes", s.maxHeaderListSize())
+		return s.rejectRequest(session, headerStream, headerStreamMutex, protocol.StreamID(h2headersFrame.StreamID), settings, http.StatusRequestHeaderFieldsTooLarge)
+	}
 
 	req, err := requestFromHeaders(headers)
 	if err != nil {
 		return err
 	}
 	utils.Infof("%s %s%s", req.Method, req.Host, req.RequestURI)
+	req.TLS = &tls.ConnectionState{}
+	if sess, ok := session.(peerCertificatesSession); ok {
+		req.TLS.PeerCertificates = sess.PeerCertificates()
+	}
+	if proto, ok := req.Context().Value(ProtocolContextKey).(string); ok {
+		sessionCtx = context.WithValue(sessionCtx, ProtocolContextKey, proto)
+	}
+	if sess, ok := session.(serverNameSession); ok {
+		req.TLS.ServerName = sess.ServerName()
+		sessionCtx = context.WithValue(sessionCtx, ServerNameContextKey, req.TLS.ServerName)
+	}
+	if sess, ok := session.(channelIDSession); ok {
+		if channelID := sess.ChannelID(); channelID != nil {
+			sessionCtx = context.WithValue(sessionCtx, ChannelIDContextKey, channelID)
+		}
+	}
 
 	dataStream, err := session.GetOrOpenStream(protocol.StreamID(h2headersFrame.StreamID))
 	if err != nil {
@@ -146,18 +419,35 @@ func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream,
 		dataStream.CloseRemote(0)
 	}
 
-	// stream's Close() closes the write side, not the read side
-	req.Body = ioutil.NopCloser(dataStream)
+	ctx, cancel := context.WithCancel(sessionCtx)
+	req = req.WithContext(ctx)
+	req.Body = newRequestBody(dataStream, cancel)
+	// cancel the request when the client resets the stream, even if the handler doesn't read the body
+	stopWatchingStream := func() bool { return false }
+	if str, ok := dataStream.(contextStream); ok {
+		stopWatchingStream = context.AfterFunc(str.Context(), cancel)
+	}
 
 	responseWriter := newResponseWriter(headerStream, headerStreamMutex, dataStream, protocol.StreamID(h2headersFrame.StreamID))
+	responseWriter.headerWriteTimeout = s.HeaderWriteTimeout
+	responseWriter.session = session
+	responseWriter.headerTableSize = utils.MinUint32(s.encoderHeaderTableSize(), settings.headerTableSize)
+	responseWriter.maxHeaderListSize = settings.maxHeaderListSize
 
 	go func() {
-		handler := s.Handler
-		if handler == nil {
-			handler = http.DefaultServeMux
+		defer cancel()
+		defer stopWatchingStream()
+		streamReset := false
+		if s.EnableConnectUDP && isConnectUDP(req) {
+			s.proxyUDP(ctx, session, responseWriter, req)
+		} else {
+			handler := s.Handler
+			if handler == nil {
+				handler = http.DefaultServeMux
+			}
+			streamReset = s.serveHTTP(handler, responseWriter, req)
 		}
-		handler.ServeHTTP(responseWriter, req)
-		if responseWriter.dataStream != nil {
+		if responseWriter.dataStream != nil && !responseWriter.dataStreamTaken && !streamReset {
 			responseWriter.dataStream.Close()
 		}
 		if s.CloseAfterFirstRequest {
@@ -169,16 +459,118 @@ func (s *Server) handleRequest(session streamCreator, headerStream utils.Stream,
 	return nil
 }
 
-// Close the server immediately, aborting requests and sending CONNECTION_CLOSE frames to connected clients
+// serveHTTP calls the handler and recovers from panics in it.
+// If the handler panicked before writing the response headers, a 500 is sent instead. Otherwise the data stream is reset, since the response can't be completed.
+// It returns true if the data stream was reset.
+func (s *Server) serveHTTP(handler http.Handler, w *responseWriter, req *http.Request) (streamReset bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p != http.ErrAbortHandler {
+			utils.Errorf("h2quic: panic serving %s: %v\n%s", req.URL, p, debug.Stack())
+		}
+		if w.headerWritten {
+			w.dataStream.Reset(uint32(qerr.InternalError))
+			streamReset = true
+			return
+		}
+		// the headers the handler set before panicking don't belong to the error response
+		for k := range w.header {
+			delete(w.header, k)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}()
+	handler.ServeHTTP(w, req)
+	return false
+}
+
+// rejectRequest responds with an error status without calling the handler
+func (s *Server) rejectRequest(session streamCreator, headerStream utils.Stream, headerStreamMutex *sync.Mutex, id protocol.StreamID, settings *clientSettings, status int) error {
+	dataStream, err := session.GetOrOpenStream(id)
+	if err != nil {
+		return err
+	}
+	responseWriter := newResponseWriter(headerStream, headerStreamMutex, dataStream, id)
+	responseWriter.headerWriteTimeout = s.HeaderWriteTimeout
+	responseWriter.session = session
+	responseWriter.headerTableSize = utils.MinUint32(s.encoderHeaderTableSize(), settings.headerTableSize)
+	responseWriter.WriteHeader(status)
+	return dataStream.Close()
+}
+
+// maxHeaderListSize is the maximum size of request header lists, taken from http.Server.MaxHeaderBytes
+func (s *Server) maxHeaderListSize() uint32 {
+	if s.MaxHeaderBytes <= 0 {
+		return http.DefaultMaxHeaderBytes
+	}
+	return uint32(s.MaxHeaderBytes)
+}
+
+// decodeHeaderBlock decodes a header block, stopping to collect header fields once the header list gets larger than maxSize.
+// The rest of the block is still decoded, so that the dynamic table stays in sync with the client's encoder.
+func decodeHeaderBlock(hpackDecoder *hpack.Decoder, headerBlock []byte, maxSize uint32) (headers []hpack.HeaderField, tooLarge bool, err error) {
+	var size uint32
+	hpackDecoder.SetMaxStringLength(int(maxSize))
+	hpackDecoder.SetEmitEnabled(true)
+	hpackDecoder.SetEmitFunc(func(f hpack.HeaderField) {
+		size += f.Size()
+		if size > maxSize {
+			tooLarge = true
+			headers = nil
+			hpackDecoder.SetEmitEnabled(false)
+			return
+		}
+		headers = append(headers, f)
+	})
+	defer hpackDecoder.SetEmitFunc(func(hpack.HeaderField) {})
+	if _, err := hpackDecoder.Write(headerBlock); err != nil {
+		return nil, false, err
+	}
+	if err := hpackDecoder.Close(); err != nil {
+		return nil, false, err
+	}
+	return headers, tooLarge, nil
+}
+
+// headerListSize calculates the size of a header list as defined for SETTINGS_MAX_HEADER_LIST_SIZE,
+// i.e. the length of all names and values plus 32 bytes per field
+func headerListSize(fields []hpack.HeaderField) uint32 {
+	var size uint32
+	for _, f := range fields {
+		size += f.Size()
+	}
+	return size
+}
+
+func (s *Server) decoderHeaderTableSize() uint32 {
+	if s.MaxDecoderHeaderTableSize == 0 {
+		return defaultHeaderTableSize
+	}
+	return s.MaxDecoderHeaderTableSize
+}
+
+func (s *Server) encoderHeaderTableSize() uint32 {
+	if s.MaxEncoderHeaderTableSize == 0 {
+		return defaultHeaderTableSize
+	}
+	return s.MaxEncoderHeaderTableSize
+}
+
+// Close the server immediately, aborting requests and sending CONNECTION_CLOSE frames to connected clients.
+// If the server listens on multiple addresses, all listeners are closed.
 func (s *Server) Close() error {
 	s.serverMutex.Lock()
 	defer s.serverMutex.Unlock()
-	if s.server != nil {
-		err := s.server.Close()
-		s.server = nil
-		return err
+	var firstErr error
+	for _, server := range s.servers {
+		if err := server.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	s.servers = nil
+	return firstErr
 }
 
 // CloseGracefully shuts down the server gracefully. The server sends a GOAWAY frame first, then waits for either timeout to trigger, or for all running requests to complete.
@@ -188,32 +580,92 @@ func (s *Server) CloseGracefully(timeout time.Duration) error {
 }
 
 // SetQuicHeaders can be used to set the proper headers that announce that this server supports QUIC.
-// The values that are set depend on the port information from s.Server.Addr, and currently look like this (if Addr has port 443):
+// Once the server is listening, the port of the UDP socket is announced, so that ephemeral ports (":0") work.
+// Before that, the port is taken from s.Server.Addr, or from the first of s.Addresses. By default, the headers look like this (if the port is 443):
 //  Alternate-Protocol: 443:quic
 //  Alt-Svc: quic=":443"; ma=2592000; v="33,32,31,30"
+// The max-age can be configured with AltSvcMaxAge. The versions are the ones the server accepts, see Versions.
 func (s *Server) SetQuicHeaders(hdr http.Header) error {
-	port := atomic.LoadUint32(&s.port)
+	port, err := s.quicPort()
+	if err != nil {
+		return err
+	}
 
-	if port == 0 {
-		// Extract port from s.Server.Addr
-		_, portStr, err := net.SplitHostPort(s.Server.Addr)
-		if err != nil {
-			return err
-		}
-		portInt, err := net.LookupPort("tcp", portStr)
-		if err != nil {
-			return err
-		}
-		port = uint32(portInt)
-		atomic.StoreUint32(&s.port, port)
+	versions, err := s.altSvcVersions()
+	if err != nil {
+		return err
+	}
+	maxAge := s.AltSvcMaxAge
+	if maxAge == 0 {
+		maxAge = defaultAltSvcMaxAge
 	}
 
-	hdr.Add("Alternate-Protocol", fmt.Sprintf("%d:quic", port))
-	hdr.Add("Alt-Svc", fmt.Sprintf(`quic=":%d"; ma=2592000; v="%s"`, port, protocol.SupportedVersionsAsString))
+	if !s.DisableAlternateProtocol {
+		hdr.Add("Alternate-Protocol", fmt.Sprintf("%d:quic", port))
+	}
+	hdr.Add("Alt-Svc", fmt.Sprintf(`quic=":%d"; ma=%d; v="%s"`, port, int64(maxAge/time.Second), versions))
 
 	return nil
 }
 
+// quicPort returns the port of the UDP socket, or the configured port if the server is not listening yet.
+// If the server listens on multiple addresses, the port of the first one is used.
+func (s *Server) quicPort() (uint32, error) {
+	if port := atomic.LoadUint32(&s.port); port != 0 {
+		return port, nil
+	}
+
+	s.serverMutex.Lock()
+	var server *quic.Server
+	if len(s.servers) > 0 {
+		server = s.servers[0]
+	}
+	s.serverMutex.Unlock()
+	if server != nil {
+		if addr, ok := server.LocalAddr().(*net.UDPAddr); ok {
+			atomic.StoreUint32(&s.port, uint32(addr.Port))
+			return uint32(addr.Port), nil
+		}
+	}
+
+	// Extract port from s.Server.Addr, or from the first of s.Addresses
+	addr := s.Server.Addr
+	if len(s.Addresses) > 0 {
+		addr = s.Addresses[0]
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(port), nil
+}
+
+// altSvcVersions formats the supported versions of the Versions for the Alt-Svc header, in descending order
+func (s *Server) altSvcVersions() (string, error) {
+	if s.Versions == nil {
+		return protocol.SupportedVersionsAsString, nil
+	}
+	var versions []int
+	for _, v := range s.Versions {
+		if protocol.IsSupportedVersion(v) {
+			versions = append(versions, int(v))
+		}
+	}
+	if len(versions) == 0 {
+		return "", errNoSupportedVersions
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	strs := make([]string, len(versions))
+	for i, v := range versions {
+		strs[i] = strconv.Itoa(v)
+	}
+	return strings.Join(strs, ","), nil
+}
+
 // ListenAndServeQUIC listens on the UDP network address addr and calls the
 // handler for HTTP/2 requests on incoming conections. http.DefaultServeMux is
 // used when handler is nil.
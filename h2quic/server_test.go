@@ -1,15 +1,30 @@
 package h2quic
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
 
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/testdata"
 	"github.com/lucas-clemente/quic-go/utils"
 
@@ -18,15 +33,25 @@ import (
 )
 
 type mockSession struct {
-	closed     bool
-	dataStream *mockStream
+	closed           bool
+	closeErr         error
+	dataStream       *mockStream
+	peerCertificates []*x509.Certificate
+	serverName       string
+	channelID        []byte
 }
 
 func (s *mockSession) GetOrOpenStream(id protocol.StreamID) (utils.Stream, error) {
 	return s.dataStream, nil
 }
 
-func (s *mockSession) Close(error) error { s.closed = true; return nil }
+func (s *mockSession) Close(e error) error { s.closed = true; s.closeErr = e; return nil }
+
+func (s *mockSession) PeerCertificates() []*x509.Certificate { return s.peerCertificates }
+
+func (s *mockSession) ServerName() string { return s.serverName }
+
+func (s *mockSession) ChannelID() []byte { return s.channelID }
 
 var _ = Describe("H2 server", func() {
 	const port = "4826"
@@ -53,12 +78,14 @@ var _ = Describe("H2 server", func() {
 			h2framer     *http2.Framer
 			hpackDecoder *hpack.Decoder
 			headerStream *mockStream
+			settings     *clientSettings
 		)
 
 		BeforeEach(func() {
 			headerStream = &mockStream{}
 			hpackDecoder = hpack.NewDecoder(4096, nil)
 			h2framer = http2.NewFramer(nil, headerStream)
+			settings = &clientSettings{headerTableSize: defaultHeaderTableSize}
 		})
 
 		It("handles a sample GET request", func() {
@@ -72,12 +99,316 @@ var _ = Describe("H2 server", func() {
 				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
 				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
 			})
-			err := s.handleRequest(session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer)
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
 			Expect(err).NotTo(HaveOccurred())
 			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
 			Expect(dataStream.remoteClosed).To(BeTrue())
 		})
 
+		It("responds with a 500 if the handler panics before writing the headers", func() {
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("X-Foo", "bar")
+				panic("foobar")
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return dataStream.closed }).Should(BeTrue())
+			frame, err := h2framer.ReadFrame()
+			Expect(err).ToNot(HaveOccurred())
+			headers, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(headers).To(ContainElement(hpack.HeaderField{Name: ":status", Value: "500"}))
+			// the headers set by the handler are not sent
+			Expect(headers).To(HaveLen(1))
+			Expect(dataStream.reset).To(BeFalse())
+		})
+
+		It("resets the stream if the handler panics after writing the headers", func() {
+			handlerReturned := make(chan struct{})
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(handlerReturned)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("foobar"))
+				panic("foobar")
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(handlerReturned).Should(BeClosed())
+			Eventually(func() bool { return dataStream.reset }).Should(BeTrue())
+			Expect(dataStream.resetCode).To(Equal(uint32(qerr.InternalError)))
+			Expect(dataStream.closed).To(BeFalse())
+			frame, err := h2framer.ReadFrame()
+			Expect(err).ToNot(HaveOccurred())
+			headers, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(headers).To(ContainElement(hpack.HeaderField{Name: ":status", Value: "200"}))
+		})
+
+		It("exposes the client certificates to the handler", func() {
+			cert := &x509.Certificate{Raw: []byte("client cert")}
+			session.peerCertificates = []*x509.Certificate{cert}
+			var peerCertificates []*x509.Certificate
+			var handlerCalled bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				peerCertificates = r.TLS.PeerCertificates
+				handlerCalled = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(peerCertificates).To(Equal([]*x509.Certificate{cert}))
+		})
+
+		It("exposes the SNI to the handler", func() {
+			session.serverName = "quic.clemente.io"
+			var tlsServerName, ctxServerName string
+			var handlerCalled bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tlsServerName = r.TLS.ServerName
+				ctxServerName, _ = r.Context().Value(ServerNameContextKey).(string)
+				handlerCalled = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(tlsServerName).To(Equal("quic.clemente.io"))
+			Expect(ctxServerName).To(Equal("quic.clemente.io"))
+		})
+
+		It("exposes the channel ID to the handler", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			channelID, _, err := crypto.SignChannelID(key, []byte("handshake"))
+			Expect(err).ToNot(HaveOccurred())
+			session.channelID = channelID
+			var ctxChannelID []byte
+			var handlerCalled bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxChannelID, _ = r.Context().Value(ChannelIDContextKey).([]byte)
+				handlerCalled = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(ctxChannelID).To(Equal(channelID))
+		})
+
+		It("doesn't set a channel ID if the client didn't send one", func() {
+			var hasChannelID bool
+			var handlerCalled bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, hasChannelID = r.Context().Value(ChannelIDContextKey).([]byte)
+				handlerCalled = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(hasChannelID).To(BeFalse())
+		})
+
+		It("has no client certificates if the client didn't authenticate", func() {
+			var tlsState *tls.ConnectionState
+			var handlerCalled bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tlsState = r.TLS
+				handlerCalled = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			Expect(tlsState).ToNot(BeNil())
+			Expect(tlsState.PeerCertificates).To(BeEmpty())
+		})
+
+		It("streams the request body to the handler without buffering it", func() {
+			const size = 1 << 20
+			dataStream.Write(bytes.Repeat([]byte{'a'}, size))
+			var unreadWhenCalled int
+			var bodyLen int
+			var handlerDone bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				unreadWhenCalled = dataStream.Len()
+				// read slowly, in small chunks
+				b := make([]byte, 64*1024)
+				for {
+					n, err := r.Body.Read(b)
+					bodyLen += n
+					if err == io.EOF {
+						break
+					}
+					Expect(err).ToNot(HaveOccurred())
+					time.Sleep(time.Millisecond)
+				}
+				handlerDone = true
+			})
+			headerStream.Write([]byte{
+				0x0, 0x0, 0x11, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5,
+				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
+				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+			})
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerDone }).Should(BeTrue())
+			// nothing was read from the data stream before the handler started reading
+			Expect(unreadWhenCalled).To(Equal(size))
+			Expect(bodyLen).To(Equal(size))
+		})
+
+		It("tunnels CONNECT requests", func() {
+			var handlerDone bool
+			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Method).To(Equal("CONNECT"))
+				Expect(r.Host).To(Equal("www.example.com:443"))
+				str := w.(DataStreamer).DataStream()
+				b := make([]byte, 6)
+				_, err := io.ReadFull(str, b)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = str.Write(b)
+				Expect(err).ToNot(HaveOccurred())
+				handlerDone = true
+			})
+			var headers bytes.Buffer
+			enc := hpack.NewEncoder(&headers)
+			enc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
+			enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "www.example.com:443"})
+			err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      5,
+				EndHeaders:    true,
+				BlockFragment: headers.Bytes(),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			dataStream.Write([]byte("foobar"))
+			err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool { return handlerDone }).Should(BeTrue())
+			// the bytes were echoed back through the tunnel
+			Expect(dataStream.Bytes()).To(Equal([]byte("foobar")))
+			// the handler is responsible for closing the tunnel
+			Consistently(func() bool { return dataStream.closed }).Should(BeFalse())
+		})
+
+		Context("CONTINUATION frames", func() {
+			var headerBlock []byte
+
+			BeforeEach(func() {
+				var headers bytes.Buffer
+				enc := hpack.NewEncoder(&headers)
+				enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+				enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+				enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/foo"})
+				enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "www.example.com"})
+				enc.WriteField(hpack.HeaderField{Name: "x-foo", Value: "bar"})
+				headerBlock = headers.Bytes()
+			})
+
+			It("reads a header block split across a HEADERS and a CONTINUATION frame", func() {
+				var handlerCalled bool
+				var path, foo string
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					path = r.URL.Path
+					foo = r.Header.Get("x-foo")
+					handlerCalled = true
+				})
+				framer := http2.NewFramer(headerStream, nil)
+				err := framer.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndStream:     true,
+					BlockFragment: headerBlock[:10],
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = framer.WriteContinuation(5, true, headerBlock[10:])
+				Expect(err).NotTo(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+				Expect(path).To(Equal("/foo"))
+				Expect(foo).To(Equal("bar"))
+			})
+
+			It("reads a header block split across multiple CONTINUATION frames", func() {
+				var handlerCalled bool
+				var foo string
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					foo = r.Header.Get("x-foo")
+					handlerCalled = true
+				})
+				framer := http2.NewFramer(headerStream, nil)
+				err := framer.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndStream:     true,
+					BlockFragment: headerBlock[:5],
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = framer.WriteContinuation(5, false, headerBlock[5:15])
+				Expect(err).NotTo(HaveOccurred())
+				err = framer.WriteContinuation(5, true, headerBlock[15:])
+				Expect(err).NotTo(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+				Expect(foo).To(Equal("bar"))
+			})
+
+			It("errors if another frame is interleaved", func() {
+				framer := http2.NewFramer(headerStream, nil)
+				err := framer.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndStream:     true,
+					BlockFragment: headerBlock[:10],
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = framer.WritePing(false, [8]byte{})
+				Expect(err).NotTo(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("errors if a CONTINUATION frame belongs to a different stream", func() {
+				framer := http2.NewFramer(headerStream, nil)
+				err := framer.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndStream:     true,
+					BlockFragment: headerBlock[:10],
+				})
+				Expect(err).NotTo(HaveOccurred())
+				err = framer.WriteContinuation(7, true, headerBlock[10:])
+				Expect(err).NotTo(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		It("does not close the dataStream when end of stream is not set", func() {
 			var handlerCalled bool
 			s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -89,11 +420,233 @@ var _ = Describe("H2 server", func() {
 				// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
 				0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
 			})
-			err := s.handleRequest(session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer)
+			err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
 			Expect(err).NotTo(HaveOccurred())
 			Eventually(func() bool { return handlerCalled }).Should(BeTrue())
 			Expect(dataStream.remoteClosed).To(BeFalse())
 		})
+
+		Context("SETTINGS", func() {
+			writeRequestWithHeader := func(name, value string) {
+				var headers bytes.Buffer
+				enc := hpack.NewEncoder(&headers)
+				enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+				enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+				enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+				enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "www.example.com"})
+				enc.WriteField(hpack.HeaderField{Name: name, Value: value})
+				err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndStream:     true,
+					EndHeaders:    true,
+					BlockFragment: headers.Bytes(),
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			It("records the client's settings", func() {
+				err := http2.NewFramer(headerStream, nil).WriteSettings(
+					http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: 1000},
+					http2.Setting{ID: http2.SettingInitialWindowSize, Val: 2000},
+					http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 10},
+				)
+				Expect(err).ToNot(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(settings.maxHeaderListSize).To(Equal(uint32(1000)))
+				Expect(settings.initialWindowSize).To(Equal(uint32(2000)))
+				Expect(settings.maxConcurrentStreams).To(Equal(uint32(10)))
+			})
+
+			It("announces the maximum header list size", func() {
+				s.MaxHeaderBytes = 1000
+				err := s.writeSettings(headerStream, &sync.Mutex{})
+				Expect(err).ToNot(HaveOccurred())
+				frame, err := h2framer.ReadFrame()
+				Expect(err).ToNot(HaveOccurred())
+				val, ok := frame.(*http2.SettingsFrame).Value(http2.SettingMaxHeaderListSize)
+				Expect(ok).To(BeTrue())
+				Expect(val).To(Equal(uint32(1000)))
+			})
+
+			It("rejects requests with a header list larger than the maximum", func() {
+				s.MaxHeaderBytes = 300
+				var handlerCalled bool
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handlerCalled = true
+				})
+				writeRequestWithHeader("x-foo", strings.Repeat("a", 300))
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				frame, err := h2framer.ReadFrame()
+				Expect(err).ToNot(HaveOccurred())
+				headers, err := hpack.NewDecoder(4096, nil).DecodeFull(frame.(*http2.HeadersFrame).HeaderBlockFragment())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(headers).To(ContainElement(hpack.HeaderField{Name: ":status", Value: "431"}))
+				Expect(dataStream.closed).To(BeTrue())
+				Consistently(func() bool { return handlerCalled }).Should(BeFalse())
+			})
+
+			It("accepts requests with a header list within the maximum", func() {
+				s.MaxHeaderBytes = 300
+				var handlerCalled bool
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handlerCalled = true
+				})
+				writeRequestWithHeader("x-foo", "bar")
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			})
+
+			It("errors on header blocks larger than the maximum header list size", func() {
+				s.MaxHeaderBytes = 300
+				// '~' has a long Huffman code, so the value is sent as a plain string
+				writeRequestWithHeader("x-foo", strings.Repeat("~", 300))
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).To(MatchError(errHeaderBlockTooLarge))
+			})
+
+			It("stops collecting header fields once the header list is too large, but keeps the decoder in sync", func() {
+				var headers bytes.Buffer
+				enc := hpack.NewEncoder(&headers)
+				enc.WriteField(hpack.HeaderField{Name: "x-foo", Value: strings.Repeat("a", 100)})
+				enc.WriteField(hpack.HeaderField{Name: "x-bar", Value: "baz"})
+				firstBlock := append([]byte(nil), headers.Bytes()...)
+				headers.Reset()
+				// x-bar is now in the dynamic table
+				enc.WriteField(hpack.HeaderField{Name: "x-bar", Value: "baz"})
+				fields, tooLarge, err := decodeHeaderBlock(hpackDecoder, firstBlock, 100)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tooLarge).To(BeTrue())
+				Expect(fields).To(BeEmpty())
+				fields, tooLarge, err = decodeHeaderBlock(hpackDecoder, headers.Bytes(), 100)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tooLarge).To(BeFalse())
+				Expect(fields).To(Equal([]hpack.HeaderField{{Name: "x-bar", Value: "baz"}}))
+			})
+
+			It("errors on header strings longer than the maximum header list size", func() {
+				var headers bytes.Buffer
+				enc := hpack.NewEncoder(&headers)
+				enc.WriteField(hpack.HeaderField{Name: "x-foo", Value: strings.Repeat("a", 200)})
+				_, _, err := decodeHeaderBlock(hpackDecoder, headers.Bytes(), 100)
+				Expect(err).To(MatchError(hpack.ErrStringLength))
+			})
+
+			It("rejects response headers larger than the client's maximum header list size", func() {
+				var writeErr error
+				var handlerDone bool
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("x-foo", strings.Repeat("a", 200))
+					_, writeErr = w.Write([]byte("foobar"))
+					handlerDone = true
+				})
+				err := http2.NewFramer(headerStream, nil).WriteSettings(http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: 100})
+				Expect(err).ToNot(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				writeRequestWithHeader("x-bar", "foo")
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() bool { return handlerDone }).Should(BeTrue())
+				Expect(writeErr).To(MatchError(errHeaderListTooLarge))
+				Expect(headerStream.Len()).To(BeZero())
+			})
+		})
+
+		Context("HPACK table sizes", func() {
+			// writeRequest writes a GET request, encoded with a dynamic table of the given size
+			writeRequest := func(tableSize uint32) {
+				var headers bytes.Buffer
+				enc := hpack.NewEncoder(&headers)
+				enc.SetMaxDynamicTableSizeLimit(tableSize)
+				enc.SetMaxDynamicTableSize(tableSize)
+				enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+				enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+				enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+				enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "www.example.com"})
+				err := http2.NewFramer(headerStream, nil).WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      5,
+					EndHeaders:    true,
+					EndStream:     true,
+					BlockFragment: headers.Bytes(),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			It("decodes a header block after a table size update", func() {
+				var handlerCalled bool
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Host).To(Equal("www.example.com"))
+					handlerCalled = true
+				})
+				s.MaxDecoderHeaderTableSize = 8192
+				hpackDecoder = hpack.NewDecoder(s.decoderHeaderTableSize(), nil)
+				writeRequest(8192)
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() bool { return handlerCalled }).Should(BeTrue())
+			})
+
+			It("rejects table size updates larger than the decoder table", func() {
+				writeRequest(8192)
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("honors the client's header table size for the responses", func() {
+				var handlerDone bool
+				s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(200)
+					handlerDone = true
+				})
+				err := http2.NewFramer(headerStream, nil).WriteSettings(http2.Setting{ID: http2.SettingHeaderTableSize, Val: 0})
+				Expect(err).ToNot(HaveOccurred())
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(settings.headerTableSize).To(BeZero())
+				writeRequest(defaultHeaderTableSize)
+				err = s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() bool { return handlerDone }).Should(BeTrue())
+				// the response was written to the same mockStream
+				frame, err := h2framer.ReadFrame()
+				Expect(err).ToNot(HaveOccurred())
+				// the header block starts with a dynamic table size update to 0
+				Expect(frame.(*http2.HeadersFrame).HeaderBlockFragment()[0]).To(Equal(byte(0x20)))
+			})
+
+			It("limits the response header table size to the local maximum", func() {
+				s.MaxEncoderHeaderTableSize = 1024
+				var w *responseWriter
+				s.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+					w = rw.(*responseWriter)
+				})
+				writeRequest(defaultHeaderTableSize)
+				err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpackDecoder, h2framer, settings)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() *responseWriter { return w }).ShouldNot(BeNil())
+				Expect(w.headerTableSize).To(Equal(uint32(1024)))
+			})
+
+			It("announces the decoder table size", func() {
+				s.MaxDecoderHeaderTableSize = 8192
+				err := s.writeSettings(headerStream, &sync.Mutex{})
+				Expect(err).ToNot(HaveOccurred())
+				frame, err := h2framer.ReadFrame()
+				Expect(err).ToNot(HaveOccurred())
+				val, ok := frame.(*http2.SettingsFrame).Value(http2.SettingHeaderTableSize)
+				Expect(ok).To(BeTrue())
+				Expect(val).To(Equal(uint32(8192)))
+			})
+
+			It("doesn't send SETTINGS for the default decoder table size", func() {
+				err := s.writeSettings(headerStream, &sync.Mutex{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(headerStream.Len()).To(BeZero())
+			})
+		})
 	})
 
 	It("handles the header stream", func() {
@@ -112,6 +665,67 @@ var _ = Describe("H2 server", func() {
 		Eventually(func() bool { return handlerCalled }).Should(BeTrue())
 	})
 
+	It("cancels the request context when the data stream fails, even if the body isn't read", func() {
+		streamCtx, streamCancel := context.WithCancel(context.Background())
+		dataStream.ctx = streamCtx
+		handlerDone := make(chan struct{})
+		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(handlerDone)
+		})
+		headerStream := &mockStream{}
+		headerStream.Write([]byte{
+			0x0, 0x0, 0x11, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5,
+			// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
+			0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+		})
+		err := s.handleRequest(context.Background(), session, headerStream, &sync.Mutex{}, hpack.NewDecoder(4096, nil), http2.NewFramer(nil, headerStream), &clientSettings{headerTableSize: defaultHeaderTableSize})
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(handlerDone).ShouldNot(BeClosed())
+		streamCancel()
+		Eventually(handlerDone).Should(BeClosed())
+	})
+
+	It("cancels the request context when the session is closed", func() {
+		var ctx context.Context
+		var ctxMutex sync.Mutex
+		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctxMutex.Lock()
+			ctx = r.Context()
+			ctxMutex.Unlock()
+			<-r.Context().Done()
+		})
+		headerStream := &mockStream{id: 3}
+		headerStream.Write([]byte{
+			0x0, 0x0, 0x11, 0x1, 0x4, 0x0, 0x0, 0x0, 0x5,
+			// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
+			0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+		})
+		// the mockStream returns an EOF after the request, just like a header stream of a closed session
+		s.handleStream(session, headerStream)
+		Eventually(func() error {
+			ctxMutex.Lock()
+			defer ctxMutex.Unlock()
+			if ctx == nil {
+				return nil
+			}
+			return ctx.Err()
+		}).Should(Equal(context.Canceled))
+	})
+
+	It("closes the session when the header stream is reset", func() {
+		headerStream := &mockStream{id: 3, reset: true}
+		s.handleStream(session, headerStream)
+		Eventually(func() bool { return session.closed }).Should(BeTrue())
+		Expect(session.closeErr).To(MatchError(errHeaderStreamReset))
+	})
+
+	It("doesn't close the session when the header stream ends without a reset", func() {
+		headerStream := &mockStream{id: 3}
+		s.handleStream(session, headerStream)
+		Consistently(func() bool { return session.closed }).Should(BeFalse())
+	})
+
 	It("ignores other streams", func() {
 		var handlerCalled bool
 		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -194,6 +808,40 @@ var _ = Describe("H2 server", func() {
 			Expect(hdr).To(Equal(expected))
 		})
 
+		It("uses the configured max-age", func() {
+			s.Server.Addr = ":443"
+			s.AltSvcMaxAge = time.Hour
+			hdr := http.Header{}
+			err := s.SetQuicHeaders(hdr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr.Get("Alt-Svc")).To(Equal(`quic=":443"; ma=3600; v="33,32,31,30"`))
+		})
+
+		It("announces only the configured versions", func() {
+			s.Server.Addr = ":443"
+			s.Versions = []protocol.VersionNumber{31, 33, 1337}
+			hdr := http.Header{}
+			err := s.SetQuicHeaders(hdr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr.Get("Alt-Svc")).To(Equal(`quic=":443"; ma=2592000; v="33,31"`))
+		})
+
+		It("errors if none of the configured versions is supported", func() {
+			s.Server.Addr = ":443"
+			s.Versions = []protocol.VersionNumber{1337}
+			err := s.SetQuicHeaders(http.Header{})
+			Expect(err).To(MatchError(errNoSupportedVersions))
+		})
+
+		It("omits the Alternate-Protocol header", func() {
+			s.Server.Addr = ":443"
+			s.DisableAlternateProtocol = true
+			hdr := http.Header{}
+			err := s.SetQuicHeaders(hdr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr).To(Equal(http.Header{"Alt-Svc": expected["Alt-Svc"]}))
+		})
+
 		It("works multiple times", func() {
 			s.Server.Addr = ":https"
 			hdr := http.Header{}
@@ -217,7 +865,7 @@ var _ = Describe("H2 server", func() {
 		Expect(err).To(MatchError("use of h2quic.Server without http.Server"))
 	})
 
-	It("should nop-Close() when s.server is nil", func() {
+	It("should nop-Close() when s.servers is nil", func() {
 		err := (&Server{}).Close()
 		Expect(err).NotTo(HaveOccurred())
 	})
@@ -244,6 +892,33 @@ var _ = Describe("H2 server", func() {
 			Expect(err).NotTo(HaveOccurred())
 		}, 0.5)
 
+		It("announces the port of the UDP socket", func(done Done) {
+			s.Server.Addr = "127.0.0.1:0"
+			go func() {
+				defer GinkgoRecover()
+				err := s.ListenAndServe()
+				Expect(err).NotTo(HaveOccurred())
+				close(done)
+			}()
+			var port int
+			Eventually(func() int {
+				s.serverMutex.Lock()
+				defer s.serverMutex.Unlock()
+				if s.servers == nil || s.servers[0].LocalAddr() == nil {
+					return 0
+				}
+				port = s.servers[0].LocalAddr().(*net.UDPAddr).Port
+				return port
+			}).ShouldNot(BeZero())
+			hdr := http.Header{}
+			err := s.SetQuicHeaders(hdr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr.Get("Alternate-Protocol")).To(Equal(fmt.Sprintf("%d:quic", port)))
+			Expect(hdr.Get("Alt-Svc")).To(HavePrefix(fmt.Sprintf(`quic=":%d";`, port)))
+			err = s.Close()
+			Expect(err).NotTo(HaveOccurred())
+		}, 0.5)
+
 		It("may only be called once", func(done Done) {
 			go func() {
 				defer GinkgoRecover()
@@ -259,6 +934,177 @@ var _ = Describe("H2 server", func() {
 		}, 0.5)
 	})
 
+	Context("listening on multiple addresses", func() {
+		// sends a packet with an unsupported version, to which the server responds with a version negotiation packet
+		expectVersionNegotiation := func(addr net.Addr) {
+			conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01})
+			Expect(err).NotTo(HaveOccurred())
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			data := make([]byte, 1000)
+			n, err := conn.Read(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data[:n]).To(Equal(append([]byte{0xd, 0x1, 0, 0, 0, 0, 0, 0, 0}, protocol.SupportedVersionsAsTags...)))
+		}
+
+		localAddrs := func() []net.Addr {
+			s.serverMutex.Lock()
+			defer s.serverMutex.Unlock()
+			var addrs []net.Addr
+			for _, server := range s.servers {
+				if addr := server.LocalAddr(); addr != nil {
+					addrs = append(addrs, addr)
+				}
+			}
+			return addrs
+		}
+
+		It("serves on all addresses and closes all of them", func() {
+			s.Addresses = []string{"127.0.0.1:0", "127.0.0.1:0"}
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- s.ListenAndServe()
+			}()
+			Eventually(localAddrs).Should(HaveLen(2))
+			addrs := localAddrs()
+			Expect(addrs[0]).NotTo(Equal(addrs[1]))
+			expectVersionNegotiation(addrs[0])
+			expectVersionNegotiation(addrs[1])
+			hdr := http.Header{}
+			err := s.SetQuicHeaders(hdr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr.Get("Alt-Svc")).To(HavePrefix(fmt.Sprintf(`quic=":%d";`, addrs[0].(*net.UDPAddr).Port)))
+			err = s.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(serveErr).Should(Receive(BeNil()))
+			Expect(localAddrs()).To(BeEmpty())
+			// the ports are released
+			for _, addr := range addrs {
+				conn, err := net.ListenUDP("udp", addr.(*net.UDPAddr))
+				Expect(err).NotTo(HaveOccurred())
+				conn.Close()
+			}
+		})
+
+		It("doesn't listen on any address if one of them fails", func() {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).NotTo(HaveOccurred())
+			freeAddr := free.LocalAddr().String()
+			free.Close()
+			s.Addresses = []string{freeAddr, conn.LocalAddr().String()}
+			err = s.ListenAndServe()
+			Expect(err).To(HaveOccurred())
+			Expect(localAddrs()).To(BeEmpty())
+			// the socket on the first address was closed again
+			c, err := net.ListenPacket("udp", freeAddr)
+			Expect(err).NotTo(HaveOccurred())
+			c.Close()
+		})
+
+		It("may only be called once", func() {
+			s.Addresses = []string{"127.0.0.1:0"}
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- s.ListenAndServe()
+			}()
+			Eventually(localAddrs).Should(HaveLen(1))
+			err := s.ListenAndServe()
+			Expect(err).To(MatchError("ListenAndServe may only be called once"))
+			err = s.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(serveErr).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("ServePacketConn", func() {
+		var conn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("works", func(done Done) {
+			go func() {
+				defer GinkgoRecover()
+				err := s.ServePacketConn(conn)
+				Expect(err).NotTo(HaveOccurred())
+				close(done)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			err := s.Close()
+			Expect(err).NotTo(HaveOccurred())
+		}, 0.5)
+
+		It("closes sessions rejected by OnNewSession without calling the handler", func() {
+			var handlerCalled int32
+			s.Handler = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				atomic.StoreInt32(&handlerCalled, 1)
+			})
+			rejected := make(chan net.Addr, 1)
+			s.OnNewSession = func(sess *quic.Session) bool {
+				rejected <- sess.RemoteAddr()
+				return false
+			}
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- s.ServePacketConn(conn)
+			}()
+
+			client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '2', 0x01})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(rejected).Should(Receive(Equal(client.LocalAddr())))
+			// the client receives a CONNECTION_CLOSE
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = client.Read(make([]byte, 1000))
+			Expect(err).NotTo(HaveOccurred())
+			Consistently(func() int32 { return atomic.LoadInt32(&handlerCalled) }).Should(BeZero())
+
+			err = s.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(serveErr).Should(Receive(BeNil()))
+		})
+
+		It("only accepts the configured versions", func() {
+			s.Versions = []protocol.VersionNumber{33}
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- s.ServePacketConn(conn)
+			}()
+
+			client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Close()
+			_, err = client.Write([]byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '2', 0x01})
+			Expect(err).NotTo(HaveOccurred())
+			// the client receives a version negotiation packet with the version that is announced in the Alt-Svc header
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			b := make([]byte, 1000)
+			n, err := client.Read(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b[9:n]).To(Equal([]byte{'Q', '0', '3', '3'}))
+
+			err = s.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(serveErr).Should(Receive(BeNil()))
+		})
+
+		It("errors when called with s.Server nil", func() {
+			err := (&Server{}).ServePacketConn(conn)
+			Expect(err).To(MatchError("use of h2quic.Server without http.Server"))
+			conn.Close()
+		})
+	})
+
 	Context("ListenAndServeTLS", func() {
 		path := os.Getenv("GOPATH")
 		path += "/src/github.com/lucas-clemente/quic-go/example/"
@@ -0,0 +1,83 @@
+package handshake
+
+import (
+	"bytes"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/qerr"
+)
+
+var (
+	errCETVDecryptionFailed = qerr.CryptoErrorWithTag(qerr.InvalidCryptoMessageParameter, uint32(TagCETV), "CETV decryption failure")
+	errMalformedCETV        = qerr.CryptoErrorWithTag(qerr.InvalidCryptoMessageParameter, uint32(TagCETV), "CETV parse error")
+	errInvalidChannelID     = qerr.CryptoErrorWithTag(qerr.InvalidChannelIDSignature, uint32(TagCIDS), "channel ID signature invalid")
+)
+
+// cetvKeyDerivationFunction is used to derive the keys of the CETV
+type cetvKeyDerivationFunction func(sharedSecret, nonces, hkdfInput []byte) (crypto.AEAD, error)
+
+// cetvKeyDerivations are the CETV key derivation functions for the supported AEADs
+var cetvKeyDerivations = map[Tag]cetvKeyDerivationFunction{
+	TagCC20: crypto.DeriveCETVKeysChacha20,
+	TagA256: crypto.DeriveCETVKeysAESGCM256,
+}
+
+// decryptCETV decrypts the client encrypted tag-values of a CHLO with keys derived from the initial shared secret.
+// It returns the tag-values, or nil if the CHLO has no CETV, and the HKDF input, which is also the data signed by the channel ID.
+func (h *CryptoSetup) decryptCETV(aead Tag, sharedSecret []byte, cryptoData map[Tag][]byte) (map[Tag][]byte, []byte, error) {
+	ciphertext, ok := cryptoData[TagCETV]
+	if !ok {
+		return nil, nil, nil
+	}
+	chlo := make(map[Tag][]byte, len(cryptoData))
+	for tag, value := range cryptoData {
+		if tag != TagCETV && tag != TagPAD {
+			chlo[tag] = value
+		}
+	}
+	var chloData bytes.Buffer
+	WriteHandshakeMessage(&chloData, TagCHLO, chlo)
+	hkdfInput := crypto.CETVHKDFInput(h.connID, chloData.Bytes(), h.scfg.Get())
+
+	cetvAEAD, err := cetvKeyDerivations[aead](sharedSecret, cryptoData[TagNONC], hkdfInput)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := cetvAEAD.Open(0, nil, ciphertext)
+	if err != nil {
+		return nil, nil, errCETVDecryptionFailed
+	}
+	messageTag, cetv, err := ParseHandshakeMessage(bytes.NewReader(plaintext))
+	if err != nil || messageTag != TagCETV {
+		return nil, nil, errMalformedCETV
+	}
+	return cetv, hkdfInput, nil
+}
+
+// verifyChannelID checks the channel ID signature in the CETV, and returns the channel ID key.
+// It returns nil if the client didn't send a channel ID.
+func verifyChannelID(cetv map[Tag][]byte, hkdfInput []byte) ([]byte, error) {
+	key, ok := cetv[TagCIDK]
+	if !ok {
+		return nil, nil
+	}
+	if err := crypto.VerifyChannelID(key, hkdfInput, cetv[TagCIDS]); err != nil {
+		return nil, errInvalidChannelID
+	}
+	return key, nil
+}
+
+// withClientAuthFromCETV returns the CHLO tag-values, with the client certificate and proof taken from the CETV if it contains them.
+// This way the client certificate is not visible on the wire.
+func withClientAuthFromCETV(cryptoData, cetv map[Tag][]byte) map[Tag][]byte {
+	if _, ok := cetv[TagCCHN]; !ok {
+		return cryptoData
+	}
+	merged := make(map[Tag][]byte, len(cryptoData)+2)
+	for tag, value := range cryptoData {
+		merged[tag] = value
+	}
+	merged[TagCCHN] = cetv[TagCCHN]
+	merged[TagCPRF] = cetv[TagCPRF]
+	return merged
+}
@@ -0,0 +1,180 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/congestion"
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"golang.org/x/crypto/hkdf"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CETV", func() {
+	var (
+		cs   *CryptoSetup
+		scfg *ServerConfig
+		chlo map[Tag][]byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		scfg, err = NewServerConfig(&mockKEX{}, &mockSigner{}, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		sno, err := scfg.newServerNonce(time.Now())
+		Expect(err).ToNot(HaveOccurred())
+		nonce := make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce, uint32(time.Now().Unix()))
+		_, err = rand.Read(nonce[4:])
+		Expect(err).ToNot(HaveOccurred())
+		cs, err = NewCryptoSetup(protocol.ConnectionID(42), net.ParseIP("1.2.3.4"), protocol.SupportedVersions[0], scfg, &mockStream{}, NewConnectionParamatersManager(), make(chan struct{}, 1), congestion.DefaultClock{})
+		Expect(err).ToNot(HaveOccurred())
+		cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
+		chlo = map[Tag][]byte{
+			TagSCID: scfg.ID(),
+			TagPUBS: []byte("pubs-c"),
+			TagNONC: nonce,
+			TagSNO:  sno,
+			TagPAD:  bytes.Repeat([]byte{'a'}, 100),
+		}
+	})
+
+	// hkdfInput is the data the client derives the CETV keys from, and signs with its channel ID key
+	hkdfInput := func() []byte {
+		withoutPadding := make(map[Tag][]byte)
+		for tag, value := range chlo {
+			if tag != TagPAD {
+				withoutPadding[tag] = value
+			}
+		}
+		var chloData bytes.Buffer
+		WriteHandshakeMessage(&chloData, TagCHLO, withoutPadding)
+		return crypto.CETVHKDFInput(42, chloData.Bytes(), scfg.Get())
+	}
+
+	// sealCETV encrypts a handshake message like a client does, and adds it to the CHLO
+	sealCETV := func(newAEAD func(otherKey, myKey, otherIV, myIV []byte) (crypto.AEAD, error), info []byte, messageTag Tag, cetv map[Tag][]byte) {
+		keys := make([]byte, 72)
+		_, err := io.ReadFull(hkdf.New(sha256.New, []byte("shared key"), chlo[TagNONC], info), keys)
+		Expect(err).ToNot(HaveOccurred())
+		// the client encrypts with the first key and IV, which the server uses to decrypt
+		clientAEAD, err := newAEAD(keys[32:64], keys[:32], keys[68:72], keys[64:68])
+		Expect(err).ToNot(HaveOccurred())
+		var plaintext bytes.Buffer
+		WriteHandshakeMessage(&plaintext, messageTag, cetv)
+		chlo[TagCETV] = clientAEAD.Seal(0, nil, plaintext.Bytes())
+	}
+
+	withChannelID := func(key *ecdsa.PrivateKey) map[Tag][]byte {
+		cidk, cids, err := crypto.SignChannelID(key, hkdfInput())
+		Expect(err).ToNot(HaveOccurred())
+		return map[Tag][]byte{TagCIDK: cidk, TagCIDS: cids}
+	}
+
+	It("doesn't require a CETV", func() {
+		_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cs.ChannelID()).To(BeNil())
+	})
+
+	It("decrypts a CETV with a channel ID", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		cetv := withChannelID(key)
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, cetv)
+		reply, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reply).To(HavePrefix("SHLO"))
+		Expect(cs.ChannelID()).To(Equal(cetv[TagCIDK]))
+	})
+
+	It("decrypts a CETV with AES-256-GCM", func() {
+		scfg.aeads = []Tag{TagCC20, TagA256}
+		chlo[TagAEAD] = []byte("A256")
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		sealCETV(crypto.NewAEADAESGCM256, hkdfInput(), TagCETV, withChannelID(key))
+		_, err = cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cs.ChannelID()).To(HaveLen(64))
+	})
+
+	It("accepts a CETV without a channel ID", func() {
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, map[Tag][]byte{})
+		_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cs.ChannelID()).To(BeNil())
+	})
+
+	It("rejects a CETV that can't be decrypted", func() {
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, map[Tag][]byte{})
+		chlo[TagCETV][0] ^= 0xff
+		_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).To(MatchError(errCETVDecryptionFailed))
+	})
+
+	It("rejects a CETV encrypted for a different CHLO", func() {
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, map[Tag][]byte{})
+		chlo[TagSNI] = []byte("quic.clemente.io")
+		_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).To(MatchError(errCETVDecryptionFailed))
+	})
+
+	It("rejects a CETV that is not a CETV message", func() {
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCHLO, map[Tag][]byte{})
+		_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).To(MatchError(errMalformedCETV))
+	})
+
+	It("rejects an invalid channel ID signature", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		cetv := withChannelID(key)
+		cetv[TagCIDS] = bytes.Repeat([]byte{1}, 64)
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, cetv)
+		_, err = cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).To(MatchError(errInvalidChannelID))
+		Expect(cs.ChannelID()).To(BeNil())
+	})
+
+	It("binds the channel ID to the server name", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		chlo[TagSNI] = []byte("quic.clemente.io")
+		cetv := withChannelID(key)
+		// a signature made for a different origin can't be reused
+		chlo[TagSNI] = []byte("example.com")
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, cetv)
+		_, err = cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).To(MatchError(errInvalidChannelID))
+	})
+
+	It("takes the client certificate from the CETV", func() {
+		ca, caKey := generateCert(true, nil, nil)
+		clientCert, clientKey := generateCert(false, ca, caKey)
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(ca)
+		scfg.SetClientAuth(tls.RequireAndVerifyClientCert, clientCAs)
+		proof, err := crypto.SignClientProof(clientKey, scfg.ID(), chlo[TagNONC], chlo[TagPUBS])
+		Expect(err).ToNot(HaveOccurred())
+		sealCETV(crypto.NewAEADChacha20Poly1305, hkdfInput(), TagCETV, map[Tag][]byte{
+			TagCCHN: encodeCertificateChain(clientCert),
+			TagCPRF: proof,
+		})
+		_, err = cs.handleCHLO("", []byte("chlo-data"), chlo)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cs.PeerCertificates()).To(Equal([]*x509.Certificate{clientCert}))
+	})
+})
@@ -2,7 +2,6 @@ package handshake
 
 import (
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"sync"
 	"time"
@@ -20,13 +19,18 @@ type ConnectionParametersManager struct {
 	mutex  sync.RWMutex
 
 	flowControlNegotiated bool // have the flow control parameters for sending already been negotiated
+	truncateConnectionID  bool // the client requested TCID=0, so that the connection ID is omitted from the packets we send
 
 	maxStreamsPerConnection            uint32
 	idleConnectionStateLifetime        time.Duration
+	maxIdleConnectionStateLifetime     time.Duration // the local cap for the idle connection state lifetime
+	connectionOptions                  [][4]byte
+	maxDatagramFrameSize               protocol.ByteCount // 0 if the client doesn't support DATAGRAM frames
 	sendStreamFlowControlWindow        protocol.ByteCount
 	sendConnectionFlowControlWindow    protocol.ByteCount
 	receiveStreamFlowControlWindow     protocol.ByteCount
 	receiveConnectionFlowControlWindow protocol.ByteCount
+	peerStatelessResetToken            []byte // nil if the client didn't send a stateless reset token
 }
 
 var errTagNotInConnectionParameterMap = errors.New("ConnectionParametersManager: Tag not found in ConnectionsParameter map")
@@ -42,6 +46,7 @@ func NewConnectionParamatersManager() *ConnectionParametersManager {
 	return &ConnectionParametersManager{
 		params: make(map[Tag][]byte),
 		idleConnectionStateLifetime:        protocol.InitialIdleConnectionStateLifetime,
+		maxIdleConnectionStateLifetime:     protocol.MaxIdleConnectionStateLifetime,
 		sendStreamFlowControlWindow:        protocol.InitialStreamFlowControlWindow,     // can only be changed by the client
 		sendConnectionFlowControlWindow:    protocol.InitialConnectionFlowControlWindow, // can only be changed by the client
 		receiveStreamFlowControlWindow:     protocol.ReceiveStreamFlowControlWindow,
@@ -58,7 +63,34 @@ func (h *ConnectionParametersManager) SetFromMap(params map[Tag][]byte) error {
 	for key, value := range params {
 		switch key {
 		case TagTCID:
+			if len(value) != 4 {
+				return ErrMalformedTag
+			}
+			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
+			if err != nil {
+				return ErrMalformedTag
+			}
 			h.params[key] = value
+			h.truncateConnectionID = clientValue == 0
+		case TagCOPT:
+			if len(value)%4 != 0 {
+				return ErrMalformedTag
+			}
+			h.connectionOptions = make([][4]byte, len(value)/4)
+			for i := range h.connectionOptions {
+				copy(h.connectionOptions[i][:], value[4*i:])
+			}
+		case TagSRST:
+			if len(value) != protocol.StatelessResetTokenLen {
+				return ErrMalformedTag
+			}
+			h.peerStatelessResetToken = value
+		case TagMDFS:
+			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
+			if err != nil {
+				return ErrMalformedTag
+			}
+			h.maxDatagramFrameSize = utils.MinByteCount(protocol.ByteCount(clientValue), protocol.MaxDatagramFrameSize)
 		case TagMSPC:
 			clientValue, err := utils.ReadUint32(bytes.NewBuffer(value))
 			if err != nil {
@@ -107,7 +139,39 @@ func (h *ConnectionParametersManager) negotiateMaxStreamsPerConnection(clientVal
 
 func (h *ConnectionParametersManager) negotiateIdleConnectionStateLifetime(clientValue time.Duration) time.Duration {
 	// TODO: what happens if the clients sets 0 seconds?
-	return utils.MinDuration(clientValue, protocol.MaxIdleConnectionStateLifetime)
+	return utils.MinDuration(clientValue, h.maxIdleConnectionStateLifetime)
+}
+
+// SetMaxIdleConnectionStateLifetime sets the local maximum for the idle connection state lifetime.
+// The negotiated value never exceeds it, no matter what the peer sends.
+func (h *ConnectionParametersManager) SetMaxIdleConnectionStateLifetime(max time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.maxIdleConnectionStateLifetime = max
+	h.idleConnectionStateLifetime = utils.MinDuration(h.idleConnectionStateLifetime, max)
+}
+
+// Reset restores the state of a new ConnectionParametersManager, discarding all negotiated values, so that it can be reused
+func (h *ConnectionParametersManager) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for tag := range h.params {
+		delete(h.params, tag)
+	}
+	h.flowControlNegotiated = false
+	h.truncateConnectionID = false
+	h.maxStreamsPerConnection = protocol.MaxStreamsPerConnection
+	h.idleConnectionStateLifetime = protocol.InitialIdleConnectionStateLifetime
+	h.maxIdleConnectionStateLifetime = protocol.MaxIdleConnectionStateLifetime
+	h.connectionOptions = nil
+	h.maxDatagramFrameSize = 0
+	h.sendStreamFlowControlWindow = protocol.InitialStreamFlowControlWindow
+	h.sendConnectionFlowControlWindow = protocol.InitialConnectionFlowControlWindow
+	h.receiveStreamFlowControlWindow = protocol.ReceiveStreamFlowControlWindow
+	h.receiveConnectionFlowControlWindow = protocol.ReceiveConnectionFlowControlWindow
+	h.peerStatelessResetToken = nil
 }
 
 // getRawValue gets the byte-slice for a tag
@@ -133,12 +197,18 @@ func (h *ConnectionParametersManager) GetSHLOMap() map[Tag][]byte {
 	icsl := bytes.NewBuffer([]byte{})
 	utils.WriteUint32(icsl, uint32(h.GetIdleConnectionStateLifetime()/time.Second))
 
-	return map[Tag][]byte{
+	shlo := map[Tag][]byte{
 		TagICSL: icsl.Bytes(),
 		TagMSPC: mspc.Bytes(),
 		TagCFCW: cfcw.Bytes(),
 		TagSFCW: sfcw.Bytes(),
 	}
+	if h.GetMaxDatagramFrameSize() > 0 {
+		mdfs := bytes.NewBuffer([]byte{})
+		utils.WriteUint32(mdfs, uint32(protocol.MaxDatagramFrameSize))
+		shlo[TagMDFS] = mdfs.Bytes()
+	}
+	return shlo
 }
 
 // GetSendStreamFlowControlWindow gets the size of the stream-level flow control window for sending data
@@ -181,6 +251,47 @@ func (h *ConnectionParametersManager) GetMaxStreamsPerConnection() uint32 {
 	return h.maxStreamsPerConnection
 }
 
+// GetConnectionOptions gets the connection options sent by the client in the COPT tag
+func (h *ConnectionParametersManager) GetConnectionOptions() [][4]byte {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.connectionOptions
+}
+
+// GetMaxDatagramFrameSize gets the maximum size of the data in a DatagramFrame
+// It returns 0 if the client doesn't support DATAGRAM frames.
+func (h *ConnectionParametersManager) GetMaxDatagramFrameSize() protocol.ByteCount {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.maxDatagramFrameSize
+}
+
+// SupportsDatagrams returns true if the client supports DATAGRAM frames
+func (h *ConnectionParametersManager) SupportsDatagrams() bool {
+	return h.GetMaxDatagramFrameSize() > 0
+}
+
+// AllowsMigration returns false if the client sent the NCMR connection option, i.e. it won't migrate the connection to a new address
+func (h *ConnectionParametersManager) AllowsMigration() bool {
+	for _, o := range h.GetConnectionOptions() {
+		if o == [4]byte{'N', 'C', 'M', 'R'} {
+			return false
+		}
+	}
+	return true
+}
+
+// PeerStatelessResetToken gets the stateless reset token sent by the client in the SRST tag
+// It returns nil if the client didn't send one.
+func (h *ConnectionParametersManager) PeerStatelessResetToken() []byte {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.peerStatelessResetToken
+}
+
 // GetIdleConnectionStateLifetime gets the idle timeout
 func (h *ConnectionParametersManager) GetIdleConnectionStateLifetime() time.Duration {
 	h.mutex.RLock()
@@ -191,16 +302,8 @@ func (h *ConnectionParametersManager) GetIdleConnectionStateLifetime() time.Dura
 
 // TruncateConnectionID determines if the client requests truncated ConnectionIDs
 func (h *ConnectionParametersManager) TruncateConnectionID() bool {
-	rawValue, err := h.getRawValue(TagTCID)
-	if err != nil {
-		return false
-	}
-	if len(rawValue) != 4 {
-		return false
-	}
-	value := binary.LittleEndian.Uint32(rawValue)
-	if value == 0 {
-		return true
-	}
-	return false
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.truncateConnectionID
 }
@@ -1,6 +1,7 @@
 package handshake
 
 import (
+	"bytes"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/protocol"
@@ -15,12 +16,13 @@ var _ = Describe("ConnectionsParameterManager", func() {
 	})
 
 	It("stores and retrieves a value", func() {
-		tcid := []byte{0x13, 0x37}
+		tcid := []byte{0x13, 0x37, 0, 0}
 		values := map[Tag][]byte{
 			TagTCID: tcid,
 		}
 
-		cpm.SetFromMap(values)
+		err := cpm.SetFromMap(values)
+		Expect(err).ToNot(HaveOccurred())
 
 		val, err := cpm.getRawValue(TagTCID)
 		Expect(err).ToNot(HaveOccurred())
@@ -80,6 +82,32 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			cpm.SetFromMap(values)
 			Expect(cpm.TruncateConnectionID()).To(BeTrue())
 		})
+
+		It("doesn't truncate the connection ID if the TCID is not 0", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagTCID: {1, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.TruncateConnectionID()).To(BeFalse())
+		})
+
+		It("errors on a malformed TCID", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagTCID: {0, 0, 0}, // 1 byte too short
+			})
+			Expect(err).To(MatchError(ErrMalformedTag))
+			Expect(cpm.TruncateConnectionID()).To(BeFalse())
+		})
+
+		It("errors on a TCID that is too long, and doesn't store it", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagTCID: {0, 0, 0, 0, 0},
+			})
+			Expect(err).To(MatchError(ErrMalformedTag))
+			Expect(cpm.TruncateConnectionID()).To(BeFalse())
+			_, err = cpm.getRawValue(TagTCID)
+			Expect(err).To(MatchError(errTagNotInConnectionParameterMap))
+		})
 	})
 
 	Context("flow control", func() {
@@ -185,6 +213,31 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
 		})
 
+		It("clamps a huge lifetime to the local maximum", func() {
+			cpm.SetMaxIdleConnectionStateLifetime(20 * time.Second)
+			values := map[Tag][]byte{
+				TagICSL: {0xFF, 0xFF, 0xFF, 0xFF},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(20 * time.Second))
+		})
+
+		It("accepts lifetimes below the local maximum", func() {
+			cpm.SetMaxIdleConnectionStateLifetime(20 * time.Second)
+			values := map[Tag][]byte{
+				TagICSL: {10, 0, 0, 0},
+			}
+			err := cpm.SetFromMap(values)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(10 * time.Second))
+		})
+
+		It("clamps the current lifetime when setting a lower local maximum", func() {
+			cpm.SetMaxIdleConnectionStateLifetime(protocol.InitialIdleConnectionStateLifetime / 2)
+			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(protocol.InitialIdleConnectionStateLifetime / 2))
+		})
+
 		It("gets idle connection state lifetime", func() {
 			value := 0xDECAFBAD * time.Second
 			cpm.idleConnectionStateLifetime = value
@@ -192,6 +245,132 @@ var _ = Describe("ConnectionsParameterManager", func() {
 		})
 	})
 
+	Context("connection options", func() {
+		It("has no connection options by default", func() {
+			Expect(cpm.GetConnectionOptions()).To(BeEmpty())
+		})
+
+		It("parses the connection options", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagCOPT: []byte("1CONTBBR"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetConnectionOptions()).To(Equal([][4]byte{
+				{'1', 'C', 'O', 'N'},
+				{'T', 'B', 'B', 'R'},
+			}))
+		})
+
+		It("errors when the length is not a multiple of 4", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagCOPT: []byte("1CONTBB"),
+			})
+			Expect(err).To(MatchError(ErrMalformedTag))
+		})
+	})
+
+	Context("datagrams", func() {
+		It("doesn't support datagrams by default", func() {
+			Expect(cpm.GetMaxDatagramFrameSize()).To(BeZero())
+			Expect(cpm.GetSHLOMap()).ToNot(HaveKey(TagMDFS))
+		})
+
+		It("negotiates the maximum datagram size", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagMDFS: {0x10, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetMaxDatagramFrameSize()).To(Equal(protocol.ByteCount(0x10)))
+		})
+
+		It("doesn't allow datagrams larger than the local maximum", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagMDFS: {0xff, 0xff, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetMaxDatagramFrameSize()).To(Equal(protocol.ByteCount(protocol.MaxDatagramFrameSize)))
+		})
+
+		It("sends the maximum datagram size in the SHLO if the client supports datagrams", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagMDFS: {0x10, 0, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			entryMap := cpm.GetSHLOMap()
+			Expect(entryMap).To(HaveKey(TagMDFS))
+			Expect(entryMap[TagMDFS]).To(Equal([]byte{byte(protocol.MaxDatagramFrameSize & 0xff), byte(protocol.MaxDatagramFrameSize >> 8), 0, 0}))
+		})
+
+		It("errors when given an invalid maximum datagram size", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagMDFS: {0x10, 0, 0},
+			})
+			Expect(err).To(MatchError(ErrMalformedTag))
+		})
+	})
+
+	Context("stateless reset token", func() {
+		It("has no stateless reset token by default", func() {
+			Expect(cpm.PeerStatelessResetToken()).To(BeNil())
+		})
+
+		It("reads the stateless reset token", func() {
+			token := bytes.Repeat([]byte{0x42}, protocol.StatelessResetTokenLen)
+			err := cpm.SetFromMap(map[Tag][]byte{TagSRST: token})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.PeerStatelessResetToken()).To(Equal(token))
+		})
+
+		It("errors when given a token of the wrong length", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{TagSRST: {0x42}})
+			Expect(err).To(MatchError(ErrMalformedTag))
+			Expect(cpm.PeerStatelessResetToken()).To(BeNil())
+		})
+	})
+
+	Context("peer capabilities", func() {
+		setFromCHLO := func(data map[Tag][]byte) {
+			var b bytes.Buffer
+			WriteHandshakeMessage(&b, TagCHLO, data)
+			_, params, err := ParseHandshakeMessage(&b)
+			Expect(err).ToNot(HaveOccurred())
+			err = cpm.SetFromMap(params)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("has no optional capabilities for a minimal CHLO", func() {
+			setFromCHLO(map[Tag][]byte{TagPAD: {0}})
+			Expect(cpm.SupportsDatagrams()).To(BeFalse())
+			Expect(cpm.AllowsMigration()).To(BeTrue())
+			Expect(cpm.TruncateConnectionID()).To(BeFalse())
+		})
+
+		It("detects datagram support", func() {
+			setFromCHLO(map[Tag][]byte{TagMDFS: {0x10, 0, 0, 0}})
+			Expect(cpm.SupportsDatagrams()).To(BeTrue())
+		})
+
+		It("doesn't support datagrams if the client allows a size of 0", func() {
+			setFromCHLO(map[Tag][]byte{TagMDFS: {0, 0, 0, 0}})
+			Expect(cpm.SupportsDatagrams()).To(BeFalse())
+		})
+
+		It("detects that the client won't migrate", func() {
+			setFromCHLO(map[Tag][]byte{TagCOPT: []byte("1CONNCMR")})
+			Expect(cpm.AllowsMigration()).To(BeFalse())
+		})
+
+		It("allows migration with other connection options", func() {
+			setFromCHLO(map[Tag][]byte{TagCOPT: []byte("1CON")})
+			Expect(cpm.AllowsMigration()).To(BeTrue())
+		})
+
+		It("detects truncated connection ID support", func() {
+			setFromCHLO(map[Tag][]byte{TagTCID: {0, 0, 0, 0}})
+			Expect(cpm.TruncateConnectionID()).To(BeTrue())
+		})
+	})
+
 	Context("max streams per connection", func() {
 		It("negotiates correctly when the client wants a larger number", func() {
 			Expect(cpm.negotiateMaxStreamsPerConnection(protocol.MaxStreamsPerConnection + 10)).To(Equal(protocol.MaxStreamsPerConnection))
@@ -225,4 +404,45 @@ var _ = Describe("ConnectionsParameterManager", func() {
 			Expect(cpm.GetMaxStreamsPerConnection()).To(Equal(value))
 		})
 	})
+
+	Context("resetting", func() {
+		BeforeEach(func() {
+			cpm.SetMaxIdleConnectionStateLifetime(20 * time.Second)
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagTCID: {0, 0, 0, 0},
+				TagICSL: {10, 0, 0, 0},
+				TagMSPC: {2, 0, 0, 0},
+				TagSFCW: {0xAD, 0xFB, 0xCA, 0xDE},
+				TagCFCW: {0xEF, 0xBE, 0xAD, 0xDE},
+				TagCOPT: []byte("NSTP"),
+				TagMDFS: {0x00, 0x04, 0x00, 0x00},
+				TagSRST: bytes.Repeat([]byte{0x42}, protocol.StatelessResetTokenLen),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			cpm.Reset()
+		})
+
+		It("restores the default idle connection state lifetime", func() {
+			Expect(cpm.GetIdleConnectionStateLifetime()).To(Equal(protocol.InitialIdleConnectionStateLifetime))
+			Expect(cpm.maxIdleConnectionStateLifetime).To(Equal(protocol.MaxIdleConnectionStateLifetime))
+		})
+
+		It("clears the negotiated values", func() {
+			Expect(cpm.TruncateConnectionID()).To(BeFalse())
+			Expect(cpm.GetMaxStreamsPerConnection()).To(Equal(protocol.MaxStreamsPerConnection))
+			Expect(cpm.GetSendStreamFlowControlWindow()).To(Equal(protocol.InitialStreamFlowControlWindow))
+			Expect(cpm.GetSendConnectionFlowControlWindow()).To(Equal(protocol.InitialConnectionFlowControlWindow))
+			Expect(cpm.GetConnectionOptions()).To(BeEmpty())
+			Expect(cpm.SupportsDatagrams()).To(BeFalse())
+			Expect(cpm.PeerStatelessResetToken()).To(BeNil())
+		})
+
+		It("allows negotiating the flow control parameters again", func() {
+			err := cpm.SetFromMap(map[Tag][]byte{
+				TagSFCW: {0x00, 0x00, 0x01, 0x00},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cpm.GetSendStreamFlowControlWindow()).To(Equal(protocol.ByteCount(0x10000)))
+		})
+	})
 })
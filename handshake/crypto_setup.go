@@ -3,22 +3,57 @@ package handshake
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"io"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
+// errClientNonceNotUnique is returned for CHLOs with a replayed client nonce
+var errClientNonceNotUnique = qerr.CryptoErrorWithTag(qerr.CryptoHandshakeStatelessReject, uint32(TagNONC), "client nonce not unique")
+
+// errServerNonceInvalid is returned for CHLOs that echo an invalid or expired server nonce
+var errServerNonceInvalid = qerr.CryptoErrorWithTag(qerr.CryptoHandshakeStatelessReject, uint32(TagSNO), "server nonce invalid")
+
+// errServerNonceMissing is returned for CHLOs that don't echo the server nonce sent in the REJ
+var errServerNonceMissing = qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, uint32(TagSNO), "server nonce required")
+
+// errHandshakeMessageTooLarge is returned when a handshake message exceeds the maximum amount of buffered crypto stream data
+var errHandshakeMessageTooLarge = qerr.CryptoErrorWithTag(qerr.CryptoInvalidValueLength, uint32(TagCHLO), "handshake message too large")
+
+var (
+	errClientCertRequired  = qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, uint32(TagCCHN), "client certificate required")
+	errMalformedClientCert = qerr.CryptoErrorWithTag(qerr.InvalidCryptoMessageParameter, uint32(TagCCHN), "malformed client certificate chain")
+	errInvalidClientProof  = qerr.CryptoErrorWithTag(qerr.ProofInvalid, uint32(TagCPRF), "client proof invalid")
+	errUntrustedClientCert = qerr.CryptoErrorWithTag(qerr.ProofInvalid, uint32(TagCCHN), "client certificate not trusted")
+)
+
 // KeyDerivationFunction is used for key derivation
 type KeyDerivationFunction func(version protocol.VersionNumber, forwardSecure bool, sharedSecret, nonces []byte, connID protocol.ConnectionID, chlo []byte, scfg []byte, cert []byte, divNonce []byte) (crypto.AEAD, error)
 
+// keyDerivations are the key derivation functions for the supported AEADs
+var keyDerivations = map[Tag]KeyDerivationFunction{
+	TagCC20: crypto.DeriveKeysChacha20,
+	TagA256: crypto.DeriveKeysAESGCM256,
+}
+
 // KeyExchangeFunction is used to make a new KEX
 type KeyExchangeFunction func() (crypto.KeyExchange, error)
 
+// keyExchanges are the supported KEXs
+var keyExchanges = map[Tag]KeyExchangeFunction{
+	TagC255: crypto.NewCurve25519KEX,
+}
+
 // The CryptoSetup handles all things crypto for the Session
 type CryptoSetup struct {
 	connID               protocol.ConnectionID
@@ -34,13 +69,31 @@ type CryptoSetup struct {
 	receivedSecurePacket        bool
 	aeadChanged                 chan struct{}
 
-	keyDerivation KeyDerivationFunction
-	keyExchange   KeyExchangeFunction
+	keyDerivations map[Tag]KeyDerivationFunction
+	keyExchange    KeyExchangeFunction
 
 	cryptoStream utils.Stream
 
 	connectionParametersManager *ConnectionParametersManager
 
+	peerCertificates []*x509.Certificate
+	serverName       string
+	channelID        []byte
+
+	// clock is used for the handshake timings
+	clock        congestion.Clock
+	rejSentTime  time.Time
+	shloSentTime time.Time
+
+	// serverNonceSent is set once a REJ was sent, the client then has to echo its server nonce
+	serverNonceSent bool
+
+	// supportedVersionsAsTags are announced in the SHLO, so that the client can detect version downgrades
+	supportedVersionsAsTags []byte
+
+	// maxCryptoStreamData is the maximum size of a handshake message read from the crypto stream
+	maxCryptoStreamData protocol.ByteCount
+
 	mutex sync.RWMutex
 }
 
@@ -55,6 +108,7 @@ func NewCryptoSetup(
 	cryptoStream utils.Stream,
 	connectionParametersManager *ConnectionParametersManager,
 	aeadChanged chan struct{},
+	clock congestion.Clock,
 ) (*CryptoSetup, error) {
 	nonce := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
@@ -71,24 +125,37 @@ func NewCryptoSetup(
 		scfg:                        scfg,
 		nonce:                       nonce,
 		diversificationNonce:        diversificationNonce,
-		keyDerivation:               crypto.DeriveKeysChacha20,
+		keyDerivations:              keyDerivations,
 		keyExchange:                 crypto.NewCurve25519KEX,
 		cryptoStream:                cryptoStream,
 		connectionParametersManager: connectionParametersManager,
 		aeadChanged:                 aeadChanged,
+		clock:                       clock,
+		supportedVersionsAsTags:     protocol.SupportedVersionsAsTags,
+		maxCryptoStreamData:         protocol.DefaultMaxCryptoStreamData,
 	}, nil
 }
 
+// SetSupportedVersions sets the versions announced in the SHLO. It must be called before the crypto stream is handled.
+func (h *CryptoSetup) SetSupportedVersions(versions []protocol.VersionNumber) {
+	h.supportedVersionsAsTags = protocol.VersionsAsTags(versions)
+}
+
+// SetMaxCryptoStreamData sets the maximum size of a handshake message. It must be called before the crypto stream is handled.
+func (h *CryptoSetup) SetMaxCryptoStreamData(max protocol.ByteCount) {
+	h.maxCryptoStreamData = max
+}
+
 // HandleCryptoStream reads and writes messages on the crypto stream
 func (h *CryptoSetup) HandleCryptoStream() error {
 	for {
-		cachingReader := utils.NewCachingReader(h.cryptoStream)
+		cachingReader := utils.NewCachingReader(&cryptoStreamLimiter{r: h.cryptoStream, remaining: h.maxCryptoStreamData})
 		messageTag, cryptoData, err := ParseHandshakeMessage(cachingReader)
 		if err != nil {
 			return err
 		}
 		if messageTag != TagCHLO {
-			return qerr.InvalidCryptoMessageType
+			return qerr.CryptoErrorWithTag(qerr.InvalidCryptoMessageType, uint32(messageTag), "expected CHLO")
 		}
 		chloData := cachingReader.Get()
 
@@ -107,26 +174,36 @@ func (h *CryptoSetup) HandleCryptoStream() error {
 func (h *CryptoSetup) handleMessage(chloData []byte, cryptoData map[Tag][]byte) (bool, error) {
 	sniSlice, ok := cryptoData[TagSNI]
 	if !ok {
-		return false, qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")
+		return false, qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, uint32(TagSNI), "SNI required")
 	}
 	sni := string(sniSlice)
 	if sni == "" {
-		return false, qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")
+		return false, qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, uint32(TagSNI), "SNI required")
 	}
+	h.mutex.Lock()
+	h.serverName = sni
+	h.mutex.Unlock()
 
 	var reply []byte
 	var err error
 	if !h.isInchoateCHLO(cryptoData) {
 		// We have a CHLO with a proper server config ID, do a 0-RTT handshake
 		reply, err = h.handleCHLO(sni, chloData, cryptoData)
-		if err != nil {
-			return false, err
-		}
-		_, err = h.cryptoStream.Write(reply)
-		if err != nil {
+		if err == errClientNonceNotUnique || err == errServerNonceInvalid {
+			// the CHLO might be a replay, force a full handshake by sending a rejection
+			utils.Infof("Rejecting CHLO: %s", err.Error())
+		} else if err != nil {
 			return false, err
+		} else {
+			_, err = h.cryptoStream.Write(reply)
+			if err != nil {
+				return false, err
+			}
+			h.mutex.Lock()
+			h.shloSentTime = h.clock.Now()
+			h.mutex.Unlock()
+			return true, nil
 		}
-		return true, nil
 	}
 
 	// We have an inchoate or non-matching CHLO, we now send a rejection
@@ -138,6 +215,11 @@ func (h *CryptoSetup) handleMessage(chloData []byte, cryptoData map[Tag][]byte)
 	if err != nil {
 		return false, err
 	}
+	h.mutex.Lock()
+	if h.rejSentTime.IsZero() {
+		h.rejSentTime = h.clock.Now()
+	}
+	h.mutex.Unlock()
 	return false, nil
 }
 
@@ -169,6 +251,14 @@ func (h *CryptoSetup) Open(packetNumber protocol.PacketNumber, associatedData []
 	return (&crypto.NullAEAD{}).Open(packetNumber, associatedData, ciphertext)
 }
 
+// ReceivedForwardSecurePacket returns true once a forward-secure packet was received.
+// From then on, Open only accepts forward-secure packets.
+func (h *CryptoSetup) ReceivedForwardSecurePacket() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.receivedForwardSecurePacket
+}
+
 // Seal a message, call LockForSealing() before!
 func (h *CryptoSetup) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
 	if h.receivedForwardSecurePacket {
@@ -182,7 +272,11 @@ func (h *CryptoSetup) Seal(packetNumber protocol.PacketNumber, associatedData []
 
 func (h *CryptoSetup) isInchoateCHLO(cryptoData map[Tag][]byte) bool {
 	scid, ok := cryptoData[TagSCID]
-	if !ok || !bytes.Equal(h.scfg.ID, scid) {
+	if !ok || !bytes.Equal(h.scfg.ID(), scid) {
+		return true
+	}
+	if h.scfg.expired(time.Now()) {
+		// the client cached a server config that may not be used for 0-RTT anymore
 		return true
 	}
 	if err := h.scfg.stkSource.VerifyToken(h.ip, cryptoData[TagSTK]); err != nil {
@@ -194,7 +288,7 @@ func (h *CryptoSetup) isInchoateCHLO(cryptoData map[Tag][]byte) bool {
 
 func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map[Tag][]byte) ([]byte, error) {
 	if len(data) < protocol.ClientHelloMinimumSize {
-		return nil, qerr.Error(qerr.CryptoInvalidValueLength, "CHLO too small")
+		return nil, qerr.CryptoErrorWithTag(qerr.CryptoInvalidValueLength, uint32(TagCHLO), "CHLO too small")
 	}
 
 	var chloOrNil []byte
@@ -202,6 +296,11 @@ func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map
 		chloOrNil = data
 	}
 
+	now := time.Now()
+	if err := h.scfg.renewIfExpired(now); err != nil {
+		return nil, err
+	}
+
 	proof, err := h.scfg.Sign(sni, chloOrNil)
 	if err != nil {
 		return nil, err
@@ -220,36 +319,92 @@ func (h *CryptoSetup) handleInchoateCHLO(sni string, data []byte, cryptoData map
 		return nil, err
 	}
 
+	sno, err := h.scfg.newServerNonce(now)
+	if err != nil {
+		return nil, err
+	}
+
+	h.serverNonceSent = true
+
 	var serverReply bytes.Buffer
 	WriteHandshakeMessage(&serverReply, TagREJ, map[Tag][]byte{
 		TagSCFG: h.scfg.Get(),
 		TagCERT: certCompressed,
 		TagPROF: proof,
 		TagSTK:  token,
+		TagSNO:  sno,
+		TagSTTL: h.scfg.ttl(now),
 	})
 	return serverReply.Bytes(), nil
 }
 
 func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]byte) ([]byte, error) {
+	// The server nonce is only optional for 0-RTT handshakes, after a REJ the client has to echo it
+	sno, hasSNO := cryptoData[TagSNO]
+	if !hasSNO && h.serverNonceSent {
+		return nil, errServerNonceMissing
+	}
+	if hasSNO {
+		if err := h.scfg.verifyServerNonce(sno, time.Now()); err != nil {
+			utils.Debugf("Invalid server nonce in CHLO: %s", err.Error())
+			return nil, errServerNonceInvalid
+		}
+	}
+	aead, err := h.scfg.selectAEAD(cryptoData[TagAEAD])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = h.scfg.selectKEX(cryptoData[TagKEXS]); err != nil {
+		return nil, err
+	}
+	keyDerivation := h.keyDerivations[aead]
+
 	// We have a CHLO matching our server config, we can continue with the 0-RTT handshake
 	sharedSecret, err := h.scfg.kex.CalculateSharedKey(cryptoData[TagPUBS])
 	if err != nil {
 		return nil, err
 	}
 
+	cetv, cetvHKDFInput, err := h.decryptCETV(aead, sharedSecret, cryptoData)
+	if err != nil {
+		return nil, err
+	}
+	channelID, err := verifyChannelID(cetv, cetvHKDFInput)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCertificates, err := h.verifyClientCertificate(withClientAuthFromCETV(cryptoData, cetv))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only register the nonce once the CHLO was validated, so that invalid CHLOs can't fill the strike register
+	if !h.scfg.strikeRegister.Insert(cryptoData[TagNONC], time.Now()) {
+		return nil, errClientNonceNotUnique
+	}
+
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	h.peerCertificates = peerCertificates
+	h.channelID = channelID
+
 	certUncompressed, err := h.scfg.signer.GetLeafCert(sni)
 	if err != nil {
 		return nil, err
 	}
 
-	h.secureAEAD, err = h.keyDerivation(
+	// The initial keys are derived from the client nonce, followed by the server nonce, if the client sent one
+	initialNonces := cryptoData[TagNONC]
+	if hasSNO {
+		initialNonces = append(append([]byte{}, initialNonces...), sno...)
+	}
+	h.secureAEAD, err = keyDerivation(
 		h.version,
 		false,
 		sharedSecret,
-		cryptoData[TagNONC],
+		initialNonces,
 		h.connID,
 		data,
 		h.scfg.Get(),
@@ -272,7 +427,11 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 	if err != nil {
 		return nil, err
 	}
-	h.forwardSecureAEAD, err = h.keyDerivation(h.version,
+	fsKeyDerivation, err := h.forwardSecureKeyDerivation(cryptoData, keyDerivation)
+	if err != nil {
+		return nil, err
+	}
+	h.forwardSecureAEAD, err = fsKeyDerivation(h.version,
 		true,
 		ephermalSharedSecret,
 		fsNonce.Bytes(),
@@ -295,7 +454,8 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 	// add crypto parameters
 	replyMap[TagPUBS] = ephermalKex.PublicKey()
 	replyMap[TagSNO] = h.nonce
-	replyMap[TagVER] = protocol.SupportedVersionsAsTags
+	replyMap[TagVER] = h.supportedVersionsAsTags
+	replyMap[TagSRST] = h.scfg.StatelessResetToken(h.connID)
 
 	var reply bytes.Buffer
 	WriteHandshakeMessage(&reply, TagSHLO, replyMap)
@@ -305,6 +465,115 @@ func (h *CryptoSetup) handleCHLO(sni string, data []byte, cryptoData map[Tag][]b
 	return reply.Bytes(), nil
 }
 
+// verifyClientCertificate checks the client certificate chain and proof according to the client auth policy of the server config.
+// It returns the client's certificate chain, or nil if the client didn't send one.
+func (h *CryptoSetup) verifyClientCertificate(cryptoData map[Tag][]byte) ([]*x509.Certificate, error) {
+	if h.scfg.clientAuth == tls.NoClientCert {
+		return nil, nil
+	}
+	chain, ok := cryptoData[TagCCHN]
+	if !ok {
+		if h.scfg.requiresClientCert() {
+			return nil, errClientCertRequired
+		}
+		return nil, nil
+	}
+	certs, err := parseCertificateChain(chain)
+	if err != nil {
+		return nil, err
+	}
+	if err := crypto.VerifyClientProof(certs[0], h.scfg.ID(), cryptoData[TagNONC], cryptoData[TagPUBS], cryptoData[TagCPRF]); err != nil {
+		return nil, errInvalidClientProof
+	}
+	if h.scfg.verifiesClientCert() {
+		opts := x509.VerifyOptions{
+			Roots:         h.scfg.clientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return nil, errUntrustedClientCert
+		}
+	}
+	return certs, nil
+}
+
+// parseCertificateChain parses a chain of DER certificates, each prefixed with its length as a uint32
+func parseCertificateChain(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var length uint32
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, errMalformedClientCert
+		}
+		if length == 0 || int(length) > r.Len() {
+			return nil, errMalformedClientCert
+		}
+		der := make([]byte, length)
+		r.Read(der)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errMalformedClientCert
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errMalformedClientCert
+	}
+	return certs, nil
+}
+
+// PeerCertificates returns the certificate chain the client authenticated with, or nil if it didn't send one
+func (h *CryptoSetup) PeerCertificates() []*x509.Certificate {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.peerCertificates
+}
+
+// ChannelID returns the channel ID key the client sent in the CETV, or nil if it didn't send one.
+// It is the x and y coordinates of a P-256 public key.
+func (h *CryptoSetup) ChannelID() []byte {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.channelID
+}
+
+// HandshakeTimes returns when the first REJ and the SHLO were sent.
+// The times are zero if the message wasn't sent (yet), e.g. there is no REJ in a 0-RTT handshake.
+func (h *CryptoSetup) HandshakeTimes() (rejSent, shloSent time.Time) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.rejSentTime, h.shloSentTime
+}
+
+// ServerName returns the SNI the client sent in its CHLO, or an empty string if no CHLO was received yet
+func (h *CryptoSetup) ServerName() string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.serverName
+}
+
+// forwardSecureKeyDerivation returns the key derivation for the forward-secure AEAD chosen by the client.
+// If the client didn't choose one, the key derivation of the initial AEAD is used.
+func (h *CryptoSetup) forwardSecureKeyDerivation(cryptoData map[Tag][]byte, initial KeyDerivationFunction) (KeyDerivationFunction, error) {
+	fsae, ok := cryptoData[TagFSAE]
+	if !ok {
+		return initial, nil
+	}
+	if len(fsae) != 4 {
+		return nil, qerr.CryptoErrorWithTag(qerr.CryptoInvalidValueLength, uint32(TagFSAE), "invalid forward-secure AEAD")
+	}
+	aead := Tag(binary.LittleEndian.Uint32(fsae))
+	if !h.scfg.offersForwardSecureAEAD(aead) {
+		return nil, qerr.CryptoErrorWithTag(qerr.CryptoNoSupport, uint32(TagFSAE), "unsupported forward-secure AEAD")
+	}
+	return h.keyDerivations[aead], nil
+}
+
 // DiversificationNonce returns a diversification nonce if required in the next packet to be Seal'ed. See LockForSealing()!
 func (h *CryptoSetup) DiversificationNonce() []byte {
 	if h.version < protocol.VersionNumber(33) {
@@ -333,3 +602,36 @@ func (h *CryptoSetup) verifyOrCreateSTK(token []byte) ([]byte, error) {
 	}
 	return token, nil
 }
+
+// cryptoStreamLimiter limits the data read from the crypto stream for a single handshake message.
+// This prevents a peer from using up memory with a huge partial handshake message.
+type cryptoStreamLimiter struct {
+	r         utils.ReadStream
+	remaining protocol.ByteCount
+}
+
+func (l *cryptoStreamLimiter) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.remaining == 0 {
+		return 0, errHandshakeMessageTooLarge
+	}
+	if protocol.ByteCount(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= protocol.ByteCount(n)
+	return n, err
+}
+
+func (l *cryptoStreamLimiter) ReadByte() (byte, error) {
+	if l.remaining == 0 {
+		return 0, errHandshakeMessageTooLarge
+	}
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.remaining--
+	}
+	return b, err
+}
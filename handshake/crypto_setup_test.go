@@ -2,11 +2,24 @@ package handshake
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
+	"io"
+	"math/big"
 	"net"
+	"time"
 
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -101,7 +114,11 @@ func (s *mockStream) Write(p []byte) (int, error) {
 
 func (s *mockStream) Close() error                       { panic("not implemented") }
 func (mockStream) CloseRemote(offset protocol.ByteCount) { panic("not implemented") }
+func (mockStream) Flush() error                          { panic("not implemented") }
+func (mockStream) SetNoDelay(bool)                       { panic("not implemented") }
+func (mockStream) Reset(uint32)                          { panic("not implemented") }
 func (s mockStream) StreamID() protocol.StreamID         { panic("not implemented") }
+func (mockStream) Stats() utils.StreamStats              { panic("not implemented") }
 
 type mockStkSource struct{}
 
@@ -123,6 +140,53 @@ func (mockStkSource) VerifyToken(ip net.IP, token []byte) error {
 	return nil
 }
 
+// generateCert creates a certificate signed by parent, or a self-signed certificate if parent is nil
+func generateCert(isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.Subject.CommonName = "ca"
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return cert, key
+}
+
+// tickingClock advances by a millisecond every time it is read
+type tickingClock struct {
+	now time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.now = c.now.Add(time.Millisecond)
+	return c.now
+}
+
+func encodeCertificateChain(certs ...*x509.Certificate) []byte {
+	b := &bytes.Buffer{}
+	for _, cert := range certs {
+		utils.WriteUint32(b, uint32(len(cert.Raw)))
+		b.Write(cert.Raw)
+	}
+	return b.Bytes()
+}
+
 var _ = Describe("Crypto setup", func() {
 	var (
 		kex         *mockKEX
@@ -135,6 +199,7 @@ var _ = Describe("Crypto setup", func() {
 		nonce32     []byte
 		ip          net.IP
 		validSTK    []byte
+		validSNO    []byte
 	)
 
 	BeforeEach(func() {
@@ -143,20 +208,23 @@ var _ = Describe("Crypto setup", func() {
 		validSTK, err = mockStkSource{}.NewToken(ip)
 		Expect(err).NotTo(HaveOccurred())
 		nonce32 = make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce32, uint32(time.Now().Unix()))
 		expectedInitialNonceLen = 32
 		expectedFSNonceLen = 64
 		aeadChanged = make(chan struct{}, 1)
 		stream = &mockStream{}
 		kex = &mockKEX{}
 		signer = &mockSigner{}
-		scfg, err = NewServerConfig(kex, signer)
+		scfg, err = NewServerConfig(kex, signer, nil, nil)
 		Expect(err).NotTo(HaveOccurred())
 		scfg.stkSource = &mockStkSource{}
+		validSNO, err = scfg.newServerNonce(time.Now())
+		Expect(err).NotTo(HaveOccurred())
 		v := protocol.SupportedVersions[len(protocol.SupportedVersions)-1]
 		cpm = NewConnectionParamatersManager()
-		cs, err = NewCryptoSetup(protocol.ConnectionID(42), ip, v, scfg, stream, cpm, aeadChanged)
+		cs, err = NewCryptoSetup(protocol.ConnectionID(42), ip, v, scfg, stream, cpm, aeadChanged, congestion.DefaultClock{})
 		Expect(err).NotTo(HaveOccurred())
-		cs.keyDerivation = mockKeyDerivation
+		cs.keyDerivations = map[Tag]KeyDerivationFunction{TagCC20: mockKeyDerivation, TagA256: crypto.DeriveKeysAESGCM256}
 		cs.keyExchange = func() (crypto.KeyExchange, error) { return &mockKEX{ephermal: true}, nil }
 	})
 
@@ -169,6 +237,12 @@ var _ = Describe("Crypto setup", func() {
 		Expect(s).ToNot(BeZero())
 	})
 
+	It("reports if a forward-secure packet was received", func() {
+		Expect(cs.ReceivedForwardSecurePacket()).To(BeFalse())
+		cs.receivedForwardSecurePacket = true
+		Expect(cs.ReceivedForwardSecurePacket()).To(BeTrue())
+	})
+
 	Context("diversification nonce", func() {
 		BeforeEach(func() {
 			cs.version = 33
@@ -213,6 +287,29 @@ var _ = Describe("Crypto setup", func() {
 			Expect(signer.gotCHLO).To(BeFalse())
 		})
 
+		It("sends the stateless reset token in the SHLO", func() {
+			response, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[TagSRST]).To(Equal(cs.scfg.StatelessResetToken(cs.connID)))
+		})
+
+		It("announces the configured versions in the SHLO", func() {
+			cs.SetSupportedVersions([]protocol.VersionNumber{31, 30})
+			response, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[TagVER]).To(Equal([]byte("Q031Q030")))
+		})
+
 		It("generates SHLO messages", func() {
 			response, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
 				TagPUBS: []byte("pubs-c"),
@@ -231,6 +328,107 @@ var _ = Describe("Crypto setup", func() {
 			Expect(cs.forwardSecureAEAD.(*mockAEAD).forwardSecure).To(BeTrue())
 		})
 
+		Context("negotiating the AEAD and KEX", func() {
+			BeforeEach(func() {
+				scfg.aeads = []Tag{TagCC20, TagA256}
+			})
+
+			It("uses the AEAD preferred by the client", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagAEAD: []byte("A256"),
+					TagKEXS: []byte("C255"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.secureAEAD).ToNot(BeAssignableToTypeOf(&mockAEAD{}))
+				expected, err := crypto.DeriveKeysAESGCM256(cs.version, false, []byte("shared key"), nonce32, 42, []byte("chlo-data"), scfg.Get(), []byte("certuncompressed"), cs.diversificationNonce)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.secureAEAD.Seal(10, []byte("aad"), []byte("foobar"))).To(Equal(expected.Seal(10, []byte("aad"), []byte("foobar"))))
+				// the forward-secure AEAD is the same as the initial one, if the client doesn't choose a different one
+				Expect(cs.forwardSecureAEAD).ToNot(BeAssignableToTypeOf(&mockAEAD{}))
+			})
+
+			It("uses the server's preferred AEAD if the client doesn't choose one", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.secureAEAD).To(BeAssignableToTypeOf(&mockAEAD{}))
+			})
+
+			It("rejects CHLOs without a mutually supported AEAD", func() {
+				scfg.aeads = []Tag{TagCC20}
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagAEAD: []byte("A256"),
+				})
+				Expect(err).To(MatchError(qerr.CryptoNoSupport))
+				Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagAEAD)))
+			})
+
+			It("rejects CHLOs without a mutually supported KEX", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagKEXS: []byte("P256"),
+				})
+				Expect(err).To(MatchError(qerr.CryptoNoSupport))
+				Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagKEXS)))
+			})
+		})
+
+		Context("choosing the forward-secure AEAD", func() {
+			BeforeEach(func() {
+				err := scfg.SetForwardSecureAEADs(TagA256)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("uses a different AEAD for forward-secure packets", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagFSAE: []byte("A256"),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.secureAEAD).To(BeAssignableToTypeOf(&mockAEAD{}))
+				Expect(cs.forwardSecureAEAD).ToNot(BeAssignableToTypeOf(&mockAEAD{}))
+				expected, err := crypto.DeriveKeysAESGCM256(cs.version, true, []byte("shared ephermal"), append(nonce32, cs.nonce...), 42, []byte("chlo-data"), scfg.Get(), []byte("certuncompressed"), nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.forwardSecureAEAD.Seal(10, []byte("aad"), []byte("foobar"))).To(Equal(expected.Seal(10, []byte("aad"), []byte("foobar"))))
+			})
+
+			It("uses the initial AEAD if the client doesn't choose one", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.forwardSecureAEAD.(*mockAEAD).forwardSecure).To(BeTrue())
+			})
+
+			It("rejects AEADs that were not offered", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagFSAE: []byte("CC20"),
+				})
+				Expect(err).To(MatchError(qerr.CryptoNoSupport))
+				Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagFSAE)))
+			})
+
+			It("rejects malformed AEAD tags", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+					TagPUBS: []byte("pubs-c"),
+					TagNONC: nonce32,
+					TagFSAE: []byte("A2"),
+				})
+				Expect(err).To(MatchError(qerr.CryptoInvalidValueLength))
+			})
+		})
+
 		It("handles long handshake", func() {
 			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
 				TagSNI: []byte("quic.clemente.io"),
@@ -238,11 +436,13 @@ var _ = Describe("Crypto setup", func() {
 				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
 			})
 			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
-				TagSCID: scfg.ID,
+				TagSCID: scfg.ID(),
 				TagSNI:  []byte("quic.clemente.io"),
 				TagNONC: nonce32,
+				TagSNO:  validSNO,
 				TagSTK:  validSTK,
 			})
+			expectedInitialNonceLen = 32 + protocol.ServerNonceLen
 			err := cs.HandleCryptoStream()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
@@ -250,9 +450,59 @@ var _ = Describe("Crypto setup", func() {
 			Expect(aeadChanged).To(Receive())
 		})
 
+		It("requires the server nonce in a long handshake", func() {
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagSTK: validSTK,
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSTK:  validSTK,
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(errServerNonceMissing))
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(aeadChanged).ToNot(Receive())
+		})
+
+		It("sends the TTL of the server config in the REJ", func() {
+			response, err := cs.handleInchoateCHLO("", sampleCHLO, nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, rej, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rej).To(HaveKey(TagSTTL))
+			ttl := time.Duration(binary.LittleEndian.Uint64(rej[TagSTTL])) * time.Second
+			Expect(ttl).To(BeNumerically("~", protocol.ServerConfigTTL, time.Minute))
+		})
+
+		It("doesn't accept an expired server config for a 0-RTT handshake", func() {
+			expiredID := scfg.ID()
+			scfg.expiry = time.Now().Add(-time.Second)
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: expiredID,
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(io.EOF)) // the client didn't send another CHLO
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(aeadChanged).ToNot(Receive())
+			// the REJ contains a renewed server config
+			Expect(scfg.ID()).ToNot(Equal(expiredID))
+			Expect(scfg.expired(time.Now())).To(BeFalse())
+			Expect(cs.isInchoateCHLO(map[Tag][]byte{TagSCID: expiredID})).To(BeTrue())
+		})
+
 		It("handles 0-RTT handshake", func() {
 			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
-				TagSCID: scfg.ID,
+				TagSCID: scfg.ID(),
 				TagSNI:  []byte("quic.clemente.io"),
 				TagNONC: nonce32,
 				TagSTK:  validSTK,
@@ -264,17 +514,71 @@ var _ = Describe("Crypto setup", func() {
 			Expect(aeadChanged).To(Receive())
 		})
 
+		It("records when the REJ and the SHLO were sent", func() {
+			start := time.Now()
+			cs.clock = &tickingClock{now: start}
+			rejSent, shloSent := cs.HandshakeTimes()
+			Expect(rejSent.IsZero()).To(BeTrue())
+			Expect(shloSent.IsZero()).To(BeTrue())
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagSTK: validSTK,
+				TagPAD: bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSNO:  validSNO,
+				TagSTK:  validSTK,
+			})
+			expectedInitialNonceLen = 32 + protocol.ServerNonceLen
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			rejSent, shloSent = cs.HandshakeTimes()
+			Expect(rejSent).To(Equal(start.Add(time.Millisecond)))
+			Expect(shloSent).To(Equal(start.Add(2 * time.Millisecond)))
+		})
+
+		It("doesn't record a REJ for a 0-RTT handshake", func() {
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSTK:  validSTK,
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			rejSent, shloSent := cs.HandshakeTimes()
+			Expect(rejSent.IsZero()).To(BeTrue())
+			Expect(shloSent.IsZero()).To(BeFalse())
+		})
+
+		It("remembers the SNI", func() {
+			Expect(cs.ServerName()).To(BeEmpty())
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSTK:  validSTK,
+			})
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cs.ServerName()).To(Equal("quic.clemente.io"))
+		})
+
 		It("recognizes inchoate CHLOs missing SCID", func() {
 			Expect(cs.isInchoateCHLO(map[Tag][]byte{})).To(BeTrue())
 		})
 
 		It("recognizes proper CHLOs", func() {
-			Expect(cs.isInchoateCHLO(map[Tag][]byte{TagSCID: scfg.ID})).To(BeFalse())
+			Expect(cs.isInchoateCHLO(map[Tag][]byte{TagSCID: scfg.ID()})).To(BeFalse())
 		})
 
 		It("errors on too short inchoate CHLOs", func() {
 			_, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize-1), nil)
 			Expect(err).To(MatchError("CryptoInvalidValueLength: CHLO too small"))
+			Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagCHLO)))
 		})
 	})
 
@@ -284,6 +588,198 @@ var _ = Describe("Crypto setup", func() {
 		})
 		err := cs.HandleCryptoStream()
 		Expect(err).To(MatchError("CryptoMessageParameterNotFound: SNI required"))
+		Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagSNI)))
+	})
+
+	It("errors with an empty SNI", func() {
+		WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+			TagSNI: []byte(""),
+			TagSTK: validSTK,
+		})
+		err := cs.HandleCryptoStream()
+		Expect(err).To(MatchError("CryptoMessageParameterNotFound: SNI required"))
+		Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagSNI)))
+	})
+
+	It("errors on messages other than CHLOs", func() {
+		WriteHandshakeMessage(&stream.dataToRead, TagSHLO, map[Tag][]byte{
+			TagSNI: []byte("quic.clemente.io"),
+		})
+		err := cs.HandleCryptoStream()
+		Expect(err).To(MatchError(qerr.InvalidCryptoMessageType))
+		Expect(err.(*qerr.CryptoError).TagString()).To(Equal("SHLO"))
+	})
+
+	Context("limiting the buffered crypto stream data", func() {
+		It("uses the default limit", func() {
+			Expect(cs.maxCryptoStreamData).To(Equal(protocol.DefaultMaxCryptoStreamData))
+		})
+
+		It("errors when a partial handshake message exceeds the limit", func() {
+			cs.SetMaxCryptoStreamData(1000)
+			b := &bytes.Buffer{}
+			WriteHandshakeMessage(b, TagCHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+				TagPAD: bytes.Repeat([]byte{'-'}, 1800),
+			})
+			// only the first part of the message arrived
+			stream.dataToRead.Write(b.Bytes()[:1200])
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(errHandshakeMessageTooLarge))
+			Expect(err.(*qerr.CryptoError).ErrorCode).To(Equal(qerr.CryptoInvalidValueLength))
+		})
+
+		It("reads messages up to the limit", func() {
+			WriteHandshakeMessage(&stream.dataToRead, TagSHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+			})
+			cs.SetMaxCryptoStreamData(protocol.ByteCount(stream.dataToRead.Len()))
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(qerr.InvalidCryptoMessageType))
+		})
+
+		It("errors when a message is 1 byte too large", func() {
+			WriteHandshakeMessage(&stream.dataToRead, TagSHLO, map[Tag][]byte{
+				TagSNI: []byte("quic.clemente.io"),
+			})
+			cs.SetMaxCryptoStreamData(protocol.ByteCount(stream.dataToRead.Len() - 1))
+			err := cs.HandleCryptoStream()
+			Expect(err).To(MatchError(errHandshakeMessageTooLarge))
+		})
+	})
+
+	Context("replay protection", func() {
+		It("rejects a replayed NONC", func() {
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).To(MatchError(errClientNonceNotUnique))
+			Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagNONC)))
+		})
+
+		It("doesn't register the NONC of an invalid CHLO", func() {
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagAEAD: []byte("foo")})
+			Expect(err).To(HaveOccurred())
+			_, err = cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a NONC replayed on a different connection", func() {
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+			cs2, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, &mockStream{}, NewConnectionParamatersManager(), make(chan struct{}, 1), congestion.DefaultClock{})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cs2.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).To(MatchError(errClientNonceNotUnique))
+		})
+
+		It("sends a REJ for a replayed CHLO, forcing a full handshake", func() {
+			chlo := map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			}
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, chlo)
+			err := cs.HandleCryptoStream()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("SHLO"))
+			Expect(aeadChanged).To(Receive())
+
+			stream2 := &mockStream{}
+			cs2, err := NewCryptoSetup(protocol.ConnectionID(43), ip, cs.version, scfg, stream2, NewConnectionParamatersManager(), aeadChanged, congestion.DefaultClock{})
+			Expect(err).ToNot(HaveOccurred())
+			cs2.keyDerivations = cs.keyDerivations
+			cs2.keyExchange = cs.keyExchange
+			WriteHandshakeMessage(&stream2.dataToRead, TagCHLO, chlo)
+			err = cs2.HandleCryptoStream()
+			Expect(err).To(HaveOccurred()) // the mock stream returns an EOF after the REJ
+			Expect(stream2.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream2.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(aeadChanged).ToNot(Receive())
+		})
+
+		It("includes a server nonce in the REJ", func() {
+			response, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(response))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveKey(TagSNO))
+			Expect(scfg.verifyServerNonce(data[TagSNO], time.Now())).To(Succeed())
+		})
+
+		It("accepts a CHLO echoing a valid server nonce", func() {
+			expectedInitialNonceLen = 32 + protocol.ServerNonceLen
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagSNO: validSNO})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("accepts a CHLO without a server nonce for a 0-RTT handshake", func() {
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a CHLO without a server nonce after a REJ", func() {
+			_, err := cs.handleInchoateCHLO("", bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize), nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).To(MatchError(errServerNonceMissing))
+		})
+
+		It("derives the initial keys from the client and the server nonce", func() {
+			scfg.aeads = []Tag{TagA256}
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagSNO:  validSNO,
+				TagAEAD: []byte("A256"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			derive := func(nonces []byte) crypto.AEAD {
+				aead, err := crypto.DeriveKeysAESGCM256(cs.version, false, []byte("shared key"), nonces, cs.connID, []byte("chlo-data"), scfg.Get(), []byte("certuncompressed"), cs.diversificationNonce)
+				Expect(err).ToNot(HaveOccurred())
+				return aead
+			}
+			sealed := cs.secureAEAD.Seal(1, []byte("ad"), []byte("foobar"))
+			Expect(derive(append(append([]byte{}, nonce32...), validSNO...)).Seal(1, []byte("ad"), []byte("foobar"))).To(Equal(sealed))
+			Expect(derive(nonce32).Seal(1, []byte("ad"), []byte("foobar"))).ToNot(Equal(sealed))
+		})
+
+		It("rejects a CHLO with a stale server nonce", func() {
+			staleSNO, err := scfg.newServerNonce(time.Now().Add(-protocol.ServerNonceLifetime - time.Second))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32, TagSNO: staleSNO})
+			Expect(err).To(MatchError(errServerNonceInvalid))
+		})
+
+		It("sends a REJ with a fresh server nonce for a CHLO with a stale server nonce", func() {
+			staleSNO, err := scfg.newServerNonce(time.Now().Add(-protocol.ServerNonceLifetime - time.Second))
+			Expect(err).ToNot(HaveOccurred())
+			WriteHandshakeMessage(&stream.dataToRead, TagCHLO, map[Tag][]byte{
+				TagSCID: scfg.ID(),
+				TagSNI:  []byte("quic.clemente.io"),
+				TagNONC: nonce32,
+				TagSNO:  staleSNO,
+				TagSTK:  validSTK,
+				TagPAD:  bytes.Repeat([]byte{'a'}, protocol.ClientHelloMinimumSize),
+			})
+			err = cs.HandleCryptoStream()
+			Expect(err).To(HaveOccurred()) // the mock stream returns an EOF after the REJ
+			Expect(stream.dataWritten.Bytes()).To(HavePrefix("REJ"))
+			Expect(stream.dataWritten.Bytes()).ToNot(ContainSubstring("SHLO"))
+			Expect(aeadChanged).ToNot(Receive())
+		})
+
+		It("uses the StrikeRegister set on the server config", func() {
+			scfg.SetStrikeRegister(NewMemoryStrikeRegister(time.Hour))
+			_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(aeadChanged).To(Receive())
+			scfg.SetStrikeRegister(NewMemoryStrikeRegister(time.Hour))
+			_, err = cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+			Expect(err).ToNot(HaveOccurred())
+		})
 	})
 
 	Context("escalating crypto", func() {
@@ -400,4 +896,128 @@ var _ = Describe("Crypto setup", func() {
 			Expect(stream.dataWritten.Bytes()).To(ContainSubstring(string(validSTK)))
 		})
 	})
+	Context("client authentication", func() {
+		var (
+			ca         *x509.Certificate
+			clientCert *x509.Certificate
+			clientKey  *ecdsa.PrivateKey
+			clientCAs  *x509.CertPool
+		)
+
+		BeforeEach(func() {
+			var caKey *ecdsa.PrivateKey
+			ca, caKey = generateCert(true, nil, nil)
+			clientCert, clientKey = generateCert(false, ca, caKey)
+			clientCAs = x509.NewCertPool()
+			clientCAs.AddCert(ca)
+		})
+
+		chloWithCert := func(cert *x509.Certificate, key *ecdsa.PrivateKey) map[Tag][]byte {
+			proof, err := crypto.SignClientProof(key, scfg.ID(), nonce32, []byte("pubs-c"))
+			Expect(err).ToNot(HaveOccurred())
+			return map[Tag][]byte{
+				TagPUBS: []byte("pubs-c"),
+				TagNONC: nonce32,
+				TagCCHN: encodeCertificateChain(cert),
+				TagCPRF: proof,
+			}
+		}
+
+		It("ignores client certificates if client auth is disabled", func() {
+			_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(clientCert, clientKey))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.PeerCertificates()).To(BeNil())
+		})
+
+		Context("requiring a client certificate", func() {
+			BeforeEach(func() {
+				scfg.SetClientAuth(tls.RequireAndVerifyClientCert, clientCAs)
+			})
+
+			It("accepts a trusted client certificate", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(clientCert, clientKey))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(aeadChanged).To(Receive())
+				Expect(cs.PeerCertificates()).To(HaveLen(1))
+				Expect(cs.PeerCertificates()[0].Subject.CommonName).To(Equal("client"))
+			})
+
+			It("accepts a chain with an intermediate", func() {
+				root, rootKey := generateCert(true, nil, nil)
+				intermediate, intermediateKey := generateCert(true, root, rootKey)
+				cert, key := generateCert(false, intermediate, intermediateKey)
+				clientCAs.AddCert(root)
+				chlo := chloWithCert(cert, key)
+				chlo[TagCCHN] = encodeCertificateChain(cert, intermediate)
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.PeerCertificates()).To(Equal([]*x509.Certificate{cert, intermediate}))
+			})
+
+			It("rejects a missing client certificate", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+				Expect(err).To(MatchError(errClientCertRequired))
+				Expect(aeadChanged).ToNot(Receive())
+			})
+
+			It("rejects an untrusted client certificate", func() {
+				selfSigned, key := generateCert(false, nil, nil)
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(selfSigned, key))
+				Expect(err).To(MatchError(errUntrustedClientCert))
+				Expect(cs.PeerCertificates()).To(BeNil())
+			})
+
+			It("rejects an invalid client proof", func() {
+				chlo := chloWithCert(clientCert, clientKey)
+				chlo[TagPUBS] = []byte("other pubs")
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+				Expect(err).To(MatchError(errInvalidClientProof))
+			})
+
+			It("rejects a proof made with a different key", func() {
+				_, otherKey := generateCert(false, nil, nil)
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(clientCert, otherKey))
+				Expect(err).To(MatchError(errInvalidClientProof))
+			})
+
+			It("rejects a malformed certificate chain", func() {
+				chlo := chloWithCert(clientCert, clientKey)
+				chlo[TagCCHN] = chlo[TagCCHN][:len(chlo[TagCCHN])-1]
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chlo)
+				Expect(err).To(MatchError(errMalformedClientCert))
+			})
+		})
+
+		Context("with optional client certificates", func() {
+			BeforeEach(func() {
+				scfg.SetClientAuth(tls.VerifyClientCertIfGiven, clientCAs)
+			})
+
+			It("accepts a trusted client certificate", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(clientCert, clientKey))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.PeerCertificates()).To(Equal([]*x509.Certificate{clientCert}))
+			})
+
+			It("accepts a CHLO without a client certificate", func() {
+				_, err := cs.handleCHLO("", []byte("chlo-data"), map[Tag][]byte{TagPUBS: []byte("pubs-c"), TagNONC: nonce32})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cs.PeerCertificates()).To(BeNil())
+			})
+
+			It("rejects an untrusted client certificate", func() {
+				selfSigned, key := generateCert(false, nil, nil)
+				_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(selfSigned, key))
+				Expect(err).To(MatchError(errUntrustedClientCert))
+			})
+		})
+
+		It("accepts any client certificate with a valid proof if it isn't verified", func() {
+			scfg.SetClientAuth(tls.RequireAnyClientCert, nil)
+			selfSigned, key := generateCert(false, nil, nil)
+			_, err := cs.handleCHLO("", []byte("chlo-data"), chloWithCert(selfSigned, key))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cs.PeerCertificates()).To(Equal([]*x509.Certificate{selfSigned}))
+		})
+	})
 })
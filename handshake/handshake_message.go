@@ -12,8 +12,27 @@ import (
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
+// A TagValue is a single entry of a crypto message
+type TagValue struct {
+	Tag   Tag
+	Value []byte
+}
+
 // ParseHandshakeMessage reads a crypto message
 func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
+	messageTag, entries, err := ParseHandshakeMessageOrdered(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	resultMap := make(map[Tag][]byte, len(entries))
+	for _, e := range entries {
+		resultMap[e.Tag] = e.Value
+	}
+	return messageTag, resultMap, nil
+}
+
+// ParseHandshakeMessageOrdered reads a crypto message, keeping the entries in the order they appear in the message
+func ParseHandshakeMessageOrdered(r utils.ReadStream) (Tag, []TagValue, error) {
 	messageTag, err := utils.ReadUint32(r)
 	if err != nil {
 		return 0, nil, err
@@ -34,7 +53,7 @@ func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
 		return 0, nil, err
 	}
 
-	resultMap := map[Tag][]byte{}
+	entries := make([]TagValue, 0, nPairs)
 
 	var dataStart uint32
 	for indexPos := 0; indexPos < int(nPairs)*8; indexPos += 8 {
@@ -52,25 +71,15 @@ func ParseHandshakeMessage(r utils.ReadStream) (Tag, map[Tag][]byte, error) {
 			return 0, nil, err
 		}
 
-		resultMap[tag] = data
+		entries = append(entries, TagValue{Tag: tag, Value: data})
 		dataStart = dataEnd
 	}
 
-	return Tag(messageTag), resultMap, nil
+	return Tag(messageTag), entries, nil
 }
 
-// WriteHandshakeMessage writes a crypto message
+// WriteHandshakeMessage writes a crypto message, with the tags sorted
 func WriteHandshakeMessage(b *bytes.Buffer, messageTag Tag, data map[Tag][]byte) {
-	utils.WriteUint32(b, uint32(messageTag))
-	utils.WriteUint16(b, uint16(len(data)))
-	utils.WriteUint16(b, 0)
-
-	// Save current position in the buffer, so that we can update the index in-place later
-	indexStart := b.Len()
-
-	indexData := make([]byte, 8*len(data))
-	b.Write(indexData) // Will be updated later
-
 	// Sort the tags
 	tags := make([]uint32, len(data))
 	i := 0
@@ -80,12 +89,30 @@ func WriteHandshakeMessage(b *bytes.Buffer, messageTag Tag, data map[Tag][]byte)
 	}
 	sort.Sort(utils.Uint32Slice(tags))
 
-	offset := uint32(0)
+	entries := make([]TagValue, len(tags))
 	for i, t := range tags {
-		v := data[Tag(t)]
-		b.Write(v)
-		offset += uint32(len(v))
-		binary.LittleEndian.PutUint32(indexData[i*8:], t)
+		entries[i] = TagValue{Tag: Tag(t), Value: data[Tag(t)]}
+	}
+	WriteHandshakeMessageOrdered(b, messageTag, entries)
+}
+
+// WriteHandshakeMessageOrdered writes a crypto message, with the entries in the given order
+func WriteHandshakeMessageOrdered(b *bytes.Buffer, messageTag Tag, entries []TagValue) {
+	utils.WriteUint32(b, uint32(messageTag))
+	utils.WriteUint16(b, uint16(len(entries)))
+	utils.WriteUint16(b, 0)
+
+	// Save current position in the buffer, so that we can update the index in-place later
+	indexStart := b.Len()
+
+	indexData := make([]byte, 8*len(entries))
+	b.Write(indexData) // Will be updated later
+
+	offset := uint32(0)
+	for i, e := range entries {
+		b.Write(e.Value)
+		offset += uint32(len(e.Value))
+		binary.LittleEndian.PutUint32(indexData[i*8:], uint32(e.Tag))
 		binary.LittleEndian.PutUint32(indexData[i*8+4:], offset)
 	}
 
@@ -17,6 +17,19 @@ var _ = Describe("Handshake Message", func() {
 			Expect(msg).To(Equal(sampleCHLOMap))
 		})
 
+		It("parses sample CHLO message in order", func() {
+			tag, entries, err := ParseHandshakeMessageOrdered(bytes.NewReader(sampleCHLO))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag).To(Equal(TagCHLO))
+			Expect(entries).To(HaveLen(len(sampleCHLOMap)))
+			for i, e := range entries {
+				Expect(e.Value).To(Equal(sampleCHLOMap[e.Tag]))
+				if i > 0 {
+					Expect(e.Tag).To(BeNumerically(">", entries[i-1].Tag))
+				}
+			}
+		})
+
 		It("rejects large numbers of pairs", func() {
 			r := bytes.NewReader([]byte("CHLO\xff\xff\xff\xff"))
 			_, _, err := ParseHandshakeMessage(r)
@@ -41,5 +54,27 @@ var _ = Describe("Handshake Message", func() {
 			WriteHandshakeMessage(b, TagCHLO, sampleCHLOMap)
 			Expect(b.Bytes()).To(Equal(sampleCHLO))
 		})
+
+		It("reproduces the original message after parsing", func() {
+			tag, entries, err := ParseHandshakeMessageOrdered(bytes.NewReader(sampleCHLO))
+			Expect(err).ToNot(HaveOccurred())
+			b := &bytes.Buffer{}
+			WriteHandshakeMessageOrdered(b, tag, entries)
+			Expect(b.Bytes()).To(Equal(sampleCHLO))
+		})
+
+		It("keeps the order of the entries", func() {
+			entries := []TagValue{
+				{Tag: TagSNI, Value: []byte("foo")},
+				{Tag: TagAEAD, Value: []byte("AESG")},
+				{Tag: TagPAD, Value: []byte{}},
+			}
+			b := &bytes.Buffer{}
+			WriteHandshakeMessageOrdered(b, TagCHLO, entries)
+			tag, parsed, err := ParseHandshakeMessageOrdered(bytes.NewReader(b.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag).To(Equal(TagCHLO))
+			Expect(parsed).To(Equal(entries))
+		})
 	})
 })
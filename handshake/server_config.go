@@ -2,22 +2,86 @@ package handshake
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 )
 
 // ServerConfig is a server config
 type ServerConfig struct {
 	kex       crypto.KeyExchange
 	signer    crypto.Signer
-	ID        []byte
+	id        []byte
+	expiry    time.Time // when the server config expires, it is renewed with a new ID
 	stkSource crypto.StkSource
+	mutex     sync.RWMutex // protects id and expiry
+
+	strikeRegister StrikeRegister
+
+	aeads              []Tag
+	kexs               []Tag
+	forwardSecureAEADs []Tag
+
+	statelessResetKey []byte
+	serverNonceKey    []byte
+
+	clientAuth tls.ClientAuthType
+	clientCAs  *x509.CertPool
 }
 
-// NewServerConfig creates a new server config
-func NewServerConfig(kex crypto.KeyExchange, signer crypto.Signer) (*ServerConfig, error) {
+var (
+	errUnsupportedAEAD = errors.New("ServerConfig: unsupported AEAD")
+	errUnsupportedKEX  = errors.New("ServerConfig: unsupported KEX")
+	errNoSigner        = errors.New("ServerConfig: no signer")
+)
+
+// defaultAEADs and defaultKEXs are offered if NewServerConfig is called without a list
+var (
+	defaultAEADs = []Tag{TagCC20}
+	defaultKEXs  = []Tag{TagC255}
+)
+
+var (
+	errMalformedServerNonce = errors.New("ServerConfig: malformed server nonce")
+	errInvalidServerNonce   = errors.New("ServerConfig: invalid server nonce")
+	errExpiredServerNonce   = errors.New("ServerConfig: server nonce expired")
+)
+
+// serverNonceMACLen is the length of the MAC at the end of a server nonce
+const serverNonceMACLen = 16
+
+// NewServerConfig creates a new server config.
+// aeads and kexs are the AEADs and KEXs offered to clients, in order of preference. If empty, the defaults are used.
+// Since only a single KeyExchange is passed, kexs may currently only contain TagC255.
+func NewServerConfig(kex crypto.KeyExchange, signer crypto.Signer, aeads, kexs []Tag) (*ServerConfig, error) {
+	if len(aeads) == 0 {
+		aeads = defaultAEADs
+	}
+	for _, aead := range aeads {
+		if _, ok := keyDerivations[aead]; !ok {
+			return nil, errUnsupportedAEAD
+		}
+	}
+	if len(kexs) == 0 {
+		kexs = defaultKEXs
+	}
+	for _, k := range kexs {
+		if _, ok := keyExchanges[k]; !ok {
+			return nil, errUnsupportedKEX
+		}
+	}
+
 	id := make([]byte, 16)
 	_, err := io.ReadFull(rand.Reader, id)
 	if err != nil {
@@ -33,29 +97,256 @@ func NewServerConfig(kex crypto.KeyExchange, signer crypto.Signer) (*ServerConfi
 		return nil, err
 	}
 
+	statelessResetKey := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, statelessResetKey); err != nil {
+		return nil, err
+	}
+
+	serverNonceKey := make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, serverNonceKey); err != nil {
+		return nil, err
+	}
+
 	return &ServerConfig{
 		kex:       kex,
 		signer:    signer,
-		ID:        id,
+		id:        id,
+		expiry:    time.Now().Add(protocol.ServerConfigTTL),
 		stkSource: stkSource,
+
+		aeads: aeads,
+		kexs:  kexs,
+
+		strikeRegister: NewMemoryStrikeRegister(protocol.StrikeRegisterWindow),
+
+		statelessResetKey: statelessResetKey,
+		serverNonceKey:    serverNonceKey,
 	}, nil
 }
 
+// ID returns the ID of the current server config. It changes when an expired server config is renewed.
+func (s *ServerConfig) ID() []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.id
+}
+
+// Expiry returns the time the server config expires
+func (s *ServerConfig) Expiry() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.expiry
+}
+
+// expired checks if the server config may not be used for 0-RTT handshakes anymore
+func (s *ServerConfig) expired(now time.Time) bool {
+	return !now.Before(s.Expiry())
+}
+
+// renewIfExpired replaces an expired server config by one with a new ID and expiry.
+// Clients that cached the old server config can't use it for 0-RTT anymore, since its ID isn't accepted.
+func (s *ServerConfig) renewIfExpired(now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Before(s.expiry) {
+		return nil
+	}
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return err
+	}
+	s.id = id
+	s.expiry = now.Add(protocol.ServerConfigTTL)
+	return nil
+}
+
+// ttl returns the remaining lifetime of the server config in seconds, as sent in the STTL tag
+func (s *ServerConfig) ttl(now time.Time) []byte {
+	ttl := s.Expiry().Sub(now)
+	if ttl < 0 {
+		ttl = 0
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(ttl/time.Second))
+	return b
+}
+
+// SetStrikeRegister sets the StrikeRegister used to detect replayed CHLOs
+func (s *ServerConfig) SetStrikeRegister(r StrikeRegister) {
+	s.strikeRegister = r
+}
+
+// SetForwardSecureAEADs sets the AEADs offered for forward-secure packets, in order of preference.
+// If none are set, the forward-secure packets use the same AEAD as the initial packets.
+func (s *ServerConfig) SetForwardSecureAEADs(aeads ...Tag) error {
+	for _, aead := range aeads {
+		if _, ok := keyDerivations[aead]; !ok {
+			return errUnsupportedAEAD
+		}
+	}
+	s.forwardSecureAEADs = aeads
+	return nil
+}
+
+// SetClientAuth sets the policy for client certificates, with the same semantics as in crypto/tls.
+// Certificates are verified against clientCAs for tls.VerifyClientCertIfGiven and tls.RequireAndVerifyClientCert.
+func (s *ServerConfig) SetClientAuth(clientAuth tls.ClientAuthType, clientCAs *x509.CertPool) {
+	s.clientAuth = clientAuth
+	s.clientCAs = clientCAs
+}
+
+func (s *ServerConfig) requiresClientCert() bool {
+	return s.clientAuth == tls.RequireAnyClientCert || s.clientAuth == tls.RequireAndVerifyClientCert
+}
+
+func (s *ServerConfig) verifiesClientCert() bool {
+	return s.clientAuth == tls.VerifyClientCertIfGiven || s.clientAuth == tls.RequireAndVerifyClientCert
+}
+
+func (s *ServerConfig) offersForwardSecureAEAD(aead Tag) bool {
+	for _, a := range s.forwardSecureAEADs {
+		if a == aead {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAEAD picks the AEAD for a CHLO, see selectTag
+func (s *ServerConfig) selectAEAD(clientAEADs []byte) (Tag, error) {
+	return selectTag(TagAEAD, clientAEADs, s.aeads)
+}
+
+// selectKEX picks the KEX for a CHLO, see selectTag
+func (s *ServerConfig) selectKEX(clientKEXs []byte) (Tag, error) {
+	return selectTag(TagKEXS, clientKEXs, s.kexs)
+}
+
+// selectTag returns the first of the client's tags, in order of the client's preference, that the server offers.
+// If the client doesn't send any tags, the server's most preferred tag is used.
+func selectTag(tag Tag, clientTags []byte, offered []Tag) (Tag, error) {
+	if clientTags == nil {
+		return offered[0], nil
+	}
+	if len(clientTags) == 0 || len(clientTags)%4 != 0 {
+		return 0, qerr.CryptoErrorWithTag(qerr.CryptoInvalidValueLength, uint32(tag), "invalid tag list")
+	}
+	for i := 0; i < len(clientTags); i += 4 {
+		t := Tag(binary.LittleEndian.Uint32(clientTags[i:]))
+		for _, o := range offered {
+			if t == o {
+				return t, nil
+			}
+		}
+	}
+	return 0, qerr.CryptoErrorWithTag(qerr.CryptoNoSupport, uint32(tag), "no mutually supported algorithm")
+}
+
+// encodeTags concatenates a list of tags, as used for TagAEAD and TagKEXS
+func encodeTags(tags []Tag) []byte {
+	b := make([]byte, 4*len(tags))
+	for i, t := range tags {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(t))
+	}
+	return b
+}
+
+// StatelessResetToken derives the stateless reset token for a connection ID.
+// The same token is derived for a connection ID as long as the ServerConfig is used, so that it doesn't have to be stored with the session.
+func (s *ServerConfig) StatelessResetToken(connectionID protocol.ConnectionID) []byte {
+	mac := hmac.New(sha256.New, s.statelessResetKey)
+	connID := make([]byte, 8)
+	binary.LittleEndian.PutUint64(connID, uint64(connectionID))
+	mac.Write(connID)
+	return mac.Sum(nil)[:protocol.StatelessResetTokenLen]
+}
+
+// newServerNonce generates a server nonce for a REJ.
+// It consists of a timestamp, random bytes and a MAC over both, so that it can be verified without storing it.
+func (s *ServerConfig) newServerNonce(now time.Time) ([]byte, error) {
+	sno := make([]byte, protocol.ServerNonceLen)
+	binary.LittleEndian.PutUint32(sno, uint32(now.Unix()))
+	macStart := protocol.ServerNonceLen - serverNonceMACLen
+	if _, err := io.ReadFull(rand.Reader, sno[4:macStart]); err != nil {
+		return nil, err
+	}
+	copy(sno[macStart:], s.serverNonceMAC(sno[:macStart]))
+	return sno, nil
+}
+
+// verifyServerNonce checks that a server nonce was generated by this server config, and that it is not older than protocol.ServerNonceLifetime
+func (s *ServerConfig) verifyServerNonce(sno []byte, now time.Time) error {
+	if len(sno) != protocol.ServerNonceLen {
+		return errMalformedServerNonce
+	}
+	macStart := protocol.ServerNonceLen - serverNonceMACLen
+	if !hmac.Equal(sno[macStart:], s.serverNonceMAC(sno[:macStart])) {
+		return errInvalidServerNonce
+	}
+	age := now.Sub(time.Unix(int64(binary.LittleEndian.Uint32(sno)), 0))
+	if age < 0 || age > protocol.ServerNonceLifetime {
+		return errExpiredServerNonce
+	}
+	return nil
+}
+
+func (s *ServerConfig) serverNonceMAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.serverNonceKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:serverNonceMACLen]
+}
+
 // Get the server config binary representation
 func (s *ServerConfig) Get() []byte {
+	s.mutex.RLock()
+	id := s.id
+	expiry := make([]byte, 8)
+	binary.LittleEndian.PutUint64(expiry, uint64(s.expiry.Unix()))
+	s.mutex.RUnlock()
+
 	var serverConfig bytes.Buffer
-	WriteHandshakeMessage(&serverConfig, TagSCFG, map[Tag][]byte{
-		TagSCID: s.ID,
-		TagKEXS: []byte("C255"),
-		TagAEAD: []byte("CC20"),
+	data := map[Tag][]byte{
+		TagSCID: id,
+		TagKEXS: encodeTags(s.kexs),
+		TagAEAD: encodeTags(s.aeads),
 		TagPUBS: append([]byte{0x20, 0x00, 0x00}, s.kex.PublicKey()...),
 		TagOBIT: {0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7},
-		TagEXPY: {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		TagEXPY: expiry,
 		TagVER:  []byte("Q032"),
-	})
+	}
+	if len(s.forwardSecureAEADs) > 0 {
+		data[TagFSAE] = encodeTags(s.forwardSecureAEADs)
+	}
+	if s.clientAuth != tls.NoClientCert {
+		if s.requiresClientCert() {
+			data[TagCCRQ] = []byte{1}
+		} else {
+			data[TagCCRQ] = []byte{0}
+		}
+	}
+	WriteHandshakeMessage(&serverConfig, TagSCFG, data)
 	return serverConfig.Bytes()
 }
 
+// Validate checks that the signer can provide the certificates and sign the server config, so that a misconfiguration is detected before the first handshake.
+// It uses an empty SNI, i.e. it checks the certificate used for clients that don't send a matching SNI.
+func (s *ServerConfig) Validate() error {
+	if s.signer == nil {
+		return errNoSigner
+	}
+	if _, err := s.signer.GetLeafCert(""); err != nil {
+		return err
+	}
+	if _, err := s.signer.GetCertsCompressed("", nil, nil); err != nil {
+		return err
+	}
+	probe := make([]byte, protocol.ClientHelloMinimumSize)
+	if _, err := s.Sign("", probe); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Sign the server config and CHLO with the server's keyData
 func (s *ServerConfig) Sign(sni string, chlo []byte) ([]byte, error) {
 	return s.signer.SignServerProof(sni, chlo, s.Get())
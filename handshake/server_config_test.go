@@ -2,13 +2,29 @@ package handshake
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+type brokenSigner struct {
+	mockSigner
+	err error
+}
+
+func (s *brokenSigner) SignServerProof(sni string, chlo []byte, serverConfigData []byte) ([]byte, error) {
+	return nil, s.err
+}
+
 var _ = Describe("ServerConfig", func() {
 	var (
 		kex  crypto.KeyExchange
@@ -19,16 +35,265 @@ var _ = Describe("ServerConfig", func() {
 		var err error
 		kex, err = crypto.NewCurve25519KEX()
 		Expect(err).NotTo(HaveOccurred())
-		scfg, err = NewServerConfig(kex, nil)
+		scfg, err = NewServerConfig(kex, nil, nil, nil)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
 	It("gets the proper binary representation", func() {
 		expected := bytes.NewBuffer([]byte{0x53, 0x43, 0x46, 0x47, 0x7, 0x0, 0x0, 0x0, 0x56, 0x45, 0x52, 0x0, 0x4, 0x0, 0x0, 0x0, 0x41, 0x45, 0x41, 0x44, 0x8, 0x0, 0x0, 0x0, 0x53, 0x43, 0x49, 0x44, 0x18, 0x0, 0x0, 0x0, 0x50, 0x55, 0x42, 0x53, 0x3b, 0x0, 0x0, 0x0, 0x4b, 0x45, 0x58, 0x53, 0x3f, 0x0, 0x0, 0x0, 0x4f, 0x42, 0x49, 0x54, 0x47, 0x0, 0x0, 0x0, 0x45, 0x58, 0x50, 0x59, 0x4f, 0x0, 0x0, 0x0, 0x51, 0x30, 0x33, 0x32, 0x43, 0x43, 0x32, 0x30})
-		expected.Write(scfg.ID)
+		expected.Write(scfg.ID())
 		expected.Write([]byte{0x20, 0x0, 0x0})
 		expected.Write(kex.PublicKey())
-		expected.Write([]byte{0x43, 0x32, 0x35, 0x35, 0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		expected.Write([]byte{0x43, 0x32, 0x35, 0x35, 0x0, 0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7})
+		expiry := make([]byte, 8)
+		binary.LittleEndian.PutUint64(expiry, uint64(scfg.Expiry().Unix()))
+		expected.Write(expiry)
 		Expect(scfg.Get()).To(Equal(expected.Bytes()))
 	})
+
+	Context("expiry", func() {
+		It("expires after the TTL", func() {
+			Expect(scfg.Expiry()).To(BeTemporally("~", time.Now().Add(protocol.ServerConfigTTL), time.Second))
+			Expect(scfg.expired(time.Now())).To(BeFalse())
+			Expect(scfg.expired(scfg.Expiry())).To(BeTrue())
+		})
+
+		It("sends the expiry in the EXPY tag", func() {
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(HaveKeyWithValue(TagEXPY, HaveLen(8)))
+			Expect(int64(binary.LittleEndian.Uint64(data[TagEXPY]))).To(Equal(scfg.Expiry().Unix()))
+		})
+
+		It("calculates the TTL", func() {
+			ttl := binary.LittleEndian.Uint64(scfg.ttl(scfg.Expiry().Add(-time.Hour)))
+			Expect(ttl).To(Equal(uint64(3600)))
+			Expect(binary.LittleEndian.Uint64(scfg.ttl(scfg.Expiry().Add(time.Hour)))).To(BeZero())
+		})
+
+		It("doesn't renew a server config that didn't expire", func() {
+			id := scfg.ID()
+			err := scfg.renewIfExpired(time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scfg.ID()).To(Equal(id))
+		})
+
+		It("renews an expired server config", func() {
+			id := scfg.ID()
+			now := scfg.Expiry().Add(time.Second)
+			err := scfg.renewIfExpired(now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scfg.ID()).ToNot(Equal(id))
+			Expect(scfg.ID()).To(HaveLen(16))
+			Expect(scfg.Expiry()).To(Equal(now.Add(protocol.ServerConfigTTL)))
+		})
+	})
+
+	Context("forward-secure AEADs", func() {
+		It("doesn't offer forward-secure AEADs by default", func() {
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).ToNot(HaveKey(TagFSAE))
+		})
+
+		It("offers forward-secure AEADs", func() {
+			err := scfg.SetForwardSecureAEADs(TagA256, TagCC20)
+			Expect(err).ToNot(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[TagFSAE]).To(Equal([]byte("A256CC20")))
+			Expect(scfg.offersForwardSecureAEAD(TagA256)).To(BeTrue())
+			Expect(scfg.offersForwardSecureAEAD(TagCC20)).To(BeTrue())
+		})
+
+		It("uses the defaults for empty lists", func() {
+			scfg, err := NewServerConfig(kex, nil, []Tag{}, []Tag{})
+			Expect(err).NotTo(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data[TagAEAD]).To(Equal([]byte("CC20")))
+			Expect(data[TagKEXS]).To(Equal([]byte("C255")))
+			Expect(scfg.selectAEAD([]byte("CC20"))).To(Equal(TagCC20))
+		})
+
+		It("rejects unsupported AEADs", func() {
+			err := scfg.SetForwardSecureAEADs(TagA256, TagAEAD)
+			Expect(err).To(MatchError(errUnsupportedAEAD))
+			Expect(scfg.offersForwardSecureAEAD(TagA256)).To(BeFalse())
+		})
+	})
+
+	Context("validating", func() {
+		It("accepts a working signer", func() {
+			scfg, err := NewServerConfig(kex, &mockSigner{}, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.Validate()).To(Succeed())
+		})
+
+		It("reports a broken signer", func() {
+			testErr := errors.New("cannot sign")
+			scfg, err := NewServerConfig(kex, &brokenSigner{err: testErr}, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.Validate()).To(MatchError(testErr))
+		})
+
+		It("reports a missing signer", func() {
+			Expect(scfg.Validate()).To(MatchError(errNoSigner))
+		})
+	})
+
+	Context("AEADs and KEXs", func() {
+		It("advertises the AEADs and KEXs in order of preference", func() {
+			scfg, err := NewServerConfig(kex, nil, []Tag{TagA256, TagCC20}, []Tag{TagC255})
+			Expect(err).NotTo(HaveOccurred())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data[TagAEAD]).To(Equal([]byte("A256CC20")))
+			Expect(data[TagKEXS]).To(Equal([]byte("C255")))
+		})
+
+		It("uses the defaults", func() {
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data[TagAEAD]).To(Equal([]byte("CC20")))
+			Expect(data[TagKEXS]).To(Equal([]byte("C255")))
+		})
+
+		It("rejects unsupported AEADs", func() {
+			_, err := NewServerConfig(kex, nil, []Tag{TagCC20, TagAEAD}, nil)
+			Expect(err).To(MatchError(errUnsupportedAEAD))
+		})
+
+		It("rejects unsupported KEXs", func() {
+			_, err := NewServerConfig(kex, nil, nil, []Tag{TagC255, TagKEXS})
+			Expect(err).To(MatchError(errUnsupportedKEX))
+		})
+
+		It("selects the client's preferred AEAD", func() {
+			scfg, err := NewServerConfig(kex, nil, []Tag{TagCC20, TagA256}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.selectAEAD([]byte("A256CC20"))).To(Equal(TagA256))
+			Expect(scfg.selectAEAD([]byte("CC20A256"))).To(Equal(TagCC20))
+		})
+
+		It("skips AEADs the server doesn't offer", func() {
+			Expect(scfg.selectAEAD([]byte("A256CC20"))).To(Equal(TagCC20))
+		})
+
+		It("uses the server's preferred AEAD if the client doesn't send any", func() {
+			scfg, err := NewServerConfig(kex, nil, []Tag{TagA256, TagCC20}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.selectAEAD(nil)).To(Equal(TagA256))
+		})
+
+		It("errors if there's no mutually supported AEAD", func() {
+			_, err := scfg.selectAEAD([]byte("A256"))
+			Expect(err).To(MatchError(qerr.CryptoNoSupport))
+			Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagAEAD)))
+		})
+
+		It("errors on malformed tag lists", func() {
+			_, err := scfg.selectKEX([]byte("C25"))
+			Expect(err).To(MatchError(qerr.CryptoInvalidValueLength))
+			Expect(err.(*qerr.CryptoError).Tag).To(Equal(uint32(TagKEXS)))
+		})
+
+		It("selects the KEX", func() {
+			Expect(scfg.selectKEX([]byte("P256C255"))).To(Equal(TagC255))
+		})
+	})
+
+	Context("stateless reset tokens", func() {
+		It("derives the same token for the same connection ID", func() {
+			token := scfg.StatelessResetToken(1337)
+			Expect(token).To(HaveLen(protocol.StatelessResetTokenLen))
+			Expect(scfg.StatelessResetToken(1337)).To(Equal(token))
+		})
+
+		It("derives different tokens for different connection IDs", func() {
+			Expect(scfg.StatelessResetToken(1337)).ToNot(Equal(scfg.StatelessResetToken(1338)))
+		})
+
+		It("derives different tokens for different server configs", func() {
+			scfg2, err := NewServerConfig(kex, nil, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg2.StatelessResetToken(1337)).ToNot(Equal(scfg.StatelessResetToken(1337)))
+		})
+	})
+	Context("server nonces", func() {
+		It("accepts its own server nonces", func() {
+			now := time.Now()
+			sno, err := scfg.newServerNonce(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sno).To(HaveLen(protocol.ServerNonceLen))
+			Expect(scfg.verifyServerNonce(sno, now)).To(Succeed())
+			Expect(scfg.verifyServerNonce(sno, now.Add(protocol.ServerNonceLifetime-time.Second))).To(Succeed())
+		})
+
+		It("generates different server nonces", func() {
+			now := time.Now()
+			sno1, err := scfg.newServerNonce(now)
+			Expect(err).NotTo(HaveOccurred())
+			sno2, err := scfg.newServerNonce(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sno1).ToNot(Equal(sno2))
+		})
+
+		It("rejects stale server nonces", func() {
+			now := time.Now()
+			sno, err := scfg.newServerNonce(now.Add(-protocol.ServerNonceLifetime - time.Second))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.verifyServerNonce(sno, now)).To(MatchError(errExpiredServerNonce))
+		})
+
+		It("rejects server nonces from the future", func() {
+			now := time.Now()
+			sno, err := scfg.newServerNonce(now.Add(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.verifyServerNonce(sno, now)).To(MatchError(errExpiredServerNonce))
+		})
+
+		It("rejects modified server nonces", func() {
+			now := time.Now()
+			sno, err := scfg.newServerNonce(now)
+			Expect(err).NotTo(HaveOccurred())
+			sno[5]++
+			Expect(scfg.verifyServerNonce(sno, now)).To(MatchError(errInvalidServerNonce))
+		})
+
+		It("rejects server nonces of another server config", func() {
+			now := time.Now()
+			scfg2, err := NewServerConfig(kex, nil, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			sno, err := scfg2.newServerNonce(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scfg.verifyServerNonce(sno, now)).To(MatchError(errInvalidServerNonce))
+		})
+
+		It("rejects server nonces with the wrong length", func() {
+			Expect(scfg.verifyServerNonce([]byte("foobar"), time.Now())).To(MatchError(errMalformedServerNonce))
+		})
+	})
+
+	Context("client authentication", func() {
+		It("doesn't request client certificates by default", func() {
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).ToNot(HaveKey(TagCCRQ))
+		})
+
+		It("requests optional client certificates", func() {
+			scfg.SetClientAuth(tls.VerifyClientCertIfGiven, x509.NewCertPool())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[TagCCRQ]).To(Equal([]byte{0}))
+		})
+
+		It("requires client certificates", func() {
+			scfg.SetClientAuth(tls.RequireAndVerifyClientCert, x509.NewCertPool())
+			_, data, err := ParseHandshakeMessage(bytes.NewReader(scfg.Get()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data[TagCCRQ]).To(Equal([]byte{1}))
+		})
+	})
 })
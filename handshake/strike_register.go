@@ -0,0 +1,100 @@
+package handshake
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// A StrikeRegister detects replayed client nonces, and is consulted before accepting a CHLO.
+// It is shared by all connections using the same ServerConfig.
+type StrikeRegister interface {
+	// Insert returns true if the nonce was not seen before.
+	// It returns false if it was, or if the register can't tell (e.g. if the nonce is too old).
+	Insert(nonce []byte, now time.Time) bool
+}
+
+type strikeRegisterEntry struct {
+	timestamp time.Time
+	nonce     string
+}
+
+// strikeRegisterEntries is a min-heap of the remembered nonces, ordered by their timestamp
+type strikeRegisterEntries []strikeRegisterEntry
+
+func (e strikeRegisterEntries) Len() int            { return len(e) }
+func (e strikeRegisterEntries) Less(i, j int) bool  { return e[i].timestamp.Before(e[j].timestamp) }
+func (e strikeRegisterEntries) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *strikeRegisterEntries) Push(x interface{}) { *e = append(*e, x.(strikeRegisterEntry)) }
+func (e *strikeRegisterEntries) Pop() interface{} {
+	old := *e
+	entry := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return entry
+}
+
+type memoryStrikeRegister struct {
+	window     time.Duration
+	maxEntries int
+
+	mutex   sync.Mutex
+	nonces  map[string]struct{}
+	entries strikeRegisterEntries
+	// horizon is the timestamp of the newest nonce that was forgotten because the register was full.
+	// Nonces that are not newer than it are rejected, since they might have been forgotten.
+	horizon time.Time
+}
+
+var _ StrikeRegister = &memoryStrikeRegister{}
+
+// NewMemoryStrikeRegister creates an in-memory StrikeRegister.
+// It accepts client nonces whose timestamp is at most window away from the current time, and remembers them for that time.
+// It remembers at most protocol.MaxStrikeRegisterEntries nonces. When it is full, the oldest nonce is forgotten,
+// and nonces that are not newer than the forgotten one are rejected.
+func NewMemoryStrikeRegister(window time.Duration) StrikeRegister {
+	return &memoryStrikeRegister{
+		window:     window,
+		maxEntries: protocol.MaxStrikeRegisterEntries,
+		nonces:     make(map[string]struct{}),
+	}
+}
+
+func (r *memoryStrikeRegister) Insert(nonce []byte, now time.Time) bool {
+	// a client nonce starts with a 4 byte timestamp
+	if len(nonce) != 32 {
+		return false
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint32(nonce)), 0)
+	if timestamp.Before(now.Add(-r.window)) || timestamp.After(now.Add(r.window)) {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// once the timestamp is outside the window, the nonce is rejected anyway
+	for len(r.entries) > 0 && r.entries[0].timestamp.Before(now.Add(-r.window)) {
+		delete(r.nonces, heap.Pop(&r.entries).(strikeRegisterEntry).nonce)
+	}
+
+	if !timestamp.After(r.horizon) {
+		return false
+	}
+	if _, ok := r.nonces[string(nonce)]; ok {
+		return false
+	}
+	if len(r.nonces) >= r.maxEntries {
+		if !timestamp.After(r.entries[0].timestamp) {
+			return false
+		}
+		oldest := heap.Pop(&r.entries).(strikeRegisterEntry)
+		delete(r.nonces, oldest.nonce)
+		r.horizon = oldest.timestamp
+	}
+	r.nonces[string(nonce)] = struct{}{}
+	heap.Push(&r.entries, strikeRegisterEntry{timestamp: timestamp, nonce: string(nonce)})
+	return true
+}
@@ -0,0 +1,98 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Strike register", func() {
+	var (
+		r   StrikeRegister
+		now time.Time
+	)
+
+	nonceAt := func(t time.Time, b byte) []byte {
+		nonce := make([]byte, 32)
+		binary.BigEndian.PutUint32(nonce, uint32(t.Unix()))
+		nonce[31] = b
+		return nonce
+	}
+
+	BeforeEach(func() {
+		r = NewMemoryStrikeRegister(time.Hour)
+		now = time.Unix(1e9, 0)
+	})
+
+	It("accepts a nonce once", func() {
+		nonce := nonceAt(now, 1)
+		Expect(r.Insert(nonce, now)).To(BeTrue())
+		Expect(r.Insert(nonce, now.Add(time.Minute))).To(BeFalse())
+	})
+
+	It("accepts different nonces", func() {
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now, 2), now)).To(BeTrue())
+	})
+
+	It("rejects nonces with an invalid length", func() {
+		Expect(r.Insert(nil, now)).To(BeFalse())
+		Expect(r.Insert(make([]byte, 31), now)).To(BeFalse())
+	})
+
+	It("rejects nonces outside of the window", func() {
+		Expect(r.Insert(nonceAt(now.Add(-2*time.Hour), 1), now)).To(BeFalse())
+		Expect(r.Insert(nonceAt(now.Add(2*time.Hour), 1), now)).To(BeFalse())
+	})
+
+	It("rejects an old nonce after it was removed from the register", func() {
+		nonce := nonceAt(now, 1)
+		Expect(r.Insert(nonce, now)).To(BeTrue())
+		// trigger a sweep
+		later := now.Add(2 * time.Hour)
+		Expect(r.Insert(nonceAt(later, 2), later)).To(BeTrue())
+		Expect(r.(*memoryStrikeRegister).nonces).To(HaveLen(1))
+		Expect(r.Insert(nonce, later)).To(BeFalse())
+	})
+
+	It("forgets the oldest nonce when it is full", func() {
+		r.(*memoryStrikeRegister).maxEntries = 2
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now.Add(time.Second), 2), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now.Add(2*time.Second), 3), now)).To(BeTrue())
+		Expect(r.(*memoryStrikeRegister).nonces).To(HaveLen(2))
+		Expect(r.(*memoryStrikeRegister).nonces).ToNot(HaveKey(string(nonceAt(now, 1))))
+	})
+
+	It("rejects nonces that are not newer than a forgotten nonce", func() {
+		r.(*memoryStrikeRegister).maxEntries = 2
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now.Add(time.Second), 2), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now.Add(2*time.Second), 3), now)).To(BeTrue())
+		// the forgotten nonce must not be accepted again
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeFalse())
+		Expect(r.Insert(nonceAt(now, 4), now)).To(BeFalse())
+		Expect(r.Insert(nonceAt(now.Add(3*time.Second), 5), now)).To(BeTrue())
+	})
+
+	It("doesn't forget a nonce for one that isn't newer", func() {
+		r.(*memoryStrikeRegister).maxEntries = 2
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now, 2), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now, 3), now)).To(BeFalse())
+		Expect(r.(*memoryStrikeRegister).nonces).To(HaveLen(2))
+		Expect(r.(*memoryStrikeRegister).horizon.IsZero()).To(BeTrue())
+	})
+
+	It("removes expired nonces when it is full", func() {
+		r.(*memoryStrikeRegister).maxEntries = 2
+		Expect(r.Insert(nonceAt(now, 1), now)).To(BeTrue())
+		Expect(r.Insert(nonceAt(now, 2), now)).To(BeTrue())
+		later := now.Add(90 * time.Minute)
+		Expect(r.Insert(nonceAt(later, 3), later)).To(BeTrue())
+		Expect(r.(*memoryStrikeRegister).nonces).To(HaveLen(1))
+		Expect(r.(*memoryStrikeRegister).horizon.IsZero()).To(BeTrue())
+	})
+})
@@ -41,6 +41,9 @@ const (
 	TagCSCT Tag = 'C' + 'S'<<8 + 'C'<<16 + 'T'<<24
 	// TagCOPT are the connection options
 	TagCOPT Tag = 'C' + 'O'<<8 + 'P'<<16 + 'T'<<24
+	// TagMDFS is the maximum size of the data in a DATAGRAM frame.
+	// If it is not sent, DATAGRAM frames are not supported.
+	TagMDFS Tag = 'M' + 'D'<<8 + 'F'<<16 + 'S'<<24
 	// TagCFCW is the initial session/connection flow control receive window
 	TagCFCW Tag = 'C' + 'F'<<8 + 'C'<<16 + 'W'<<24
 	// TagSFCW is the initial stream flow control receive window.
@@ -62,15 +65,27 @@ const (
 	TagKEXS Tag = 'K' + 'E'<<8 + 'X'<<16 + 'S'<<24
 	// TagAEAD is the list of AEAD algos
 	TagAEAD Tag = 'A' + 'E'<<8 + 'A'<<16 + 'D'<<24
+	// TagFSAE is the list of AEAD algos for forward-secure packets, if they differ from TagAEAD
+	TagFSAE Tag = 'F' + 'S'<<8 + 'A'<<16 + 'E'<<24
 	// TagPUBS is the public value for the KEX
 	TagPUBS Tag = 'P' + 'U'<<8 + 'B'<<16 + 'S'<<24
 	// TagOBIT is the client orbit
 	TagOBIT Tag = 'O' + 'B'<<8 + 'I'<<16 + 'T'<<24
 	// TagEXPY is the server config expiry
 	TagEXPY Tag = 'E' + 'X'<<8 + 'P'<<16 + 'Y'<<24
+	// TagSTTL is the time in seconds the server config sent in a REJ may still be used
+	TagSTTL Tag = 'S' + 'T'<<8 + 'T'<<16 + 'L'<<24
 	// TagCERT is the CERT data
 	TagCERT Tag = 0xff545243
 
+	// TagCC20 is the AEAD algo chacha20poly1305
+	TagCC20 Tag = 'C' + 'C'<<8 + '2'<<16 + '0'<<24
+	// TagA256 is the AEAD algo AES-256-GCM
+	TagA256 Tag = 'A' + '2'<<8 + '5'<<16 + '6'<<24
+
+	// TagC255 is the KEX algo Curve25519
+	TagC255 Tag = 'C' + '2'<<8 + '5'<<16 + '5'<<24
+
 	// TagSHLO is the server hello
 	TagSHLO Tag = 'S' + 'H'<<8 + 'L'<<16 + 'O'<<24
 
@@ -80,4 +95,23 @@ const (
 	TagRSEQ Tag = 'R' + 'S'<<8 + 'E'<<16 + 'Q'<<24
 	// TagRNON is the public reset nonce
 	TagRNON Tag = 'R' + 'N'<<8 + 'O'<<16 + 'N'<<24
+	// TagCADR is the client address, as seen by the server
+	TagCADR Tag = 'C' + 'A'<<8 + 'D'<<16 + 'R'<<24
+
+	// TagSRST is the stateless reset token
+	TagSRST Tag = 'S' + 'R'<<8 + 'S'<<16 + 'T'<<24
+
+	// TagCCRQ is the client certificate request in the server config, 1 if a client certificate is required, 0 if it is optional
+	TagCCRQ Tag = 'C' + 'C'<<8 + 'R'<<16 + 'Q'<<24
+	// TagCCHN is the client certificate chain, each certificate prefixed with its length as a uint32
+	TagCCHN Tag = 'C' + 'C'<<8 + 'H'<<16 + 'N'<<24
+	// TagCPRF is the client proof, the signature of the handshake with the client certificate's key
+	TagCPRF Tag = 'C' + 'P'<<8 + 'R'<<16 + 'F'<<24
+
+	// TagCETV are the client encrypted tag-values, a message encrypted with keys derived from the initial shared secret
+	TagCETV Tag = 'C' + 'E'<<8 + 'T'<<16 + 'V'<<24
+	// TagCIDK is the channel ID key, sent in the CETV
+	TagCIDK Tag = 'C' + 'I'<<8 + 'D'<<16 + 'K'<<24
+	// TagCIDS is the channel ID signature, sent in the CETV
+	TagCIDS Tag = 'C' + 'I'<<8 + 'D'<<16 + 'S'<<24
 )
@@ -3,9 +3,11 @@ package quic
 import (
 	"bytes"
 	"errors"
+	"sync"
 	"sync/atomic"
 
 	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/handshake"
 	"github.com/lucas-clemente/quic-go/protocol"
@@ -23,13 +25,19 @@ type packetPacker struct {
 	connectionID protocol.ConnectionID
 	version      protocol.VersionNumber
 	cryptoSetup  *handshake.CryptoSetup
+	aead         crypto.AEAD // seals the packets, this is the cryptoSetup unless replaced in tests
 
 	sentPacketHandler           ackhandler.SentPacketHandler
 	connectionParametersManager *handshake.ConnectionParametersManager
 
-	streamFrameQueue *streamFrameQueue
-	controlFrames    []frames.Frame
-	blockedManager   *blockedManager
+	streamFrameQueue   *streamFrameQueue
+	controlFrames      []frames.Frame
+	controlFramesMutex sync.Mutex
+	datagramFrames     []*frames.DatagramFrame
+	datagramMutex      sync.Mutex
+	blockedManager     *blockedManager
+
+	padding PaddingPolicy
 
 	lastPacketNumber protocol.PacketNumber
 }
@@ -37,6 +45,7 @@ type packetPacker struct {
 func newPacketPacker(connectionID protocol.ConnectionID, cryptoSetup *handshake.CryptoSetup, sentPacketHandler ackhandler.SentPacketHandler, connectionParametersHandler *handshake.ConnectionParametersManager, blockedManager *blockedManager, version protocol.VersionNumber) *packetPacker {
 	return &packetPacker{
 		cryptoSetup:                 cryptoSetup,
+		aead:                        cryptoSetup,
 		connectionID:                connectionID,
 		connectionParametersManager: connectionParametersHandler,
 		version:                     version,
@@ -54,12 +63,25 @@ func (p *packetPacker) AddHighPrioStreamFrame(f frames.StreamFrame) {
 	p.streamFrameQueue.Push(&f, true)
 }
 
+// AddDatagram queues a DatagramFrame
+// It is sent once, and not retransmitted if the packet is lost.
+// If protocol.MaxDatagramSendQueueLen frames are already queued, the frame is dropped and false is returned.
+func (p *packetPacker) AddDatagram(f *frames.DatagramFrame) bool {
+	p.datagramMutex.Lock()
+	defer p.datagramMutex.Unlock()
+	if len(p.datagramFrames) >= protocol.MaxDatagramSendQueueLen {
+		return false
+	}
+	p.datagramFrames = append(p.datagramFrames, f)
+	return true
+}
+
 func (p *packetPacker) AddBlocked(streamID protocol.StreamID, byteOffset protocol.ByteCount) {
 	// TODO: send out connection-level BlockedFrames at the right time
 	// see https://github.com/lucas-clemente/quic-go/issues/113
 	// TODO: remove this function completely once #113 is resolved
 	if streamID == 0 {
-		p.controlFrames = append(p.controlFrames, &frames.BlockedFrame{StreamID: 0})
+		p.queueControlFrames(&frames.BlockedFrame{StreamID: 0})
 	}
 
 	p.blockedManager.AddBlockedStream(streamID, byteOffset)
@@ -75,12 +97,12 @@ func (p *packetPacker) PackPacket(stopWaitingFrame *frames.StopWaitingFrame, con
 
 func (p *packetPacker) packPacket(stopWaitingFrame *frames.StopWaitingFrame, controlFrames []frames.Frame, onlySendOneControlFrame bool) (*packedPacket, error) {
 	// don't send out packets that only contain a StopWaitingFrame
-	if len(p.controlFrames) == 0 && len(controlFrames) == 0 && p.streamFrameQueue.Len() == 0 {
+	if !p.HasControlFrames() && len(controlFrames) == 0 && p.DatagramQueueByteLen() == 0 && p.streamFrameQueue.Len() == 0 {
 		return nil, nil
 	}
 
 	if len(controlFrames) > 0 {
-		p.controlFrames = append(p.controlFrames, controlFrames...)
+		p.queueControlFrames(controlFrames...)
 	}
 
 	currentPacketNumber := protocol.PacketNumber(atomic.AddUint64(
@@ -126,6 +148,10 @@ func (p *packetPacker) packPacket(stopWaitingFrame *frames.StopWaitingFrame, con
 	if err != nil {
 		return nil, err
 	}
+	payload, err = p.pad(payload, payloadFrames, publicHeaderLength, currentPacketNumber)
+	if err != nil {
+		return nil, err
+	}
 
 	entropyBit, err := utils.RandomBit()
 	if err != nil {
@@ -140,7 +166,7 @@ func (p *packetPacker) packPacket(stopWaitingFrame *frames.StopWaitingFrame, con
 		return nil, err
 	}
 
-	ciphertext := p.cryptoSetup.Seal(currentPacketNumber, raw.Bytes(), payload)
+	ciphertext := p.aead.Seal(currentPacketNumber, raw.Bytes(), payload)
 	raw.Write(ciphertext)
 
 	if protocol.ByteCount(raw.Len()) > protocol.MaxPacketSize {
@@ -179,6 +205,8 @@ func (p *packetPacker) composeNextPacket(stopWaitingFrame *frames.StopWaitingFra
 		payloadLength += minLength
 	}
 
+	// fill the packet with as many control frames as fit
+	p.controlFramesMutex.Lock()
 	for len(p.controlFrames) > 0 {
 		frame := p.controlFrames[0]
 		minLength, _ := frame.MinLength() // controlFrames does not contain any StopWaitingFrames. So it will *never* return an error
@@ -189,6 +217,20 @@ func (p *packetPacker) composeNextPacket(stopWaitingFrame *frames.StopWaitingFra
 		payloadLength += minLength
 		p.controlFrames = p.controlFrames[1:]
 	}
+	p.controlFramesMutex.Unlock()
+
+	p.datagramMutex.Lock()
+	for len(p.datagramFrames) > 0 {
+		frame := p.datagramFrames[0]
+		minLength, _ := frame.MinLength() // DatagramFrame.MinLength *never* returns an error
+		if payloadLength+minLength > maxFrameSize {
+			break
+		}
+		payloadFrames = append(payloadFrames, frame)
+		payloadLength += minLength
+		p.datagramFrames = p.datagramFrames[1:]
+	}
+	p.datagramMutex.Unlock()
 
 	if payloadLength > maxFrameSize {
 		return nil, errors.New("PacketPacker BUG: packet payload too large")
@@ -225,7 +267,7 @@ func (p *packetPacker) composeNextPacket(stopWaitingFrame *frames.StopWaitingFra
 				payloadFrames = append(payloadFrames, blockedFrame)
 				payloadLength += blockedLength
 			} else {
-				p.controlFrames = append(p.controlFrames, blockedFrame)
+				p.queueControlFrames(blockedFrame)
 			}
 		}
 
@@ -248,7 +290,33 @@ func (p *packetPacker) composeNextPacket(stopWaitingFrame *frames.StopWaitingFra
 
 // Empty returns true if no frames are queued
 func (p *packetPacker) Empty() bool {
-	return p.streamFrameQueue.ByteLen() == 0
+	return p.streamFrameQueue.ByteLen() == 0 && p.DatagramQueueByteLen() == 0 && !p.HasControlFrames()
+}
+
+// HasControlFrames returns true if control frames are queued, that didn't fit into the previous packet
+func (p *packetPacker) HasControlFrames() bool {
+	p.controlFramesMutex.Lock()
+	defer p.controlFramesMutex.Unlock()
+	return len(p.controlFrames) > 0
+}
+
+func (p *packetPacker) queueControlFrames(f ...frames.Frame) {
+	p.controlFramesMutex.Lock()
+	p.controlFrames = append(p.controlFrames, f...)
+	p.controlFramesMutex.Unlock()
+}
+
+// DatagramQueueByteLen returns the size of all queued DatagramFrames
+func (p *packetPacker) DatagramQueueByteLen() protocol.ByteCount {
+	p.datagramMutex.Lock()
+	defer p.datagramMutex.Unlock()
+
+	var l protocol.ByteCount
+	for _, f := range p.datagramFrames {
+		minLength, _ := f.MinLength()
+		l += minLength
+	}
+	return l
 }
 
 func (p *packetPacker) StreamFrameQueueByteLen() protocol.ByteCount {
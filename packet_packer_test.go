@@ -5,9 +5,11 @@ import (
 	"time"
 
 	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/handshake"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/testutil"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -23,6 +25,17 @@ func (h *mockSentPacketHandler) GetLargestObserved() protocol.PacketNumber
 func (h *mockSentPacketHandler) CongestionAllowsSending() bool                      { panic("not implemented") }
 func (h *mockSentPacketHandler) CheckForError() error                               { panic("not implemented") }
 func (h *mockSentPacketHandler) TimeOfFirstRTO() time.Time                          { panic("not implemented") }
+func (h *mockSentPacketHandler) RetransmissionTimeout() time.Duration               { panic("not implemented") }
+func (h *mockSentPacketHandler) ShouldSendProbe() bool                              { return false }
+func (h *mockSentPacketHandler) SetConnectionOptions([][4]byte)                     {}
+func (h *mockSentPacketHandler) SetPacketThreshold(uint32)                          {}
+func (h *mockSentPacketHandler) SetMinRetransmissionTime(time.Duration)             {}
+func (h *mockSentPacketHandler) SetTimerJitter(float64)                             {}
+func (h *mockSentPacketHandler) SetMaxConsecutiveRTOs(uint32)                       {}
+func (h *mockSentPacketHandler) SetInitialPacketNumber(protocol.PacketNumber)       {}
+func (h *mockSentPacketHandler) SetCongestionWindowObserver(congestion.CongestionWindowObserver) {
+}
+func (h *mockSentPacketHandler) SetPacketAckedObserver(ackhandler.PacketAckedObserver) {}
 
 func newMockSentPacketHandler() ackhandler.SentPacketHandler {
 	return &mockSentPacketHandler{}
@@ -35,8 +48,10 @@ var _ = Describe("Packet packer", func() {
 	)
 
 	BeforeEach(func() {
+		cryptoSetup := &handshake.CryptoSetup{}
 		packer = &packetPacker{
-			cryptoSetup:                 &handshake.CryptoSetup{},
+			cryptoSetup:                 cryptoSetup,
+			aead:                        testutil.NewNonceReuseDetectingAEAD(cryptoSetup),
 			connectionParametersManager: handshake.NewConnectionParamatersManager(),
 			sentPacketHandler:           newMockSentPacketHandler(),
 			blockedManager:              newBlockedManager(),
@@ -70,6 +85,29 @@ var _ = Describe("Packet packer", func() {
 		Expect(p.raw).To(ContainSubstring(string(b.Bytes())))
 	})
 
+	It("omits the connection ID after TCID negotiation", func() {
+		packer.connectionID = 0xdecafbad
+		f := frames.StreamFrame{
+			StreamID: 5,
+			Data:     []byte{0xDE, 0xCA, 0xFB, 0xAD},
+		}
+		packer.AddStreamFrame(f)
+		p, err := packer.PackPacket(nil, []frames.Frame{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.raw[0] & 0x0c).To(Equal(byte(0x0c)))
+		Expect(p.raw[1:9]).To(Equal([]byte{0xad, 0xfb, 0xca, 0xde, 0, 0, 0, 0}))
+		err = packer.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+			handshake.TagTCID: {0, 0, 0, 0},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		packer.AddStreamFrame(f)
+		pTruncated, err := packer.PackPacket(nil, []frames.Frame{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pTruncated.raw[0] & 0x0c).To(BeZero())
+		Expect(pTruncated.raw).To(HaveLen(len(p.raw) - 8))
+		Expect(pTruncated.raw).ToNot(ContainSubstring(string([]byte{0xad, 0xfb, 0xca, 0xde})))
+	})
+
 	It("packs a ConnectionCloseFrame", func() {
 		ccf := frames.ConnectionCloseFrame{
 			ErrorCode:    0x1337,
@@ -169,6 +207,25 @@ var _ = Describe("Packet packer", func() {
 		Expect(payloadFrames).To(HaveLen(10))
 	})
 
+	It("packs many small control frames into far fewer packets", func() {
+		const numFrames = 500
+		var controlFrames []frames.Frame
+		for i := 0; i < numFrames; i++ {
+			controlFrames = append(controlFrames, &frames.WindowUpdateFrame{StreamID: protocol.StreamID(i), ByteOffset: 0x1337})
+		}
+		var numPackets, numPackedFrames int
+		p, err := packer.PackPacket(nil, controlFrames)
+		for p != nil {
+			Expect(err).ToNot(HaveOccurred())
+			numPackets++
+			numPackedFrames += len(p.frames)
+			p, err = packer.PackPacket(nil, nil)
+		}
+		Expect(err).ToNot(HaveOccurred())
+		Expect(numPackedFrames).To(Equal(numFrames))
+		Expect(numPackets).To(BeNumerically("<=", 10))
+	})
+
 	It("only increases the packet number when there is an actual packet to send", func() {
 		f := frames.StreamFrame{
 			StreamID: 5,
@@ -442,6 +499,60 @@ var _ = Describe("Packet packer", func() {
 		})
 	})
 
+	Context("Datagram frames", func() {
+		const maxPublicHeaderLen = 1 + 8 + 32 + 6
+
+		It("packs a DatagramFrame", func() {
+			f := &frames.DatagramFrame{Data: []byte("foobar")}
+			packer.AddDatagram(f)
+			p, err := packer.PackPacket(nil, []frames.Frame{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).ToNot(BeNil())
+			Expect(p.frames).To(Equal([]frames.Frame{f}))
+			Expect(packer.Empty()).To(BeTrue())
+		})
+
+		It("packs DatagramFrames together with StreamFrames", func() {
+			f := &frames.DatagramFrame{Data: []byte("foobar")}
+			packer.AddDatagram(f)
+			packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			p, err := packer.composeNextPacket(nil, publicHeaderLen)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(HaveLen(2))
+			Expect(p[0]).To(Equal(f))
+		})
+
+		It("sends a DatagramFrame in the next packet if it doesn't fit", func() {
+			f1 := &frames.DatagramFrame{Data: make([]byte, protocol.MaxDatagramFrameSize)}
+			f2 := &frames.DatagramFrame{Data: []byte("foobar")}
+			packer.AddDatagram(f1)
+			packer.AddDatagram(f2)
+			Expect(packer.DatagramQueueByteLen()).To(Equal(protocol.MaxDatagramFrameSize + 3 + 6 + 3))
+			p, err := packer.composeNextPacket(nil, maxPublicHeaderLen)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal([]frames.Frame{f1}))
+			p, err = packer.composeNextPacket(nil, maxPublicHeaderLen)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal([]frames.Frame{f2}))
+		})
+
+		It("drops DatagramFrames when the queue is full", func() {
+			for i := 0; i < protocol.MaxDatagramSendQueueLen; i++ {
+				Expect(packer.AddDatagram(&frames.DatagramFrame{Data: []byte("foobar")})).To(BeTrue())
+			}
+			Expect(packer.AddDatagram(&frames.DatagramFrame{Data: []byte("foobar")})).To(BeFalse())
+			Expect(packer.datagramFrames).To(HaveLen(protocol.MaxDatagramSendQueueLen))
+		})
+
+		It("fits a DatagramFrame of the maximum size into a packet with the largest PublicHeader", func() {
+			f := &frames.DatagramFrame{Data: make([]byte, protocol.MaxDatagramFrameSize)}
+			packer.AddDatagram(f)
+			p, err := packer.composeNextPacket(nil, maxPublicHeaderLen)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal([]frames.Frame{f}))
+		})
+	})
+
 	It("says whether it is empty", func() {
 		Expect(packer.Empty()).To(BeTrue())
 		f := frames.StreamFrame{
@@ -451,4 +562,15 @@ var _ = Describe("Packet packer", func() {
 		packer.AddStreamFrame(f)
 		Expect(packer.Empty()).To(BeFalse())
 	})
+
+	It("is not empty when DatagramFrames are queued", func() {
+		packer.AddDatagram(&frames.DatagramFrame{})
+		Expect(packer.Empty()).To(BeFalse())
+	})
+
+	It("is not empty when control frames are queued", func() {
+		packer.controlFrames = []frames.Frame{&frames.BlockedFrame{StreamID: 0}}
+		Expect(packer.HasControlFrames()).To(BeTrue())
+		Expect(packer.Empty()).To(BeFalse())
+	})
 })
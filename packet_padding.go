@@ -0,0 +1,84 @@
+package quic
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// aeadOverhead is the number of bytes that sealing adds to the payload, for all AEADs
+const aeadOverhead = 12
+
+// A PaddingPolicy determines the size that outgoing packets are padded to with PADDING, so that packet sizes don't leak message boundaries.
+// Packets are padded to a random size between MinPacketSize and MaxPacketSize, both including the public header.
+// The zero value disables padding.
+type PaddingPolicy struct {
+	MinPacketSize protocol.ByteCount
+	MaxPacketSize protocol.ByteCount
+}
+
+// PadToFixedSize pads all packets to the same size
+func PadToFixedSize(size protocol.ByteCount) PaddingPolicy {
+	return PaddingPolicy{MinPacketSize: size, MaxPacketSize: size}
+}
+
+// PadToRandomSize pads every packet to a random size between min and max
+func PadToRandomSize(min, max protocol.ByteCount) PaddingPolicy {
+	return PaddingPolicy{MinPacketSize: min, MaxPacketSize: max}
+}
+
+// packetSize returns the size of the next packet, or 0 if packets are not padded.
+// It is capped to protocol.MaxPacketSize.
+func (p PaddingPolicy) packetSize() (protocol.ByteCount, error) {
+	if p.MaxPacketSize == 0 {
+		return 0, nil
+	}
+	size := p.MaxPacketSize
+	if p.MinPacketSize < p.MaxPacketSize {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(p.MaxPacketSize-p.MinPacketSize)+1))
+		if err != nil {
+			return 0, err
+		}
+		size = p.MinPacketSize + protocol.ByteCount(n.Int64())
+	}
+	if size > protocol.MaxPacketSize {
+		return protocol.MaxPacketSize, nil
+	}
+	return size, nil
+}
+
+// pad appends PADDING to the payload, so that the sealed packet reaches the size determined by the PaddingPolicy.
+// PADDING extends to the end of the packet, so the last StreamFrame has to be written with its data length.
+// If the packet is only 1 byte short of the size, there's no room for the data length, and a PING frame is inserted instead.
+func (p *packetPacker) pad(payload []byte, payloadFrames []frames.Frame, publicHeaderLength protocol.ByteCount, currentPacketNumber protocol.PacketNumber) ([]byte, error) {
+	size, err := p.padding.packetSize()
+	if err != nil {
+		return nil, err
+	}
+	length := publicHeaderLength + protocol.ByteCount(len(payload)) + aeadOverhead
+	if length >= size {
+		return payload, nil
+	}
+
+	var lastStreamFrame *frames.StreamFrame
+	if len(payloadFrames) > 0 {
+		lastStreamFrame, _ = payloadFrames[len(payloadFrames)-1].(*frames.StreamFrame)
+	}
+	if lastStreamFrame != nil && !lastStreamFrame.DataLenPresent {
+		if size-length == 1 {
+			// The PING is not added to the packet's frames, there's no need to retransmit it.
+			framesWithPing := append(append([]frames.Frame{}, payloadFrames[:len(payloadFrames)-1]...), &frames.PingFrame{}, lastStreamFrame)
+			return p.getPayload(framesWithPing, currentPacketNumber)
+		}
+		lastStreamFrame.DataLenPresent = true
+		payload, err = p.getPayload(payloadFrames, currentPacketNumber)
+		if err != nil {
+			return nil, err
+		}
+		length = publicHeaderLength + protocol.ByteCount(len(payload)) + aeadOverhead
+	}
+
+	return append(payload, make([]byte, size-length)...), nil
+}
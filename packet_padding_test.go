@@ -0,0 +1,127 @@
+package quic
+
+import (
+	"bytes"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/handshake"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Packet padding", func() {
+	var packer *packetPacker
+
+	BeforeEach(func() {
+		cryptoSetup := &handshake.CryptoSetup{}
+		packer = &packetPacker{
+			connectionID:                0x1337,
+			cryptoSetup:                 cryptoSetup,
+			aead:                        testutil.NewNonceReuseDetectingAEAD(cryptoSetup),
+			connectionParametersManager: handshake.NewConnectionParamatersManager(),
+			sentPacketHandler:           newMockSentPacketHandler(),
+			blockedManager:              newBlockedManager(),
+			streamFrameQueue:            newStreamFrameQueue(),
+		}
+	})
+
+	unpack := func(raw []byte) []frames.Frame {
+		r := bytes.NewReader(raw)
+		hdr, err := parsePublicHeader(r)
+		Expect(err).ToNot(HaveOccurred())
+		unpacker := &packetUnpacker{aead: &crypto.NullAEAD{}}
+		packet, err := unpacker.Unpack(raw[:len(raw)-r.Len()], hdr, r)
+		Expect(err).ToNot(HaveOccurred())
+		return packet.frames
+	}
+
+	It("doesn't pad packets by default", func() {
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(p.raw)).To(BeNumerically("<", 100))
+	})
+
+	It("pads packets to a fixed size", func() {
+		packer.padding = PadToFixedSize(1000)
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.raw).To(HaveLen(1000))
+		fs := unpack(p.raw)
+		Expect(fs).To(HaveLen(1))
+		Expect(fs[0].(*frames.StreamFrame).StreamID).To(Equal(protocol.StreamID(5)))
+		Expect(fs[0].(*frames.StreamFrame).Data).To(Equal([]byte("foobar")))
+	})
+
+	It("pads packets that are 1 or 2 bytes short of the size", func() {
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		unpaddedLen := len(p.raw)
+		for _, short := range []int{1, 2} {
+			packer.padding = PadToFixedSize(protocol.ByteCount(unpaddedLen + short))
+			packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			p, err = packer.PackPacket(nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.raw).To(HaveLen(unpaddedLen + short))
+			fs := unpack(p.raw)
+			Expect(fs[len(fs)-1].(*frames.StreamFrame).Data).To(Equal([]byte("foobar")))
+		}
+	})
+
+	It("pads packets that only contain control frames", func() {
+		packer.padding = PadToFixedSize(500)
+		p, err := packer.PackPacket(nil, []frames.Frame{&frames.WindowUpdateFrame{StreamID: 5, ByteOffset: 0x1337}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.raw).To(HaveLen(500))
+		Expect(unpack(p.raw)).To(Equal([]frames.Frame{&frames.WindowUpdateFrame{StreamID: 5, ByteOffset: 0x1337}}))
+	})
+
+	It("pads packets to a random size in a range", func() {
+		packer.padding = PadToRandomSize(500, 600)
+		sizes := make(map[int]bool)
+		for i := 0; i < 20; i++ {
+			packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			p, err := packer.PackPacket(nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(p.raw)).To(And(BeNumerically(">=", 500), BeNumerically("<=", 600)))
+			Expect(unpack(p.raw)[0].(*frames.StreamFrame).Data).To(Equal([]byte("foobar")))
+			sizes[len(p.raw)] = true
+		}
+		Expect(len(sizes)).To(BeNumerically(">", 1))
+	})
+
+	It("doesn't pad packets that are already larger", func() {
+		packer.padding = PadToFixedSize(100)
+		data := bytes.Repeat([]byte{'f'}, 200)
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: data})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(p.raw)).To(BeNumerically(">", 200))
+		Expect(unpack(p.raw)[0].(*frames.StreamFrame).Data).To(Equal(data))
+	})
+
+	It("caps the size to the maximum packet size", func() {
+		packer.padding = PadToFixedSize(2 * protocol.MaxPacketSize)
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.raw).To(HaveLen(int(protocol.MaxPacketSize)))
+	})
+
+	It("keeps full packets intact", func() {
+		packer.padding = PadToFixedSize(protocol.MaxPacketSize)
+		data := bytes.Repeat([]byte{'f'}, int(protocol.MaxPacketSize))
+		packer.AddStreamFrame(frames.StreamFrame{StreamID: 5, Data: data})
+		p, err := packer.PackPacket(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(p.raw)).To(BeNumerically("<=", protocol.MaxPacketSize))
+		f := unpack(p.raw)[0].(*frames.StreamFrame)
+		Expect(bytes.HasPrefix(data, f.Data)).To(BeTrue())
+	})
+})
@@ -12,14 +12,26 @@ import (
 	"github.com/lucas-clemente/quic-go/qerr"
 )
 
+var errTooManyStreamFrames = qerr.Error(qerr.InvalidStreamData, "too many STREAM frames in a packet")
+
 type unpackedPacket struct {
-	entropyBit bool
-	frames     []frames.Frame
+	entropyBit    bool
+	forwardSecure bool
+	frames        []frames.Frame
+}
+
+// forwardSecureOpener is implemented by the CryptoSetup
+// Once it returns true, only forward-secure packets can be opened.
+type forwardSecureOpener interface {
+	ReceivedForwardSecurePacket() bool
 }
 
 type packetUnpacker struct {
 	version protocol.VersionNumber
 	aead    crypto.AEAD
+
+	// maxStreamFrames is the maximum number of STREAM frames in a packet, if 0 there is no limit
+	maxStreamFrames int
 }
 
 func (u *packetUnpacker) Unpack(publicHeaderBinary []byte, hdr *publicHeader, r *bytes.Reader) (*unpackedPacket, error) {
@@ -31,6 +43,11 @@ func (u *packetUnpacker) Unpack(publicHeaderBinary []byte, hdr *publicHeader, r
 	}
 	r = bytes.NewReader(plaintext)
 
+	var forwardSecure bool
+	if fso, ok := u.aead.(forwardSecureOpener); ok {
+		forwardSecure = fso.ReceivedForwardSecurePacket()
+	}
+
 	privateFlag, err := r.ReadByte()
 	if err != nil {
 		return nil, qerr.MissingPayload
@@ -38,6 +55,7 @@ func (u *packetUnpacker) Unpack(publicHeaderBinary []byte, hdr *publicHeader, r
 	entropyBit := privateFlag&0x01 > 0
 
 	fs := make([]frames.Frame, 0, 1)
+	var numStreamFrames int
 
 	// Read all frames in the packet
 ReadLoop:
@@ -47,6 +65,11 @@ ReadLoop:
 
 		var frame frames.Frame
 		if typeByte&0x80 == 0x80 {
+			numStreamFrames++
+			if u.maxStreamFrames > 0 && numStreamFrames > u.maxStreamFrames {
+				// stop parsing, so that a flood of frames doesn't cost any more CPU
+				return nil, errTooManyStreamFrames
+			}
 			frame, err = frames.ParseStreamFrame(r)
 			if err != nil {
 				err = qerr.Error(qerr.InvalidStreamData, err.Error())
@@ -94,6 +117,11 @@ ReadLoop:
 				}
 			case 0x07:
 				frame, err = frames.ParsePingFrame(r)
+			case 0x08:
+				frame, err = frames.ParseDatagramFrame(r)
+				if _, ok := err.(*qerr.QuicError); err != nil && !ok {
+					err = qerr.Error(qerr.InvalidFrameData, err.Error())
+				}
 			default:
 				err = qerr.Error(qerr.InvalidFrameData, fmt.Sprintf("unknown type byte 0x%x", typeByte))
 			}
@@ -108,7 +136,8 @@ ReadLoop:
 	}
 
 	return &unpackedPacket{
-		entropyBit: entropyBit,
-		frames:     fs,
+		entropyBit:    entropyBit,
+		forwardSecure: forwardSecure,
+		frames:        fs,
 	}, nil
 }
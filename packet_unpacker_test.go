@@ -6,6 +6,7 @@ import (
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -45,6 +46,21 @@ var _ = Describe("Packet unpacker", func() {
 		Expect(packet.frames).To(BeEmpty())
 	})
 
+	It("marks packets as forward-secure", func() {
+		fsAEAD := &mockForwardSecureAEAD{forwardSecure: true}
+		aead = fsAEAD
+		unpacker.aead = fsAEAD
+		setReader(nil)
+		packet, err := unpacker.Unpack(hdrBin, hdr, r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet.forwardSecure).To(BeTrue())
+		fsAEAD.forwardSecure = false
+		setReader(nil)
+		packet, err = unpacker.Unpack(hdrBin, hdr, r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet.forwardSecure).To(BeFalse())
+	})
+
 	It("unpacks stream frames", func() {
 		f := &frames.StreamFrame{
 			StreamID: 1,
@@ -58,6 +74,45 @@ var _ = Describe("Packet unpacker", func() {
 		Expect(packet.frames).To(Equal([]frames.Frame{f}))
 	})
 
+	Context("limiting the number of STREAM frames", func() {
+		writeStreamFrames := func(n int) {
+			for i := 0; i < n; i++ {
+				f := &frames.StreamFrame{StreamID: 5, Offset: protocol.ByteCount(i), Data: []byte{'f'}, DataLenPresent: true}
+				err := f.Write(buf, 0)
+				Expect(err).ToNot(HaveOccurred())
+			}
+		}
+
+		BeforeEach(func() {
+			unpacker.maxStreamFrames = 3
+		})
+
+		It("accepts packets with up to the maximum number of STREAM frames", func() {
+			writeStreamFrames(3)
+			setReader(buf.Bytes())
+			packet, err := unpacker.Unpack(hdrBin, hdr, r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(packet.frames).To(HaveLen(3))
+		})
+
+		It("errors on packets with too many STREAM frames", func() {
+			writeStreamFrames(100)
+			setReader(buf.Bytes())
+			_, err := unpacker.Unpack(hdrBin, hdr, r)
+			Expect(err).To(MatchError(errTooManyStreamFrames))
+		})
+
+		It("only counts STREAM frames", func() {
+			writeStreamFrames(3)
+			err := (&frames.PingFrame{}).Write(buf, 0)
+			Expect(err).ToNot(HaveOccurred())
+			setReader(buf.Bytes())
+			packet, err := unpacker.Unpack(hdrBin, hdr, r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(packet.frames).To(HaveLen(4))
+		})
+	})
+
 	It("unpacks ack frames", func() {
 		f := &frames.AckFrame{
 			LargestObserved: 0x13,
@@ -173,9 +228,24 @@ var _ = Describe("Packet unpacker", func() {
 		}))
 	})
 
+	It("unpacks DATAGRAM frames", func() {
+		setReader([]byte{0x08, 0x3, 0x0, 'f', 'o', 'o'})
+		packet, err := unpacker.Unpack(hdrBin, hdr, r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet.frames).To(Equal([]frames.Frame{
+			&frames.DatagramFrame{Data: []byte("foo")},
+		}))
+	})
+
+	It("errors on invalid DATAGRAM frames", func() {
+		setReader([]byte{0x08, 0x3, 0x0, 'f'})
+		_, err := unpacker.Unpack(hdrBin, hdr, r)
+		Expect(err).To(MatchError(qerr.Error(qerr.InvalidFrameData, "unexpected EOF")))
+	})
+
 	It("errors on invalid type", func() {
-		setReader([]byte{0x08})
+		setReader([]byte{0x09})
 		_, err := unpacker.Unpack(hdrBin, hdr, r)
-		Expect(err).To(MatchError("InvalidFrameData: unknown type byte 0x8"))
+		Expect(err).To(MatchError("InvalidFrameData: unknown type byte 0x9"))
 	})
 })
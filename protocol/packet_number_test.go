@@ -193,6 +193,22 @@ var _ = Describe("packet number calculation", func() {
 				}
 			})
 
+			It("works across wrap boundaries", func() {
+				for _, length := range []PacketNumberLen{PacketNumberLen1, PacketNumberLen2, PacketNumberLen4} {
+					boundary := uint64(1) << (length * 8)
+					for i := boundary - 100; i < boundary+100; i++ {
+						packetNumber := PacketNumber(i)
+						highestAcked := PacketNumber(i - 20)
+						length := GetPacketNumberLengthForPublicHeader(packetNumber, highestAcked)
+						wirePacketNumber := (uint64(packetNumber) << (64 - length*8)) >> (64 - length*8)
+
+						// the receiver might not have received the packets sent after the highest acked packet yet
+						Expect(InferPacketNumber(length, highestAcked, PacketNumber(wirePacketNumber))).To(Equal(packetNumber))
+						Expect(InferPacketNumber(length, packetNumber-1, PacketNumber(wirePacketNumber))).To(Equal(packetNumber))
+					}
+				}
+			})
+
 			It("works for packet numbers larger than 2^48", func() {
 				for i := (uint64(1) << 48); i < ((uint64(1) << 63) - 1); i += (uint64(1) << 48) {
 					packetNumber := PacketNumber(i)
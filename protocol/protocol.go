@@ -24,6 +24,9 @@ const (
 	PacketNumberLen6 PacketNumberLen = 6
 )
 
+// MaxPacketNumber is the largest packet number that can be encoded in the public header
+const MaxPacketNumber PacketNumber = 1<<(8*PacketNumberLen6) - 1
+
 // A ConnectionID in QUIC
 type ConnectionID uint64
 
@@ -43,6 +46,10 @@ const MaxPacketSize ByteCount = 1350
 // MaxFrameAndPublicHeaderSize is the maximum size of a QUIC frame plus PublicHeader
 const MaxFrameAndPublicHeaderSize = MaxPacketSize - 1 /*private header*/ - 12 /*crypto signature*/
 
+// MaxDatagramFrameSize is the maximum size of the data in a DatagramFrame
+// It is chosen such that a datagram fits into a packet with the largest possible PublicHeader.
+const MaxDatagramFrameSize = MaxFrameAndPublicHeaderSize - 1 /*public flags*/ - 8 /*connection ID*/ - 32 /*diversification nonce*/ - 6 /*packet number*/ - 3 /*frame header*/
+
 // DefaultTCPMSS is the default maximum packet size used in the Linux TCP implementation.
 // Used in QUIC for congestion window computations in bytes.
 const DefaultTCPMSS ByteCount = 1460
@@ -59,8 +66,12 @@ const InitialIdleConnectionStateLifetime = 30 * time.Second
 // DefaultRetransmissionTime is the RTO time on new connections
 const DefaultRetransmissionTime = 500 * time.Millisecond
 
-// MinRetransmissionTime is the minimum RTO time
-const MinRetransmissionTime = 200 * time.Millisecond
+// DefaultMinRetransmissionTime is the default minimum RTO time.
+// It prevents spurious retransmissions on networks with a very low RTT.
+const DefaultMinRetransmissionTime = 200 * time.Millisecond
+
+// MaxRetransmissionTime is the maximum RTO time, including the exponential backoff
+const MaxRetransmissionTime = 60 * time.Second
 
 // ClientHelloMinimumSize is the minimum size the server expectes an inchoate CHLO to have.
 const ClientHelloMinimumSize = 1024
@@ -13,9 +13,9 @@ const DefaultMaxCongestionWindow PacketNumber = 107
 // InitialCongestionWindow is the initial congestion window in QUIC packets
 const InitialCongestionWindow PacketNumber = 32
 
-// MaxUndecryptablePackets limits the number of undecryptable packets that a
-// session queues for later until it sends a public reset.
-const MaxUndecryptablePackets = 10
+// DefaultMaxUndecryptablePackets is the default limit for the number of undecryptable packets that a
+// session queues for later. Further undecryptable packets are dropped.
+const DefaultMaxUndecryptablePackets = 10
 
 // SmallPacketPayloadSizeThreshold defines a threshold for small packets
 // if the packet payload size (i.e. the packet without public header and private header) is below SmallPacketSizeThreshold, sending will be delayed by SmallPacketSendDelay
@@ -24,6 +24,12 @@ const SmallPacketPayloadSizeThreshold = MaxPacketSize / 2
 // SmallPacketSendDelay is the time delay applied to small packets
 const SmallPacketSendDelay = 500 * time.Microsecond
 
+// MaxPacketsPerSendBatch is the maximum number of packets that are packed and written to the socket at once
+const MaxPacketsPerSendBatch = 10
+
+// DefaultReceiveBatchSize is the default number of packets that are read from the socket at once
+const DefaultReceiveBatchSize = 16
+
 // ReceiveStreamFlowControlWindow is the stream-level flow control window for receiving data
 // This is the value that Google servers are using
 const ReceiveStreamFlowControlWindow ByteCount = (1 << 20) // 1 MB
@@ -32,6 +38,10 @@ const ReceiveStreamFlowControlWindow ByteCount = (1 << 20) // 1 MB
 // This is the value that Google servers are using
 const ReceiveConnectionFlowControlWindow ByteCount = (1 << 20) * 1.5 // 1.5 MB
 
+// DefaultMaxReceiveBufferSize is the default maximum amount of data buffered in all streams of a connection
+// The flow control windows limit the buffered data as well, so this is only reached if the peer violates them for the crypto and header streams.
+const DefaultMaxReceiveBufferSize ByteCount = 2 * ReceiveConnectionFlowControlWindow
+
 // MaxStreamsPerConnection is the maximum value accepted for the number of streams per connection
 const MaxStreamsPerConnection uint32 = 100
 
@@ -45,15 +55,69 @@ const MaxIdleConnectionStateLifetime = 60 * time.Second
 // WindowUpdateNumRepetitions is the number of times the same WindowUpdate frame will be sent to the client
 const WindowUpdateNumRepetitions uint8 = 2
 
+// MaxDatagramQueueLen is the max number of received datagrams stored in each session that were not yet read by the application.
+// Further datagrams are dropped.
+const MaxDatagramQueueLen = 128
+
+// MaxDatagramSendQueueLen is the max number of datagrams queued for sending in each session.
+// Further datagrams are dropped.
+const MaxDatagramSendQueueLen = 128
+
 // MaxSessionUnprocessedPackets is the max number of packets stored in each session that are not yet processed.
 const MaxSessionUnprocessedPackets = 128
 
+// DrainingPeriodRTOs is the length of the draining period of a closed session, in multiples of the RTO
+const DrainingPeriodRTOs = 3
+
+// StatelessResetTokenLen is the length of a stateless reset token
+const StatelessResetTokenLen = 16
+
+// StatelessResetSize is the size of the stateless resets sent by the server.
+// Only packets larger than this trigger a stateless reset, so that two endpoints can't keep resetting each other.
+const StatelessResetSize = 1 + 8 + 1 + 16 + StatelessResetTokenLen
+
+// MaxSessionVersions is the max number of session versions the server remembers for stateless resets.
+// Once it is reached, the version of the oldest session is forgotten.
+const MaxSessionVersions = 1 << 16
+
+// PacketNumberExhaustionMargin is the number of packet numbers below MaxPacketNumber at which a session is closed.
+// The remaining packet numbers are used for the CONNECTION_CLOSE, so that the packet numbers never wrap.
+const PacketNumberExhaustionMargin PacketNumber = 16
+
+// DefaultPacketThreshold is the number of packets sent after a packet that have to be acked, so that it is considered lost and retransmitted
+const DefaultPacketThreshold = 3
+
+// MaxAckDelay is the maximum time the peer is expected to delay sending an ACK
+// Larger delays reported in ACK frames are not subtracted from the RTT samples.
+// This is the value Chrome uses for its delayed ack timer.
+const MaxAckDelay = 25 * time.Millisecond
+
+// MaxTimerJitter is the maximum jitter that can be applied to the retransmission timer, as a fraction of the timeout
+const MaxTimerJitter = 0.5
+
 // RetransmissionThreshold + 1 is the number of times a packet has to be NACKed so that it gets retransmitted
 const RetransmissionThreshold uint8 = 3
 
 // STKExpiryTimeSec is the valid time of a source address token in seconds
 const STKExpiryTimeSec = 24 * 60 * 60
 
+// ServerConfigTTL is the time a server config may be used for 0-RTT handshakes, before it is renewed
+const ServerConfigTTL = 7 * 24 * time.Hour
+
+// StrikeRegisterWindow is the max difference between the timestamp of a client nonce and the current time.
+// The in-memory strike register only has to remember nonces for this time.
+const StrikeRegisterWindow = 10 * time.Minute
+
+// MaxStrikeRegisterEntries is the max number of client nonces remembered by the in-memory strike register.
+// Once it is full, the oldest nonce is forgotten, and nonces that are not newer than it are rejected.
+const MaxStrikeRegisterEntries = 1 << 16
+
+// ServerNonceLifetime is the time a server nonce sent in a REJ is accepted in CHLOs
+const ServerNonceLifetime = 10 * time.Minute
+
+// ServerNonceLen is the length of a server nonce
+const ServerNonceLen = 32
+
 // MaxTrackedSentPackets is maximum number of sent packets saved for either later retransmission or entropy calculation
 // TODO: find a reasonable value here
 // TODO: decrease this value after dropping support for QUIC 33 and earlier
@@ -69,3 +133,7 @@ const CryptoMaxParams = 128
 
 // CryptoParameterMaxLength is the upper limit for the length of a parameter in a crypto message.
 const CryptoParameterMaxLength = 2000
+
+// DefaultMaxCryptoStreamData is the default maximum amount of data of a single handshake message that is buffered from the crypto stream.
+// This is well above the size of any CHLO sent by a client.
+const DefaultMaxCryptoStreamData ByteCount = 16 * (1 << 10) // 16 kB
@@ -1,7 +1,6 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
 	"strconv"
 )
@@ -31,6 +30,15 @@ func VersionTagToNumber(v uint32) VersionNumber {
 	return VersionNumber(((v>>8)&0xff-'0')*100 + ((v>>16)&0xff-'0')*10 + ((v>>24)&0xff - '0'))
 }
 
+// VersionsAsTags encodes the versions as the tags used in the version negotiation packet and the SHLO
+func VersionsAsTags(versions []VersionNumber) []byte {
+	b := make([]byte, 4*len(versions))
+	for i, v := range versions {
+		binary.LittleEndian.PutUint32(b[4*i:], VersionNumberToTag(v))
+	}
+	return b
+}
+
 // IsSupportedVersion returns true if the server supports this version
 func IsSupportedVersion(v VersionNumber) bool {
 	for _, t := range SupportedVersions {
@@ -42,13 +50,7 @@ func IsSupportedVersion(v VersionNumber) bool {
 }
 
 func init() {
-	var b bytes.Buffer
-	for _, v := range SupportedVersions {
-		s := make([]byte, 4)
-		binary.LittleEndian.PutUint32(s, VersionNumberToTag(v))
-		b.Write(s)
-	}
-	SupportedVersionsAsTags = b.Bytes()
+	SupportedVersionsAsTags = VersionsAsTags(SupportedVersions)
 
 	for i := len(SupportedVersions) - 1; i >= 0; i-- {
 		SupportedVersionsAsString += strconv.Itoa(int(SupportedVersions[i]))
@@ -22,6 +22,11 @@ var _ = Describe("Version", func() {
 		Expect(protocol.SupportedVersionsAsTags).To(Equal([]byte("Q030Q031Q032Q033")))
 	})
 
+	It("encodes versions as tags", func() {
+		Expect(protocol.VersionsAsTags([]protocol.VersionNumber{32, 30})).To(Equal([]byte("Q032Q030")))
+		Expect(protocol.VersionsAsTags(nil)).To(BeEmpty())
+	})
+
 	It("has proper version list", func() {
 		Expect(protocol.SupportedVersionsAsString).To(Equal("33,32,31,30"))
 	})
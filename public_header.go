@@ -13,7 +13,6 @@ import (
 var (
 	errPacketNumberLenNotSet          = errors.New("PublicHeader: PacketNumberLen not set")
 	errResetAndVersionFlagSet         = errors.New("PublicHeader: Reset Flag and Version Flag should not be set at the same time")
-	errReceivedTruncatedConnectionID  = qerr.Error(qerr.InvalidPacketHeader, "receiving packets with truncated ConnectionID is not supported")
 	errInvalidConnectionID            = qerr.Error(qerr.InvalidPacketHeader, "connection ID cannot be 0")
 	errGetLengthOnlyForRegularPackets = errors.New("PublicHeader: GetLength can only be called for regular packets")
 )
@@ -116,9 +115,7 @@ func parsePublicHeader(b io.ByteReader) (*publicHeader, error) {
 	// 	return nil, errors.New("diversification nonces should only be sent by servers")
 	// }
 
-	if publicFlagByte&0x08 == 0 {
-		return nil, errReceivedTruncatedConnectionID
-	}
+	header.TruncateConnectionID = publicFlagByte&0x08 == 0
 
 	switch publicFlagByte & 0x30 {
 	case 0x30:
@@ -131,14 +128,16 @@ func parsePublicHeader(b io.ByteReader) (*publicHeader, error) {
 		header.PacketNumberLen = protocol.PacketNumberLen1
 	}
 
-	// Connection ID
-	connID, err := utils.ReadUint64(b)
-	if err != nil {
-		return nil, err
-	}
-	header.ConnectionID = protocol.ConnectionID(connID)
-	if header.ConnectionID == 0 {
-		return nil, errInvalidConnectionID
+	// Connection ID (optional)
+	if !header.TruncateConnectionID {
+		connID, err := utils.ReadUint64(b)
+		if err != nil {
+			return nil, err
+		}
+		header.ConnectionID = protocol.ConnectionID(connID)
+		if header.ConnectionID == 0 {
+			return nil, errInvalidConnectionID
+		}
 	}
 
 	// Version (optional)
@@ -22,10 +22,14 @@ var _ = Describe("Public Header", func() {
 			Expect(b.Len()).To(BeZero())
 		})
 
-		It("does not accept 0-byte connection ID", func() {
+		It("parses a header without a connection ID", func() {
 			b := bytes.NewReader([]byte{0x00, 0x01})
-			_, err := parsePublicHeader(b)
-			Expect(err).To(MatchError(errReceivedTruncatedConnectionID))
+			hdr, err := parsePublicHeader(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.TruncateConnectionID).To(BeTrue())
+			Expect(hdr.ConnectionID).To(BeZero())
+			Expect(hdr.PacketNumber).To(Equal(protocol.PacketNumber(1)))
+			Expect(b.Len()).To(BeZero())
 		})
 
 		It("rejects 0 as a connection ID", func() {
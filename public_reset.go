@@ -2,23 +2,106 @@ package quic
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
 
 	"github.com/lucas-clemente/quic-go/handshake"
 	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
-func writePublicReset(connectionID protocol.ConnectionID, rejectedPacketNumber protocol.PacketNumber, nonceProof uint64) []byte {
+// address families used in the CADR tag
+const (
+	addressFamilyIPv4 = 2
+	addressFamilyIPv6 = 10
+)
+
+var (
+	errPublicResetWrongTag    = qerr.Error(qerr.InvalidPublicRstPacket, "expected a PRST message")
+	errPublicResetMissingRSEQ = qerr.Error(qerr.InvalidPublicRstPacket, "RSEQ missing or invalid")
+	errPublicResetMissingRNON = qerr.Error(qerr.InvalidPublicRstPacket, "RNON missing or invalid")
+	errInvalidClientAddress   = qerr.Error(qerr.InvalidPublicRstPacket, "invalid CADR")
+)
+
+// A publicReset holds the values of the PRST message of a public reset packet
+type publicReset struct {
+	rejectedPacketNumber protocol.PacketNumber // RSEQ
+	nonceProof           uint64                // RNON
+	clientAddr           *net.UDPAddr          // CADR, optional
+}
+
+// parsePublicResetTags parses the PRST message of a public reset packet
+func parsePublicResetTags(r utils.ReadStream) (*publicReset, error) {
+	tag, data, err := handshake.ParseHandshakeMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if tag != handshake.TagPRST {
+		return nil, errPublicResetWrongTag
+	}
+	pr := &publicReset{}
+	rseq, ok := data[handshake.TagRSEQ]
+	if !ok || len(rseq) != 8 {
+		return nil, errPublicResetMissingRSEQ
+	}
+	pr.rejectedPacketNumber = protocol.PacketNumber(binary.LittleEndian.Uint64(rseq))
+	rnon, ok := data[handshake.TagRNON]
+	if !ok || len(rnon) != 8 {
+		return nil, errPublicResetMissingRNON
+	}
+	pr.nonceProof = binary.LittleEndian.Uint64(rnon)
+	if cadr, ok := data[handshake.TagCADR]; ok {
+		pr.clientAddr, err = parseClientAddress(cadr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pr, nil
+}
+
+// parseClientAddress decodes the CADR tag: the address family, the IP and the port
+func parseClientAddress(data []byte) (*net.UDPAddr, error) {
+	if len(data) < 2 {
+		return nil, errInvalidClientAddress
+	}
+	var ipLen int
+	switch binary.LittleEndian.Uint16(data) {
+	case addressFamilyIPv4:
+		ipLen = net.IPv4len
+	case addressFamilyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, errInvalidClientAddress
+	}
+	if len(data) != 2+ipLen+2 {
+		return nil, errInvalidClientAddress
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, data[2:2+ipLen])
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: int(binary.LittleEndian.Uint16(data[2+ipLen:])),
+	}, nil
+}
+
+// writeStatelessReset writes a stateless reset packet.
+// It looks like a regular packet of the session's version with a 1 byte packet number and random payload, ending with the stateless reset token.
+func writeStatelessReset(connectionID protocol.ConnectionID, version protocol.VersionNumber, token []byte) ([]byte, error) {
 	b := &bytes.Buffer{}
-	b.WriteByte(0x0a)
+	// the public flags of a packet with an 8 byte connection ID, see WritePublicHeader
+	if version < protocol.VersionNumber(33) {
+		b.WriteByte(0x0c)
+	} else {
+		b.WriteByte(0x08)
+	}
 	utils.WriteUint64(b, uint64(connectionID))
-	utils.WriteUint32(b, uint32(handshake.TagPRST))
-	utils.WriteUint32(b, 2)
-	utils.WriteUint32(b, uint32(handshake.TagRNON))
-	utils.WriteUint32(b, 8)
-	utils.WriteUint32(b, uint32(handshake.TagRSEQ))
-	utils.WriteUint32(b, 16)
-	utils.WriteUint64(b, nonceProof)
-	utils.WriteUint64(b, uint64(rejectedPacketNumber))
-	return b.Bytes()
+	random := make([]byte, protocol.StatelessResetSize-b.Len()-len(token))
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	b.Write(random)
+	b.Write(token)
+	return b.Bytes(), nil
 }
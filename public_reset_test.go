@@ -1,25 +1,131 @@
 package quic
 
 import (
+	"bytes"
+	"net"
+
+	"github.com/lucas-clemente/quic-go/handshake"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("public reset", func() {
 	Context("writing", func() {
-		It("writes public reset packets", func() {
-			Expect(writePublicReset(0xdeadbeef, 0x8badf00d, 0xdecafbad)).To(Equal([]byte{
-				0x0a,
-				0xef, 0xbe, 0xad, 0xde, 0x00, 0x00, 0x00, 0x00,
-				'P', 'R', 'S', 'T',
-				0x02, 0x00, 0x00, 0x00,
-				'R', 'N', 'O', 'N',
-				0x08, 0x00, 0x00, 0x00,
-				'R', 'S', 'E', 'Q',
-				0x10, 0x00, 0x00, 0x00,
-				0xad, 0xfb, 0xca, 0xde, 0x0, 0x0, 0x0, 0x0,
-				0x0d, 0xf0, 0xad, 0x8b, 0x0, 0x0, 0x0, 0x0,
-			}))
+		It("writes stateless resets", func() {
+			token := bytes.Repeat([]byte{0x42}, protocol.StatelessResetTokenLen)
+			reset, err := writeStatelessReset(0xdeadbeef, 32, token)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reset).To(HaveLen(protocol.StatelessResetSize))
+			Expect(reset[:9]).To(Equal([]byte{0x0c, 0xef, 0xbe, 0xad, 0xde, 0x00, 0x00, 0x00, 0x00}))
+			Expect(reset[len(reset)-len(token):]).To(Equal(token))
+		})
+
+		It("writes the public flags of version 33 stateless resets", func() {
+			reset, err := writeStatelessReset(0xdeadbeef, 33, bytes.Repeat([]byte{0x42}, protocol.StatelessResetTokenLen))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reset[0]).To(Equal(byte(0x08)))
+			hdr, err := parsePublicHeader(bytes.NewReader(reset))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.ConnectionID).To(Equal(protocol.ConnectionID(0xdeadbeef)))
+			Expect(hdr.PacketNumberLen).To(Equal(protocol.PacketNumberLen1))
+		})
+
+		It("parses stateless resets like regular packets", func() {
+			reset, err := writeStatelessReset(0xdeadbeef, 32, bytes.Repeat([]byte{0x42}, protocol.StatelessResetTokenLen))
+			Expect(err).ToNot(HaveOccurred())
+			hdr, err := parsePublicHeader(bytes.NewReader(reset))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hdr.ConnectionID).To(Equal(protocol.ConnectionID(0xdeadbeef)))
+		})
+	})
+
+	Context("PRST tags", func() {
+		parse := func(data map[handshake.Tag][]byte) (*publicReset, error) {
+			b := &bytes.Buffer{}
+			handshake.WriteHandshakeMessage(b, handshake.TagPRST, data)
+			return parsePublicResetTags(bytes.NewReader(b.Bytes()))
+		}
+
+		It("parses RSEQ and RNON", func() {
+			pr, err := parse(map[handshake.Tag][]byte{
+				handshake.TagRSEQ: {0x0d, 0xf0, 0xad, 0x8b, 0x0, 0x0, 0x0, 0x0},
+				handshake.TagRNON: {0xad, 0xfb, 0xca, 0xde, 0x0, 0x0, 0x0, 0x0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pr.rejectedPacketNumber).To(Equal(protocol.PacketNumber(0x8badf00d)))
+			Expect(pr.nonceProof).To(Equal(uint64(0xdecafbad)))
+			Expect(pr.clientAddr).To(BeNil())
+		})
+
+		It("parses an IPv4 CADR", func() {
+			pr, err := parse(map[handshake.Tag][]byte{
+				handshake.TagRSEQ: make([]byte, 8),
+				handshake.TagRNON: make([]byte, 8),
+				handshake.TagCADR: {0x02, 0x00, 192, 168, 13, 37, 0x51, 0x11},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pr.clientAddr.IP.Equal(net.IPv4(192, 168, 13, 37))).To(BeTrue())
+			Expect(pr.clientAddr.IP).To(HaveLen(net.IPv4len))
+			Expect(pr.clientAddr.Port).To(Equal(4433))
+		})
+
+		It("parses an IPv6 CADR", func() {
+			ip := net.ParseIP("2001:db8::1")
+			pr, err := parse(map[handshake.Tag][]byte{
+				handshake.TagRSEQ: make([]byte, 8),
+				handshake.TagRNON: make([]byte, 8),
+				handshake.TagCADR: append(append([]byte{0x0a, 0x00}, ip...), 0xbb, 0x01),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pr.clientAddr).To(Equal(&net.UDPAddr{IP: ip, Port: 443}))
+		})
+
+		It("errors on other messages", func() {
+			b := &bytes.Buffer{}
+			handshake.WriteHandshakeMessage(b, handshake.TagCHLO, map[handshake.Tag][]byte{})
+			_, err := parsePublicResetTags(bytes.NewReader(b.Bytes()))
+			Expect(err).To(MatchError(errPublicResetWrongTag))
+			Expect(qerr.ToQuicError(err).ErrorCode).To(Equal(qerr.InvalidPublicRstPacket))
+		})
+
+		It("errors when RSEQ is missing", func() {
+			b := &bytes.Buffer{}
+			handshake.WriteHandshakeMessage(b, handshake.TagPRST, map[handshake.Tag][]byte{
+				handshake.TagRNON: make([]byte, 8),
+			})
+			_, err := parsePublicResetTags(bytes.NewReader(b.Bytes()))
+			Expect(err).To(MatchError(errPublicResetMissingRSEQ))
+		})
+
+		It("errors when RNON has the wrong length", func() {
+			b := &bytes.Buffer{}
+			handshake.WriteHandshakeMessage(b, handshake.TagPRST, map[handshake.Tag][]byte{
+				handshake.TagRSEQ: make([]byte, 8),
+				handshake.TagRNON: make([]byte, 4),
+			})
+			_, err := parsePublicResetTags(bytes.NewReader(b.Bytes()))
+			Expect(err).To(MatchError(errPublicResetMissingRNON))
+		})
+
+		It("errors on invalid CADRs", func() {
+			for _, cadr := range [][]byte{
+				{0x02},
+				{0x02, 0x00, 127, 0, 0, 1, 0x34},
+				{0x0a, 0x00, 127, 0, 0, 1, 0x34, 0x12},
+				{0x03, 0x00, 127, 0, 0, 1, 0x34, 0x12},
+			} {
+				b := &bytes.Buffer{}
+				handshake.WriteHandshakeMessage(b, handshake.TagPRST, map[handshake.Tag][]byte{
+					handshake.TagRSEQ: make([]byte, 8),
+					handshake.TagRNON: make([]byte, 8),
+					handshake.TagCADR: cadr,
+				})
+				_, err := parsePublicResetTags(bytes.NewReader(b.Bytes()))
+				Expect(err).To(MatchError(errInvalidClientAddress))
+			}
 		})
 	})
 })
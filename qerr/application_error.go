@@ -0,0 +1,29 @@
+package qerr
+
+import "fmt"
+
+// applicationErrorFlag is set in the error code of CONNECTION_CLOSE frames that carry an application error code.
+// It distinguishes application error codes from transport error codes, which are much smaller.
+const applicationErrorFlag ErrorCode = 1 << 31
+
+// MaxApplicationErrorCode is the largest application error code that can be sent
+const MaxApplicationErrorCode = uint32(applicationErrorFlag - 1)
+
+// An ApplicationError is used when the application closes the connection
+type ApplicationError struct {
+	ErrorCode uint32
+	Reason    string
+}
+
+func (e *ApplicationError) Error() string {
+	return fmt.Sprintf("Application error 0x%x: %s", e.ErrorCode, e.Reason)
+}
+
+// ErrorFromConnectionClose returns the error sent in a CONNECTION_CLOSE frame.
+// It returns an ApplicationError if the frame carries an application error code, and a QuicError otherwise.
+func ErrorFromConnectionClose(errorCode ErrorCode, reason string) error {
+	if errorCode&applicationErrorFlag != 0 {
+		return &ApplicationError{ErrorCode: uint32(errorCode &^ applicationErrorFlag), Reason: reason}
+	}
+	return Error(errorCode, reason)
+}
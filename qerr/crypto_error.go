@@ -0,0 +1,44 @@
+package qerr
+
+import "fmt"
+
+// A CryptoError is an error in the crypto handshake, caused by a single tag of a handshake message
+type CryptoError struct {
+	ErrorCode    ErrorCode
+	Tag          uint32 // the offending tag, as a handshake.Tag
+	ErrorMessage string
+}
+
+// CryptoErrorWithTag creates a new CryptoError
+func CryptoErrorWithTag(errorCode ErrorCode, tag uint32, errorMessage string) *CryptoError {
+	return &CryptoError{
+		ErrorCode:    errorCode,
+		Tag:          tag,
+		ErrorMessage: errorMessage,
+	}
+}
+
+// Error returns the same message as a QuicError with the same error code
+func (e *CryptoError) Error() string {
+	return fmt.Sprintf("%s: %s", e.ErrorCode.String(), e.ErrorMessage)
+}
+
+// TagString returns the offending tag as a string, e.g. "SNI"
+func (e *CryptoError) TagString() string {
+	var b []byte
+	for t := e.Tag; t != 0; t >>= 8 {
+		b = append(b, byte(t))
+	}
+	return string(b)
+}
+
+// Is matches its ErrorCode, and QuicErrors with the same error code and message
+func (e *CryptoError) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrorCode:
+		return t == e.ErrorCode
+	case *QuicError:
+		return t.ErrorCode == e.ErrorCode && t.ErrorMessage == e.ErrorMessage
+	}
+	return false
+}
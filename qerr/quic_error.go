@@ -1,6 +1,7 @@
 package qerr
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/lucas-clemente/quic-go/utils"
@@ -32,13 +33,22 @@ func (e *QuicError) Error() string {
 }
 
 // ToQuicError converts an arbitrary error to a QuicError. It leaves QuicErrors
-// unchanged, and properly handles `ErrorCode`s.
+// unchanged, and properly handles `ErrorCode`s, `ApplicationError`s, `CryptoError`s and errors wrapping a QuicError.
 func ToQuicError(err error) *QuicError {
 	switch e := err.(type) {
 	case *QuicError:
 		return e
 	case ErrorCode:
 		return Error(e, "")
+	case *ApplicationError:
+		return Error(applicationErrorFlag|ErrorCode(e.ErrorCode), e.Reason)
+	case *CryptoError:
+		return Error(e.ErrorCode, e.ErrorMessage)
+	}
+	// errors wrapping a QuicError keep its error code, and add their details to the message
+	var quicErr *QuicError
+	if errors.As(err, &quicErr) {
+		return Error(quicErr.ErrorCode, err.Error())
 	}
 	utils.Errorf("Internal error: %v", err)
 	return Error(InternalError, err.Error())
@@ -1,6 +1,8 @@
 package qerr_test
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/lucas-clemente/quic-go/qerr"
@@ -35,8 +37,63 @@ var _ = Describe("Quic error", func() {
 			Expect(qerr.ToQuicError(err)).To(Equal(qerr.Error(qerr.DecryptionFailure, "")))
 		})
 
+		It("sets the application error flag for ApplicationErrors", func() {
+			err := &qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"}
+			Expect(qerr.ToQuicError(err)).To(Equal(qerr.Error(0x80001337, "foobar")))
+		})
+
+		It("keeps the error code of wrapped QuicErrors", func() {
+			err := fmt.Errorf("details: %w", qerr.Error(qerr.DecryptionFailure, "foo"))
+			Expect(qerr.ToQuicError(err)).To(Equal(qerr.Error(qerr.DecryptionFailure, "details: DecryptionFailure: foo")))
+		})
+
 		It("changes default errors to InternalError", func() {
 			Expect(qerr.ToQuicError(io.EOF)).To(Equal(qerr.Error(qerr.InternalError, "EOF")))
 		})
 	})
+
+	Context("ApplicationError", func() {
+		It("has a string representation", func() {
+			err := &qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"}
+			Expect(err.Error()).To(Equal("Application error 0x1337: foobar"))
+		})
+
+		It("is restored from a CONNECTION_CLOSE", func() {
+			quicErr := qerr.ToQuicError(&qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"})
+			err := qerr.ErrorFromConnectionClose(quicErr.ErrorCode, quicErr.ErrorMessage)
+			Expect(err).To(Equal(&qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"}))
+		})
+
+		It("returns QuicErrors for transport error codes", func() {
+			err := qerr.ErrorFromConnectionClose(qerr.PeerGoingAway, "foobar")
+			Expect(err).To(Equal(qerr.Error(qerr.PeerGoingAway, "foobar")))
+		})
+	})
+
+	Context("CryptoError", func() {
+		const tagSNI = 'S' + 'N'<<8 + 'I'<<16
+
+		It("has the same string representation as a QuicError", func() {
+			err := qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, tagSNI, "SNI required")
+			Expect(err.Error()).To(Equal("CryptoMessageParameterNotFound: SNI required"))
+		})
+
+		It("returns the tag as a string", func() {
+			err := qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, tagSNI, "SNI required")
+			Expect(err.TagString()).To(Equal("SNI"))
+		})
+
+		It("matches QuicErrors and ErrorCodes", func() {
+			err := qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, tagSNI, "SNI required")
+			Expect(err).To(MatchError(qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")))
+			Expect(err).To(MatchError(qerr.CryptoMessageParameterNotFound))
+			Expect(errors.Is(err, qerr.Error(qerr.CryptoMessageParameterNotFound, "foobar"))).To(BeFalse())
+			Expect(errors.Is(err, qerr.InternalError)).To(BeFalse())
+		})
+
+		It("is converted to a QuicError", func() {
+			err := qerr.CryptoErrorWithTag(qerr.CryptoMessageParameterNotFound, tagSNI, "SNI required")
+			Expect(qerr.ToQuicError(err)).To(Equal(qerr.Error(qerr.CryptoMessageParameterNotFound, "SNI required")))
+		})
+	})
 })
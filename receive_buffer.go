@@ -0,0 +1,58 @@
+package quic
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/qerr"
+)
+
+var errReceiveBufferExceeded = qerr.Error(qerr.FlowControlReceivedTooMuchData, "connection receive buffer exceeded")
+
+// receiveBuffer counts the data queued in the streamFrameSorters of all streams of a connection
+type receiveBuffer struct {
+	buffered protocol.ByteCount
+	max      protocol.ByteCount
+	mutex    sync.Mutex
+}
+
+func newReceiveBuffer(max protocol.ByteCount) *receiveBuffer {
+	return &receiveBuffer{max: max}
+}
+
+// Reserve adds n bytes to the buffered data
+// It errors if this would exceed the maximum.
+func (b *receiveBuffer) Reserve(n protocol.ByteCount) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.buffered+n > b.max {
+		return errReceiveBufferExceeded
+	}
+	b.buffered += n
+	return nil
+}
+
+// Release removes n bytes from the buffered data
+func (b *receiveBuffer) Release(n protocol.ByteCount) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.buffered -= n
+}
+
+// SetMax sets the maximum amount of buffered data
+func (b *receiveBuffer) SetMax(max protocol.ByteCount) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.max = max
+}
+
+// Buffered returns the amount of buffered data
+func (b *receiveBuffer) Buffered() protocol.ByteCount {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buffered
+}
@@ -0,0 +1,39 @@
+package quic
+
+import (
+	"github.com/lucas-clemente/quic-go/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Receive buffer", func() {
+	var b *receiveBuffer
+
+	BeforeEach(func() {
+		b = newReceiveBuffer(100)
+	})
+
+	It("counts reserved bytes", func() {
+		Expect(b.Reserve(60)).To(Succeed())
+		Expect(b.Reserve(40)).To(Succeed())
+		Expect(b.Buffered()).To(Equal(protocol.ByteCount(100)))
+	})
+
+	It("errors when the maximum is exceeded", func() {
+		Expect(b.Reserve(60)).To(Succeed())
+		Expect(b.Reserve(41)).To(MatchError(errReceiveBufferExceeded))
+		Expect(b.Buffered()).To(Equal(protocol.ByteCount(60)))
+	})
+
+	It("releases bytes", func() {
+		Expect(b.Reserve(100)).To(Succeed())
+		b.Release(30)
+		Expect(b.Buffered()).To(Equal(protocol.ByteCount(70)))
+		Expect(b.Reserve(30)).To(Succeed())
+	})
+
+	It("changes the maximum", func() {
+		b.SetMax(200)
+		Expect(b.Reserve(150)).To(Succeed())
+	})
+})
@@ -3,9 +3,11 @@ package quic
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/crypto"
 	"github.com/lucas-clemente/quic-go/handshake"
@@ -14,6 +16,12 @@ import (
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
+var (
+	errSessionRejected     = qerr.Error(qerr.ConnectionCancelled, "session rejected")
+	errNoSupportedVersions = errors.New("none of the configured versions is supported")
+	errUnknownClientAddr   = qerr.Error(qerr.InvalidPacketHeader, "no session for a packet without a connection ID")
+)
+
 // packetHandler handles packets
 type packetHandler interface {
 	handlePacket(addr interface{}, hdr *publicHeader, data []byte)
@@ -21,22 +29,133 @@ type packetHandler interface {
 	Close(error) error
 }
 
-// A Server of QUIC
+// A Server of QUIC.
+// Unless documented otherwise, options that are left at 0 use the defaults from the protocol package.
+// All options must be set before serving.
 type Server struct {
+	// SocketReceiveBufferSize and SocketSendBufferSize are the sizes of the UDP socket buffers (SO_RCVBUF and SO_SNDBUF).
+	// If 0, the OS defaults are used.
+	SocketReceiveBufferSize int
+	SocketSendBufferSize    int
+
+	// ReceiveBatchSize is the maximum number of packets read from the socket in a single syscall.
+	// It is only used on Linux.
+	ReceiveBatchSize int
+
+	// RewriteOutgoingPacket is called with every packet right before it is written to the socket, e.g. for fault injection.
+	// It can inspect the packet, return a modified packet, or return nil to drop it.
+	// This bypasses the congestion controller and the loss detection: a dropped packet still counts as sent, and is only retransmitted when it is detected as lost.
+	// It is called concurrently for different sessions. If nil, packets are written unmodified.
+	RewriteOutgoingPacket func([]byte) []byte
+	// RewriteIncomingPacket is called with every packet read from the socket, before it is handled.
+	// It can inspect the packet, return a modified packet, or return nil to drop it. If nil, packets are handled unmodified.
+	RewriteIncomingPacket func([]byte) []byte
+
+	// RequireForwardSecrecy makes sessions drop application data until the forward-secure encryption is used.
+	// The dropped data is not acknowledged, so the client retransmits it.
+	RequireForwardSecrecy bool
+
+	// MaxUndecryptablePackets is the maximum number of packets each session queues while it can't decrypt them yet, e.g. because they arrived before the CHLO.
+	// Further undecryptable packets are dropped, see SessionStats.
+	MaxUndecryptablePackets int
+
+	// MinRetransmissionTimeout is the lower bound for the retransmission timeout.
+	// Raising it avoids spurious retransmissions on networks with a very low RTT.
+	MinRetransmissionTimeout time.Duration
+
+	// MaxIdleConnectionStateLifetime is the upper bound for the idle timeout negotiated with the client.
+	// A client asking for a longer idle timeout gets this one.
+	MaxIdleConnectionStateLifetime time.Duration
+
+	// PacketThreshold is the number of packets sent later that have to be acked, so that a missing packet is considered lost and retransmitted.
+	// Raising it avoids spurious retransmissions on paths that reorder packets.
+	// If negative, this loss detection is disabled, and packets are only retransmitted after enough NACKs, by the time threshold, or after an RTO.
+	PacketThreshold int
+
+	// RetransmissionTimerJitter randomizes the retransmission timeout by up to this fraction in both directions, e.g. 0.1 for ±10%.
+	// It prevents many sessions from retransmitting at the same time after a shared path event. It is capped to protocol.MaxTimerJitter.
+	RetransmissionTimerJitter float64
+
+	// OnCongestionWindowChange is called whenever the congestion controller of a session changes the congestion window or the slow start threshold.
+	// It is called from the session's run loop, so it must not block.
+	OnCongestionWindowChange func(connectionID protocol.ConnectionID, congestionWindow, slowStartThreshold protocol.ByteCount)
+
+	// SlowHandshakeThreshold makes sessions log handshakes that take longer than this, with the time to the REJ, the SHLO and the first forward-secure packet.
+	// The log is written at LogLevelInfo. If 0, no handshakes are logged.
+	SlowHandshakeThreshold time.Duration
+
+	// Padding pads outgoing packets with PADDING, to a fixed size or to a random size in a range, see PaddingPolicy.
+	// This hides the sizes of the messages sent on the streams, at the cost of bandwidth. By default, packets are not padded.
+	Padding PaddingPolicy
+
+	// MaxStreamRetransmissions is the number of times the same stream data is retransmitted before the session is closed with a TooManyRtos error.
+	// This closes sessions on a black-holed path before the idle timeout. If 0, stream data is retransmitted until the session times out.
+	MaxStreamRetransmissions int
+
+	// MaxHalfOpenStreams is the number of half-open streams a session tolerates, i.e. streams that were closed by the server, but not by the client with a FIN or a RST_STREAM.
+	// If the client leaves more streams half-open, the session is closed with a TooManyOpenStreams error. If 0, there is no limit.
+	MaxHalfOpenStreams int
+
+	// MaxConsecutiveRTOs is the number of consecutive RTOs without an ACK after which the client is considered unreachable.
+	// When the next RTO fires, the session is closed with a TooManyRtos error. This detects dead clients faster than the idle timeout while data is outstanding.
+	// If 0, the session is only closed by the idle timeout.
+	MaxConsecutiveRTOs int
+
+	// MaxStreamFramesPerPacket limits the number of STREAM frames in a single packet. This bounds the work done for every packet, together with the gap limit of the streams.
+	// If a packet contains more STREAM frames, the session is closed with an InvalidStreamData error. If 0, there is no limit.
+	MaxStreamFramesPerPacket int
+
+	// MaxConnectionMemory limits the memory used by the buffers of a session: the stream data queued for sending, the data received on its streams that wasn't read yet, and the queued undecryptable packets.
+	// The application can queue as much stream data as the client's flow control windows allow, so the budget should not be smaller than those.
+	// It is a single budget on top of the limits of the individual buffers. If a session exceeds it, it is closed with a FlowControlReceivedTooMuchData error. If 0, there is no limit.
+	MaxConnectionMemory protocol.ByteCount
+
+	// TolerateIdenticalOverlaps makes sessions accept STREAM frames that overlap with data received before, as long as the overlapping bytes are identical.
+	// This allows clients to retransmit data with different frame boundaries. By default, such frames close the session with an OverlappingStreamData error.
+	TolerateIdenticalOverlaps bool
+
+	// Versions are the QUIC versions that the server accepts, in order of preference. Versions that are not supported are left out.
+	// Clients offering another version receive a version negotiation packet with these versions, and they are announced in the SHLO.
+	// This allows forcing a specific version, e.g. for interop testing. If nil, all versions in protocol.SupportedVersions are accepted.
+	// ListenAndServe and Serve return an error if none of the versions is supported.
+	Versions []protocol.VersionNumber
+
+	// MaxCryptoStreamData is the maximum amount of data of a single handshake message that a session buffers from the crypto stream.
+	// If a client sends a larger handshake message, the handshake fails with a CryptoInvalidValueLength error.
+	MaxCryptoStreamData protocol.ByteCount
+
+	// StrikeRegister detects replayed CHLOs. It is shared by all sessions.
+	// If nil, an in-memory strike register is used, see handshake.NewMemoryStrikeRegister.
+	StrikeRegister handshake.StrikeRegister
+
+	// ForwardSecureAEADs are the AEADs offered to clients for forward-secure packets, in order of preference.
+	// If empty, the forward-secure packets use the same AEAD as the initial packets.
+	ForwardSecureAEADs []handshake.Tag
+
+	// OnNewSession is called for every new session, before it handles its first packet. It can be used to reject clients, e.g. based on the session's RemoteAddr.
+	// If it returns false, the session is closed with a ConnectionCancelled error, and the StreamCallback is never called for it.
+	// It is called from the server's receive loop, so it must not block.
+	OnNewSession func(*Session) bool
+
 	addr *net.UDPAddr
 
-	conn      *net.UDPConn
+	conn      net.PacketConn
+	closed    bool
 	connMutex sync.Mutex
 
 	signer crypto.Signer
 	scfg   *handshake.ServerConfig
 
-	sessions      map[protocol.ConnectionID]packetHandler
-	sessionsMutex sync.RWMutex
+	sessions        map[protocol.ConnectionID]packetHandler
+	sessionVersions map[protocol.ConnectionID]protocol.VersionNumber // the versions of the sessions, kept after they are closed for stateless resets
+	sessionIDs      []protocol.ConnectionID                          // the keys of sessionVersions, oldest first
+	sessionsByAddr  map[string]protocol.ConnectionID                 // the connection IDs of the open sessions by the client's address, for packets without a connection ID
+	sessionAddrs    map[protocol.ConnectionID]string                 // the inverse of sessionsByAddr
+	sessionsMutex   sync.RWMutex
 
 	streamCallback StreamCallback
 
-	newSession func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error)
+	newSession func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, config *sessionConfig) (packetHandler, error)
 }
 
 // NewServer makes a new server
@@ -50,10 +169,11 @@ func NewServer(addr string, tlsConfig *tls.Config, cb StreamCallback) (*Server,
 	if err != nil {
 		return nil, err
 	}
-	scfg, err := handshake.NewServerConfig(kex, signer)
+	scfg, err := handshake.NewServerConfig(kex, signer, nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	scfg.SetClientAuth(tlsConfig.ClientAuth, tlsConfig.ClientCAs)
 
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -61,42 +181,100 @@ func NewServer(addr string, tlsConfig *tls.Config, cb StreamCallback) (*Server,
 	}
 
 	return &Server{
-		addr:           udpAddr,
-		signer:         signer,
-		scfg:           scfg,
-		streamCallback: cb,
-		sessions:       map[protocol.ConnectionID]packetHandler{},
-		newSession:     newSession,
+		addr:            udpAddr,
+		signer:          signer,
+		scfg:            scfg,
+		streamCallback:  cb,
+		sessions:        map[protocol.ConnectionID]packetHandler{},
+		sessionVersions: map[protocol.ConnectionID]protocol.VersionNumber{},
+		sessionsByAddr:  map[string]protocol.ConnectionID{},
+		sessionAddrs:    map[protocol.ConnectionID]string{},
+		newSession:      newSession,
 	}, nil
 }
 
+// ValidateConfig checks that the certificates can be used for handshakes, see handshake.ServerConfig.Validate.
+func (s *Server) ValidateConfig() error {
+	return s.scfg.Validate()
+}
+
 // ListenAndServe listens and serves a connection
 func (s *Server) ListenAndServe() error {
+	if err := s.configure(); err != nil {
+		return err
+	}
 	conn, err := net.ListenUDP("udp", s.addr)
 	if err != nil {
 		return err
 	}
+	if err := setSocketBufferSizes(conn, s.SocketReceiveBufferSize, s.SocketSendBufferSize); err != nil {
+		conn.Close()
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve serves QUIC connections on an existing net.PacketConn.
+// This allows using transports other than UDP, e.g. in-memory connections in tests.
+// The Server's address and socket buffer sizes are not used.
+// If the server was closed before, conn is closed and Serve returns immediately.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if err := s.configure(); err != nil {
+		return err
+	}
 	s.connMutex.Lock()
+	if s.closed {
+		s.connMutex.Unlock()
+		return conn.Close()
+	}
 	s.conn = conn
 	s.connMutex.Unlock()
 
+	reader := newBatchReader(conn, s.ReceiveBatchSize)
 	for {
-		data := make([]byte, protocol.MaxPacketSize)
-		n, remoteAddr, err := conn.ReadFromUDP(data)
+		datagrams, err := reader.readBatch()
 		if err != nil {
-			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+			if strings.HasSuffix(err.Error(), "use of closed network connection") || s.isClosed() {
 				return nil
 			}
 			return err
 		}
-		data = data[:n]
-		if err := s.handlePacket(conn, remoteAddr, data); err != nil {
-			utils.Errorf("error handling packet: %s", err.Error())
+		for _, d := range datagrams {
+			if err := s.handlePacket(conn, d.remoteAddr, d.data); err != nil {
+				utils.Errorf("error handling packet: %s", err.Error())
+			}
 		}
 	}
 }
 
-// Close the server
+// configure checks the options, and applies the handshake options to the server config
+func (s *Server) configure() error {
+	if len(s.versions()) == 0 {
+		return errNoSupportedVersions
+	}
+	if s.StrikeRegister != nil {
+		s.scfg.SetStrikeRegister(s.StrikeRegister)
+	}
+	return s.scfg.SetForwardSecureAEADs(s.ForwardSecureAEADs...)
+}
+
+// LocalAddr returns the local address of the connection the server is serving on, or nil if it is not serving
+func (s *Server) LocalAddr() net.Addr {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+func (s *Server) isClosed() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.conn == nil
+}
+
+// Close the server. A closed server doesn't serve again.
 func (s *Server) Close() error {
 	s.sessionsMutex.Lock()
 	for _, session := range s.sessions {
@@ -111,6 +289,7 @@ func (s *Server) Close() error {
 	s.connMutex.Lock()
 	defer s.connMutex.Unlock()
 
+	s.closed = true
 	if s.conn == nil {
 		return nil
 	}
@@ -120,7 +299,12 @@ func (s *Server) Close() error {
 	return s.conn.Close()
 }
 
-func (s *Server) handlePacket(conn *net.UDPConn, remoteAddr *net.UDPAddr, packet []byte) error {
+func (s *Server) handlePacket(conn net.PacketConn, remoteAddr net.Addr, packet []byte) error {
+	if s.RewriteIncomingPacket != nil {
+		if packet = s.RewriteIncomingPacket(packet); packet == nil {
+			return nil
+		}
+	}
 	if protocol.ByteCount(len(packet)) > protocol.MaxPacketSize {
 		return qerr.PacketTooLarge
 	}
@@ -132,54 +316,199 @@ func (s *Server) handlePacket(conn *net.UDPConn, remoteAddr *net.UDPAddr, packet
 		return qerr.Error(qerr.InvalidPacketHeader, err.Error())
 	}
 	hdr.Raw = packet[:len(packet)-r.Len()]
+	addr := remoteAddr.String()
 
-	// Send Version Negotiation Packet if the client is speaking a different protocol version
-	if hdr.VersionFlag && !protocol.IsSupportedVersion(hdr.VersionNumber) {
-		utils.Infof("Client offered version %d, sending VersionNegotiationPacket", hdr.VersionNumber)
-		_, err = conn.WriteToUDP(composeVersionNegotiation(hdr.ConnectionID), remoteAddr)
-		if err != nil {
-			return err
+	s.sessionsMutex.RLock()
+	if hdr.TruncateConnectionID {
+		// Clients that negotiated TCID=0 may omit the connection ID, so the packet is routed by the client's address.
+		// All packets arrive on the same socket, so the address identifies the 4-tuple of the session.
+		// This only works as long as the client doesn't migrate: a packet without a connection ID from a new address is dropped.
+		connID, ok := s.sessionsByAddr[addr]
+		if !ok {
+			s.sessionsMutex.RUnlock()
+			return errUnknownClientAddr
 		}
-		return nil
+		hdr.ConnectionID = connID
 	}
-
-	s.sessionsMutex.RLock()
 	session, ok := s.sessions[hdr.ConnectionID]
+	addrChanged := s.sessionAddrs[hdr.ConnectionID] != addr
 	s.sessionsMutex.RUnlock()
 
+	// Send Version Negotiation Packet if the client is speaking a different protocol version
+	if hdr.VersionFlag && !s.acceptsVersion(hdr.VersionNumber) {
+		utils.Infof("Client offered version %d, sending VersionNegotiationPacket", hdr.VersionNumber)
+		return s.writeTo(conn, composeVersionNegotiation(hdr.ConnectionID, s.versions()), remoteAddr)
+	}
+
 	if !ok {
 		utils.Infof("Serving new connection: %x, version %d from %v", hdr.ConnectionID, hdr.VersionNumber, remoteAddr)
 		session, err = s.newSession(
-			&udpConn{conn: conn, currentAddr: remoteAddr},
+			&udpConn{conn: conn, currentAddr: remoteAddr, rewrite: s.RewriteOutgoingPacket},
 			hdr.VersionNumber,
 			hdr.ConnectionID,
 			s.scfg,
 			s.streamCallback,
 			s.closeCallback,
+			s.sessionConfig(),
 		)
 		if err != nil {
 			return err
 		}
+		s.sessionsMutex.Lock()
+		s.rememberSessionVersion(hdr.ConnectionID, hdr.VersionNumber)
+		s.sessionsMutex.Unlock()
+		if !s.acceptSession(session) {
+			s.sessionsMutex.Lock()
+			s.sessions[hdr.ConnectionID] = nil
+			s.sessionsMutex.Unlock()
+			return nil
+		}
 		go session.run()
 		s.sessionsMutex.Lock()
 		s.sessions[hdr.ConnectionID] = session
 		s.sessionsMutex.Unlock()
 	}
+	if session != nil && addrChanged {
+		s.sessionsMutex.Lock()
+		// the session might have been closed in the meantime
+		if s.sessions[hdr.ConnectionID] == session {
+			s.rememberSessionAddr(hdr.ConnectionID, addr)
+		}
+		s.sessionsMutex.Unlock()
+	}
 	if session == nil {
 		// Late packet for closed session
-		return nil
+		s.sessionsMutex.RLock()
+		version := s.sessionVersions[hdr.ConnectionID]
+		s.sessionsMutex.RUnlock()
+		return s.sendStatelessReset(conn, remoteAddr, hdr.ConnectionID, version, len(packet))
 	}
 	session.handlePacket(remoteAddr, hdr, packet[len(packet)-r.Len():])
 	return nil
 }
 
+// rememberSessionVersion stores the version of a session for stateless resets.
+// At most protocol.MaxSessionVersions are kept, the oldest one is dropped first.
+// The caller must hold the sessionsMutex.
+func (s *Server) rememberSessionVersion(id protocol.ConnectionID, v protocol.VersionNumber) {
+	if len(s.sessionIDs) >= protocol.MaxSessionVersions {
+		delete(s.sessionVersions, s.sessionIDs[0])
+		s.sessionIDs = s.sessionIDs[1:]
+	}
+	s.sessionVersions[id] = v
+	s.sessionIDs = append(s.sessionIDs, id)
+}
+
+// rememberSessionAddr routes packets without a connection ID from addr to the session with the connection ID id.
+// The session's previous address isn't used any more. The caller must hold the sessionsMutex.
+func (s *Server) rememberSessionAddr(id protocol.ConnectionID, addr string) {
+	s.forgetSessionAddr(id)
+	if oldID, ok := s.sessionsByAddr[addr]; ok {
+		delete(s.sessionAddrs, oldID)
+	}
+	s.sessionsByAddr[addr] = id
+	s.sessionAddrs[id] = addr
+}
+
+// forgetSessionAddr removes the address of a session. The caller must hold the sessionsMutex.
+func (s *Server) forgetSessionAddr(id protocol.ConnectionID) {
+	if addr, ok := s.sessionAddrs[id]; ok {
+		delete(s.sessionsByAddr, addr)
+		delete(s.sessionAddrs, id)
+	}
+}
+
+// acceptSession asks OnNewSession whether a new session is accepted, and closes it if not
+func (s *Server) acceptSession(session packetHandler) bool {
+	sess, ok := session.(*Session)
+	if !ok || s.OnNewSession == nil || s.OnNewSession(sess) {
+		return true
+	}
+	utils.Infof("Rejecting connection %x from %v", sess.connectionID, sess.RemoteAddr())
+	sess.Close(errSessionRejected)
+	return false
+}
+
+// sendStatelessReset tells the client that the session is gone.
+// Only packets larger than the stateless reset are answered, so that two endpoints can't keep resetting each other.
+func (s *Server) sendStatelessReset(conn net.PacketConn, remoteAddr net.Addr, connectionID protocol.ConnectionID, version protocol.VersionNumber, packetSize int) error {
+	if packetSize <= protocol.StatelessResetSize {
+		return nil
+	}
+	reset, err := writeStatelessReset(connectionID, version, s.scfg.StatelessResetToken(connectionID))
+	if err != nil {
+		return err
+	}
+	return s.writeTo(conn, reset, remoteAddr)
+}
+
+// writeTo writes a packet that doesn't belong to a session, applying the RewriteOutgoingPacket hook
+func (s *Server) writeTo(conn net.PacketConn, p []byte, remoteAddr net.Addr) error {
+	if s.RewriteOutgoingPacket != nil {
+		if p = s.RewriteOutgoingPacket(p); p == nil {
+			return nil
+		}
+	}
+	_, err := conn.WriteTo(p, remoteAddr)
+	return err
+}
+
+func (s *Server) sessionConfig() *sessionConfig {
+	config := &sessionConfig{
+		requireForwardSecrecy:          s.RequireForwardSecrecy,
+		maxUndecryptablePackets:        s.MaxUndecryptablePackets,
+		minRetransmissionTime:          s.MinRetransmissionTimeout,
+		maxIdleConnectionStateLifetime: s.MaxIdleConnectionStateLifetime,
+		packetThreshold:                s.PacketThreshold,
+		timerJitter:                    s.RetransmissionTimerJitter,
+		onCongestionWindowChange:       s.OnCongestionWindowChange,
+		slowHandshakeThreshold:         s.SlowHandshakeThreshold,
+		padding:                        s.Padding,
+		maxStreamRetransmissions:       s.MaxStreamRetransmissions,
+		maxHalfOpenStreams:             s.MaxHalfOpenStreams,
+		maxConsecutiveRTOs:             s.MaxConsecutiveRTOs,
+		maxStreamFramesPerPacket:       s.MaxStreamFramesPerPacket,
+		maxCryptoStreamData:            s.MaxCryptoStreamData,
+		maxConnectionMemory:            s.MaxConnectionMemory,
+		tolerateIdenticalOverlaps:      s.TolerateIdenticalOverlaps,
+	}
+	if s.Versions != nil {
+		config.versions = s.versions()
+	}
+	return config
+}
+
+// versions returns the versions that the server accepts, in order of preference
+func (s *Server) versions() []protocol.VersionNumber {
+	if s.Versions == nil {
+		return protocol.SupportedVersions
+	}
+	var versions []protocol.VersionNumber
+	for _, v := range s.Versions {
+		if protocol.IsSupportedVersion(v) {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+func (s *Server) acceptsVersion(v protocol.VersionNumber) bool {
+	for _, t := range s.versions() {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) closeCallback(id protocol.ConnectionID) {
 	s.sessionsMutex.Lock()
 	s.sessions[id] = nil
+	s.forgetSessionAddr(id)
 	s.sessionsMutex.Unlock()
 }
 
-func composeVersionNegotiation(connectionID protocol.ConnectionID) []byte {
+func composeVersionNegotiation(connectionID protocol.ConnectionID, versions []protocol.VersionNumber) []byte {
 	fullReply := &bytes.Buffer{}
 	responsePublicHeader := publicHeader{
 		ConnectionID: connectionID,
@@ -191,6 +520,6 @@ func composeVersionNegotiation(connectionID protocol.ConnectionID) []byte {
 	if err != nil {
 		utils.Errorf("error composing version negotiation packet: %s", err.Error())
 	}
-	fullReply.Write(protocol.SupportedVersionsAsTags)
+	fullReply.Write(protocol.VersionsAsTags(versions))
 	return fullReply.Bytes()
 }
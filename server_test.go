@@ -1,6 +1,9 @@
 package quic
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"net"
 	"time"
 
@@ -8,6 +11,7 @@ import (
 	"github.com/lucas-clemente/quic-go/handshake"
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/testdata"
+	"github.com/lucas-clemente/quic-go/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -15,6 +19,7 @@ import (
 
 type mockSession struct {
 	connectionID protocol.ConnectionID
+	version      protocol.VersionNumber
 	packetCount  int
 	closed       bool
 }
@@ -26,12 +31,62 @@ func (s *mockSession) handlePacket(addr interface{}, hdr *publicHeader, data []b
 func (s *mockSession) run()              {}
 func (s *mockSession) Close(error) error { s.closed = true; return nil }
 
-func newMockSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error) {
+func newMockSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, config *sessionConfig) (packetHandler, error) {
 	return &mockSession{
 		connectionID: connectionID,
+		version:      v,
 	}, nil
 }
 
+type mockAddr string
+
+func (a mockAddr) Network() string { return "mock" }
+func (a mockAddr) String() string  { return string(a) }
+
+// mockPacketConn is an in-memory net.PacketConn
+type mockPacketConn struct {
+	addr        net.Addr
+	dataToRead  chan []byte
+	readFrom    net.Addr
+	dataWritten chan []byte
+	writtenTo   chan net.Addr
+	closed      chan struct{}
+}
+
+var _ net.PacketConn = &mockPacketConn{}
+
+func newMockPacketConn() *mockPacketConn {
+	return &mockPacketConn{
+		addr:        mockAddr("server"),
+		dataToRead:  make(chan []byte, 10),
+		readFrom:    mockAddr("client"),
+		dataWritten: make(chan []byte, 10),
+		writtenTo:   make(chan net.Addr, 10),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (c *mockPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case data := <-c.dataToRead:
+		return copy(b, data), c.readFrom, nil
+	case <-c.closed:
+		return 0, nil, errors.New("mock connection closed")
+	}
+}
+
+func (c *mockPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.dataWritten <- append([]byte{}, b...)
+	c.writtenTo <- addr
+	return len(b), nil
+}
+
+func (c *mockPacketConn) Close() error                     { close(c.closed); return nil }
+func (c *mockPacketConn) LocalAddr() net.Addr              { return c.addr }
+func (c *mockPacketConn) SetDeadline(time.Time) error      { return nil }
+func (c *mockPacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *mockPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
 var _ = Describe("Server", func() {
 	Describe("with mock session", func() {
 		var (
@@ -40,8 +95,11 @@ var _ = Describe("Server", func() {
 
 		BeforeEach(func() {
 			server = &Server{
-				sessions:   map[protocol.ConnectionID]packetHandler{},
-				newSession: newMockSession,
+				sessions:        map[protocol.ConnectionID]packetHandler{},
+				sessionVersions: map[protocol.ConnectionID]protocol.VersionNumber{},
+				sessionsByAddr:  map[string]protocol.ConnectionID{},
+				sessionAddrs:    map[protocol.ConnectionID]string{},
+				newSession:      newMockSession,
 			}
 		})
 
@@ -50,21 +108,136 @@ var _ = Describe("Server", func() {
 				[]byte{0x01 | 0x08 | 0x04, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 				protocol.SupportedVersionsAsTags...,
 			)
-			Expect(composeVersionNegotiation(1)).To(Equal(expected))
+			Expect(composeVersionNegotiation(1, protocol.SupportedVersions)).To(Equal(expected))
 		})
 
 		It("creates new sessions", func() {
-			err := server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err := server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).connectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(1))
 		})
 
+		It("creates sessions with the version negotiated in a version negotiation round-trip", func() {
+			conn := newMockPacketConn()
+			err := server.handlePacket(conn, mockAddr("client"), []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '0', '0', 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.dataWritten).To(Receive()) // the version negotiation packet
+			Expect(server.sessions).To(BeEmpty())
+			err = server.handlePacket(conn, mockAddr("client"), []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '2', 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.sessions).To(HaveLen(1))
+			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).version).To(Equal(protocol.VersionNumber(32)))
+		})
+
+		It("passes the maximum crypto stream data to the sessions", func() {
+			server.MaxCryptoStreamData = 1337
+			Expect(server.sessionConfig().maxCryptoStreamData).To(Equal(protocol.ByteCount(1337)))
+		})
+
+		It("passes the maximum idle connection state lifetime to the sessions", func() {
+			server.MaxIdleConnectionStateLifetime = 10 * time.Second
+			Expect(server.sessionConfig().maxIdleConnectionStateLifetime).To(Equal(10 * time.Second))
+		})
+
+		It("passes the packet threshold to the sessions", func() {
+			server.PacketThreshold = 10
+			Expect(server.sessionConfig().packetThreshold).To(Equal(10))
+		})
+
+		It("passes the memory limit to the sessions", func() {
+			server.MaxConnectionMemory = 1 << 20
+			Expect(server.sessionConfig().maxConnectionMemory).To(Equal(protocol.ByteCount(1 << 20)))
+		})
+
+		It("passes the overlap tolerance to the sessions", func() {
+			Expect(server.sessionConfig().tolerateIdenticalOverlaps).To(BeFalse())
+			server.TolerateIdenticalOverlaps = true
+			Expect(server.sessionConfig().tolerateIdenticalOverlaps).To(BeTrue())
+		})
+
+		Context("restricting the versions", func() {
+			BeforeEach(func() {
+				server.Versions = []protocol.VersionNumber{31, 30, 1337}
+			})
+
+			It("only uses supported versions, in order of preference", func() {
+				Expect(server.versions()).To(Equal([]protocol.VersionNumber{31, 30}))
+				Expect(server.sessionConfig().versions).To(Equal([]protocol.VersionNumber{31, 30}))
+			})
+
+			It("uses all supported versions by default", func() {
+				server.Versions = nil
+				Expect(server.versions()).To(Equal(protocol.SupportedVersions))
+				Expect(server.sessionConfig().versions).To(BeNil())
+			})
+
+			It("sends a version negotiation packet with the configured versions if the client offers another supported version", func() {
+				conn := newMockPacketConn()
+				err := server.handlePacket(conn, mockAddr("client"), []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '2', 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions).To(BeEmpty())
+				var data []byte
+				Expect(conn.dataWritten).To(Receive(&data))
+				Expect(data).To(HaveSuffix("Q031Q030"))
+				Expect(data).ToNot(ContainSubstring("Q032"))
+			})
+
+			It("accepts a forced older version", func() {
+				conn := newMockPacketConn()
+				err := server.handlePacket(conn, mockAddr("client"), []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '0', 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.dataWritten).ToNot(Receive())
+				Expect(server.sessions).To(HaveLen(1))
+				Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).version).To(Equal(protocol.VersionNumber(30)))
+			})
+		})
+
+		Context("rewriting packets", func() {
+			drop := func([]byte) []byte { return nil }
+
+			It("drops incoming packets", func() {
+				server.RewriteIncomingPacket = drop
+				err := server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions).To(BeEmpty())
+			})
+
+			It("rewrites incoming packets", func() {
+				server.RewriteIncomingPacket = func([]byte) []byte {
+					return []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01}
+				}
+				err := server.handlePacket(nil, mockAddr("client"), []byte("foobar"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions).To(HaveKey(protocol.ConnectionID(0x4cfa9f9b668619f6)))
+			})
+
+			It("drops outgoing packets that don't belong to a session", func() {
+				server.RewriteOutgoingPacket = drop
+				conn := newMockPacketConn()
+				err := server.handlePacket(conn, mockAddr("client"), []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '0', '0', 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.dataWritten).ToNot(Receive())
+			})
+
+			It("passes the outgoing hook to the connection of new sessions", func() {
+				server.RewriteOutgoingPacket = bytes.ToUpper
+				var conn connection
+				server.newSession = func(c connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, config *sessionConfig) (packetHandler, error) {
+					conn = c
+					return newMockSession(c, v, connectionID, sCfg, streamCallback, closeCallback, config)
+				}
+				err := server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.(*udpConn).rewrite([]byte("foobar"))).To(Equal([]byte("FOOBAR")))
+			})
+		})
+
 		It("assigns packets to existing sessions", func() {
-			err := server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err := server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
 			Expect(err).ToNot(HaveOccurred())
-			err = server.handlePacket(nil, nil, []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			err = server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
 			Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).connectionID).To(Equal(protocol.ConnectionID(0x4cfa9f9b668619f6)))
@@ -73,7 +246,7 @@ var _ = Describe("Server", func() {
 
 		It("closes and deletes sessions", func() {
 			pheader := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x51, 0x30, 0x33, 0x32, 0x01}
-			err := server.handlePacket(nil, nil, append(pheader, (&crypto.NullAEAD{}).Seal(0, pheader, nil)...))
+			err := server.handlePacket(nil, mockAddr("client"), append(pheader, (&crypto.NullAEAD{}).Seal(0, pheader, nil)...))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(server.sessions).To(HaveLen(1))
 			server.closeCallback(0x4cfa9f9b668619f6)
@@ -82,6 +255,100 @@ var _ = Describe("Server", func() {
 			Expect(server.sessions[0x4cfa9f9b668619f6]).To(BeNil())
 		})
 
+		Context("packets without a connection ID", func() {
+			BeforeEach(func() {
+				err := server.handlePacket(nil, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("routes them by the client's address", func() {
+				err := server.handlePacket(nil, mockAddr("client"), []byte{0x00, 0x02})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions).To(HaveLen(1))
+				Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(2))
+				err = server.handlePacket(nil, mockAddr("other client"), []byte{0x00, 0x03})
+				Expect(err).To(MatchError(errUnknownClientAddr))
+				Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(2))
+			})
+
+			It("uses the address of the last packet with a connection ID", func() {
+				err := server.handlePacket(nil, mockAddr("migrated client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x02})
+				Expect(err).ToNot(HaveOccurred())
+				err = server.handlePacket(nil, mockAddr("migrated client"), []byte{0x00, 0x03})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessions[0x4cfa9f9b668619f6].(*mockSession).packetCount).To(Equal(3))
+				err = server.handlePacket(nil, mockAddr("client"), []byte{0x00, 0x04})
+				Expect(err).To(MatchError(errUnknownClientAddr))
+			})
+
+			It("forgets the address when the session is closed", func() {
+				server.closeCallback(0x4cfa9f9b668619f6)
+				Expect(server.sessionsByAddr).To(BeEmpty())
+				Expect(server.sessionAddrs).To(BeEmpty())
+				err := server.handlePacket(nil, mockAddr("client"), []byte{0x00, 0x02})
+				Expect(err).To(MatchError(errUnknownClientAddr))
+			})
+		})
+
+		Context("stateless resets", func() {
+			var conn *mockPacketConn
+
+			BeforeEach(func() {
+				var err error
+				server.scfg, err = handshake.NewServerConfig(nil, nil, nil, nil)
+				Expect(err).ToNot(HaveOccurred())
+				conn = newMockPacketConn()
+				server.sessions[0x4cfa9f9b668619f6] = &mockSession{}
+				server.closeCallback(0x4cfa9f9b668619f6)
+			})
+
+			It("sends a stateless reset for late packets of closed sessions", func() {
+				packet := append([]byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01}, make([]byte, 100)...)
+				err := server.handlePacket(conn, mockAddr("client"), packet)
+				Expect(err).ToNot(HaveOccurred())
+				var reset []byte
+				Expect(conn.dataWritten).To(Receive(&reset))
+				Expect(reset).To(HaveLen(protocol.StatelessResetSize))
+				Expect(reset[:9]).To(Equal([]byte{0x0c, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c}))
+				Expect(reset[len(reset)-protocol.StatelessResetTokenLen:]).To(Equal(server.scfg.StatelessResetToken(0x4cfa9f9b668619f6)))
+				Expect(conn.writtenTo).To(Receive(Equal(mockAddr("client"))))
+			})
+
+			It("uses the public flags of the session's version", func() {
+				server.sessionVersions[0x4cfa9f9b668619f6] = 33
+				packet := append([]byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01}, make([]byte, 100)...)
+				err := server.handlePacket(conn, mockAddr("client"), packet)
+				Expect(err).ToNot(HaveOccurred())
+				var reset []byte
+				Expect(conn.dataWritten).To(Receive(&reset))
+				Expect(reset[0]).To(Equal(byte(0x08)))
+			})
+
+			It("remembers the versions of sessions", func() {
+				packet := append([]byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '3', 0x01}, make([]byte, 100)...)
+				delete(server.sessions, 0x4cfa9f9b668619f6)
+				err := server.handlePacket(conn, mockAddr("client"), packet)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(server.sessionVersions[0x4cfa9f9b668619f6]).To(Equal(protocol.VersionNumber(33)))
+			})
+
+			It("only remembers a limited number of session versions", func() {
+				for i := 0; i < protocol.MaxSessionVersions+1; i++ {
+					server.rememberSessionVersion(protocol.ConnectionID(i), 33)
+				}
+				Expect(server.sessionVersions).To(HaveLen(protocol.MaxSessionVersions))
+				Expect(server.sessionVersions).ToNot(HaveKey(protocol.ConnectionID(0)))
+				Expect(server.sessionVersions).To(HaveKey(protocol.ConnectionID(protocol.MaxSessionVersions)))
+			})
+
+			It("doesn't send stateless resets in response to small packets", func() {
+				packet := append([]byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01}, make([]byte, protocol.StatelessResetSize-10)...)
+				err := server.handlePacket(conn, mockAddr("client"), packet)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.dataWritten).ToNot(Receive())
+			})
+		})
+
 		It("closes sessions when Close is called", func() {
 			session := &mockSession{}
 			server.sessions[1] = session
@@ -164,4 +431,157 @@ var _ = Describe("Server", func() {
 		err = server.Close()
 		Expect(err).ToNot(HaveOccurred())
 	}, 1)
+
+	Context("OnNewSession", func() {
+		var (
+			server               *Server
+			conn                 *mockPacketConn
+			streamCallbackCalled bool
+		)
+
+		packet := []byte{0x09, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 'Q', '0', '3', '2', 0x01}
+		connID := protocol.ConnectionID(0x4cfa9f9b668619f6)
+
+		BeforeEach(func() {
+			var err error
+			streamCallbackCalled = false
+			server, err = NewServer("", testdata.GetTLSConfig(), func(*Session, utils.Stream) { streamCallbackCalled = true })
+			Expect(err).ToNot(HaveOccurred())
+			conn = newMockPacketConn()
+		})
+
+		It("closes sessions that are rejected", func() {
+			var rejected *Session
+			server.OnNewSession = func(s *Session) bool {
+				rejected = s
+				return false
+			}
+			err := server.handlePacket(conn, mockAddr("client"), packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rejected).ToNot(BeNil())
+			Expect(rejected.RemoteAddr()).To(Equal(mockAddr("client")))
+			Expect(rejected.Context().Done()).To(BeClosed())
+			Expect(conn.dataWritten).To(Receive()) // the CONNECTION_CLOSE
+			Expect(server.sessions).To(HaveKeyWithValue(connID, BeNil()))
+			Expect(streamCallbackCalled).To(BeFalse())
+		})
+
+		It("serves sessions that are accepted", func() {
+			var accepted *Session
+			server.OnNewSession = func(s *Session) bool {
+				accepted = s
+				accepted.drainingTimeout = time.Nanosecond
+				return true
+			}
+			err := server.handlePacket(conn, mockAddr("client"), packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(accepted).ToNot(BeNil())
+			Expect(server.sessions[connID]).To(Equal(accepted))
+			Expect(accepted.Context().Done()).ToNot(BeClosed())
+			accepted.Close(nil)
+		})
+	})
+
+	It("refuses to serve if none of the configured versions is supported", func() {
+		server, err := NewServer("127.0.0.1:0", testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		server.Versions = []protocol.VersionNumber{1337}
+		Expect(server.ListenAndServe()).To(MatchError(errNoSupportedVersions))
+		Expect(server.Serve(newMockPacketConn())).To(MatchError(errNoSupportedVersions))
+		Expect(server.LocalAddr()).To(BeNil())
+	})
+
+	It("refuses to serve if a forward-secure AEAD is not supported", func() {
+		server, err := NewServer("127.0.0.1:0", testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		server.ForwardSecureAEADs = []handshake.Tag{handshake.TagAEAD}
+		Expect(server.ListenAndServe()).To(HaveOccurred())
+		Expect(server.Serve(newMockPacketConn())).To(HaveOccurred())
+		Expect(server.LocalAddr()).To(BeNil())
+	})
+
+	It("validates the certificates", func() {
+		server, err := NewServer("", testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ValidateConfig()).To(Succeed())
+	})
+
+	It("reports missing certificates when validating", func() {
+		server, err := NewServer("", &tls.Config{}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.ValidateConfig()).To(MatchError("no matching certificate found"))
+	})
+
+	It("reports the local address", func(done Done) {
+		server, err := NewServer("127.0.0.1:0", testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.LocalAddr()).To(BeNil())
+		go func() {
+			defer GinkgoRecover()
+			err := server.ListenAndServe()
+			Expect(err).ToNot(HaveOccurred())
+			close(done)
+		}()
+		Eventually(server.LocalAddr).ShouldNot(BeNil())
+		Expect(server.LocalAddr().(*net.UDPAddr).Port).ToNot(BeZero())
+		err = server.Close()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.LocalAddr()).To(BeNil())
+	}, 1)
+
+	It("doesn't serve after it was closed", func() {
+		server, err := NewServer("", testdata.GetTLSConfig(), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.Close()).To(Succeed())
+		conn := newMockPacketConn()
+		Expect(server.Serve(conn)).To(Succeed())
+		Expect(conn.closed).To(BeClosed())
+		Expect(server.LocalAddr()).To(BeNil())
+	})
+
+	Context("serving on a custom net.PacketConn", func() {
+		It("sends version negotiation packets", func(done Done) {
+			server, err := NewServer("", testdata.GetTLSConfig(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			conn := newMockPacketConn()
+			go func() {
+				defer GinkgoRecover()
+				err := server.Serve(conn)
+				Expect(err).ToNot(HaveOccurred())
+				close(done)
+			}()
+
+			conn.dataToRead <- []byte{0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 'Q', '0', '0', '0', 0x01}
+			var data []byte
+			Eventually(conn.dataWritten).Should(Receive(&data))
+			expected := append(
+				[]byte{0xd, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+				protocol.SupportedVersionsAsTags...,
+			)
+			Expect(data).To(Equal(expected))
+			Expect(conn.writtenTo).To(Receive(Equal(mockAddr("client"))))
+
+			err = server.Close()
+			Expect(err).ToNot(HaveOccurred())
+		}, 1)
+
+		It("creates sessions for non-UDP addresses", func() {
+			server, err := NewServer("", testdata.GetTLSConfig(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			conn := newMockPacketConn()
+			server.conn = conn
+			var sessionConn connection
+			server.newSession = func(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, config *sessionConfig) (packetHandler, error) {
+				sessionConn = conn
+				return newMockSession(conn, v, connectionID, sCfg, streamCallback, closeCallback, config)
+			}
+			err = server.handlePacket(conn, mockAddr("client"), []byte{0x08, 0xf6, 0x19, 0x86, 0x66, 0x9b, 0x9f, 0xfa, 0x4c, 0x01})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sessionConn.RemoteAddr()).To(Equal(mockAddr("client")))
+			Expect(sessionConn.IP()).To(BeNil())
+			err = sessionConn.write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.dataWritten).To(Receive(Equal([]byte("foobar"))))
+		})
+	})
 })
@@ -2,13 +2,19 @@ package quic
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/congestion"
 	"github.com/lucas-clemente/quic-go/flowcontrol"
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/handshake"
@@ -27,55 +33,194 @@ var (
 	errRstStreamOnInvalidStream    = errors.New("RST_STREAM received for unknown stream")
 	errWindowUpdateOnInvalidStream = qerr.Error(qerr.InvalidWindowUpdateData, "WINDOW_UPDATE received for unknown stream")
 	errWindowUpdateOnClosedStream  = errors.New("WINDOW_UPDATE received for an already closed stream")
+	errInvalidApplicationErrorCode = errors.New("application error code too large")
+	errInvalidReasonPhrase         = errors.New("reason phrase is not valid UTF-8")
+	errDatagramsNotNegotiated      = errors.New("the peer doesn't support datagrams")
+	errDatagramTooLarge            = errors.New("datagram too large")
+	errUnexpectedDatagram          = qerr.Error(qerr.InvalidFrameData, "received DATAGRAM frame, but datagrams were not negotiated")
+	errTooManyRetransmissions      = qerr.Error(qerr.TooManyRtos, "stream data was retransmitted too often")
+	errTooManyHalfOpenStreams      = qerr.Error(qerr.TooManyOpenStreams, "too many half-open streams")
+	errConnectionMemoryExceeded    = qerr.Error(qerr.FlowControlReceivedTooMuchData, "connection memory limit exceeded")
+	errReservedStreamID            = qerr.Error(qerr.InvalidStreamID, "stream 0 is reserved")
 )
 
-// StreamCallback gets a stream frame and returns a reply frame
+// StreamCallback is called exactly once for every stream opened by the peer.
+// It is called from the session's run loop, so long-running work should be done in a new goroutine.
+// It must not call Session.Close or Session.CloseWithError synchronously, since those wait for the run loop to return.
 type StreamCallback func(*Session, utils.Stream)
 
+// sessionConfig holds the options the Server passes to its sessions
+type sessionConfig struct {
+	// requireForwardSecrecy drops application data that is not forward-secure
+	requireForwardSecrecy bool
+	// maxUndecryptablePackets limits the queue of undecryptable packets, if 0 protocol.DefaultMaxUndecryptablePackets is used
+	maxUndecryptablePackets int
+	// minRetransmissionTime is the lower bound for the RTO, if 0 protocol.DefaultMinRetransmissionTime is used
+	minRetransmissionTime time.Duration
+	// maxIdleConnectionStateLifetime is the upper bound for the negotiated idle timeout, if 0 protocol.MaxIdleConnectionStateLifetime is used
+	maxIdleConnectionStateLifetime time.Duration
+	// packetThreshold is the packet reordering threshold of the loss detection, if 0 protocol.DefaultPacketThreshold is used, if negative it is disabled
+	packetThreshold int
+	// timerJitter is the maximum jitter applied to the retransmission timer, as a fraction of the timeout
+	timerJitter float64
+	// onCongestionWindowChange is called when the congestion window changes, if set
+	onCongestionWindowChange func(connectionID protocol.ConnectionID, congestionWindow, slowStartThreshold protocol.ByteCount)
+	// slowHandshakeThreshold is the handshake duration above which a completed handshake is logged, if 0 no handshakes are logged
+	slowHandshakeThreshold time.Duration
+	// clock is used for the handshake timings, if nil congestion.DefaultClock is used
+	clock congestion.Clock
+	// padding is the PaddingPolicy for outgoing packets
+	padding PaddingPolicy
+	// maxStreamRetransmissions is the number of times stream data is retransmitted before the session is closed, if 0 it is retransmitted until the session times out
+	maxStreamRetransmissions int
+	// maxHalfOpenStreams is the number of streams that we closed, but the peer didn't, above which the session is closed, if 0 there is no limit
+	maxHalfOpenStreams int
+	// maxConsecutiveRTOs is the number of RTOs without an ACK after which the peer is considered unreachable and the session is closed, if 0 there is no limit
+	maxConsecutiveRTOs int
+	// maxStreamFramesPerPacket is the number of STREAM frames in a packet above which the session is closed, if 0 there is no limit
+	maxStreamFramesPerPacket int
+	// versions are the versions announced in the SHLO, if nil protocol.SupportedVersions are announced
+	versions []protocol.VersionNumber
+	// maxCryptoStreamData is the maximum size of a handshake message, if 0 protocol.DefaultMaxCryptoStreamData is used
+	maxCryptoStreamData protocol.ByteCount
+	// maxConnectionMemory is the amount of memory used by the buffers of the session above which the session is closed, if 0 there is no limit
+	maxConnectionMemory protocol.ByteCount
+	// tolerateIdenticalOverlaps makes streams accept STREAM frames that overlap with received data, if the overlapping bytes are identical
+	tolerateIdenticalOverlaps bool
+	// initialPacketNumber is the packet number of the first packet sent, if 0 packet number 1 is used. It makes packet numbers predictable in tests.
+	initialPacketNumber protocol.PacketNumber
+}
+
+// congestionWindowObserver passes changes of the congestion window on to the callback set in the sessionConfig
+type congestionWindowObserver struct {
+	connectionID protocol.ConnectionID
+	callback     func(connectionID protocol.ConnectionID, congestionWindow, slowStartThreshold protocol.ByteCount)
+}
+
+func (o *congestionWindowObserver) OnCongestionWindowChange(congestionWindow, slowStartThreshold protocol.ByteCount) {
+	o.callback(o.connectionID, congestionWindow, slowStartThreshold)
+}
+
+// SessionStats are the counters of a session
+type SessionStats struct {
+	// DroppedUndecryptablePackets is the number of undecryptable packets that were dropped because the queue was full
+	DroppedUndecryptablePackets uint64
+	// HandshakeDuration is the time from the first packet until the first forward-secure packet was received, or 0 if the handshake is not complete
+	HandshakeDuration time.Duration
+	// SendWindow is the number of bytes that can be sent before the session is blocked by connection-level flow control
+	SendWindow protocol.ByteCount
+	// ReceiveWindow is the number of bytes the peer can send before exceeding the connection-level flow control window
+	ReceiveWindow protocol.ByteCount
+}
+
+// A SendLimit is the reason why a session isn't sending more data
+type SendLimit int32
+
+const (
+	// SendLimitNone means that the session sends all the data it has
+	SendLimitNone SendLimit = iota
+	// SendLimitCongestionWindow means that the congestion window is full
+	SendLimitCongestionWindow
+	// SendLimitFlowControl means that the connection-level send window, or the send window of a stream, is used up
+	SendLimitFlowControl
+	// SendLimitPacing means that sending is delayed to fill a packet, see protocol.SmallPacketSendDelay
+	SendLimitPacing
+)
+
+func (l SendLimit) String() string {
+	switch l {
+	case SendLimitNone:
+		return "None"
+	case SendLimitCongestionWindow:
+		return "CongestionWindow"
+	case SendLimitFlowControl:
+		return "FlowControl"
+	case SendLimitPacing:
+		return "Pacing"
+	}
+	return "unknown"
+}
+
 // closeCallback is called when a session is closed
 type closeCallback func(id protocol.ConnectionID)
 
 // A Session is a QUIC session
 type Session struct {
 	connectionID protocol.ConnectionID
+	version      protocol.VersionNumber
 
 	streamCallback StreamCallback
 	closeCallback  closeCallback
 
-	conn connection
+	conn   connection
+	config *sessionConfig
 
 	streams          map[protocol.StreamID]*stream
 	openStreamsCount uint32
 	streamsMutex     sync.RWMutex
+	streamsCond      *sync.Cond // signaled when streams are retired, and when the session is closed
+	streamsErr       error      // the error the session was closed with
 
 	sentPacketHandler     ackhandler.SentPacketHandler
 	receivedPacketHandler ackhandler.ReceivedPacketHandler
 	stopWaitingManager    ackhandler.StopWaitingManager
 	windowUpdateManager   *windowUpdateManager
 	blockedManager        *blockedManager
+	streamAckTracker      *streamAckTracker
+
+	rstStreamFrames      []*frames.RstStreamFrame
+	rstStreamFramesMutex sync.Mutex
 
 	flowController flowcontrol.FlowController // connection level flow controller
+	receiveBuffer  *receiveBuffer             // data buffered in all streams
 
 	unpacker *packetUnpacker
 	packer   *packetPacker
 
 	cryptoSetup *handshake.CryptoSetup
 
-	receivedPackets  chan receivedPacket
-	sendingScheduled chan struct{}
-	closeChan        chan struct{}
-	closed           uint32 // atomic bool
+	receivedPackets   chan receivedPacket
+	receivedDatagrams chan []byte
+	sendingScheduled  chan struct{}
+	flushRequested    int32 // atomic bool, set when a stream is flushed, so that small packets are sent without delay
+	closeChan         chan struct{}
+	closed            uint32 // atomic bool
+
+	// drainingTimeout is the time after closing during which late packets are handled by the session.
+	// If 0, it is protocol.DrainingPeriodRTOs times the RTO.
+	drainingTimeout time.Duration
+	closeDone       chan struct{} // closed when closeImpl returned
+	closedRemotely  bool
+	closePacket     []byte // the CONNECTION_CLOSE packet we sent
 
-	undecryptablePackets []receivedPacket
-	aeadChanged          chan struct{}
+	running     uint32        // atomic bool, set when run() is called
+	runLoopDone chan struct{} // closed when the run loop and the crypto stream handler returned
+
+	ctx       context.Context
+	ctxCancel context.CancelCauseFunc
+
+	undecryptablePackets        []receivedPacket
+	maxUndecryptablePackets     int
+	droppedUndecryptablePackets uint64 // used atomically
+	aeadChanged                 chan struct{}
+
+	handshakeComplete          chan struct{}
+	handshakeCompleteSignalled bool
+	handshakeDuration          int64 // a time.Duration, used atomically
+
+	clock        congestion.Clock
+	creationTime time.Time
 
 	smallPacketDelayedOccurranceTime time.Time
+	sendLimit                        int32 // a SendLimit, set by the run loop and used atomically
+	maxIdleTimeout                   int64 // a time.Duration set by SetIdleTimeout, used atomically. If 0, the negotiated idle timeout is used
 
 	connectionParametersManager *handshake.ConnectionParametersManager
 
+	// The largest packet number that was successfully unpacked.
 	// Used to calculate the next packet number from the truncated wire
 	// representation, and sent back in public reset packets
-	lastRcvdPacketNumber protocol.PacketNumber
+	largestRcvdPacketNumber protocol.PacketNumber
 
 	lastNetworkActivityTime time.Time
 
@@ -85,13 +230,26 @@ type Session struct {
 }
 
 // newSession makes a new session
-func newSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback) (packetHandler, error) {
+func newSession(conn connection, v protocol.VersionNumber, connectionID protocol.ConnectionID, sCfg *handshake.ServerConfig, streamCallback StreamCallback, closeCallback closeCallback, config *sessionConfig) (packetHandler, error) {
 	stopWaitingManager := ackhandler.NewStopWaitingManager()
 	connectionParametersManager := handshake.NewConnectionParamatersManager()
+	if config.maxIdleConnectionStateLifetime != 0 {
+		connectionParametersManager.SetMaxIdleConnectionStateLifetime(config.maxIdleConnectionStateLifetime)
+	}
+	maxUndecryptablePackets := config.maxUndecryptablePackets
+	if maxUndecryptablePackets == 0 {
+		maxUndecryptablePackets = protocol.DefaultMaxUndecryptablePackets
+	}
+	clock := config.clock
+	if clock == nil {
+		clock = congestion.DefaultClock{}
+	}
 
 	session := &Session{
 		connectionID:                connectionID,
+		version:                     v,
 		conn:                        conn,
+		config:                      config,
 		streamCallback:              streamCallback,
 		closeCallback:               closeCallback,
 		streams:                     make(map[protocol.StreamID]*stream),
@@ -101,38 +259,91 @@ func newSession(conn connection, v protocol.VersionNumber, connectionID protocol
 		flowController:              flowcontrol.NewFlowController(0, connectionParametersManager),
 		windowUpdateManager:         newWindowUpdateManager(),
 		blockedManager:              newBlockedManager(),
+		streamAckTracker:            newStreamAckTracker(),
+		receiveBuffer:               newReceiveBuffer(protocol.DefaultMaxReceiveBufferSize),
 		receivedPackets:             make(chan receivedPacket, protocol.MaxSessionUnprocessedPackets),
+		receivedDatagrams:           make(chan []byte, protocol.MaxDatagramQueueLen),
 		closeChan:                   make(chan struct{}, 1),
+		closeDone:                   make(chan struct{}),
+		runLoopDone:                 make(chan struct{}),
 		sendingScheduled:            make(chan struct{}, 1),
 		connectionParametersManager: connectionParametersManager,
-		undecryptablePackets:        make([]receivedPacket, 0, protocol.MaxUndecryptablePackets),
+		undecryptablePackets:        make([]receivedPacket, 0, maxUndecryptablePackets),
+		maxUndecryptablePackets:     maxUndecryptablePackets,
 		aeadChanged:                 make(chan struct{}, 1),
+		handshakeComplete:           make(chan struct{}),
+		clock:                       clock,
+		creationTime:                clock.Now(),
 		timer:                       time.NewTimer(0),
 		lastNetworkActivityTime: time.Now(),
 	}
+	session.sentPacketHandler.SetMinRetransmissionTime(config.minRetransmissionTime)
+	session.sentPacketHandler.SetTimerJitter(config.timerJitter)
+	if config.packetThreshold > 0 {
+		session.sentPacketHandler.SetPacketThreshold(uint32(config.packetThreshold))
+	} else if config.packetThreshold < 0 {
+		session.sentPacketHandler.SetPacketThreshold(0)
+	}
+	session.sentPacketHandler.SetMaxConsecutiveRTOs(uint32(config.maxConsecutiveRTOs))
+	session.sentPacketHandler.SetPacketAckedObserver(session.streamAckTracker)
+	if config.onCongestionWindowChange != nil {
+		session.sentPacketHandler.SetCongestionWindowObserver(&congestionWindowObserver{
+			connectionID: connectionID,
+			callback:     config.onCongestionWindowChange,
+		})
+	}
+	session.ctx, session.ctxCancel = context.WithCancelCause(context.Background())
+	session.streamsCond = sync.NewCond(&session.streamsMutex)
 
 	cryptoStream, _ := session.OpenStream(1)
 	var err error
-	session.cryptoSetup, err = handshake.NewCryptoSetup(connectionID, conn.IP(), v, sCfg, cryptoStream, session.connectionParametersManager, session.aeadChanged)
+	session.cryptoSetup, err = handshake.NewCryptoSetup(connectionID, conn.IP(), v, sCfg, cryptoStream, session.connectionParametersManager, session.aeadChanged, clock)
 	if err != nil {
 		return nil, err
 	}
+	if config.versions != nil {
+		session.cryptoSetup.SetSupportedVersions(config.versions)
+	}
+	if config.maxCryptoStreamData != 0 {
+		session.cryptoSetup.SetMaxCryptoStreamData(config.maxCryptoStreamData)
+	}
 
 	session.packer = newPacketPacker(connectionID, session.cryptoSetup, session.sentPacketHandler, session.connectionParametersManager, session.blockedManager, v)
-	session.unpacker = &packetUnpacker{aead: session.cryptoSetup, version: v}
+	session.packer.padding = config.padding
+	if config.initialPacketNumber != 0 {
+		session.sentPacketHandler.SetInitialPacketNumber(config.initialPacketNumber)
+		session.packer.lastPacketNumber = config.initialPacketNumber - 1
+	}
+	session.unpacker = &packetUnpacker{aead: session.cryptoSetup, version: v, maxStreamFrames: config.maxStreamFramesPerPacket}
 
 	return session, err
 }
 
 // run the session main loop
 func (s *Session) run() {
+	atomic.StoreUint32(&s.running, 1)
+
 	// Start the crypto stream handler
+	cryptoDone := make(chan struct{})
 	go func() {
+		defer close(cryptoDone)
 		if err := s.cryptoSetup.HandleCryptoStream(); err != nil {
-			s.Close(err)
+			s.closeImpl(err, false)
 		}
 	}()
 
+	s.runLoop()
+
+	// The crypto stream handler returns once the crypto stream was closed by closeImpl
+	<-cryptoDone
+	<-s.closeDone
+	s.timer.Stop()
+	d := s.newDrainer()
+	close(s.runLoopDone)
+	d.drain()
+}
+
+func (s *Session) runLoop() {
 	for {
 		// Close immediately if requested
 		select {
@@ -141,6 +352,11 @@ func (s *Session) run() {
 		default:
 		}
 
+		if s.memoryLimitExceeded() {
+			s.closeImpl(errConnectionMemoryExceeded, false)
+			continue
+		}
+
 		s.maybeResetTimer()
 
 		var err error
@@ -157,10 +373,16 @@ func (s *Session) run() {
 		case p := <-s.receivedPackets:
 			err = s.handlePacketImpl(p.remoteAddr, p.publicHeader, p.data)
 			if qErr, ok := err.(*qerr.QuicError); ok && qErr.ErrorCode == qerr.DecryptionFailure {
+				if s.isStatelessReset(p.data) {
+					s.closeImpl(qerr.Error(qerr.PublicReset, "received a stateless reset"), true)
+					continue
+				}
 				s.tryQueueingUndecryptablePacket(p)
 				continue
 			}
 		case <-s.aeadChanged:
+			// the connection options were received in the CHLO that changed the AEAD
+			s.sentPacketHandler.SetConnectionOptions(s.connectionParametersManager.GetConnectionOptions())
 			s.tryDecryptingQueuedPackets()
 		}
 
@@ -174,22 +396,79 @@ func (s *Session) run() {
 			case errWindowUpdateOnClosedStream:
 				// Can happen when we already sent the last StreamFrame with the FinBit, but the client already sent a WindowUpdate for this Stream
 			default:
-				s.Close(err)
+				s.closeImpl(err, false)
 			}
 		}
 
 		if err := s.maybeSendPacket(); err != nil {
-			s.Close(err)
+			s.closeImpl(err, false)
 		}
-		if time.Now().Sub(s.lastNetworkActivityTime) > s.connectionParametersManager.GetIdleConnectionStateLifetime() {
-			s.Close(qerr.Error(qerr.NetworkIdleTimeout, "No recent network activity."))
+		if time.Now().Sub(s.lastNetworkActivityTime) > s.idleTimeout() {
+			s.closeImpl(qerr.Error(qerr.NetworkIdleTimeout, "No recent network activity."), false)
 		}
 		s.garbageCollectStreams()
+		if s.tooManyHalfOpenStreams() {
+			s.closeImpl(errTooManyHalfOpenStreams, false)
+		}
+	}
+}
+
+// A drainer handles packets received after the session was closed.
+// If we closed the session, late packets are answered by repeating our CONNECTION_CLOSE, with an exponential backoff.
+// If the peer closed it, they are discarded.
+// The session is removed from the server when the draining period is over, so that late packets don't create a new session.
+type drainer struct {
+	connectionID    protocol.ConnectionID
+	conn            connection
+	receivedPackets <-chan receivedPacket
+	closePacket     []byte
+	timeout         time.Duration
+	closeCallback   closeCallback
+}
+
+func (s *Session) newDrainer() *drainer {
+	d := &drainer{
+		connectionID:    s.connectionID,
+		conn:            s.conn,
+		receivedPackets: s.receivedPackets,
+		timeout:         s.drainingTimeout,
+		closeCallback:   s.closeCallback,
+	}
+	if !s.closedRemotely {
+		d.closePacket = s.closePacket
+	}
+	if d.timeout == 0 {
+		d.timeout = protocol.DrainingPeriodRTOs * s.sentPacketHandler.RetransmissionTimeout()
+	}
+	return d
+}
+
+func (d *drainer) drain() {
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	var numLatePackets uint64
+	for {
+		select {
+		case <-d.receivedPackets:
+			numLatePackets++
+			// only respond to the 1st, 2nd, 4th, 8th, ... late packet
+			if d.closePacket == nil || numLatePackets&(numLatePackets-1) != 0 {
+				continue
+			}
+			utils.Debugf("-> Repeating CONNECTION_CLOSE for late packet")
+			if err := d.conn.write(d.closePacket); err != nil {
+				utils.Errorf("error repeating CONNECTION_CLOSE: %s", err.Error())
+			}
+		case <-timer.C:
+			d.closeCallback(d.connectionID)
+			return
+		}
 	}
 }
 
 func (s *Session) maybeResetTimer() {
-	nextDeadline := s.lastNetworkActivityTime.Add(s.connectionParametersManager.GetIdleConnectionStateLifetime())
+	nextDeadline := s.lastNetworkActivityTime.Add(s.idleTimeout())
 
 	if !s.smallPacketDelayedOccurranceTime.IsZero() {
 		// nextDeadline = utils.MinDuration(firstTimeout, s.smallPacketDelayedOccurranceTime.Add(protocol.SmallPacketSendDelay).Sub(now))
@@ -222,10 +501,9 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 	// Calculate packet number
 	hdr.PacketNumber = protocol.InferPacketNumber(
 		hdr.PacketNumberLen,
-		s.lastRcvdPacketNumber,
+		s.largestRcvdPacketNumber,
 		hdr.PacketNumber,
 	)
-	s.lastRcvdPacketNumber = hdr.PacketNumber
 	utils.Debugf("<- Reading packet 0x%x (%d bytes) for connection %x", hdr.PacketNumber, r.Size(), hdr.ConnectionID)
 
 	// TODO: Only do this after authenticating
@@ -235,10 +513,29 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 	if err != nil {
 		return err
 	}
+	// Only authenticated packets move the base for inferring packet numbers,
+	// and reordered packets don't move it backwards
+	if hdr.PacketNumber > s.largestRcvdPacketNumber {
+		s.largestRcvdPacketNumber = hdr.PacketNumber
+	}
 
-	s.receivedPacketHandler.ReceivedPacket(hdr.PacketNumber, packet.entropyBit)
+	// The first forward-secure packet confirms that the client received our SHLO
+	if packet.forwardSecure && !s.handshakeCompleteSignalled {
+		s.handshakeCompleteSignalled = true
+		close(s.handshakeComplete)
+		s.handshakeCompleted(s.clock.Now())
+	}
 
-	for _, ff := range packet.frames {
+	fs := packet.frames
+	if s.config.requireForwardSecrecy && !packet.forwardSecure {
+		fs = s.dropApplicationData(fs)
+	}
+	// don't acknowledge dropped application data, so that the peer retransmits it
+	if len(fs) == len(packet.frames) {
+		s.receivedPacketHandler.ReceivedPacket(hdr.PacketNumber, packet.entropyBit)
+	}
+
+	for _, ff := range fs {
 		var err error
 		switch frame := ff.(type) {
 		case *frames.StreamFrame:
@@ -249,7 +546,7 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 			err = s.handleAckFrame(frame)
 		case *frames.ConnectionCloseFrame:
 			utils.Debugf("\t<- %#v", frame)
-			s.closeImpl(qerr.Error(frame.ErrorCode, frame.ReasonPhrase), true)
+			s.handleConnectionCloseFrame(frame)
 		case *frames.GoawayFrame:
 			utils.Debugf("\t<- %#v", frame)
 			err = errors.New("unimplemented: handling GOAWAY frames")
@@ -266,6 +563,9 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 			utils.Infof("BLOCKED frame received for connection %x stream %d", s.connectionID, frame.StreamID)
 		case *frames.PingFrame:
 			utils.Debugf("\t<- %#v", frame)
+		case *frames.DatagramFrame:
+			utils.Debugf("\t<- &frames.DatagramFrame{Data length: 0x%x}", len(frame.Data))
+			err = s.handleDatagramFrame(frame)
 		default:
 			return errors.New("Session BUG: unexpected frame type")
 		}
@@ -276,6 +576,19 @@ func (s *Session) handlePacketImpl(remoteAddr interface{}, hdr *publicHeader, da
 	return nil
 }
 
+// dropApplicationData removes all StreamFrames except the ones on the crypto stream
+func (s *Session) dropApplicationData(fs []frames.Frame) []frames.Frame {
+	var kept []frames.Frame
+	for _, f := range fs {
+		if sf, ok := f.(*frames.StreamFrame); ok && sf.StreamID != 1 {
+			utils.Debugf("\tDropping non-forward-secure StreamFrame for stream %d", sf.StreamID)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
 // handlePacket handles a packet
 func (s *Session) handlePacket(remoteAddr interface{}, hdr *publicHeader, data []byte) {
 	// Discard packets once the amount of queued packets is larger than
@@ -287,6 +600,9 @@ func (s *Session) handlePacket(remoteAddr interface{}, hdr *publicHeader, data [
 }
 
 func (s *Session) handleStreamFrame(frame *frames.StreamFrame) error {
+	if s.isReservedStreamID(frame.StreamID) {
+		return errReservedStreamID
+	}
 	s.streamsMutex.RLock()
 	str, streamExists := s.streams[frame.StreamID]
 	s.streamsMutex.RUnlock()
@@ -317,6 +633,12 @@ func (s *Session) isValidStreamID(streamID protocol.StreamID) bool {
 	return streamID%2 == 1
 }
 
+// isReservedStreamID checks if a stream ID can never be used for a stream.
+// Stream 0 stands for the connection in WINDOW_UPDATE and BLOCKED frames.
+func (s *Session) isReservedStreamID(streamID protocol.StreamID) bool {
+	return streamID == 0
+}
+
 func (s *Session) handleWindowUpdateFrame(frame *frames.WindowUpdateFrame) error {
 	if frame.StreamID == 0 {
 		updated := s.flowController.UpdateSendWindow(frame.ByteOffset)
@@ -372,8 +694,240 @@ func (s *Session) handleAckFrame(frame *frames.AckFrame) error {
 }
 
 // Close the connection. If err is nil it will be set to qerr.PeerGoingAway.
+// Once the session is running, Close waits until its goroutines returned. Only the handling of late packets during the draining period continues.
+// It must not be called synchronously from the StreamCallback, which runs on the run loop.
 func (s *Session) Close(e error) error {
-	return s.closeImpl(e, false)
+	err := s.closeImpl(e, false)
+	s.waitForRunLoop()
+	return err
+}
+
+// waitForRunLoop waits until the run loop returned, if the session is running.
+// Closes originating from the session itself go through closeImpl, which never waits.
+func (s *Session) waitForRunLoop() {
+	if atomic.LoadUint32(&s.running) == 0 {
+		return
+	}
+	<-s.runLoopDone
+}
+
+// SupportsDatagrams returns true if the client supports datagrams, see SendMessage.
+// It is only meaningful once the CHLO was received.
+func (s *Session) SupportsDatagrams() bool {
+	return s.connectionParametersManager.SupportsDatagrams()
+}
+
+// AllowsMigration returns false if the client announced that it won't migrate the connection to a new address.
+// It is only meaningful once the CHLO was received.
+func (s *Session) AllowsMigration() bool {
+	return s.connectionParametersManager.AllowsMigration()
+}
+
+// PeerCertificates returns the certificate chain the client authenticated with, or nil if it didn't send one.
+// It is only meaningful once the CHLO was received.
+func (s *Session) PeerCertificates() []*x509.Certificate {
+	return s.cryptoSetup.PeerCertificates()
+}
+
+// ServerName returns the SNI the client sent in its CHLO.
+// It is only meaningful once the CHLO was received.
+func (s *Session) ServerName() string {
+	return s.cryptoSetup.ServerName()
+}
+
+// ChannelID returns the channel ID key the client sent encrypted in its CHLO, or nil if it didn't send one.
+// It is only meaningful once the handshake is complete.
+func (s *Session) ChannelID() []byte {
+	return s.cryptoSetup.ChannelID()
+}
+
+// Stats returns the counters of this session
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		DroppedUndecryptablePackets: atomic.LoadUint64(&s.droppedUndecryptablePackets),
+		HandshakeDuration:           time.Duration(atomic.LoadInt64(&s.handshakeDuration)),
+		SendWindow:                  s.flowController.SendWindowSize(),
+		ReceiveWindow:               s.flowController.ReceiveWindowSize(),
+	}
+}
+
+// SendLimitReason returns the limit that currently keeps the session from sending more data.
+// If the congestion window is full, that is reported, even if flow control would limit sending as well.
+func (s *Session) SendLimitReason() SendLimit {
+	limit := SendLimit(atomic.LoadInt32(&s.sendLimit))
+	if limit == SendLimitCongestionWindow {
+		return limit
+	}
+	if s.flowControlBlocked() {
+		return SendLimitFlowControl
+	}
+	return limit
+}
+
+func (s *Session) flowControlBlocked() bool {
+	if s.flowController.SendWindowSize() == 0 {
+		return true
+	}
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	for _, str := range s.streams {
+		if str != nil && str.flowControlBlocked() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Session) setSendLimit(limit SendLimit) {
+	atomic.StoreInt32(&s.sendLimit, int32(limit))
+}
+
+// handshakeCompleted records the handshake duration, and logs the handshake if it was slower than the slowHandshakeThreshold
+func (s *Session) handshakeCompleted(now time.Time) {
+	duration := now.Sub(s.creationTime)
+	atomic.StoreInt64(&s.handshakeDuration, int64(duration))
+	if s.isSlowHandshake(duration) {
+		utils.Infof("Slow handshake: %s", s.handshakePhases(now))
+	}
+}
+
+func (s *Session) isSlowHandshake(duration time.Duration) bool {
+	return s.config.slowHandshakeThreshold > 0 && duration > s.config.slowHandshakeThreshold
+}
+
+// handshakePhases formats the time to the REJ, the SHLO and the first forward-secure packet as key=value pairs.
+// A phase that didn't happen, e.g. the REJ in a 0-RTT handshake, is logged as "-".
+func (s *Session) handshakePhases(fsReceived time.Time) string {
+	rejSent, shloSent := s.cryptoSetup.HandshakeTimes()
+	phase := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Sub(s.creationTime).String()
+	}
+	return fmt.Sprintf("connection=%x duration=%s rej=%s shlo=%s fs=%s", s.connectionID, fsReceived.Sub(s.creationTime), phase(rejSent), phase(shloSent), phase(fsReceived))
+}
+
+// HandshakeComplete returns a channel that is closed once the handshake is complete, i.e. when the first forward-secure packet was received.
+// Data received before that might have been replayed.
+func (s *Session) HandshakeComplete() <-chan struct{} {
+	return s.handshakeComplete
+}
+
+// SetMaxReceiveBufferSize sets the maximum amount of data buffered in all streams.
+// If the peer sends more data than that, the connection is closed with a FlowControlReceivedTooMuchData error.
+func (s *Session) SetMaxReceiveBufferSize(max protocol.ByteCount) {
+	s.receiveBuffer.SetMax(max)
+}
+
+// SetIdleTimeout lowers the idle timeout of the session, e.g. to free the state of inactive clients earlier.
+// The negotiated idle timeout can't be exceeded, longer timeouts are clamped to it. A value of 0 restores the negotiated idle timeout.
+func (s *Session) SetIdleTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&s.maxIdleTimeout, int64(d))
+	// wake up the run loop, so that the timer is reset
+	s.scheduleSending()
+}
+
+// idleTimeout returns the negotiated idle timeout, or the one set by SetIdleTimeout if it is lower
+func (s *Session) idleTimeout() time.Duration {
+	idleTimeout := s.connectionParametersManager.GetIdleConnectionStateLifetime()
+	if max := time.Duration(atomic.LoadInt64(&s.maxIdleTimeout)); max > 0 {
+		return utils.MinDuration(idleTimeout, max)
+	}
+	return idleTimeout
+}
+
+// Context returns a context that is canceled when the session is closed.
+// The *qerr.QuicError (or *qerr.ApplicationError) that closed the session is available via context.Cause.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Version returns the QUIC version used for this session.
+// If the client's first version was not supported, this is the version it chose after version negotiation.
+func (s *Session) Version() protocol.VersionNumber {
+	return s.version
+}
+
+// LocalAddr returns the local address of the connection
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer. It changes when the peer migrates to a new address.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) handleDatagramFrame(frame *frames.DatagramFrame) error {
+	if s.connectionParametersManager.GetMaxDatagramFrameSize() == 0 {
+		return errUnexpectedDatagram
+	}
+	// Discard datagrams once the amount of queued datagrams is larger than
+	// the channel size, protocol.MaxDatagramQueueLen
+	select {
+	case s.receivedDatagrams <- frame.Data:
+	default:
+		utils.Debugf("Dropping datagram, the receive queue is full")
+	}
+	return nil
+}
+
+// SendMessage sends an unreliable datagram.
+// Datagrams are not retransmitted if lost, and may be delivered in any order.
+// They can only be sent if the peer supports them, and must fit into a single packet.
+// If protocol.MaxDatagramSendQueueLen datagrams are already waiting to be sent, e.g. because they are sent faster than congestion control allows, the datagram is dropped.
+func (s *Session) SendMessage(b []byte) error {
+	if s.ctx.Err() != nil {
+		return context.Cause(s.ctx)
+	}
+	maxSize := s.connectionParametersManager.GetMaxDatagramFrameSize()
+	if maxSize == 0 {
+		return errDatagramsNotNegotiated
+	}
+	if protocol.ByteCount(len(b)) > maxSize {
+		return errDatagramTooLarge
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	if !s.packer.AddDatagram(&frames.DatagramFrame{Data: data}) {
+		utils.Debugf("Dropping datagram, the send queue is full")
+		return nil
+	}
+	s.scheduleSending()
+	return nil
+}
+
+// ReceiveMessage blocks until a datagram is received, or the session is closed.
+func (s *Session) ReceiveMessage() ([]byte, error) {
+	select {
+	case b := <-s.receivedDatagrams:
+		return b, nil
+	case <-s.ctx.Done():
+		return nil, context.Cause(s.ctx)
+	}
+}
+
+func (s *Session) handleConnectionCloseFrame(frame *frames.ConnectionCloseFrame) {
+	s.closeImpl(qerr.ErrorFromConnectionClose(frame.ErrorCode, frame.ReasonPhrase), true)
+}
+
+// CloseWithError closes the connection with an application error code and a UTF-8 reason phrase.
+// The peer's streams return a *qerr.ApplicationError carrying both.
+// Like Close, it waits for the run loop to return, and must not be called synchronously from the StreamCallback.
+func (s *Session) CloseWithError(code uint32, reason string) error {
+	if code > qerr.MaxApplicationErrorCode {
+		return errInvalidApplicationErrorCode
+	}
+	if !utf8.ValidString(reason) {
+		return errInvalidReasonPhrase
+	}
+	err := s.closeImpl(&qerr.ApplicationError{ErrorCode: code, Reason: reason}, false)
+	s.waitForRunLoop()
+	return err
 }
 
 func (s *Session) closeImpl(e error, remoteClose bool) error {
@@ -381,6 +935,8 @@ func (s *Session) closeImpl(e error, remoteClose bool) error {
 	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
 		return nil
 	}
+	defer close(s.closeDone)
+	s.closedRemotely = remoteClose
 	s.closeChan <- struct{}{}
 
 	if e == nil {
@@ -388,23 +944,31 @@ func (s *Session) closeImpl(e error, remoteClose bool) error {
 	}
 
 	utils.Errorf("Closing session with error: %s", e.Error())
+	quicErr := qerr.ToQuicError(e)
+	if appErr, ok := e.(*qerr.ApplicationError); ok {
+		s.ctxCancel(appErr)
+	} else {
+		s.ctxCancel(quicErr)
+	}
 	s.closeStreamsWithError(e)
-	s.closeCallback(s.connectionID)
 
 	if remoteClose {
-		return nil
+		if quicErr.ErrorCode == qerr.PublicReset {
+			// the peer lost the connection state, there's nobody to respond to
+			return nil
+		}
+		// respond with a single CONNECTION_CLOSE, all further packets are discarded while draining
+		return s.sendConnectionClose(qerr.Error(qerr.PeerGoingAway, ""))
 	}
 
-	quicErr := qerr.ToQuicError(e)
-	if quicErr.ErrorCode == qerr.DecryptionFailure {
-		return s.sendPublicReset(s.lastRcvdPacketNumber)
-	}
 	return s.sendConnectionClose(quicErr)
 }
 
 func (s *Session) closeStreamsWithError(err error) {
 	s.streamsMutex.Lock()
 	defer s.streamsMutex.Unlock()
+	s.streamsErr = err
+	s.streamsCond.Broadcast()
 	for _, s := range s.streams {
 		if s == nil {
 			continue
@@ -420,8 +984,14 @@ func (s *Session) maybeSendPacket() error {
 	}
 
 	if !s.sentPacketHandler.CongestionAllowsSending() {
+		s.setSendLimit(SendLimitCongestionWindow)
 		return nil
 	}
+	s.setSendLimit(SendLimitNone)
+
+	if atomic.CompareAndSwapInt32(&s.flushRequested, 1, 0) {
+		return s.sendPacket()
+	}
 
 	// always send out retransmissions immediately. No need to check the size of the packet
 	// in the edge cases where a belated ACK was received for a packet that was already queued for retransmission, we might send out a small packet. However, this shouldn't happen very often
@@ -450,6 +1020,7 @@ func (s *Session) maybeSendPacket() error {
 
 	// note that maxPacketSize can get (much) larger than protocol.MaxPacketSize if there is a long queue of StreamFrames
 	maxPacketSize += s.packer.StreamFrameQueueByteLen()
+	maxPacketSize += s.packer.DatagramQueueByteLen()
 
 	if maxPacketSize > protocol.SmallPacketPayloadSizeThreshold {
 		return s.sendPacket()
@@ -462,20 +1033,56 @@ func (s *Session) maybeSendPacket() error {
 	if s.smallPacketDelayedOccurranceTime.IsZero() {
 		s.smallPacketDelayedOccurranceTime = time.Now()
 	}
+	s.setSendLimit(SendLimitPacing)
 
 	return nil
 }
 
 func (s *Session) sendPacket() error {
 	s.smallPacketDelayedOccurranceTime = time.Time{} // zero
+	s.setSendLimit(SendLimitNone)
+
+	// pack as many packets as possible, and write them with a single syscall
+	var batch [][]byte
+	for len(batch) < protocol.MaxPacketsPerSendBatch {
+		packet, err := s.packNextPacket()
+		if err != nil {
+			return err
+		}
+		if packet == nil {
+			break
+		}
+		batch = append(batch, packet.raw)
+		// only continue if the next packet won't be a small one
+		// control frames are only left over if they didn't fit into this packet
+		if !s.sentPacketHandler.ProbablyHasPacketForRetransmission() && !s.packer.HasControlFrames() && s.packer.StreamFrameQueueByteLen() <= protocol.SmallPacketPayloadSizeThreshold {
+			break
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := s.conn.writeBatch(batch); err != nil {
+		return err
+	}
 
+	if !s.packer.Empty() {
+		s.scheduleSending()
+	}
+
+	return nil
+}
+
+func (s *Session) packNextPacket() (*packedPacket, error) {
 	err := s.sentPacketHandler.CheckForError()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !s.sentPacketHandler.CongestionAllowsSending() {
-		return nil
+		s.setSendLimit(SendLimitCongestionWindow)
+		return nil, nil
 	}
 
 	var controlFrames []frames.Frame
@@ -486,10 +1093,16 @@ func (s *Session) sendPacket() error {
 	if retransmitPacket != nil {
 		utils.Debugf("\tDequeueing retransmission for packet 0x%x", retransmitPacket.PacketNumber)
 		s.stopWaitingManager.RegisterPacketForRetransmission(retransmitPacket)
-		// resend the frames that were in the packet
+		// resend the frames that were in the packet, without the data that was acked in other packets
 		controlFrames = append(controlFrames, retransmitPacket.GetControlFramesForRetransmission()...)
 		for _, streamFrame := range retransmitPacket.GetStreamFramesForRetransmission() {
-			s.packer.AddHighPrioStreamFrame(*streamFrame)
+			for _, part := range s.streamAckTracker.UnackedParts(streamFrame) {
+				n := s.streamAckTracker.CountRetransmission(part)
+				if s.config.maxStreamRetransmissions > 0 && n > s.config.maxStreamRetransmissions {
+					return nil, errTooManyRetransmissions
+				}
+				s.packer.AddHighPrioStreamFrame(*part)
+			}
 		}
 	}
 
@@ -499,9 +1112,22 @@ func (s *Session) sendPacket() error {
 		controlFrames = append(controlFrames, wuf)
 	}
 
+	s.rstStreamFramesMutex.Lock()
+	for _, rst := range s.rstStreamFrames {
+		controlFrames = append(controlFrames, rst)
+	}
+	s.rstStreamFrames = nil
+	s.rstStreamFramesMutex.Unlock()
+
+	// after an RTO, make sure to send a retransmittable packet, so that the peer ACKs it
+	if s.sentPacketHandler.ShouldSendProbe() && len(controlFrames) == 0 && s.packer.Empty() {
+		utils.Debugf("\tSending a PING as a probe")
+		controlFrames = append(controlFrames, &frames.PingFrame{})
+	}
+
 	ack, err := s.receivedPacketHandler.GetAckFrame(true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if ack != nil {
 		controlFrames = append(controlFrames, ack)
@@ -511,10 +1137,10 @@ func (s *Session) sendPacket() error {
 	packet, err := s.packer.PackPacket(stopWaitingFrame, controlFrames)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if packet == nil {
-		return nil
+		return nil, nil
 	}
 
 	err = s.sentPacketHandler.SentPacket(&ackhandler.Packet{
@@ -524,23 +1150,14 @@ func (s *Session) sendPacket() error {
 		Length:       protocol.ByteCount(len(packet.raw)),
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	s.stopWaitingManager.SentStopWaitingWithPacket(packet.number)
 
 	s.logPacket(packet)
 
-	err = s.conn.write(packet.raw)
-	if err != nil {
-		return err
-	}
-
-	if !s.packer.Empty() {
-		s.scheduleSending()
-	}
-
-	return nil
+	return packet, nil
 }
 
 func (s *Session) sendConnectionClose(quicErr *qerr.QuicError) error {
@@ -552,6 +1169,7 @@ func (s *Session) sendConnectionClose(quicErr *qerr.QuicError) error {
 		return errors.New("Session BUG: expected packet not to be nil")
 	}
 	s.logPacket(packet)
+	s.closePacket = packet.raw
 	return s.conn.write(packet.raw)
 }
 
@@ -577,6 +1195,20 @@ func (s *Session) queueStreamFrame(frame *frames.StreamFrame) error {
 	return nil
 }
 
+// flush sends the queued stream frames with the next packet, even if the packet is small
+func (s *Session) flush() {
+	atomic.StoreInt32(&s.flushRequested, 1)
+	s.scheduleSending()
+}
+
+// queueRstStreamFrame queues a RST_STREAM frame for sending with the next packet
+func (s *Session) queueRstStreamFrame(frame *frames.RstStreamFrame) {
+	s.rstStreamFramesMutex.Lock()
+	s.rstStreamFrames = append(s.rstStreamFrames, frame)
+	s.rstStreamFramesMutex.Unlock()
+	s.scheduleSending()
+}
+
 // updateReceiveFlowControlWindow updates the flow control window for a stream
 func (s *Session) updateReceiveFlowControlWindow(streamID protocol.StreamID, byteOffset protocol.ByteCount) error {
 	s.windowUpdateManager.SetStreamOffset(streamID, byteOffset)
@@ -594,6 +1226,21 @@ func (s *Session) OpenStream(id protocol.StreamID) (utils.Stream, error) {
 	return s.newStreamImpl(id)
 }
 
+// OpenStreamSync opens a new stream, blocking until the number of open streams is below the negotiated maximum.
+// It unblocks when streams are retired, or when the maximum is raised.
+func (s *Session) OpenStreamSync(id protocol.StreamID) (utils.Stream, error) {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	for s.streamsErr == nil && s.openStreamsCount >= s.connectionParametersManager.GetMaxStreamsPerConnection() {
+		utils.Debugf("Blocked opening stream %d: %d streams open", id, s.openStreamsCount)
+		s.streamsCond.Wait()
+	}
+	if s.streamsErr != nil {
+		return nil, s.streamsErr
+	}
+	return s.newStreamImpl(id)
+}
+
 // GetOrOpenStream returns an existing stream with the given id, or opens a new stream
 func (s *Session) GetOrOpenStream(id protocol.StreamID) (utils.Stream, error) {
 	s.streamsMutex.Lock()
@@ -604,8 +1251,52 @@ func (s *Session) GetOrOpenStream(id protocol.StreamID) (utils.Stream, error) {
 	return s.newStreamImpl(id)
 }
 
+// tooManyHalfOpenStreams checks if the peer keeps more streams open than allowed by the maxHalfOpenStreams, after we closed them
+func (s *Session) tooManyHalfOpenStreams() bool {
+	if s.config.maxHalfOpenStreams == 0 {
+		return false
+	}
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	var n int
+	for _, str := range s.streams {
+		if str != nil && str.halfOpen() {
+			n++
+		}
+	}
+	return n > s.config.maxHalfOpenStreams
+}
+
+// memoryUsage returns the amount of memory used by the buffers of the session:
+// the stream data queued for sending, the data buffered in the streams, and the undecryptable packets.
+// It must only be called from the run loop.
+func (s *Session) memoryUsage() protocol.ByteCount {
+	usage := s.packer.streamFrameQueue.ByteLen() + s.receiveBuffer.Buffered()
+	for _, p := range s.undecryptablePackets {
+		usage += protocol.ByteCount(len(p.data))
+	}
+	return usage
+}
+
+// memoryLimitExceeded checks if the buffers of the session use more memory than the maxConnectionMemory
+func (s *Session) memoryLimitExceeded() bool {
+	return s.config.maxConnectionMemory != 0 && s.memoryUsage() > s.config.maxConnectionMemory
+}
+
+// NumActiveStreams returns the number of streams that are not closed in both directions yet, including the crypto stream.
+// This is the number that is limited by the negotiated maximum number of streams.
+// Streams are retired by the run loop after both directions were closed, so the number may lag behind shortly.
+func (s *Session) NumActiveStreams() int {
+	s.streamsMutex.RLock()
+	defer s.streamsMutex.RUnlock()
+	return int(s.openStreamsCount)
+}
+
 // The streamsMutex is locked by OpenStream or GetOrOpenStream before calling this function.
 func (s *Session) newStreamImpl(id protocol.StreamID) (*stream, error) {
+	if s.isReservedStreamID(id) {
+		return nil, errReservedStreamID
+	}
 	maxAllowedStreams := uint32(protocol.MaxStreamsMultiplier * float32(s.connectionParametersManager.GetMaxStreamsPerConnection()))
 	if s.openStreamsCount >= maxAllowedStreams {
 		return nil, qerr.TooManyOpenStreams
@@ -614,11 +1305,14 @@ func (s *Session) newStreamImpl(id protocol.StreamID) (*stream, error) {
 	if err != nil {
 		return nil, err
 	}
+	stream.frameQueue.receiveBuffer = s.receiveBuffer
+	stream.frameQueue.tolerateIdenticalOverlaps = s.config.tolerateIdenticalOverlaps
 	if s.streams[id] != nil {
 		return nil, fmt.Errorf("Session: stream with ID %d already exists", id)
 	}
 	s.openStreamsCount++
 	s.streams[id] = stream
+	s.streamAckTracker.AddStream(id)
 	return stream, nil
 }
 
@@ -638,15 +1332,17 @@ func (s *Session) garbageCollectStreams() {
 			s.windowUpdateManager.RemoveStream(k)
 		}
 		if v.finished() {
+			v.discardReceivedData()
 			s.openStreamsCount--
+			// The tracker removes streams once all data up to the FIN was acked, until then lost data is retransmitted.
+			if v.failed() {
+				s.streamAckTracker.RemoveStream(k)
+			}
 			s.streams[k] = nil
 		}
 	}
-}
-
-func (s *Session) sendPublicReset(rejectedPacketNumber protocol.PacketNumber) error {
-	utils.Infof("Sending public reset for connection %x, packet number %d", s.connectionID, rejectedPacketNumber)
-	return s.conn.write(writePublicReset(s.connectionID, rejectedPacketNumber, 0))
+	// wake up OpenStreamSync, since streams might have been retired or the maximum might have been raised
+	s.streamsCond.Broadcast()
 }
 
 // scheduleSending signals that we have data for sending
@@ -657,11 +1353,22 @@ func (s *Session) scheduleSending() {
 	}
 }
 
+// isStatelessReset checks if an undecryptable packet ends with the stateless reset token of the client
+func (s *Session) isStatelessReset(data []byte) bool {
+	token := s.connectionParametersManager.PeerStatelessResetToken()
+	if token == nil || len(data) < len(token) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(data[len(data)-len(token):], token) == 1
+}
+
 func (s *Session) tryQueueingUndecryptablePacket(p receivedPacket) {
-	utils.Debugf("Queueing packet 0x%x for later decryption", p.publicHeader.PacketNumber)
-	if len(s.undecryptablePackets)+1 >= protocol.MaxUndecryptablePackets {
-		s.Close(qerr.Error(qerr.DecryptionFailure, "too many undecryptable packets received"))
+	if len(s.undecryptablePackets) >= s.maxUndecryptablePackets {
+		utils.Debugf("Dropping undecryptable packet 0x%x, the queue is full", p.publicHeader.PacketNumber)
+		atomic.AddUint64(&s.droppedUndecryptablePackets, 1)
+		return
 	}
+	utils.Debugf("Queueing packet 0x%x for later decryption", p.publicHeader.PacketNumber)
 	s.undecryptablePackets = append(s.undecryptablePackets, p)
 }
 
@@ -2,6 +2,7 @@ package quic
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -19,11 +20,49 @@ import (
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/qerr"
 	"github.com/lucas-clemente/quic-go/testdata"
+	"github.com/lucas-clemente/quic-go/testutil"
 	"github.com/lucas-clemente/quic-go/utils"
 )
 
+// probeSentPacketHandler requests a probe packet once
+type probeSentPacketHandler struct {
+	ackhandler.SentPacketHandler
+	probe bool
+}
+
+func (h *probeSentPacketHandler) ShouldSendProbe() bool {
+	probe := h.probe
+	h.probe = false
+	return probe
+}
+
+// retransmitSentPacketHandler returns a packet for retransmission once
+type retransmitSentPacketHandler struct {
+	ackhandler.SentPacketHandler
+	packet *ackhandler.Packet
+}
+
+func (h *retransmitSentPacketHandler) DequeuePacketForRetransmission() *ackhandler.Packet {
+	packet := h.packet
+	h.packet = nil
+	return packet
+}
+
+func (h *retransmitSentPacketHandler) ProbablyHasPacketForRetransmission() bool {
+	return h.packet != nil
+}
+
+// congestionLimitedSentPacketHandler doesn't allow sending
+type congestionLimitedSentPacketHandler struct {
+	ackhandler.SentPacketHandler
+}
+
+func (h *congestionLimitedSentPacketHandler) CongestionAllowsSending() bool { return false }
+
 type mockConnection struct {
-	written [][]byte
+	written    [][]byte
+	batches    int
+	remoteAddr net.Addr
 }
 
 func (m *mockConnection) write(p []byte) error {
@@ -31,38 +70,72 @@ func (m *mockConnection) write(p []byte) error {
 	return nil
 }
 
-func (*mockConnection) setCurrentRemoteAddr(addr interface{}) {}
-func (*mockConnection) IP() net.IP                            { return nil }
+func (m *mockConnection) writeBatch(packets [][]byte) error {
+	m.written = append(m.written, packets...)
+	m.batches++
+	return nil
+}
+
+func (m *mockConnection) setCurrentRemoteAddr(addr interface{}) {
+	if a, ok := addr.(net.Addr); ok {
+		m.remoteAddr = a
+	}
+}
+func (*mockConnection) IP() net.IP             { return nil }
+func (*mockConnection) LocalAddr() net.Addr    { return &net.UDPAddr{} }
+func (m *mockConnection) RemoteAddr() net.Addr { return m.remoteAddr }
+
+type mockForwardSecureAEAD struct {
+	crypto.NullAEAD
+	forwardSecure bool
+}
+
+func (a *mockForwardSecureAEAD) ReceivedForwardSecurePacket() bool { return a.forwardSecure }
+
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time          { return c.now }
+func (c *mockClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
 
 var _ = Describe("Session", func() {
 	var (
-		session              *Session
-		streamCallbackCalled bool
-		closeCallbackCalled  bool
-		conn                 *mockConnection
+		session               *Session
+		streamCallbackCalled  bool
+		streamCallbackStreams []utils.Stream
+		closeCallbackCalled   bool
+		conn                  *mockConnection
 	)
 
 	BeforeEach(func() {
 		conn = &mockConnection{}
 		streamCallbackCalled = false
+		streamCallbackStreams = nil
 		closeCallbackCalled = false
 
 		signer, err := crypto.NewProofSource(testdata.GetTLSConfig())
 		Expect(err).ToNot(HaveOccurred())
 		kex, err := crypto.NewCurve25519KEX()
 		Expect(err).NotTo(HaveOccurred())
-		scfg, err := handshake.NewServerConfig(kex, signer)
+		scfg, err := handshake.NewServerConfig(kex, signer, nil, nil)
 		Expect(err).NotTo(HaveOccurred())
 		pSession, err := newSession(
 			conn,
 			0,
 			0,
 			scfg,
-			func(*Session, utils.Stream) { streamCallbackCalled = true },
+			func(_ *Session, s utils.Stream) {
+				streamCallbackCalled = true
+				streamCallbackStreams = append(streamCallbackStreams, s)
+			},
 			func(protocol.ConnectionID) { closeCallbackCalled = true },
+			&sessionConfig{},
 		)
 		Expect(err).NotTo(HaveOccurred())
 		session = pSession.(*Session)
+		session.drainingTimeout = time.Nanosecond // don't block when run() returns
+		session.packer.aead = testutil.NewNonceReuseDetectingAEAD(session.cryptoSetup)
 		Expect(session.streams).To(HaveLen(1)) // Crypto stream
 	})
 
@@ -80,6 +153,48 @@ var _ = Describe("Session", func() {
 			Expect(p).To(Equal([]byte{0xde, 0xca, 0xfb, 0xad}))
 		})
 
+		It("calls the stream callback exactly once per stream", func() {
+			for i := 0; i < 3; i++ {
+				for _, id := range []protocol.StreamID{5, 7} {
+					err := session.handleStreamFrame(&frames.StreamFrame{
+						StreamID: id,
+						Offset:   protocol.ByteCount(i),
+						Data:     []byte{0xde},
+					})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}
+			Expect(streamCallbackStreams).To(HaveLen(2))
+			Expect(streamCallbackStreams[0].StreamID()).To(Equal(protocol.StreamID(5)))
+			Expect(streamCallbackStreams[1].StreamID()).To(Equal(protocol.StreamID(7)))
+		})
+
+		It("doesn't call the stream callback for streams opened locally", func() {
+			_, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     []byte{0xde},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(streamCallbackStreams).To(BeEmpty())
+		})
+
+		It("rejects overlapping data by default", func() {
+			err := session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("ab")})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, Offset: 1, Data: []byte("bc")})
+			Expect(err).To(MatchError(errOverlappingStreamData))
+		})
+
+		It("accepts identical overlapping data, if configured", func() {
+			session.config.tolerateIdenticalOverlaps = true
+			err := session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("ab")})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, Offset: 1, Data: []byte("bc")})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
 		It("rejects streams with even StreamIDs", func() {
 			err := session.handleStreamFrame(&frames.StreamFrame{
 				StreamID: 4,
@@ -88,6 +203,45 @@ var _ = Describe("Session", func() {
 			Expect(err).To(MatchError(qerr.InvalidStreamID))
 		})
 
+		It("rejects STREAM frames on the reserved stream 0", func() {
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 0,
+				Data:     []byte{0xde, 0xca, 0xfb, 0xad},
+			})
+			Expect(err).To(MatchError(errReservedStreamID))
+			Expect(qerr.ToQuicError(err).ErrorCode).To(Equal(qerr.InvalidStreamID))
+			Expect(session.streams).ToNot(HaveKey(protocol.StreamID(0)))
+			Expect(streamCallbackCalled).To(BeFalse())
+		})
+
+		It("doesn't open the reserved stream 0", func() {
+			_, err := session.OpenStream(0)
+			Expect(err).To(MatchError(errReservedStreamID))
+			_, err = session.GetOrOpenStream(0)
+			Expect(err).To(MatchError(errReservedStreamID))
+			Expect(session.streams).ToNot(HaveKey(protocol.StreamID(0)))
+		})
+
+		It("closes the session when receiving a STREAM frame on stream 0", func(done Done) {
+			aead := &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+			buf := &bytes.Buffer{}
+			buf.WriteByte(0x01) // private header
+			err := (&frames.StreamFrame{StreamID: 0, Data: []byte("foobar")}).Write(buf, 0)
+			Expect(err).ToNot(HaveOccurred())
+			hdr := &publicHeader{
+				PacketNumber:    1,
+				PacketNumberLen: protocol.PacketNumberLen6,
+				Raw:             []byte{0x3c},
+			}
+			session.handlePacket(nil, hdr, aead.Seal(1, hdr.Raw, buf.Bytes()))
+			session.run()
+			Expect(context.Cause(session.Context())).To(MatchError(errReservedStreamID))
+			Expect(conn.written).ToNot(BeEmpty())
+			Expect(conn.written[len(conn.written)-1]).To(ContainSubstring("stream 0 is reserved"))
+			close(done)
+		})
+
 		It("does not reject existing streams with even StreamIDs", func() {
 			_, err := session.OpenStream(4)
 			Expect(err).ToNot(HaveOccurred())
@@ -165,6 +319,8 @@ var _ = Describe("Session", func() {
 			session.garbageCollectStreams()
 			Expect(session.streams).To(HaveLen(2))
 			Expect(session.streams[5]).To(BeNil())
+			// the FIN wasn't acked yet, so it's still retransmitted if it is lost
+			Expect(session.streamAckTracker.streams).To(HaveKey(protocol.StreamID(5)))
 		})
 
 		It("closes streams with error", func() {
@@ -185,6 +341,84 @@ var _ = Describe("Session", func() {
 			session.garbageCollectStreams()
 			Expect(session.streams).To(HaveLen(2))
 			Expect(session.streams[5]).To(BeNil())
+			Expect(session.streamAckTracker.streams).ToNot(HaveKey(protocol.StreamID(5)))
+		})
+
+		It("counts the active streams", func() {
+			Expect(session.NumActiveStreams()).To(Equal(1)) // the crypto stream
+			str5, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = session.OpenStream(7)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.NumActiveStreams()).To(Equal(3))
+			// closing one direction doesn't retire the stream
+			str5.Close()
+			session.garbageCollectStreams()
+			Expect(session.NumActiveStreams()).To(Equal(3))
+			err = session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, FinBit: true})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str5.Read(make([]byte, 1))
+			Expect(err).To(MatchError(io.EOF))
+			session.garbageCollectStreams()
+			Expect(session.NumActiveStreams()).To(Equal(2))
+		})
+
+		Context("half-open streams", func() {
+			BeforeEach(func() {
+				session.config.maxHalfOpenStreams = 2
+			})
+
+			openAndClose := func(id protocol.StreamID) {
+				err := session.handleStreamFrame(&frames.StreamFrame{StreamID: id, Data: []byte("foobar")})
+				Expect(err).ToNot(HaveOccurred())
+				err = session.streams[id].Close()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			It("tolerates half-open streams up to the limit", func() {
+				openAndClose(5)
+				openAndClose(7)
+				Expect(session.tooManyHalfOpenStreams()).To(BeFalse())
+				openAndClose(9)
+				Expect(session.tooManyHalfOpenStreams()).To(BeTrue())
+			})
+
+			It("doesn't count streams that the peer closed or reset", func() {
+				openAndClose(5)
+				openAndClose(7)
+				err := session.handleStreamFrame(&frames.StreamFrame{StreamID: 5, Offset: 6, FinBit: true})
+				Expect(err).ToNot(HaveOccurred())
+				err = session.handleRstStreamFrame(&frames.RstStreamFrame{StreamID: 7})
+				Expect(err).ToNot(HaveOccurred())
+				openAndClose(9)
+				openAndClose(11)
+				Expect(session.tooManyHalfOpenStreams()).To(BeFalse())
+			})
+
+			It("doesn't count streams that are still open on our side", func() {
+				for id := protocol.StreamID(5); id < 15; id += 2 {
+					err := session.handleStreamFrame(&frames.StreamFrame{StreamID: id, Data: []byte("foobar")})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(session.tooManyHalfOpenStreams()).To(BeFalse())
+			})
+
+			It("has no limit by default", func() {
+				session.config.maxHalfOpenStreams = 0
+				for id := protocol.StreamID(5); id < 15; id += 2 {
+					openAndClose(id)
+				}
+				Expect(session.tooManyHalfOpenStreams()).To(BeFalse())
+			})
+
+			It("closes the session when the limit is exceeded", func(done Done) {
+				openAndClose(5)
+				openAndClose(7)
+				openAndClose(9)
+				session.run()
+				Expect(context.Cause(session.Context())).To(MatchError(errTooManyHalfOpenStreams))
+				close(done)
+			})
 		})
 
 		It("removes closed streams from BlockedManager", func() {
@@ -243,6 +477,30 @@ var _ = Describe("Session", func() {
 		})
 	})
 
+	It("returns the version", func() {
+		signer, err := crypto.NewProofSource(testdata.GetTLSConfig())
+		Expect(err).ToNot(HaveOccurred())
+		kex, err := crypto.NewCurve25519KEX()
+		Expect(err).NotTo(HaveOccurred())
+		scfg, err := handshake.NewServerConfig(kex, signer, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		pSession, err := newSession(&mockConnection{}, protocol.VersionNumber(32), 0, scfg, nil, nil, &sessionConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pSession.(*Session).Version()).To(Equal(protocol.VersionNumber(32)))
+	})
+
+	Context("addresses", func() {
+		It("returns the remote address", func() {
+			addr := &net.UDPAddr{IP: net.IPv4(192, 168, 13, 37), Port: 1337}
+			conn.setCurrentRemoteAddr(addr)
+			Expect(session.RemoteAddr()).To(Equal(addr))
+		})
+
+		It("returns the local address", func() {
+			Expect(session.LocalAddr()).To(Equal(&net.UDPAddr{}))
+		})
+	})
+
 	Context("handling RST_STREAM frames", func() {
 		It("closes the receiving streams for writing and reading", func() {
 			s, err := session.OpenStream(5)
@@ -322,7 +580,7 @@ var _ = Describe("Session", func() {
 
 		It("shuts down without error", func() {
 			session.Close(nil)
-			Expect(closeCallbackCalled).To(BeTrue())
+			Eventually(func() bool { return closeCallbackCalled }).Should(BeTrue())
 			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
 			Expect(conn.written).To(HaveLen(1))
 			Expect(conn.written[0][len(conn.written[0])-7:]).To(Equal([]byte{0x02, byte(qerr.PeerGoingAway), 0, 0, 0, 0, 0}))
@@ -335,12 +593,66 @@ var _ = Describe("Session", func() {
 			Expect(conn.written).To(HaveLen(1))
 		})
 
+		It("answers late packets with the CONNECTION_CLOSE while draining", func() {
+			session.drainingTimeout = time.Hour
+			session.Close(nil)
+			Expect(conn.written).To(HaveLen(1))
+			session.handlePacket(nil, &publicHeader{PacketNumber: 1}, []byte("foobar"))
+			Eventually(func() int { return len(conn.written) }).Should(Equal(2))
+			Consistently(func() int { return len(conn.written) }).Should(Equal(2))
+			Expect(conn.written[1]).To(Equal(conn.written[0]))
+			Expect(closeCallbackCalled).To(BeFalse())
+		})
+
+		It("backs off exponentially when answering late packets", func() {
+			session.drainingTimeout = time.Hour
+			session.Close(nil)
+			for i := 0; i < 8; i++ {
+				session.handlePacket(nil, &publicHeader{PacketNumber: protocol.PacketNumber(i + 1)}, []byte("foobar"))
+			}
+			// the 1st, 2nd, 4th and 8th packet are answered
+			Eventually(func() int { return len(conn.written) }).Should(Equal(1 + 4))
+			Consistently(func() int { return len(conn.written) }).Should(Equal(1 + 4))
+		})
+
+		It("removes the session after the draining period", func() {
+			session.drainingTimeout = 50 * time.Millisecond
+			session.Close(nil)
+			Consistently(func() bool { return closeCallbackCalled }, 30*time.Millisecond).Should(BeFalse())
+			Eventually(func() bool { return closeCallbackCalled }).Should(BeTrue())
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+		})
+
+		It("discards late packets if the peer closed the session", func() {
+			session.drainingTimeout = time.Hour
+			session.handleConnectionCloseFrame(&frames.ConnectionCloseFrame{ErrorCode: qerr.InternalError})
+			Expect(conn.written).To(HaveLen(1))
+			for i := 0; i < 3; i++ {
+				session.handlePacket(nil, &publicHeader{PacketNumber: protocol.PacketNumber(i + 1)}, []byte("foobar"))
+			}
+			Eventually(func() int { return len(session.receivedPackets) }).Should(BeZero())
+			Consistently(func() bool { return closeCallbackCalled }).Should(BeFalse())
+			Expect(conn.written).To(HaveLen(1))
+		})
+
+		It("responds to a CONNECTION_CLOSE with a single CONNECTION_CLOSE", func() {
+			frame := &frames.ConnectionCloseFrame{ErrorCode: qerr.InternalError, ReasonPhrase: "foobar"}
+			session.handleConnectionCloseFrame(frame)
+			session.handleConnectionCloseFrame(frame)
+			session.Close(errors.New("local error"))
+			Eventually(func() bool { return closeCallbackCalled }).Should(BeTrue())
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0][len(conn.written[0])-7:]).To(Equal([]byte{0x02, byte(qerr.PeerGoingAway), 0, 0, 0, 0, 0}))
+			Expect(context.Cause(session.Context())).To(MatchError(qerr.Error(qerr.InternalError, "foobar")))
+		})
+
 		It("closes streams with proper error", func() {
 			testErr := errors.New("test error")
 			s, err := session.OpenStream(5)
 			Expect(err).NotTo(HaveOccurred())
 			session.Close(testErr)
-			Expect(closeCallbackCalled).To(BeTrue())
+			Eventually(func() bool { return closeCallbackCalled }).Should(BeTrue())
 			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
 			n, err := s.Read([]byte{0})
 			Expect(n).To(BeZero())
@@ -349,6 +661,113 @@ var _ = Describe("Session", func() {
 			Expect(n).To(BeZero())
 			Expect(err).To(MatchError(testErr))
 		})
+
+		It("waits for the run loop to return", func() {
+			Eventually(func() uint32 { return atomic.LoadUint32(&session.running) }).Should(Equal(uint32(1)))
+			session.Close(nil)
+			Expect(session.runLoopDone).To(BeClosed())
+		})
+
+		It("can be closed from a goroutine started by the stream callback", func() {
+			aead := &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+			session.streamCallback = func(sess *Session, _ utils.Stream) { go sess.Close(nil) }
+			buf := &bytes.Buffer{}
+			buf.WriteByte(0x01) // private header
+			err := (&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}).Write(buf, 0)
+			Expect(err).ToNot(HaveOccurred())
+			hdr := &publicHeader{PacketNumber: 1, PacketNumberLen: protocol.PacketNumberLen6, Raw: []byte{0x3c}}
+			session.handlePacket(nil, hdr, aead.Seal(1, hdr.Raw, buf.Bytes()))
+			Eventually(session.runLoopDone).Should(BeClosed())
+		})
+
+		It("waits for the run loop when closed from another goroutine while the stream callback is running", func() {
+			aead := &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+			callbackRunning := make(chan struct{})
+			releaseCallback := make(chan struct{})
+			session.streamCallback = func(*Session, utils.Stream) {
+				close(callbackRunning)
+				<-releaseCallback
+			}
+			buf := &bytes.Buffer{}
+			buf.WriteByte(0x01) // private header
+			err := (&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}).Write(buf, 0)
+			Expect(err).ToNot(HaveOccurred())
+			hdr := &publicHeader{PacketNumber: 1, PacketNumberLen: protocol.PacketNumberLen6, Raw: []byte{0x3c}}
+			session.handlePacket(nil, hdr, aead.Seal(1, hdr.Raw, buf.Bytes()))
+			Eventually(callbackRunning).Should(BeClosed())
+			closed := make(chan struct{})
+			go func() {
+				session.Close(nil)
+				close(closed)
+			}()
+			Consistently(closed).ShouldNot(BeClosed())
+			close(releaseCallback)
+			Eventually(closed).Should(BeClosed())
+			Expect(session.runLoopDone).To(BeClosed())
+		})
+
+		It("doesn't leak goroutines when opening and closing many sessions", func() {
+			session.Close(nil)
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			signer, err := crypto.NewProofSource(testdata.GetTLSConfig())
+			Expect(err).ToNot(HaveOccurred())
+			kex, err := crypto.NewCurve25519KEX()
+			Expect(err).NotTo(HaveOccurred())
+			scfg, err := handshake.NewServerConfig(kex, signer, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 100; i++ {
+				pSession, err := newSession(&mockConnection{}, 0, protocol.ConnectionID(i), scfg, func(*Session, utils.Stream) {}, func(protocol.ConnectionID) {}, &sessionConfig{})
+				Expect(err).NotTo(HaveOccurred())
+				sess := pSession.(*Session)
+				sess.drainingTimeout = time.Nanosecond
+				go sess.run()
+				Eventually(func() uint32 { return atomic.LoadUint32(&sess.running) }).Should(Equal(uint32(1)))
+				sess.Close(nil)
+				Expect(sess.runLoopDone).To(BeClosed())
+			}
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+		})
+
+		It("closes with an application error, which the peer receives", func() {
+			err := session.CloseWithError(0x1337, "foobar")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() int { return runtime.NumGoroutine() }).Should(Equal(nGoRoutinesBefore))
+			Expect(conn.written).To(HaveLen(1))
+			frameLen := 1 + 4 + 2 + len("foobar")
+			raw := conn.written[0][len(conn.written[0])-frameLen:]
+			frame, err := frames.ParseConnectionCloseFrame(bytes.NewReader(raw))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.ErrorCode).ToNot(Equal(qerr.ErrorCode(0x1337))) // application error codes are distinguishable from transport error codes
+			Expect(frame.ReasonPhrase).To(Equal("foobar"))
+
+			// deliver the frame to another session
+			signer, err := crypto.NewProofSource(testdata.GetTLSConfig())
+			Expect(err).ToNot(HaveOccurred())
+			kex, err := crypto.NewCurve25519KEX()
+			Expect(err).NotTo(HaveOccurred())
+			scfg, err := handshake.NewServerConfig(kex, signer, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			pSession, err := newSession(&mockConnection{}, 0, 0, scfg, func(*Session, utils.Stream) {}, func(protocol.ConnectionID) {}, &sessionConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			peer := pSession.(*Session)
+			str, err := peer.OpenStream(5)
+			Expect(err).NotTo(HaveOccurred())
+			peer.handleConnectionCloseFrame(frame)
+			_, err = str.Read([]byte{0})
+			Expect(err).To(Equal(&qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"}))
+			Expect(context.Cause(peer.Context())).To(Equal(&qerr.ApplicationError{ErrorCode: 0x1337, Reason: "foobar"}))
+		})
+
+		It("rejects invalid application errors", func() {
+			err := session.CloseWithError(qerr.MaxApplicationErrorCode+1, "foobar")
+			Expect(err).To(MatchError(errInvalidApplicationErrorCode))
+			err = session.CloseWithError(0x1337, string([]byte{0xff, 0xfe}))
+			Expect(err).To(MatchError(errInvalidReasonPhrase))
+			Expect(session.Context().Err()).ToNot(HaveOccurred())
+			session.Close(nil)
+		})
 	})
 
 	Context("sending packets", func() {
@@ -378,6 +797,138 @@ var _ = Describe("Session", func() {
 			Expect(conn.written[0]).To(ContainSubstring(string("foobar")))
 		})
 
+		It("uses the configured initial packet number", func() {
+			pSession, err := newSession(conn, 0, 0x1337, nil, nil, nil, &sessionConfig{initialPacketNumber: 1000})
+			Expect(err).ToNot(HaveOccurred())
+			session = pSession.(*Session)
+			for i := 0; i < 2; i++ {
+				session.queueStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Data:     []byte("foobar"),
+				})
+				err = session.sendPacket()
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(conn.written).To(HaveLen(2))
+			for i, packet := range conn.written {
+				hdr, err := parsePublicHeader(bytes.NewReader(packet))
+				Expect(err).ToNot(HaveOccurred())
+				// the packet number is truncated on the wire
+				Expect(protocol.InferPacketNumber(hdr.PacketNumberLen, protocol.PacketNumber(999+i), hdr.PacketNumber)).To(Equal(protocol.PacketNumber(1000 + i)))
+			}
+		})
+
+		It("sends a PING as a probe if there is no retransmittable data", func() {
+			session.sentPacketHandler = &probeSentPacketHandler{SentPacketHandler: session.sentPacketHandler, probe: true}
+			err := session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0][len(conn.written[0])-1]).To(Equal(byte(0x07)))
+			// the probe is only sent once
+			err = session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+		})
+
+		It("doesn't send a PING probe if there is data to send", func() {
+			session.sentPacketHandler = &probeSentPacketHandler{SentPacketHandler: session.sentPacketHandler, probe: true}
+			session.queueStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     []byte("foobar"),
+			})
+			err := session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).To(HaveSuffix("foobar"))
+		})
+
+		It("retransmits only the data of a lost StreamFrame that was not acked in another packet", func() {
+			_, err := session.GetOrOpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			session.streamAckTracker.OnPacketAcked(&ackhandler.Packet{
+				PacketNumber: 2,
+				Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}},
+			})
+			session.sentPacketHandler = &retransmitSentPacketHandler{
+				SentPacketHandler: session.sentPacketHandler,
+				packet: &ackhandler.Packet{
+					PacketNumber: 1,
+					Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobarbaz")}},
+				},
+			}
+			err = session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).To(HaveSuffix("baz"))
+			Expect(conn.written[0]).ToNot(ContainSubstring("foobar"))
+		})
+
+		It("closes the session when stream data was retransmitted too often", func() {
+			session.config.maxStreamRetransmissions = 2
+			_, err := session.GetOrOpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			handler := &retransmitSentPacketHandler{SentPacketHandler: session.sentPacketHandler}
+			session.sentPacketHandler = handler
+			lose := func() error {
+				handler.packet = &ackhandler.Packet{
+					PacketNumber: 1,
+					Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}},
+				}
+				return session.sendPacket()
+			}
+			Expect(lose()).To(Succeed())
+			Expect(lose()).To(Succeed())
+			Expect(lose()).To(MatchError(errTooManyRetransmissions))
+		})
+
+		It("retransmits stream data indefinitely by default", func() {
+			handler := &retransmitSentPacketHandler{SentPacketHandler: session.sentPacketHandler}
+			session.sentPacketHandler = handler
+			for i := 0; i < 100; i++ {
+				handler.packet = &ackhandler.Packet{
+					PacketNumber: 1,
+					Frames:       []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}},
+				}
+				Expect(session.sendPacket()).To(Succeed())
+			}
+		})
+
+		It("writes multiple packets in one batch", func() {
+			session.queueStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     bytes.Repeat([]byte{'f'}, int(3*protocol.MaxPacketSize)),
+			})
+			err := session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(conn.written)).To(BeNumerically(">=", 3))
+			Expect(conn.batches).To(Equal(1))
+		})
+
+		It("limits the number of packets in one batch", func() {
+			session.queueStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     bytes.Repeat([]byte{'f'}, int(2*protocol.MaxPacketsPerSendBatch*protocol.MaxPacketSize)),
+			})
+			err := session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.written).To(HaveLen(protocol.MaxPacketsPerSendBatch))
+			Expect(conn.batches).To(Equal(1))
+		})
+
+		It("packs many control frames into a few packets", func() {
+			const numFrames = 300
+			for i := 0; i < numFrames; i++ {
+				session.queueRstStreamFrame(&frames.RstStreamFrame{StreamID: protocol.StreamID(5 + 2*i)})
+			}
+			frameLen, _ := (&frames.RstStreamFrame{}).MinLength()
+			err := session.sendPacket()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(conn.written)).To(BeNumerically("<=", int(numFrames*frameLen/protocol.MaxFrameAndPublicHeaderSize)+2))
+			Expect(conn.batches).To(Equal(1))
+			// all frames were sent
+			Expect(session.packer.Empty()).To(BeTrue())
+		})
+
 		It("sends a WindowUpdate frame", func() {
 			_, err := session.OpenStream(5)
 			Expect(err).ToNot(HaveOccurred())
@@ -405,11 +956,14 @@ var _ = Describe("Session", func() {
 			Expect(conn.written).To(HaveLen(int(protocol.WindowUpdateNumRepetitions))) // no packet was sent
 		})
 
-		It("sends public reset", func() {
-			err := session.sendPublicReset(1)
+		It("sends a RST_STREAM frame when a stream is reset", func() {
+			str, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			str.Reset(0xdecafbad)
+			err = session.sendPacket()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(conn.written).To(HaveLen(1))
-			Expect(conn.written[0]).To(ContainSubstring(string([]byte("PRST"))))
+			Expect(conn.written[0]).To(ContainSubstring(string([]byte{0x01, 0x05, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xad, 0xfb, 0xca, 0xde})))
 		})
 
 		Context("Blocked", func() {
@@ -482,6 +1036,43 @@ var _ = Describe("Session", func() {
 				Expect(conn.written).To(HaveLen(1))
 			})
 
+			It("delays a small frame", func() {
+				session.queueStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Data:     []byte("foobar"),
+				})
+				err := session.maybeSendPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.written).To(BeEmpty())
+			})
+
+			It("sends a small frame immediately when flushed", func() {
+				session.queueStreamFrame(&frames.StreamFrame{
+					StreamID: 5,
+					Data:     []byte("foobar"),
+				})
+				session.flush()
+				err := session.maybeSendPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+			})
+
+			It("doesn't coalesce writes on a stream with no-delay", func() {
+				str, err := session.OpenStream(5)
+				Expect(err).ToNot(HaveOccurred())
+				str.SetNoDelay(true)
+				_, err = str.Write([]byte("foobar1"))
+				Expect(err).ToNot(HaveOccurred())
+				err = session.maybeSendPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.written).To(HaveLen(1))
+				_, err = str.Write([]byte("foobar2"))
+				Expect(err).ToNot(HaveOccurred())
+				err = session.maybeSendPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn.written).To(HaveLen(2))
+			})
+
 			It("sends out two big frames in two packet", func() {
 				go session.run()
 
@@ -549,22 +1140,204 @@ var _ = Describe("Session", func() {
 		Expect(err).To(MatchError(qerr.InvalidCryptoMessageType))
 	})
 
-	It("sends public reset after too many undecryptable packets", func() {
-		// Write protocol.MaxUndecryptablePackets and expect a public reset to happen
-		for i := 0; i < protocol.MaxUndecryptablePackets; i++ {
-			hdr := &publicHeader{
-				PacketNumber: protocol.PacketNumber(i + 1),
+	Context("undecryptable packets", func() {
+		queueUndecryptablePackets := func(n int) {
+			for i := 0; i < n; i++ {
+				session.tryQueueingUndecryptablePacket(receivedPacket{
+					publicHeader: &publicHeader{PacketNumber: protocol.PacketNumber(i + 1)},
+					data:         []byte("foobar"),
+				})
 			}
-			session.handlePacket(nil, hdr, []byte("foobar"))
 		}
-		session.run()
 
-		Expect(conn.written).To(HaveLen(1))
-		Expect(conn.written[0]).To(ContainSubstring(string([]byte("PRST"))))
+		It("queues undecryptable packets", func() {
+			hdr := &publicHeader{PacketNumber: 1}
+			session.handlePacket(nil, hdr, []byte("foobar"))
+			go session.run()
+			Eventually(func() []receivedPacket { return session.undecryptablePackets }).Should(HaveLen(1))
+			session.Close(nil)
+		})
+
+		It("caps the queue at the default size", func() {
+			queueUndecryptablePackets(protocol.DefaultMaxUndecryptablePackets + 3)
+			Expect(session.undecryptablePackets).To(HaveLen(protocol.DefaultMaxUndecryptablePackets))
+			Expect(session.undecryptablePackets[0].publicHeader.PacketNumber).To(Equal(protocol.PacketNumber(1)))
+			Expect(session.Stats().DroppedUndecryptablePackets).To(Equal(uint64(3)))
+			Expect(session.Context().Err()).ToNot(HaveOccurred())
+		})
+
+		It("caps the queue at the configured size", func() {
+			pSession, err := newSession(conn, 0, 0, nil, nil, nil, &sessionConfig{maxUndecryptablePackets: 3})
+			Expect(err).ToNot(HaveOccurred())
+			session = pSession.(*Session)
+			queueUndecryptablePackets(5)
+			Expect(session.undecryptablePackets).To(HaveLen(3))
+			Expect(session.Stats().DroppedUndecryptablePackets).To(Equal(uint64(2)))
+		})
 	})
 
-	It("unqueues undecryptable packets for later decryption", func() {
-		session.undecryptablePackets = []receivedPacket{{
+	Context("send limit", func() {
+		It("reports no limit if all data was sent", func() {
+			session.queueStreamFrame(&frames.StreamFrame{StreamID: 5, Data: bytes.Repeat([]byte{'f'}, int(protocol.SmallPacketPayloadSizeThreshold)+1)})
+			err := session.maybeSendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(session.SendLimitReason()).To(Equal(SendLimitNone))
+		})
+
+		It("reports a full congestion window", func() {
+			session.sentPacketHandler = &congestionLimitedSentPacketHandler{SentPacketHandler: session.sentPacketHandler}
+			session.queueStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			err := session.maybeSendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.written).To(BeEmpty())
+			Expect(session.SendLimitReason()).To(Equal(SendLimitCongestionWindow))
+			Expect(session.SendLimitReason().String()).To(Equal("CongestionWindow"))
+		})
+
+		It("reports an exhausted flow control window", func() {
+			str, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			window := str.(*stream).flowController.SendWindowSize()
+			_, err = str.Write(make([]byte, window))
+			Expect(err).ToNot(HaveOccurred())
+			err = session.maybeSendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.SendLimitReason()).To(Equal(SendLimitFlowControl))
+		})
+
+		It("doesn't report flow control for streams that were closed", func() {
+			str, err := session.OpenStream(5)
+			Expect(err).ToNot(HaveOccurred())
+			window := str.(*stream).flowController.SendWindowSize()
+			session.flowController.UpdateSendWindow(2 * window)
+			_, err = str.Write(make([]byte, window))
+			Expect(err).ToNot(HaveOccurred())
+			err = str.Close()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.SendLimitReason()).To(Equal(SendLimitNone))
+		})
+
+		It("reports pacing when a small packet is delayed", func() {
+			session.queueStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			err := session.maybeSendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.written).To(BeEmpty())
+			Expect(session.SendLimitReason()).To(Equal(SendLimitPacing))
+		})
+	})
+
+	It("reports the connection-level flow control windows", func() {
+		sendWindow := session.Stats().SendWindow
+		Expect(sendWindow).ToNot(BeZero())
+		Expect(session.Stats().ReceiveWindow).ToNot(BeZero())
+		str, err := session.OpenStream(5)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Stats().SendWindow).To(Equal(sendWindow - 6))
+	})
+
+	It("uses the configured minimum retransmission timeout", func() {
+		Expect(session.sentPacketHandler.RetransmissionTimeout()).To(Equal(protocol.DefaultRetransmissionTime))
+		pSession, err := newSession(conn, 0, 0, nil, nil, nil, &sessionConfig{minRetransmissionTime: time.Second})
+		Expect(err).ToNot(HaveOccurred())
+		session = pSession.(*Session)
+		Expect(session.sentPacketHandler.RetransmissionTimeout()).To(Equal(time.Second))
+	})
+
+	Context("packet threshold", func() {
+		// packet 2 is NACKed once packet 3 was acked, shortly after it was sent
+		sendAndNack := func() {
+			sendPacket := func(p protocol.PacketNumber) {
+				err := session.sentPacketHandler.SentPacket(&ackhandler.Packet{PacketNumber: p, Length: 1, Frames: []frames.Frame{&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}}})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			// get an RTT sample, so that packet 2 isn't declared lost by the time threshold
+			sendPacket(1)
+			time.Sleep(50 * time.Millisecond)
+			err := session.sentPacketHandler.ReceivedAck(&frames.AckFrame{LargestObserved: 1})
+			Expect(err).ToNot(HaveOccurred())
+			sendPacket(2)
+			sendPacket(3)
+			err = session.sentPacketHandler.ReceivedAck(&frames.AckFrame{
+				LargestObserved: 3,
+				NackRanges:      []frames.NackRange{{FirstPacketNumber: 2, LastPacketNumber: 2}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("uses the default packet threshold", func() {
+			sendAndNack()
+			Expect(session.sentPacketHandler.ProbablyHasPacketForRetransmission()).To(BeFalse())
+		})
+
+		It("uses the configured packet threshold", func() {
+			pSession, err := newSession(conn, 0, 0, nil, nil, nil, &sessionConfig{packetThreshold: 1})
+			Expect(err).ToNot(HaveOccurred())
+			session = pSession.(*Session)
+			sendAndNack()
+			Expect(session.sentPacketHandler.DequeuePacketForRetransmission().PacketNumber).To(Equal(protocol.PacketNumber(2)))
+		})
+	})
+
+	It("caps the negotiated idle connection state lifetime", func() {
+		pSession, err := newSession(conn, 0, 0, nil, nil, nil, &sessionConfig{maxIdleConnectionStateLifetime: 10 * time.Second})
+		Expect(err).ToNot(HaveOccurred())
+		session = pSession.(*Session)
+		Expect(session.connectionParametersManager.GetIdleConnectionStateLifetime()).To(Equal(10 * time.Second))
+		err = session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+			handshake.TagICSL: {0x3c, 0, 0, 0}, // 60s
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.connectionParametersManager.GetIdleConnectionStateLifetime()).To(Equal(10 * time.Second))
+	})
+
+	Context("stateless resets", func() {
+		var token []byte
+
+		BeforeEach(func() {
+			// the client derives its token the same way the server does
+			clientConfig, err := handshake.NewServerConfig(nil, nil, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			token = clientConfig.StatelessResetToken(0)
+			err = session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+				handshake.TagSRST: token,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		handleRawPacket := func(packet []byte) {
+			r := bytes.NewReader(packet)
+			hdr, err := parsePublicHeader(r)
+			Expect(err).ToNot(HaveOccurred())
+			hdr.Raw = packet[:len(packet)-r.Len()]
+			session.handlePacket(nil, hdr, packet[len(packet)-r.Len():])
+		}
+
+		It("closes the session when receiving a stateless reset", func(done Done) {
+			reset, err := writeStatelessReset(1, session.version, token)
+			Expect(err).ToNot(HaveOccurred())
+			handleRawPacket(reset)
+			session.run()
+			Expect(context.Cause(session.Context())).To(MatchError(qerr.Error(qerr.PublicReset, "received a stateless reset")))
+			Expect(conn.written).To(BeEmpty())
+			close(done)
+		}, 0.5)
+
+		It("queues undecryptable packets that don't end with the token", func() {
+			reset, err := writeStatelessReset(1, session.version, bytes.Repeat([]byte{'f'}, protocol.StatelessResetTokenLen))
+			Expect(err).ToNot(HaveOccurred())
+			handleRawPacket(reset)
+			go session.run()
+			Eventually(func() []receivedPacket { return session.undecryptablePackets }).Should(HaveLen(1))
+			Consistently(func() error { return session.Context().Err() }).ShouldNot(HaveOccurred())
+			session.Close(nil)
+		})
+	})
+
+	It("unqueues undecryptable packets for later decryption", func() {
+		session.undecryptablePackets = []receivedPacket{{
 			nil,
 			&publicHeader{PacketNumber: protocol.PacketNumber(42)},
 			nil,
@@ -586,6 +1359,206 @@ var _ = Describe("Session", func() {
 		close(done)
 	}, 0.5)
 
+	Context("the session context", func() {
+		It("is not canceled while the session is open", func() {
+			Expect(session.Context().Err()).ToNot(HaveOccurred())
+		})
+
+		It("is canceled with the close error as cause", func() {
+			testErr := qerr.Error(qerr.InternalError, "foobar")
+			session.Close(testErr)
+			Expect(session.Context().Done()).To(BeClosed())
+			Expect(context.Cause(session.Context())).To(Equal(testErr))
+		})
+
+		It("is canceled with a QUIC error if the session is closed with a non-QUIC error", func() {
+			session.Close(errors.New("foobar"))
+			Expect(session.Context().Done()).To(BeClosed())
+			cause := context.Cause(session.Context()).(*qerr.QuicError)
+			Expect(cause.ErrorCode).To(Equal(qerr.InternalError))
+		})
+
+		It("is canceled with the idle timeout error", func(done Done) {
+			session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+				handshake.TagICSL: {0, 0, 0, 0},
+			})
+			session.packer.connectionParametersManager = session.connectionParametersManager
+			session.packer.sentPacketHandler = newMockSentPacketHandler()
+			session.run() // Would normally not return
+			Expect(session.Context().Done()).To(BeClosed())
+			cause := context.Cause(session.Context()).(*qerr.QuicError)
+			Expect(cause.ErrorCode).To(Equal(qerr.NetworkIdleTimeout))
+			close(done)
+		}, 0.5)
+	})
+
+	It("closes the session when an unreachable peer doesn't ack anything for too many RTOs", func() {
+		session.sentPacketHandler.SetMaxConsecutiveRTOs(1)
+		// get a small RTT sample, so that the RTO is the minimum RTO
+		session.sentPacketHandler.SetMinRetransmissionTime(10 * time.Millisecond)
+		Expect(session.sentPacketHandler.SentPacket(&ackhandler.Packet{PacketNumber: 1, Length: 1})).To(Succeed())
+		Expect(session.sentPacketHandler.ReceivedAck(&frames.AckFrame{LargestObserved: 1})).To(Succeed())
+		session.packer.lastPacketNumber = 1
+		session.queueStreamFrame(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		go session.run()
+		// the first RTO fires after 10ms, the second one after another 20ms
+		Eventually(session.Context().Done()).Should(BeClosed())
+		cause := context.Cause(session.Context()).(*qerr.QuicError)
+		Expect(cause.ErrorCode).To(Equal(qerr.TooManyRtos))
+		Eventually(session.runLoopDone).Should(BeClosed())
+		Expect(len(conn.written)).To(BeNumerically(">=", 3)) // the data, the probe and the CONNECTION_CLOSE
+	})
+
+	It("closes the session when a packet contains too many STREAM frames", func() {
+		aead := &mockForwardSecureAEAD{}
+		session.unpacker = &packetUnpacker{aead: aead, maxStreamFrames: 10}
+		buf := &bytes.Buffer{}
+		buf.WriteByte(0x01) // private header
+		for i := 0; i < 200; i++ {
+			err := (&frames.StreamFrame{StreamID: 5, Offset: protocol.ByteCount(i), Data: []byte{'f'}, DataLenPresent: true}).Write(buf, 0)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		go session.run()
+		hdr := &publicHeader{PacketNumber: 1, PacketNumberLen: protocol.PacketNumberLen6, Raw: []byte{0x3c}}
+		session.handlePacket(nil, hdr, aead.Seal(1, hdr.Raw, buf.Bytes()))
+		Eventually(session.Context().Done()).Should(BeClosed())
+		cause := context.Cause(session.Context()).(*qerr.QuicError)
+		Expect(cause.ErrorCode).To(Equal(qerr.InvalidStreamData))
+		Eventually(session.runLoopDone).Should(BeClosed())
+		Expect(session.streams).ToNot(HaveKey(protocol.StreamID(5)))
+		Expect(streamCallbackCalled).To(BeFalse())
+	})
+
+	Context("idle timeout", func() {
+		It("uses the negotiated idle timeout", func() {
+			Expect(session.idleTimeout()).To(Equal(session.connectionParametersManager.GetIdleConnectionStateLifetime()))
+		})
+
+		It("lowers the idle timeout", func() {
+			session.SetIdleTimeout(time.Second)
+			Expect(session.idleTimeout()).To(Equal(time.Second))
+		})
+
+		It("doesn't raise the idle timeout above the negotiated value", func() {
+			negotiated := session.connectionParametersManager.GetIdleConnectionStateLifetime()
+			session.SetIdleTimeout(2 * negotiated)
+			Expect(session.idleTimeout()).To(Equal(negotiated))
+		})
+
+		It("restores the negotiated idle timeout", func() {
+			session.SetIdleTimeout(time.Second)
+			session.SetIdleTimeout(0)
+			Expect(session.idleTimeout()).To(Equal(session.connectionParametersManager.GetIdleConnectionStateLifetime()))
+		})
+
+		It("closes the session when the lowered idle timeout expires", func() {
+			session.packer.sentPacketHandler = newMockSentPacketHandler()
+			go session.run()
+			Eventually(func() uint32 { return atomic.LoadUint32(&session.running) }).Should(Equal(uint32(1)))
+			Consistently(session.Context().Done()).ShouldNot(BeClosed())
+			session.SetIdleTimeout(50 * time.Millisecond)
+			Eventually(session.Context().Done()).Should(BeClosed())
+			cause := context.Cause(session.Context()).(*qerr.QuicError)
+			Expect(cause.ErrorCode).To(Equal(qerr.NetworkIdleTimeout))
+		})
+	})
+
+	Context("datagrams", func() {
+		enableDatagrams := func() {
+			err := session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+				handshake.TagMDFS: {0xff, 0xff, 0, 0},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("tells if the client supports datagrams", func() {
+			Expect(session.SupportsDatagrams()).To(BeFalse())
+			enableDatagrams()
+			Expect(session.SupportsDatagrams()).To(BeTrue())
+		})
+
+		It("sends a datagram", func() {
+			enableDatagrams()
+			err := session.SendMessage([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			err = session.sendPacket()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.written).To(HaveLen(1))
+			Expect(conn.written[0]).To(ContainSubstring(string([]byte{0x08, 0x6, 0x0, 'f', 'o', 'o', 'b', 'a', 'r'})))
+		})
+
+		It("doesn't send datagrams if the peer doesn't support them", func() {
+			err := session.SendMessage([]byte("foobar"))
+			Expect(err).To(MatchError(errDatagramsNotNegotiated))
+		})
+
+		It("doesn't send datagrams that are too large", func() {
+			enableDatagrams()
+			err := session.SendMessage(make([]byte, protocol.MaxDatagramFrameSize+1))
+			Expect(err).To(MatchError(errDatagramTooLarge))
+		})
+
+		It("drops datagrams when the send queue is full", func() {
+			enableDatagrams()
+			for i := 0; i < protocol.MaxDatagramSendQueueLen+10; i++ {
+				Expect(session.SendMessage([]byte("foobar"))).To(Succeed())
+			}
+			Expect(session.packer.DatagramQueueByteLen()).To(Equal(protocol.MaxDatagramSendQueueLen * protocol.ByteCount(3+6)))
+		})
+
+		It("doesn't send datagrams after the session was closed", func() {
+			enableDatagrams()
+			testErr := qerr.Error(qerr.InternalError, "foobar")
+			session.Close(testErr)
+			err := session.SendMessage([]byte("foobar"))
+			Expect(err).To(MatchError(testErr))
+		})
+
+		It("receives datagrams in the order they arrive, and doesn't deliver lost ones", func() {
+			enableDatagrams()
+			// the datagram "2" was lost
+			err := session.handleDatagramFrame(&frames.DatagramFrame{Data: []byte("3")})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleDatagramFrame(&frames.DatagramFrame{Data: []byte("1")})
+			Expect(err).ToNot(HaveOccurred())
+			b, err := session.ReceiveMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b).To(Equal([]byte("3")))
+			b, err = session.ReceiveMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b).To(Equal([]byte("1")))
+			received := make(chan []byte)
+			go func() {
+				b, _ := session.ReceiveMessage()
+				received <- b
+			}()
+			Consistently(received).ShouldNot(Receive())
+			session.Close(nil)
+			Eventually(received).Should(Receive(BeNil()))
+		})
+
+		It("drops datagrams when the receive queue is full", func() {
+			enableDatagrams()
+			for i := 0; i < protocol.MaxDatagramQueueLen+1; i++ {
+				err := session.handleDatagramFrame(&frames.DatagramFrame{Data: []byte("foobar")})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(session.receivedDatagrams).To(HaveLen(protocol.MaxDatagramQueueLen))
+		})
+
+		It("errors when receiving a datagram if datagrams were not negotiated", func() {
+			err := session.handleDatagramFrame(&frames.DatagramFrame{Data: []byte("foobar")})
+			Expect(err).To(MatchError(errUnexpectedDatagram))
+		})
+
+		It("returns the close error when receiving", func() {
+			testErr := qerr.Error(qerr.InternalError, "foobar")
+			session.Close(testErr)
+			_, err := session.ReceiveMessage()
+			Expect(err).To(MatchError(testErr))
+		})
+	})
+
 	It("errors when the SentPacketHandler has too many packets tracked", func() {
 		streamFrame := frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}
 		for i := uint32(1); i < protocol.MaxTrackedSentPackets+10; i++ {
@@ -632,6 +1605,379 @@ var _ = Describe("Session", func() {
 		Eventually(func() bool { return len(conn.written) > 0 }).Should(BeTrue())
 	})
 
+	Context("requiring forward secrecy", func() {
+		var aead *mockForwardSecureAEAD
+
+		BeforeEach(func() {
+			aead = &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+			session.config.requireForwardSecrecy = true
+		})
+
+		handlePacket := func(packetNumber protocol.PacketNumber, fs ...frames.Frame) {
+			buf := &bytes.Buffer{}
+			buf.WriteByte(0x01) // private header
+			for _, f := range fs {
+				err := f.Write(buf, 0)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			hdr := &publicHeader{
+				PacketNumber:    packetNumber,
+				PacketNumberLen: protocol.PacketNumberLen6,
+				Raw:             []byte{0x3c},
+			}
+			err := session.handlePacketImpl(nil, hdr, aead.Seal(packetNumber, hdr.Raw, buf.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("drops application data in packets that are not forward-secure", func() {
+			handlePacket(1, &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			Expect(session.streams).ToNot(HaveKey(protocol.StreamID(5)))
+			Expect(streamCallbackCalled).To(BeFalse())
+			ack, err := session.receivedPacketHandler.GetAckFrame(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ack).To(BeNil())
+		})
+
+		It("still handles other frames", func() {
+			handlePacket(1,
+				&frames.StreamFrame{StreamID: 5, Data: []byte("foobar"), DataLenPresent: true},
+				&frames.WindowUpdateFrame{StreamID: 0, ByteOffset: 0x800000},
+			)
+			Expect(session.streams).ToNot(HaveKey(protocol.StreamID(5)))
+			Expect(session.flowController.SendWindowSize()).To(Equal(protocol.ByteCount(0x800000)))
+		})
+
+		It("delivers application data in forward-secure packets", func() {
+			handlePacket(1, &frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+			aead.forwardSecure = true
+			handlePacket(2, &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			Expect(streamCallbackStreams).To(HaveLen(1))
+			p := make([]byte, 6)
+			n, err := streamCallbackStreams[0].Read(p)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p[:n]).To(Equal([]byte("foobar")))
+			ack, err := session.receivedPacketHandler.GetAckFrame(false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ack.LargestObserved).To(Equal(protocol.PacketNumber(2)))
+		})
+
+		It("delivers application data in packets that are not forward-secure, if not required", func() {
+			session.config.requireForwardSecrecy = false
+			handlePacket(1, &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+			Expect(session.streams).To(HaveKey(protocol.StreamID(5)))
+		})
+	})
+
+	Context("packet number inference", func() {
+		var aead *mockForwardSecureAEAD
+
+		BeforeEach(func() {
+			aead = &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+		})
+
+		// handlePacket sends the packet number truncated to packetNumberLen
+		handlePacket := func(packetNumber protocol.PacketNumber, packetNumberLen protocol.PacketNumberLen) (protocol.PacketNumber, error) {
+			hdr := &publicHeader{
+				PacketNumber:    packetNumber & (1<<(8*packetNumberLen) - 1),
+				PacketNumberLen: packetNumberLen,
+				Raw:             []byte{0x3c},
+			}
+			err := session.handlePacketImpl(nil, hdr, aead.Seal(packetNumber, hdr.Raw, []byte{0x01}))
+			return hdr.PacketNumber, err
+		}
+
+		It("reconstructs packet numbers across a wrap boundary", func() {
+			_, err := handlePacket(0xffef, protocol.PacketNumberLen2)
+			Expect(err).ToNot(HaveOccurred())
+			for pn := protocol.PacketNumber(0xfff0); pn < 0x10010; pn++ {
+				inferred, err := handlePacket(pn, protocol.PacketNumberLen1)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(inferred).To(Equal(pn))
+			}
+			Expect(session.largestRcvdPacketNumber).To(Equal(protocol.PacketNumber(0x1000f)))
+		})
+
+		It("infers packet numbers relative to the largest received packet number", func() {
+			inferred, err := handlePacket(0x1ff, protocol.PacketNumberLen2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inferred).To(Equal(protocol.PacketNumber(0x1ff)))
+			// reordered packet
+			inferred, err = handlePacket(0x1f0, protocol.PacketNumberLen1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inferred).To(Equal(protocol.PacketNumber(0x1f0)))
+			Expect(session.largestRcvdPacketNumber).To(Equal(protocol.PacketNumber(0x1ff)))
+			inferred, err = handlePacket(0x201, protocol.PacketNumberLen1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inferred).To(Equal(protocol.PacketNumber(0x201)))
+		})
+
+		It("doesn't use packets that can't be unpacked for inference", func() {
+			_, err := handlePacket(0x1ff, protocol.PacketNumberLen2)
+			Expect(err).ToNot(HaveOccurred())
+			hdr := &publicHeader{
+				PacketNumber:    0x3000,
+				PacketNumberLen: protocol.PacketNumberLen2,
+				Raw:             []byte{0x3c},
+			}
+			err = session.handlePacketImpl(nil, hdr, []byte("invalid"))
+			Expect(err).To(HaveOccurred())
+			Expect(session.largestRcvdPacketNumber).To(Equal(protocol.PacketNumber(0x1ff)))
+		})
+	})
+
+	Context("handshake completion", func() {
+		var aead *mockForwardSecureAEAD
+
+		BeforeEach(func() {
+			aead = &mockForwardSecureAEAD{}
+			session.unpacker = &packetUnpacker{aead: aead}
+		})
+
+		handlePacket := func(packetNumber protocol.PacketNumber) {
+			hdr := &publicHeader{
+				PacketNumber:    packetNumber,
+				PacketNumberLen: protocol.PacketNumberLen6,
+				Raw:             []byte{0x3c},
+			}
+			err := session.handlePacketImpl(nil, hdr, aead.Seal(packetNumber, hdr.Raw, []byte{0x01}))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("signals handshake completion when the first forward-secure packet is received", func() {
+			earlySubscriber := session.HandshakeComplete()
+			handlePacket(1)
+			Expect(earlySubscriber).ToNot(BeClosed())
+			aead.forwardSecure = true
+			handlePacket(2)
+			Expect(earlySubscriber).To(BeClosed())
+			handlePacket(3)
+			Expect(session.HandshakeComplete()).To(BeClosed())
+		})
+
+		Context("timing", func() {
+			var clock *mockClock
+
+			BeforeEach(func() {
+				clock = &mockClock{now: time.Now()}
+				pSession, err := newSession(conn, 0, 0x1337, nil, nil, nil, &sessionConfig{
+					slowHandshakeThreshold: time.Second,
+					clock:                  clock,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				session = pSession.(*Session)
+				session.unpacker = &packetUnpacker{aead: aead}
+			})
+
+			It("records the handshake duration", func() {
+				Expect(session.Stats().HandshakeDuration).To(BeZero())
+				clock.Advance(300 * time.Millisecond)
+				handlePacket(1)
+				Expect(session.Stats().HandshakeDuration).To(BeZero())
+				aead.forwardSecure = true
+				clock.Advance(200 * time.Millisecond)
+				handlePacket(2)
+				Expect(session.Stats().HandshakeDuration).To(Equal(500 * time.Millisecond))
+				clock.Advance(time.Second)
+				handlePacket(3)
+				Expect(session.Stats().HandshakeDuration).To(Equal(500 * time.Millisecond))
+			})
+
+			It("detects slow handshakes", func() {
+				Expect(session.isSlowHandshake(time.Second)).To(BeFalse())
+				Expect(session.isSlowHandshake(time.Second + time.Nanosecond)).To(BeTrue())
+				session.config.slowHandshakeThreshold = 0
+				Expect(session.isSlowHandshake(time.Hour)).To(BeFalse())
+			})
+
+			It("logs the phases of a slow handshake", func() {
+				clock.Advance(1500 * time.Millisecond)
+				aead.forwardSecure = true
+				handlePacket(1)
+				Expect(session.isSlowHandshake(session.Stats().HandshakeDuration)).To(BeTrue())
+				Expect(session.handshakePhases(clock.Now())).To(Equal("connection=1337 duration=1.5s rej=- shlo=- fs=1.5s"))
+			})
+		})
+
+		It("can be waited for by multiple goroutines", func() {
+			var waiting int32
+			for i := 0; i < 3; i++ {
+				go func() {
+					defer GinkgoRecover()
+					<-session.HandshakeComplete()
+					atomic.AddInt32(&waiting, 1)
+				}()
+			}
+			aead.forwardSecure = true
+			handlePacket(1)
+			Eventually(func() int32 { return atomic.LoadInt32(&waiting) }).Should(Equal(int32(3)))
+		})
+	})
+
+	Context("limiting the receive buffer", func() {
+		const numStreams = 20
+		const dataLen = 100
+
+		BeforeEach(func() {
+			session.SetMaxReceiveBufferSize(numStreams * dataLen)
+			// fill the buffer with out-of-order data on many streams
+			for i := 0; i < numStreams; i++ {
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: protocol.StreamID(5 + 2*i),
+					Offset:   10,
+					Data:     make([]byte, dataLen),
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(session.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount(numStreams * dataLen)))
+		})
+
+		It("errors when the buffer is exceeded", func() {
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Offset:   0,
+				Data:     []byte{0xde},
+			})
+			Expect(err).To(MatchError(errReceiveBufferExceeded))
+			Expect(qerr.ToQuicError(err).ErrorCode).To(Equal(qerr.FlowControlReceivedTooMuchData))
+		})
+
+		It("frees the buffer when data is read", func() {
+			session.SetMaxReceiveBufferSize(numStreams*dataLen + 10)
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     make([]byte, 10),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			n, err := session.streams[5].Read(make([]byte, 10+dataLen))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(10 + dataLen))
+			Expect(session.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount((numStreams - 1) * dataLen)))
+			err = session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 7,
+				Data:     []byte{0xde},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("frees the buffer when a stream is garbage collected", func() {
+			str := session.streams[5]
+			str.RegisterError(errors.New("test"))
+			_, err := str.Read(make([]byte, dataLen))
+			Expect(err).To(MatchError("test"))
+			session.garbageCollectStreams()
+			Expect(session.streams[5]).To(BeNil())
+			Expect(session.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount((numStreams - 1) * dataLen)))
+		})
+	})
+
+	Context("limiting the memory of a session", func() {
+		BeforeEach(func() {
+			// out-of-order data on a stream
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Offset:   10,
+				Data:     make([]byte, 60),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			// data queued for sending
+			err = session.queueStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     make([]byte, 30),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			session.tryQueueingUndecryptablePacket(receivedPacket{
+				publicHeader: &publicHeader{PacketNumber: 1},
+				data:         make([]byte, 20),
+			})
+		})
+
+		It("adds up the memory used by all buffers", func() {
+			Expect(session.memoryUsage()).To(Equal(protocol.ByteCount(60 + 30 + 20)))
+		})
+
+		It("tolerates usage up to the limit", func() {
+			session.config.maxConnectionMemory = 110
+			Expect(session.memoryLimitExceeded()).To(BeFalse())
+			session.config.maxConnectionMemory = 109
+			Expect(session.memoryLimitExceeded()).To(BeTrue())
+		})
+
+		It("has no limit by default", func() {
+			Expect(session.memoryLimitExceeded()).To(BeFalse())
+		})
+
+		It("closes the session when the budget is exceeded", func(done Done) {
+			session.config.maxConnectionMemory = 100
+			session.run()
+			Expect(context.Cause(session.Context())).To(MatchError(errConnectionMemoryExceeded))
+			Expect(qerr.ToQuicError(context.Cause(session.Context())).ErrorCode).To(Equal(qerr.FlowControlReceivedTooMuchData))
+			close(done)
+		})
+	})
+
+	Context("connection-level flow control, for receiving", func() {
+		// each stream stays within its stream-level window, but together they exceed the connection-level window
+		const dataLen = protocol.ReceiveConnectionFlowControlWindow/2 + 1
+
+		It("errors when the data on all streams exceeds the connection-level window", func() {
+			Expect(dataLen).To(BeNumerically("<=", protocol.ReceiveStreamFlowControlWindow))
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     make([]byte, dataLen),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 7,
+				Data:     make([]byte, dataLen),
+			})
+			Expect(err).To(MatchError(errConnectionFlowControlViolation))
+		})
+
+		It("sends a connection-level WindowUpdate when data on all streams was read", func() {
+			const streamDataLen = protocol.ReceiveConnectionFlowControlWindow / 4
+			for _, id := range []protocol.StreamID{5, 7, 9} {
+				err := session.handleStreamFrame(&frames.StreamFrame{
+					StreamID: id,
+					Data:     make([]byte, streamDataLen),
+				})
+				Expect(err).ToNot(HaveOccurred())
+				_, err = io.ReadFull(session.streams[id], make([]byte, streamDataLen))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(session.windowUpdateManager.streamOffsets).To(HaveKey(protocol.StreamID(0)))
+			Expect(session.windowUpdateManager.streamOffsets[0].Offset).To(Equal(3*streamDataLen + protocol.ReceiveConnectionFlowControlWindow))
+			// no stream used up half of its stream-level window
+			Expect(session.windowUpdateManager.streamOffsets).To(HaveLen(1))
+			// the peer can now send more data on a new stream
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 11,
+				Data:     make([]byte, dataLen),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the window used by data that was discarded when a stream was garbage collected", func() {
+			err := session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 5,
+				Data:     make([]byte, dataLen),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			str := session.streams[5]
+			str.RegisterError(errors.New("test"))
+			str.eof = 1
+			session.garbageCollectStreams()
+			Expect(session.streams[5]).To(BeNil())
+			Expect(session.windowUpdateManager.streamOffsets).To(HaveKey(protocol.StreamID(0)))
+			err = session.handleStreamFrame(&frames.StreamFrame{
+				StreamID: 7,
+				Data:     make([]byte, dataLen),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
 	Context("counting streams", func() {
 		It("errors when too many streams are opened", func() {
 			// 1.1 * 100
@@ -655,5 +2001,66 @@ var _ = Describe("Session", func() {
 				session.garbageCollectStreams()
 			}
 		})
+
+		Context("blocking when opening streams", func() {
+			BeforeEach(func() {
+				// the crypto stream counts as well, so only 2 more streams can be opened
+				err := session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+					handshake.TagMSPC: {3, 0, 0, 0},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				for i := 3; i <= 5; i += 2 {
+					_, err := session.OpenStreamSync(protocol.StreamID(i))
+					Expect(err).NotTo(HaveOccurred())
+				}
+			})
+
+			It("blocks until a stream is retired", func() {
+				var opened int32
+				go func() {
+					defer GinkgoRecover()
+					_, err := session.OpenStreamSync(7)
+					Expect(err).NotTo(HaveOccurred())
+					atomic.StoreInt32(&opened, 1)
+				}()
+				Consistently(func() int32 { return atomic.LoadInt32(&opened) }).Should(BeZero())
+				str := session.streams[3]
+				str.Close()
+				str.CloseRemote(0)
+				_, err := str.Read([]byte{0})
+				Expect(err).To(MatchError(io.EOF))
+				session.garbageCollectStreams()
+				Eventually(func() int32 { return atomic.LoadInt32(&opened) }).Should(BeEquivalentTo(1))
+			})
+
+			It("blocks until the limit is raised", func() {
+				var opened int32
+				go func() {
+					defer GinkgoRecover()
+					_, err := session.OpenStreamSync(7)
+					Expect(err).NotTo(HaveOccurred())
+					atomic.StoreInt32(&opened, 1)
+				}()
+				Consistently(func() int32 { return atomic.LoadInt32(&opened) }).Should(BeZero())
+				err := session.connectionParametersManager.SetFromMap(map[handshake.Tag][]byte{
+					handshake.TagMSPC: {4, 0, 0, 0},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				session.garbageCollectStreams()
+				Eventually(func() int32 { return atomic.LoadInt32(&opened) }).Should(BeEquivalentTo(1))
+			})
+
+			It("returns an error when the session is closed", func() {
+				testErr := errors.New("test error")
+				errChan := make(chan error)
+				go func() {
+					_, err := session.OpenStreamSync(7)
+					errChan <- err
+				}()
+				Consistently(errChan).ShouldNot(Receive())
+				session.Close(testErr)
+				Eventually(errChan).Should(Receive(MatchError(testErr)))
+			})
+		})
 	})
 })
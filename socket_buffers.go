@@ -0,0 +1,30 @@
+package quic
+
+import (
+	"net"
+
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+// setSocketBufferSizes applies the requested SO_RCVBUF and SO_SNDBUF sizes to the socket.
+// A size of 0 leaves the OS default unchanged.
+// Since the OS may silently clamp the values, we read them back and warn if they are too small.
+func setSocketBufferSizes(conn *net.UDPConn, receiveBufferSize, sendBufferSize int) error {
+	if receiveBufferSize > 0 {
+		if err := conn.SetReadBuffer(receiveBufferSize); err != nil {
+			return err
+		}
+		if size, err := getReceiveBufferSize(conn); err == nil && size < receiveBufferSize {
+			utils.Errorf("Warning: requested a socket receive buffer of %d bytes, but the OS only granted %d bytes", receiveBufferSize, size)
+		}
+	}
+	if sendBufferSize > 0 {
+		if err := conn.SetWriteBuffer(sendBufferSize); err != nil {
+			return err
+		}
+		if size, err := getSendBufferSize(conn); err == nil && size < sendBufferSize {
+			utils.Errorf("Warning: requested a socket send buffer of %d bytes, but the OS only granted %d bytes", sendBufferSize, size)
+		}
+	}
+	return nil
+}
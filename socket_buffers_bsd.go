@@ -0,0 +1,8 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package quic
+
+// grantedBufferSize converts a SO_RCVBUF or SO_SNDBUF value read from the socket into the size that was granted.
+func grantedBufferSize(reported int) int {
+	return reported
+}
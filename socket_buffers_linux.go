@@ -0,0 +1,9 @@
+// +build linux
+
+package quic
+
+// grantedBufferSize converts a SO_RCVBUF or SO_SNDBUF value read from the socket into the size that was granted.
+// Linux doubles the requested value to allow space for bookkeeping overhead, and reports the doubled value.
+func grantedBufferSize(reported int) int {
+	return reported / 2
+}
@@ -0,0 +1,14 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package quic
+
+import (
+	"errors"
+	"net"
+)
+
+var errSocketOptionNotSupported = errors.New("reading socket options is not supported on this platform")
+
+func getReceiveBufferSize(*net.UDPConn) (int, error) { return 0, errSocketOptionNotSupported }
+
+func getSendBufferSize(*net.UDPConn) (int, error) { return 0, errSocketOptionNotSupported }
@@ -0,0 +1,63 @@
+package quic
+
+import (
+	"net"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Socket buffers", func() {
+	var conn *net.UDPConn
+
+	BeforeEach(func() {
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		conn, err = net.ListenUDP("udp", addr)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+	})
+
+	It("sets the buffer sizes", func() {
+		if runtime.GOOS != "linux" {
+			Skip("reading back socket buffer sizes is only tested on Linux")
+		}
+		err := setSocketBufferSizes(conn, 64*1024, 32*1024)
+		Expect(err).ToNot(HaveOccurred())
+		rcv, err := getReceiveBufferSize(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rcv).To(BeNumerically(">=", 64*1024))
+		snd, err := getSendBufferSize(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snd).To(BeNumerically(">=", 32*1024))
+	})
+
+	It("reports the size granted by the OS, not the doubled size", func() {
+		if runtime.GOOS != "linux" {
+			Skip("reading back socket buffer sizes is only tested on Linux")
+		}
+		// 64 kB is below the default net.core.rmem_max, so it is not clamped
+		err := setSocketBufferSizes(conn, 64*1024, 0)
+		Expect(err).ToNot(HaveOccurred())
+		rcv, err := getReceiveBufferSize(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rcv).To(Equal(64 * 1024))
+	})
+
+	It("leaves the defaults if no sizes are given", func() {
+		if runtime.GOOS != "linux" {
+			Skip("reading back socket buffer sizes is only tested on Linux")
+		}
+		before, err := getReceiveBufferSize(conn)
+		Expect(err).ToNot(HaveOccurred())
+		err = setSocketBufferSizes(conn, 0, 0)
+		Expect(err).ToNot(HaveOccurred())
+		after, err := getReceiveBufferSize(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(after).To(Equal(before))
+	})
+})
@@ -0,0 +1,32 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package quic
+
+import (
+	"net"
+	"syscall"
+)
+
+func getReceiveBufferSize(conn *net.UDPConn) (int, error) {
+	return getSocketOption(conn, syscall.SO_RCVBUF)
+}
+
+func getSendBufferSize(conn *net.UDPConn) (int, error) {
+	return getSocketOption(conn, syscall.SO_SNDBUF)
+}
+
+// getSocketOption reads a buffer size from the socket, as granted by the OS
+func getSocketOption(conn *net.UDPConn, opt int) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return grantedBufferSize(size), sockErr
+}
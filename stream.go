@@ -1,6 +1,8 @@
 package quic
 
 import (
+	"context"
+	"errors"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -15,6 +17,8 @@ import (
 
 type streamHandler interface {
 	queueStreamFrame(*frames.StreamFrame) error
+	flush()
+	queueRstStreamFrame(*frames.RstStreamFrame)
 	updateReceiveFlowControlWindow(streamID protocol.StreamID, byteOffset protocol.ByteCount) error
 	streamBlocked(streamID protocol.StreamID, byteOffset protocol.ByteCount)
 }
@@ -22,6 +26,8 @@ type streamHandler interface {
 var (
 	errFlowControlViolation           = qerr.FlowControlReceivedTooMuchData
 	errConnectionFlowControlViolation = qerr.FlowControlReceivedTooMuchData
+	errWriteAfterClose                = errors.New("write on closed stream")
+	errStreamReset                    = errors.New("stream reset")
 )
 
 // A Stream assembles the data from StreamFrames and provides a super-convenient Read-Interface
@@ -39,10 +45,28 @@ type stream struct {
 	err   error
 	mutex sync.Mutex
 
+	// ctx is canceled with the err once it is set
+	ctx       context.Context
+	ctxCancel context.CancelCauseFunc
+
 	// eof is set if we are finished reading
 	eof int32 // really a bool
 	// closed is set when we are finished writing
 	closed int32 // really a bool
+	// remoteClosed is set when a frame with the FinBit was received, even if it wasn't read yet
+	remoteClosed int32 // really a bool
+	// noDelay is set if every Write should be flushed
+	noDelay int32 // really a bool
+	// resetSent is set once a RST_STREAM was queued
+	resetSent int32 // really a bool
+
+	// counters for Stats(), all used atomically
+	bytesRead      uint64
+	bytesWritten   uint64
+	framesReceived uint64
+	framesSent     uint64
+	finReceived    int32 // really a bool
+	finSent        int32 // really a bool
 
 	frameQueue        *streamFrameSorter
 	newFrameOrErrCond sync.Cond
@@ -64,6 +88,7 @@ func newStream(session streamHandler, connectionParameterManager *handshake.Conn
 		flowController:                     flowcontrol.NewFlowController(StreamID, connectionParameterManager),
 		frameQueue:                         newStreamFrameSorter(),
 	}
+	s.ctx, s.ctxCancel = context.WithCancelCause(context.Background())
 
 	// crypto and header stream don't contribute to connection level flow control
 	// TODO: only include the header stream here when using HTTP2
@@ -129,7 +154,11 @@ func (s *stream) Read(p []byte) (int, error) {
 
 		s.readPosInFrame += m
 		bytesRead += m
+		// discardReceivedData reads the readOffset concurrently
+		s.mutex.Lock()
 		s.readOffset += protocol.ByteCount(m)
+		s.mutex.Unlock()
+		atomic.AddUint64(&s.bytesRead, uint64(m))
 
 		s.flowController.AddBytesRead(protocol.ByteCount(m))
 		if s.contributesToConnectionFlowControl {
@@ -145,6 +174,7 @@ func (s *stream) Read(p []byte) (int, error) {
 			s.mutex.Unlock()
 			if fin {
 				atomic.StoreInt32(&s.eof, 1)
+				atomic.StoreInt32(&s.finReceived, 1)
 				return bytesRead, io.EOF
 			}
 		}
@@ -180,6 +210,11 @@ func (s *stream) Write(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	// The peer closing its side (CloseRemote or a FinBit) doesn't affect writing,
+	// only our own Close() does.
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return 0, errWriteAfterClose
+	}
 
 	dataWritten := 0
 
@@ -217,21 +252,57 @@ func (s *stream) Write(p []byte) (int, error) {
 		}
 
 		dataWritten += int(dataLen) // We cannot have written more than the int range
+		atomic.AddUint64(&s.bytesWritten, uint64(dataLen))
+		atomic.AddUint64(&s.framesSent, 1)
 		s.flowController.AddBytesSent(protocol.ByteCount(dataLen))
 		if s.contributesToConnectionFlowControl {
 			s.connectionFlowController.AddBytesSent(protocol.ByteCount(dataLen))
 		}
+		// Reset reads the writeOffset concurrently
+		s.mutex.Lock()
 		s.writeOffset += protocol.ByteCount(dataLen)
+		s.mutex.Unlock()
 
 		s.maybeTriggerBlocked()
 	}
 
+	if atomic.LoadInt32(&s.noDelay) != 0 {
+		s.session.flush()
+	}
 	return dataWritten, nil
 }
 
-// Close implements io.Closer
+// Flush sends the queued data of this stream without waiting for more data, as long as congestion control allows it
+func (s *stream) Flush() error {
+	s.mutex.Lock()
+	err := s.err
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	s.session.flush()
+	return nil
+}
+
+// SetNoDelay controls whether every Write is flushed, see Flush
+func (s *stream) SetNoDelay(noDelay bool) {
+	var v int32
+	if noDelay {
+		v = 1
+	}
+	atomic.StoreInt32(&s.noDelay, v)
+}
+
+// Close implements io.Closer. Calling it more than once is a no-op.
 func (s *stream) Close() error {
-	atomic.StoreInt32(&s.closed, 1)
+	if atomic.LoadInt32(&s.resetSent) != 0 {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	atomic.StoreInt32(&s.finSent, 1)
+	atomic.AddUint64(&s.framesSent, 1)
 	return s.session.queueStreamFrame(&frames.StreamFrame{
 		StreamID: s.streamID,
 		Offset:   s.writeOffset,
@@ -239,6 +310,22 @@ func (s *stream) Close() error {
 	})
 }
 
+// Reset aborts the stream by sending a RST_STREAM frame. Reading from and writing to the stream fails afterwards.
+func (s *stream) Reset(errorCode uint32) {
+	if !atomic.CompareAndSwapInt32(&s.resetSent, 0, 1) {
+		return
+	}
+	s.RegisterError(errStreamReset)
+	s.mutex.Lock()
+	writeOffset := s.writeOffset
+	s.mutex.Unlock()
+	s.session.queueRstStreamFrame(&frames.RstStreamFrame{
+		StreamID:   s.streamID,
+		ByteOffset: writeOffset,
+		ErrorCode:  errorCode,
+	})
+}
+
 // AddStreamFrame adds a new stream frame
 func (s *stream) AddStreamFrame(frame *frames.StreamFrame) error {
 	maxOffset := frame.Offset + frame.DataLen()
@@ -259,6 +346,10 @@ func (s *stream) AddStreamFrame(frame *frames.StreamFrame) error {
 	if err != nil && err != errDuplicateStreamData {
 		return err
 	}
+	atomic.AddUint64(&s.framesReceived, 1)
+	if frame.FinBit {
+		atomic.StoreInt32(&s.remoteClosed, 1)
+	}
 	s.newFrameOrErrCond.Signal()
 	return nil
 }
@@ -310,10 +401,28 @@ func (s *stream) RegisterError(err error) {
 		return
 	}
 	s.err = err
+	s.ctxCancel(err)
 	s.windowUpdateOrErrCond.Signal()
 	s.newFrameOrErrCond.Signal()
 }
 
+// discardReceivedData drops all data that was received but not read
+// The dropped data is counted as read by the connection-level flow controller, otherwise it would permanently use up the connection-level receive window.
+func (s *stream) discardReceivedData() {
+	s.mutex.Lock()
+	s.frameQueue.ReleaseAll()
+	unread := s.flowController.GetHighestReceived() - s.readOffset
+	s.mutex.Unlock()
+
+	if !s.contributesToConnectionFlowControl || unread == 0 {
+		return
+	}
+	s.connectionFlowController.AddBytesRead(unread)
+	if doUpdate, byteOffset := s.connectionFlowController.MaybeTriggerWindowUpdate(); doUpdate {
+		s.session.updateReceiveFlowControlWindow(0, byteOffset)
+	}
+}
+
 func (s *stream) finishedReading() bool {
 	return atomic.LoadInt32(&s.eof) != 0
 }
@@ -322,6 +431,34 @@ func (s *stream) finishedWriting() bool {
 	return atomic.LoadInt32(&s.closed) != 0
 }
 
+// halfOpen returns true if we finished writing, but the peer didn't close its side of the stream
+func (s *stream) halfOpen() bool {
+	if !s.finishedWriting() || atomic.LoadInt32(&s.remoteClosed) != 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err == nil
+}
+
+// failed returns true if the stream was reset, or closed with an error
+func (s *stream) failed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err != nil
+}
+
+// flowControlBlocked returns true if the stream can't send more data because the stream-level or the connection-level send window is used up
+func (s *stream) flowControlBlocked() bool {
+	if s.finishedWriting() {
+		return false
+	}
+	if s.flowController.SendWindowSize() == 0 {
+		return true
+	}
+	return s.contributesToConnectionFlowControl && s.connectionFlowController.SendWindowSize() == 0
+}
+
 func (s *stream) finished() bool {
 	return s.finishedReading() && s.finishedWriting()
 }
@@ -329,3 +466,28 @@ func (s *stream) finished() bool {
 func (s *stream) StreamID() protocol.StreamID {
 	return s.streamID
 }
+
+// Context returns a context that is canceled when the stream fails, e.g. because it was reset or the session was closed.
+// The error is available via context.Cause.
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+// Stats returns the counters of this stream
+func (s *stream) Stats() utils.StreamStats {
+	s.mutex.Lock()
+	reset := s.err != nil
+	s.mutex.Unlock()
+
+	return utils.StreamStats{
+		BytesRead:      protocol.ByteCount(atomic.LoadUint64(&s.bytesRead)),
+		BytesWritten:   protocol.ByteCount(atomic.LoadUint64(&s.bytesWritten)),
+		FramesReceived: atomic.LoadUint64(&s.framesReceived),
+		FramesSent:     atomic.LoadUint64(&s.framesSent),
+		FinReceived:    atomic.LoadInt32(&s.finReceived) != 0,
+		FinSent:        atomic.LoadInt32(&s.finSent) != 0,
+		Reset:          reset,
+		SendWindow:     s.flowController.SendWindowSize(),
+		ReceiveWindow:  s.flowController.ReceiveWindowSize(),
+	}
+}
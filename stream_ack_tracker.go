@@ -0,0 +1,141 @@
+package quic
+
+import (
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/protocol"
+	"github.com/lucas-clemente/quic-go/utils"
+)
+
+type streamAckState struct {
+	gaps      *utils.ByteIntervalList // the byte ranges that were not acked yet
+	finAcked  bool
+	finOffset protocol.ByteCount
+
+	retransmissions     int                // how often the data at retransmittedOffset was retransmitted
+	retransmittedOffset protocol.ByteCount // the first unacked byte when it was last retransmitted
+}
+
+// streamAckTracker keeps track of the byte ranges of every stream that were acked by the peer.
+// When a packet is lost, it is used to retransmit only the data that didn't arrive in another packet.
+type streamAckTracker struct {
+	streams map[protocol.StreamID]*streamAckState
+	mutex   sync.Mutex
+}
+
+var _ ackhandler.PacketAckedObserver = &streamAckTracker{}
+
+func newStreamAckTracker() *streamAckTracker {
+	return &streamAckTracker{
+		streams: make(map[protocol.StreamID]*streamAckState),
+	}
+}
+
+// AddStream starts tracking the acked byte ranges of a stream
+func (t *streamAckTracker) AddStream(streamID protocol.StreamID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.streams[streamID]; ok {
+		return
+	}
+	state := &streamAckState{gaps: utils.NewByteIntervalList()}
+	state.gaps.AddRange(0, protocol.MaxByteCount)
+	t.streams[streamID] = state
+}
+
+// OnPacketAcked marks the data of all StreamFrames in the packet as acked.
+// Frames of streams that are not tracked (anymore) are ignored.
+func (t *streamAckTracker) OnPacketAcked(packet *ackhandler.Packet) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, f := range packet.GetStreamFramesForRetransmission() {
+		state, ok := t.streams[f.StreamID]
+		if !ok {
+			continue
+		}
+		state.gaps.RemoveRange(f.Offset, f.Offset+f.DataLen())
+		if f.FinBit {
+			state.finAcked = true
+			state.finOffset = f.Offset + f.DataLen()
+		}
+		if next, ok := state.gaps.NextInterval(0); state.finAcked && (!ok || next.Start >= state.finOffset) {
+			// everything up to the FIN was acked, nothing of this stream will be retransmitted anymore
+			delete(t.streams, f.StreamID)
+		}
+	}
+}
+
+// UnackedParts returns the parts of a StreamFrame that were not acked yet.
+// The returned frames share the data with the original frame.
+// Nothing is returned for streams that are not tracked (anymore), since either all their data was acked, or they were reset.
+func (t *streamAckTracker) UnackedParts(f *frames.StreamFrame) []*frames.StreamFrame {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.streams[f.StreamID]
+	if !ok {
+		return nil
+	}
+
+	start := f.Offset
+	end := f.Offset + f.DataLen()
+	var parts []*frames.StreamFrame
+	for _, part := range state.gaps.Intersections(start, end) {
+		parts = append(parts, &frames.StreamFrame{
+			StreamID:       f.StreamID,
+			Offset:         part.Start,
+			Data:           f.Data[part.Start-start : part.End-start],
+			DataLenPresent: f.DataLenPresent,
+		})
+	}
+
+	if f.FinBit && !state.finAcked {
+		if len(parts) > 0 && parts[len(parts)-1].Offset+parts[len(parts)-1].DataLen() == end {
+			parts[len(parts)-1].FinBit = true
+		} else {
+			parts = append(parts, &frames.StreamFrame{
+				StreamID: f.StreamID,
+				Offset:   end,
+				FinBit:   true,
+			})
+		}
+	}
+	return parts
+}
+
+// CountRetransmission is called when a StreamFrame is retransmitted.
+// It returns how often the first unacked byte of the stream was retransmitted, which is only counted if the frame contains that byte.
+// Retransmissions of streams that are not tracked (anymore) are not counted.
+func (t *streamAckTracker) CountRetransmission(f *frames.StreamFrame) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.streams[f.StreamID]
+	if !ok {
+		return 0
+	}
+	head, _ := state.gaps.NextInterval(0) // the gaps always extend to protocol.MaxByteCount
+	end := f.Offset + f.DataLen()
+	if f.Offset > head.Start || end < head.Start || (end == head.Start && !f.FinBit) {
+		return state.retransmissions
+	}
+	if head.Start != state.retransmittedOffset {
+		// the data retransmitted before was acked
+		state.retransmittedOffset = head.Start
+		state.retransmissions = 0
+	}
+	state.retransmissions++
+	return state.retransmissions
+}
+
+// RemoveStream deletes the state of a stream, e.g. when it was reset.
+// Its data won't be retransmitted anymore.
+func (t *streamAckTracker) RemoveStream(streamID protocol.StreamID) {
+	t.mutex.Lock()
+	delete(t.streams, streamID)
+	t.mutex.Unlock()
+}
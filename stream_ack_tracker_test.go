@@ -0,0 +1,172 @@
+package quic
+
+import (
+	"github.com/lucas-clemente/quic-go/ackhandler"
+	"github.com/lucas-clemente/quic-go/frames"
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream ACK tracker", func() {
+	var tracker *streamAckTracker
+
+	ack := func(fs ...*frames.StreamFrame) {
+		packet := &ackhandler.Packet{PacketNumber: 1}
+		for _, f := range fs {
+			packet.Frames = append(packet.Frames, f)
+		}
+		tracker.OnPacketAcked(packet)
+	}
+
+	BeforeEach(func() {
+		tracker = newStreamAckTracker()
+		tracker.AddStream(5)
+		tracker.AddStream(7)
+	})
+
+	It("returns the whole frame if nothing was acked on the stream", func() {
+		f := &frames.StreamFrame{StreamID: 5, Offset: 10, Data: []byte("foobar"), FinBit: true}
+		Expect(tracker.UnackedParts(f)).To(Equal([]*frames.StreamFrame{f}))
+	})
+
+	It("returns nothing if the whole frame was acked", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")}, &frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar")})
+		f := &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}
+		Expect(tracker.UnackedParts(f)).To(BeEmpty())
+	})
+
+	It("returns the frame if only other streams were acked", func() {
+		ack(&frames.StreamFrame{StreamID: 7, Data: []byte("foobar")})
+		f := &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}
+		Expect(tracker.UnackedParts(f)).To(Equal([]*frames.StreamFrame{f}))
+	})
+
+	It("cuts off the acked data at the beginning", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+		parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar")})
+		Expect(parts).To(HaveLen(1))
+		Expect(parts[0].Offset).To(Equal(protocol.ByteCount(3)))
+		Expect(parts[0].Data).To(Equal([]byte("bar")))
+	})
+
+	It("splits a frame if the data in the middle was acked", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Offset: 12, Data: []byte("ba")})
+		parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Offset: 10, Data: []byte("foobar"), DataLenPresent: true})
+		Expect(parts).To(HaveLen(2))
+		Expect(parts[0].Offset).To(Equal(protocol.ByteCount(10)))
+		Expect(parts[0].Data).To(Equal([]byte("fo")))
+		Expect(parts[0].DataLenPresent).To(BeTrue())
+		Expect(parts[1].Offset).To(Equal(protocol.ByteCount(14)))
+		Expect(parts[1].Data).To(Equal([]byte("ar")))
+	})
+
+	It("handles acks that overlap multiple gaps", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Offset: 2, Data: []byte("a")}, &frames.StreamFrame{StreamID: 5, Offset: 6, Data: []byte("b")})
+		ack(&frames.StreamFrame{StreamID: 5, Offset: 1, Data: []byte("abcdefg")})
+		parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("0123456789")})
+		Expect(parts).To(HaveLen(2))
+		Expect(parts[0].Data).To(Equal([]byte("0")))
+		Expect(parts[1].Offset).To(Equal(protocol.ByteCount(8)))
+		Expect(parts[1].Data).To(Equal([]byte("89")))
+	})
+
+	Context("FIN", func() {
+		It("keeps the FIN on the last part", func() {
+			ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+			parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar"), FinBit: true})
+			Expect(parts).To(HaveLen(1))
+			Expect(parts[0].Data).To(Equal([]byte("bar")))
+			Expect(parts[0].FinBit).To(BeTrue())
+		})
+
+		It("sends a FIN without data if the end of the frame was acked", func() {
+			ack(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar")})
+			parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar"), FinBit: true})
+			Expect(parts).To(HaveLen(2))
+			Expect(parts[0].Data).To(Equal([]byte("foo")))
+			Expect(parts[0].FinBit).To(BeFalse())
+			Expect(parts[1].Offset).To(Equal(protocol.ByteCount(6)))
+			Expect(parts[1].Data).To(BeEmpty())
+			Expect(parts[1].FinBit).To(BeTrue())
+		})
+
+		It("doesn't retransmit an acked FIN", func() {
+			ack(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar"), FinBit: true})
+			parts := tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foobar"), FinBit: true})
+			Expect(parts).To(HaveLen(1))
+			Expect(parts[0].Data).To(Equal([]byte("foo")))
+			Expect(parts[0].FinBit).To(BeFalse())
+		})
+
+		It("deletes the state once all data and the FIN were acked", func() {
+			tracker.RemoveStream(7)
+			ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+			ack(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar"), FinBit: true})
+			Expect(tracker.streams).To(BeEmpty())
+		})
+	})
+
+	Context("counting retransmissions", func() {
+		It("counts retransmissions of the first unacked byte", func() {
+			f := &frames.StreamFrame{StreamID: 5, Data: []byte("foobar")}
+			Expect(tracker.CountRetransmission(f)).To(Equal(1))
+			Expect(tracker.CountRetransmission(f)).To(Equal(2))
+		})
+
+		It("doesn't count frames after the first unacked byte", func() {
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar")})).To(BeZero())
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(Equal(1))
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar")})).To(Equal(1))
+		})
+
+		It("counts streams separately", func() {
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(Equal(1))
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 7, Data: []byte("foo")})).To(Equal(1))
+		})
+
+		It("restarts counting when the data was acked", func() {
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(Equal(1))
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(Equal(2))
+			ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Offset: 3, Data: []byte("bar")})).To(Equal(1))
+		})
+
+		It("counts a FIN without data at the first unacked byte", func() {
+			ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+			Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Offset: 3, FinBit: true})).To(Equal(1))
+		})
+	})
+
+	It("removes streams", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+		tracker.RemoveStream(5)
+		tracker.RemoveStream(7)
+		Expect(tracker.streams).To(BeEmpty())
+	})
+
+	It("doesn't recreate the state of a removed stream for late ACKs", func() {
+		tracker.RemoveStream(5)
+		tracker.RemoveStream(7)
+		ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})
+		Expect(tracker.streams).To(BeEmpty())
+	})
+
+	It("returns nothing for removed streams", func() {
+		tracker.RemoveStream(5)
+		Expect(tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(BeEmpty())
+	})
+
+	It("returns nothing once all data and the FIN were acked", func() {
+		ack(&frames.StreamFrame{StreamID: 5, Data: []byte("foo"), FinBit: true})
+		Expect(tracker.UnackedParts(&frames.StreamFrame{StreamID: 5, Data: []byte("foo"), FinBit: true})).To(BeEmpty())
+	})
+
+	It("doesn't count retransmissions of removed streams", func() {
+		tracker.RemoveStream(5)
+		tracker.RemoveStream(7)
+		Expect(tracker.CountRetransmission(&frames.StreamFrame{StreamID: 5, Data: []byte("foo")})).To(BeZero())
+		Expect(tracker.streams).To(BeEmpty())
+	})
+})
@@ -1,7 +1,10 @@
 package quic
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
@@ -11,8 +14,18 @@ import (
 
 type streamFrameSorter struct {
 	queuedFrames map[protocol.ByteCount]*frames.StreamFrame
+	frameIndex   []protocol.ByteCount // the offsets of the queued frames that contain data in order, used to find the frames overlapping a range
 	readPosition protocol.ByteCount
 	gaps         *utils.ByteIntervalList
+	gapIndex     []*utils.ByteIntervalElement // the elements of gaps in order, used to find a gap with a binary search
+	maxGaps      int                          // the number of gaps above which Push fails, protocol.MaxStreamFrameSorterGaps unless raised in benchmarks
+
+	// receiveBuffer accounts for the queued data of all streams of a connection, if set
+	receiveBuffer *receiveBuffer
+
+	// tolerateIdenticalOverlaps makes Push accept frames that overlap with received data,
+	// as long as the overlapping bytes are identical to the data received before
+	tolerateIdenticalOverlaps bool
 }
 
 var (
@@ -22,16 +35,61 @@ var (
 	errEmptyStreamData                 = errors.New("Stream Data empty")
 )
 
+// overlappingStreamDataError is returned when a frame overlaps with data that was already received.
+// It matches errOverlappingStreamData.
+type overlappingStreamDataError struct {
+	Offset      protocol.ByteCount
+	DataLen     protocol.ByteCount
+	Conflicting utils.ByteInterval // the interval of received data the frame overlaps with
+}
+
+func (e *overlappingStreamDataError) Error() string {
+	return fmt.Sprintf("frame at offset %d (length %d) overlaps with received data at [%d, %d)", e.Offset, e.DataLen, e.Conflicting.Start, e.Conflicting.End)
+}
+
+func (e *overlappingStreamDataError) Unwrap() error {
+	return errOverlappingStreamData
+}
+
+func (e *overlappingStreamDataError) Is(target error) bool {
+	qErr, ok := target.(*qerr.QuicError)
+	return ok && qErr.ErrorCode == qerr.OverlappingStreamData
+}
+
 func newStreamFrameSorter() *streamFrameSorter {
 	s := streamFrameSorter{
 		gaps:         utils.NewByteIntervalList(),
+		maxGaps:      protocol.MaxStreamFrameSorterGaps,
 		queuedFrames: make(map[protocol.ByteCount]*frames.StreamFrame),
 	}
-	s.gaps.PushFront(utils.ByteInterval{Start: 0, End: protocol.MaxByteCount})
+	s.gapIndex = []*utils.ByteIntervalElement{s.gaps.PushBack(utils.ByteInterval{Start: 0, End: protocol.MaxByteCount})}
 	return &s
 }
 
 func (s *streamFrameSorter) Push(frame *frames.StreamFrame) error {
+	err := s.push(frame)
+	if _, ok := err.(*overlappingStreamDataError); ok && s.tolerateIdenticalOverlaps {
+		return s.pushOverlapping(frame, err)
+	}
+	if err == errDuplicateStreamData && frame.FinBit {
+		// the data might have been received without the FinBit before
+		s.pushFin(frame.StreamID, frame.Offset+frame.DataLen())
+	}
+	return err
+}
+
+// pushFin queues an empty frame with the FinBit at offset, unless a frame is already queued there, or the data up to a larger offset was already read
+func (s *streamFrameSorter) pushFin(streamID protocol.StreamID, offset protocol.ByteCount) {
+	if offset < s.readPosition {
+		return
+	}
+	if _, ok := s.queuedFrames[offset]; ok {
+		return
+	}
+	s.queuedFrames[offset] = &frames.StreamFrame{StreamID: streamID, Offset: offset, FinBit: true}
+}
+
+func (s *streamFrameSorter) push(frame *frames.StreamFrame) error {
 	_, ok := s.queuedFrames[frame.Offset]
 	if ok {
 		return errDuplicateStreamData
@@ -48,57 +106,202 @@ func (s *streamFrameSorter) Push(frame *frames.StreamFrame) error {
 		return errEmptyStreamData
 	}
 
-	var foundInGap bool
+	// the index of the gap that contains the frame
+	gapIndex := -1
 
-	for gap := s.gaps.Front(); gap != nil; gap = gap.Next() {
+	// all gaps before this one end before the frame starts
+	for i := s.findGap(start); i < len(s.gapIndex); i++ {
+		gap := s.gapIndex[i]
 		// the complete frame lies before or after the gap
 		if end <= gap.Value.Start || start > gap.Value.End {
 			continue
 		}
 
 		if start < gap.Value.Start {
-			return errOverlappingStreamData
+			// the received data ends where this gap starts
+			conflicting := utils.ByteInterval{End: gap.Value.Start}
+			if i > 0 {
+				conflicting.Start = s.gapIndex[i-1].Value.End
+			}
+			return &overlappingStreamDataError{Offset: start, DataLen: end - start, Conflicting: conflicting}
 		}
 
 		if start < gap.Value.End && end > gap.Value.End {
-			return errOverlappingStreamData
+			// the received data starts where this gap ends
+			conflicting := utils.ByteInterval{Start: gap.Value.End, End: s.gapIndex[i+1].Value.Start}
+			return &overlappingStreamDataError{Offset: start, DataLen: end - start, Conflicting: conflicting}
 		}
 
-		foundInGap = true
+		if end <= gap.Value.End {
+			gapIndex = i
+			break
+		}
+	}
 
-		if start == gap.Value.Start {
-			if end == gap.Value.End {
-				s.gaps.Remove(gap)
-				break
-			}
-			if end < gap.Value.End {
-				gap.Value.Start = end
-				break
-			}
+	if gapIndex == -1 {
+		return errDuplicateStreamData
+	}
+
+	// the gap is only modified once the frame is sure to be queued, otherwise its data would never be received again
+	gap := s.gapIndex[gapIndex]
+	if start != gap.Value.Start && end != gap.Value.End && s.gaps.Len() >= s.maxGaps {
+		// splitting the gap would create too many gaps
+		return errTooManyGapsInReceivedStreamData
+	}
+
+	if s.receiveBuffer != nil {
+		if err := s.receiveBuffer.Reserve(frame.DataLen()); err != nil {
+			return err
 		}
+	}
 
-		if end == gap.Value.End {
-			gap.Value.End = start
-			break
+	s.removeFromGap(gapIndex, start, end)
+	s.queuedFrames[frame.Offset] = frame
+	s.indexFrame(frame.Offset)
+	return nil
+}
+
+// PushMany pushes a batch of frames, stopping at the first error.
+// If the frames are contiguous and all fit into the same gap, the gap list is only traversed once.
+func (s *streamFrameSorter) PushMany(fs []*frames.StreamFrame) error {
+	if s.pushContiguous(fs) {
+		return nil
+	}
+	for _, f := range fs {
+		if err := s.Push(f); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if end < gap.Value.End {
-			intv := utils.ByteInterval{Start: end, End: gap.Value.End}
-			s.gaps.InsertAfter(intv, gap)
-			gap.Value.End = start
-			break
+// pushContiguous queues frames that are ordered, contiguous and fit into a single gap.
+// It returns false without modifying the sorter if that's not the case.
+func (s *streamFrameSorter) pushContiguous(fs []*frames.StreamFrame) bool {
+	if len(fs) < 2 {
+		return false
+	}
+	start := fs[0].Offset
+	end := start
+	for _, f := range fs {
+		if f.Offset != end || f.DataLen() == 0 {
+			return false
 		}
+		if _, ok := s.queuedFrames[f.Offset]; ok {
+			return false
+		}
+		end += f.DataLen()
 	}
 
-	if !foundInGap {
-		return errDuplicateStreamData
+	// only the first gap that doesn't end before start can contain the frames
+	i := s.findGap(start)
+	if i == len(s.gapIndex) {
+		return false
 	}
+	gap := s.gapIndex[i]
+	if start < gap.Value.Start || end > gap.Value.End {
+		return false
+	}
+	if start != gap.Value.Start && end != gap.Value.End && s.gaps.Len() >= s.maxGaps {
+		// splitting the gap would create too many gaps, let Push return the error
+		return false
+	}
+	if s.receiveBuffer != nil && s.receiveBuffer.Reserve(end-start) != nil {
+		// let Push return the error
+		return false
+	}
+	s.removeFromGap(i, start, end)
+	for _, f := range fs {
+		s.queuedFrames[f.Offset] = f
+		s.indexFrame(f.Offset)
+	}
+	return true
+}
 
-	if s.gaps.Len() > protocol.MaxStreamFrameSorterGaps {
-		return errTooManyGapsInReceivedStreamData
+// indexFrame inserts the offset of a queued frame with data into the frameIndex
+func (s *streamFrameSorter) indexFrame(offset protocol.ByteCount) {
+	i := sort.Search(len(s.frameIndex), func(i int) bool {
+		return s.frameIndex[i] >= offset
+	})
+	s.frameIndex = append(s.frameIndex, 0)
+	copy(s.frameIndex[i+1:], s.frameIndex[i:])
+	s.frameIndex[i] = offset
+}
+
+// findGap returns the index of the first gap that ends at or after offset, or len(s.gapIndex) if there is none
+func (s *streamFrameSorter) findGap(offset protocol.ByteCount) int {
+	return sort.Search(len(s.gapIndex), func(i int) bool {
+		return s.gapIndex[i].Value.End >= offset
+	})
+}
+
+// removeFromGap removes the range [start, end) from the i-th gap, which has to contain it, splitting the gap if necessary
+func (s *streamFrameSorter) removeFromGap(i int, start, end protocol.ByteCount) {
+	gap := s.gapIndex[i]
+	switch {
+	case start == gap.Value.Start && end == gap.Value.End:
+		s.gaps.Remove(gap)
+		s.gapIndex = append(s.gapIndex[:i], s.gapIndex[i+1:]...)
+	case start == gap.Value.Start:
+		gap.Value.Start = end
+	case end == gap.Value.End:
+		gap.Value.End = start
+	default:
+		next := s.gaps.InsertAfter(utils.ByteInterval{Start: end, End: gap.Value.End}, gap)
+		gap.Value.End = start
+		s.gapIndex = append(s.gapIndex, nil)
+		copy(s.gapIndex[i+2:], s.gapIndex[i+1:])
+		s.gapIndex[i+1] = next
 	}
+}
 
-	s.queuedFrames[frame.Offset] = frame
+// pushOverlapping handles a frame that overlaps with received data.
+// If the overlapping bytes match the received data, only the new parts of the frame are queued.
+// Data that was already read can't be compared anymore, and is treated as a duplicate.
+func (s *streamFrameSorter) pushOverlapping(frame *frames.StreamFrame, overlapErr error) error {
+	start := frame.Offset
+	end := frame.Offset + frame.DataLen()
+
+	// the queued frames don't overlap, so they end in the same order as they start
+	i := sort.Search(len(s.frameIndex), func(i int) bool {
+		f := s.queuedFrames[s.frameIndex[i]]
+		return f.Offset+f.DataLen() > start
+	})
+	for ; i < len(s.frameIndex) && s.frameIndex[i] < end; i++ {
+		f := s.queuedFrames[s.frameIndex[i]]
+		lo := utils.MaxByteCount(start, f.Offset)
+		hi := utils.MinByteCount(end, f.Offset+f.DataLen())
+		if lo >= hi {
+			continue
+		}
+		if !bytes.Equal(frame.Data[lo-start:hi-start], f.Data[lo-f.Offset:hi-f.Offset]) {
+			return overlapErr
+		}
+	}
+
+	var newData []*frames.StreamFrame
+	for _, part := range s.gaps.Intersections(start, end) {
+		newData = append(newData, &frames.StreamFrame{
+			StreamID: frame.StreamID,
+			Offset:   part.Start,
+			Data:     frame.Data[part.Start-start : part.End-start],
+			FinBit:   frame.FinBit && part.End == end,
+		})
+	}
+
+	for _, f := range newData {
+		if err := s.push(f); err != nil {
+			return err
+		}
+	}
+	if frame.FinBit && (len(newData) == 0 || !newData[len(newData)-1].FinBit) {
+		if err := s.push(&frames.StreamFrame{StreamID: frame.StreamID, Offset: end, FinBit: true}); err != nil && err != errDuplicateStreamData {
+			return err
+		}
+	}
+	if len(newData) == 0 {
+		return errDuplicateStreamData
+	}
 	return nil
 }
 
@@ -107,10 +310,28 @@ func (s *streamFrameSorter) Pop() *frames.StreamFrame {
 	if frame != nil {
 		s.readPosition += frame.DataLen()
 		delete(s.queuedFrames, frame.Offset)
+		if frame.DataLen() > 0 {
+			// the frame at the read position is the first one in the index
+			s.frameIndex = s.frameIndex[1:]
+		}
+		if s.receiveBuffer != nil {
+			s.receiveBuffer.Release(frame.DataLen())
+		}
 	}
 	return frame
 }
 
+// ReleaseAll drops all queued frames, and releases their data from the receiveBuffer
+func (s *streamFrameSorter) ReleaseAll() {
+	for offset, frame := range s.queuedFrames {
+		if s.receiveBuffer != nil {
+			s.receiveBuffer.Release(frame.DataLen())
+		}
+		delete(s.queuedFrames, offset)
+	}
+	s.frameIndex = nil
+}
+
 func (s *streamFrameSorter) Head() *frames.StreamFrame {
 	frame, ok := s.queuedFrames[s.readPosition]
 	if ok {
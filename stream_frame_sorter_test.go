@@ -1,6 +1,10 @@
 package quic
 
 import (
+	"errors"
+	"math/rand"
+	"testing"
+
 	"github.com/lucas-clemente/quic-go/frames"
 	"github.com/lucas-clemente/quic-go/protocol"
 	"github.com/lucas-clemente/quic-go/qerr"
@@ -25,10 +29,35 @@ var _ = Describe("StreamFrame sorter", func() {
 		s = newStreamFrameSorter()
 	})
 
+	AfterEach(func() {
+		// the gap index mirrors the gap list
+		Expect(s.gapIndex).To(HaveLen(s.gaps.Len()))
+		var i int
+		for gap := s.gaps.Front(); gap != nil; gap = gap.Next() {
+			Expect(s.gapIndex[i]).To(BeIdenticalTo(gap))
+			i++
+		}
+	})
+
 	It("head returns nil when empty", func() {
 		Expect(s.Head()).To(BeNil())
 	})
 
+	It("fills many gaps in random order", func() {
+		const n = 200
+		s.maxGaps = n + 1
+		for i := 0; i < n; i++ {
+			err := s.Push(&frames.StreamFrame{Offset: protocol.ByteCount(2 * i * 10), Data: make([]byte, 10)})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(s.gaps.Len()).To(Equal(n))
+		for _, i := range rand.Perm(n) {
+			err := s.Push(&frames.StreamFrame{Offset: protocol.ByteCount((2*i + 1) * 10), Data: make([]byte, 10)})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		compareGapValues(s.gaps, []utils.ByteInterval{{Start: 2 * n * 10, End: protocol.MaxByteCount}})
+	})
+
 	Context("Push", func() {
 		It("inserts and pops a single frame", func() {
 			f := &frames.StreamFrame{
@@ -93,6 +122,37 @@ var _ = Describe("StreamFrame sorter", func() {
 				Expect(s.Pop()).To(Equal(f1))
 				Expect(s.Pop()).To(Equal(f2))
 			})
+
+			It("keeps the FinBit of a duplicate frame, if the data was queued without it", func() {
+				f := &frames.StreamFrame{Offset: 0, Data: []byte("foobar")}
+				err := s.Push(f)
+				Expect(err).ToNot(HaveOccurred())
+				err = s.Push(&frames.StreamFrame{StreamID: 5, Offset: 0, Data: []byte("foobar"), FinBit: true})
+				Expect(err).To(MatchError(errDuplicateStreamData))
+				Expect(s.Pop()).To(Equal(f))
+				Expect(s.Pop()).To(Equal(&frames.StreamFrame{StreamID: 5, Offset: 6, FinBit: true}))
+			})
+
+			It("keeps the FinBit of a duplicate frame, if the data was already read", func() {
+				err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.Pop()).ToNot(BeNil())
+				err = s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("bar"), FinBit: true})
+				Expect(err).To(MatchError(errDuplicateStreamData))
+				Expect(s.Pop()).To(Equal(&frames.StreamFrame{Offset: 6, FinBit: true}))
+			})
+
+			It("doesn't queue the FinBit of a duplicate frame twice", func() {
+				fin := &frames.StreamFrame{Offset: 6, FinBit: true}
+				err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+				Expect(err).ToNot(HaveOccurred())
+				err = s.Push(fin)
+				Expect(err).ToNot(HaveOccurred())
+				err = s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar"), FinBit: true})
+				Expect(err).To(MatchError(errDuplicateStreamData))
+				Expect(s.queuedFrames).To(HaveLen(2))
+				Expect(s.queuedFrames[6]).To(BeIdenticalTo(fin))
+			})
 		})
 
 		Context("Gap handling", func() {
@@ -329,6 +389,35 @@ var _ = Describe("StreamFrame sorter", func() {
 					compareGapValues(s.gaps, expectedGaps)
 				})
 
+				It("reports the conflicting interval for a frame that overlaps at the beginning", func() {
+					// 8 to 14
+					err := s.Push(&frames.StreamFrame{Offset: 8, Data: []byte("foobar")})
+					Expect(errors.Is(err, errOverlappingStreamData)).To(BeTrue())
+					Expect(err).To(Equal(&overlappingStreamDataError{
+						Offset:      8,
+						DataLen:     6,
+						Conflicting: utils.ByteInterval{Start: 5, End: 10},
+					}))
+					Expect(err.Error()).To(Equal("frame at offset 8 (length 6) overlaps with received data at [5, 10)"))
+				})
+
+				It("reports the conflicting interval for a frame that overlaps at the end", func() {
+					// 4 to 6
+					err := s.Push(&frames.StreamFrame{Offset: 4, Data: []byte("12")})
+					Expect(err).To(Equal(&overlappingStreamDataError{
+						Offset:      4,
+						DataLen:     2,
+						Conflicting: utils.ByteInterval{Start: 5, End: 10},
+					}))
+				})
+
+				It("keeps the error code when converted to a QuicError", func() {
+					err := s.Push(&frames.StreamFrame{Offset: 8, Data: []byte("foobar")})
+					quicErr := qerr.ToQuicError(err)
+					Expect(quicErr.ErrorCode).To(Equal(qerr.OverlappingStreamData))
+					Expect(quicErr.ErrorMessage).To(ContainSubstring("[5, 10)"))
+				})
+
 				It("rejects a frame that completely covers two gaps", func() {
 					// 10 to 20
 					f := &frames.StreamFrame{
@@ -396,6 +485,111 @@ var _ = Describe("StreamFrame sorter", func() {
 				})
 			})
 
+			Context("tolerating identical overlaps", func() {
+				var expectedGaps []utils.ByteInterval
+
+				BeforeEach(func() {
+					s.tolerateIdenticalOverlaps = true
+					// create gaps: 0-5, 10-15, 20-inf
+					err := s.Push(&frames.StreamFrame{Offset: 5, Data: []byte("fghij")})
+					Expect(err).ToNot(HaveOccurred())
+					err = s.Push(&frames.StreamFrame{Offset: 15, Data: []byte("pqrst")})
+					Expect(err).ToNot(HaveOccurred())
+					expectedGaps = []utils.ByteInterval{
+						{Start: 0, End: 5},
+						{Start: 10, End: 15},
+						{Start: 20, End: protocol.MaxByteCount},
+					}
+				})
+
+				It("accepts a frame that overlaps at the start with identical data", func() {
+					// 3 to 7
+					err := s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("defg")})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.queuedFrames).To(HaveKey(protocol.ByteCount(3)))
+					Expect(s.queuedFrames[3].Data).To(Equal([]byte("de")))
+					Expect(s.queuedFrames[5].Data).To(Equal([]byte("fghij")))
+					expectedGaps[0] = utils.ByteInterval{Start: 0, End: 3}
+					compareGapValues(s.gaps, expectedGaps)
+				})
+
+				It("accepts a frame that overlaps at the end with identical data", func() {
+					// 12 to 17
+					err := s.Push(&frames.StreamFrame{Offset: 12, Data: []byte("mnopq")})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.queuedFrames[12].Data).To(Equal([]byte("mno")))
+					expectedGaps[1] = utils.ByteInterval{Start: 10, End: 12}
+					compareGapValues(s.gaps, expectedGaps)
+				})
+
+				It("accepts a frame that covers received data and multiple gaps", func() {
+					// 0 to 22
+					err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("abcdefghijklmnopqrstuv"), FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.queuedFrames[0].Data).To(Equal([]byte("abcde")))
+					Expect(s.queuedFrames[10].Data).To(Equal([]byte("klmno")))
+					Expect(s.queuedFrames[20].Data).To(Equal([]byte("uv")))
+					Expect(s.queuedFrames[20].FinBit).To(BeTrue())
+					Expect(s.gaps.Len()).To(Equal(1))
+					Expect(s.gaps.Front().Value).To(Equal(utils.ByteInterval{Start: 22, End: protocol.MaxByteCount}))
+				})
+
+				It("queues the FinBit when the frame ends with received data", func() {
+					// 10 to 20
+					err := s.Push(&frames.StreamFrame{Offset: 10, Data: []byte("klmnopqrst"), FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.queuedFrames[10].FinBit).To(BeFalse())
+					Expect(s.queuedFrames).To(HaveKey(protocol.ByteCount(20)))
+					Expect(s.queuedFrames[20].FinBit).To(BeTrue())
+				})
+
+				It("rejects a frame that overlaps with conflicting data", func() {
+					// 3 to 7
+					err := s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("deXg")})
+					Expect(err).To(MatchError(errOverlappingStreamData))
+					Expect(err).To(BeAssignableToTypeOf(&overlappingStreamDataError{}))
+					Expect(s.queuedFrames).ToNot(HaveKey(protocol.ByteCount(3)))
+					compareGapValues(s.gaps, expectedGaps)
+				})
+
+				It("rejects a frame covering multiple gaps if only some of the data conflicts", func() {
+					// 0 to 22
+					err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("abcdefghijklmnopqXstuv")})
+					Expect(err).To(MatchError(errOverlappingStreamData))
+					Expect(s.queuedFrames).To(HaveLen(2))
+					compareGapValues(s.gaps, expectedGaps)
+				})
+
+				It("doesn't compare data that was already read", func() {
+					err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("abcde")})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.Pop().Data).To(Equal([]byte("abcde")))
+					// 3 to 7, the data before the read position can't be checked anymore
+					err = s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("XXfg")})
+					Expect(err).To(MatchError(errDuplicateStreamData))
+				})
+
+				It("keeps the offsets of the frames with data in order", func() {
+					err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("abcde")})
+					Expect(err).ToNot(HaveOccurred())
+					err = s.Push(&frames.StreamFrame{Offset: 12, Data: []byte("mnopq")})
+					Expect(err).ToNot(HaveOccurred())
+					err = s.Push(&frames.StreamFrame{Offset: 30, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(s.frameIndex).To(Equal([]protocol.ByteCount{0, 5, 12, 15}))
+					s.Pop()
+					Expect(s.frameIndex).To(Equal([]protocol.ByteCount{5, 12, 15}))
+					s.ReleaseAll()
+					Expect(s.frameIndex).To(BeEmpty())
+				})
+
+				It("still rejects conflicting overlaps when not enabled", func() {
+					s.tolerateIdenticalOverlaps = false
+					err := s.Push(&frames.StreamFrame{Offset: 3, Data: []byte("defg")})
+					Expect(err).To(MatchError(errOverlappingStreamData))
+				})
+			})
+
 			Context("DOS protection", func() {
 				It("errors when too many gaps are created", func() {
 					for i := 0; i < protocol.MaxStreamFrameSorterGaps; i++ {
@@ -413,8 +607,195 @@ var _ = Describe("StreamFrame sorter", func() {
 					}
 					err := s.Push(f)
 					Expect(err).To(MatchError(errTooManyGapsInReceivedStreamData))
+					// the data can still be received later
+					Expect(s.gaps.Len()).To(Equal(protocol.MaxStreamFrameSorterGaps))
+					Expect(s.gaps.Back().Value.Start).To(BeNumerically("<", f.Offset))
 				})
 			})
 		})
 	})
+
+	Context("receive buffer accounting", func() {
+		BeforeEach(func() {
+			s.receiveBuffer = newReceiveBuffer(10)
+		})
+
+		It("reserves queued data, and releases it when popped", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount(6)))
+			s.Pop()
+			Expect(s.receiveBuffer.Buffered()).To(BeZero())
+		})
+
+		It("doesn't count duplicate data", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			err = s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+			Expect(err).To(MatchError(errDuplicateStreamData))
+			Expect(s.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount(6)))
+		})
+
+		It("errors when the receive buffer is exceeded", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			err = s.Push(&frames.StreamFrame{Offset: 6, Data: []byte("foobar")})
+			Expect(err).To(MatchError(errReceiveBufferExceeded))
+			Expect(s.queuedFrames).ToNot(HaveKey(protocol.ByteCount(6)))
+		})
+
+		It("accepts the data again once the receive buffer has space", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			err = s.Push(&frames.StreamFrame{Offset: 6, Data: []byte("foobar")})
+			Expect(err).To(MatchError(errReceiveBufferExceeded))
+			Expect(s.gaps.Front().Value).To(Equal(utils.ByteInterval{Start: 6, End: protocol.MaxByteCount}))
+			Expect(s.Pop().Data).To(Equal([]byte("foobar")))
+			err = s.Push(&frames.StreamFrame{Offset: 6, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Pop().Data).To(Equal([]byte("foobar")))
+		})
+
+		It("errors when the receive buffer is exceeded by PushMany", func() {
+			err := s.PushMany([]*frames.StreamFrame{
+				{Offset: 0, Data: []byte("foobar")},
+				{Offset: 6, Data: []byte("foobar")},
+			})
+			Expect(err).To(MatchError(errReceiveBufferExceeded))
+			Expect(s.receiveBuffer.Buffered()).To(Equal(protocol.ByteCount(6)))
+		})
+
+		It("releases all queued data", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 0, Data: []byte("foo")})
+			Expect(err).ToNot(HaveOccurred())
+			err = s.Push(&frames.StreamFrame{Offset: 5, Data: []byte("bar")})
+			Expect(err).ToNot(HaveOccurred())
+			s.ReleaseAll()
+			Expect(s.queuedFrames).To(BeEmpty())
+			Expect(s.receiveBuffer.Buffered()).To(BeZero())
+		})
+	})
+
+	Context("PushMany", func() {
+		contiguousFrames := func(offset protocol.ByteCount, n int) []*frames.StreamFrame {
+			fs := make([]*frames.StreamFrame, n)
+			for i := range fs {
+				fs[i] = &frames.StreamFrame{Offset: offset, Data: []byte("foobar")}
+				offset += 6
+			}
+			return fs
+		}
+
+		It("inserts an ordered batch", func() {
+			fs := contiguousFrames(0, 3)
+			err := s.PushMany(fs)
+			Expect(err).ToNot(HaveOccurred())
+			for _, f := range fs {
+				Expect(s.Pop()).To(Equal(f))
+			}
+			Expect(s.Head()).To(BeNil())
+			compareGapValues(s.gaps, []utils.ByteInterval{{Start: 18, End: protocol.MaxByteCount}})
+		})
+
+		It("inserts an ordered batch in the middle of a gap", func() {
+			err := s.PushMany(contiguousFrames(6, 2))
+			Expect(err).ToNot(HaveOccurred())
+			compareGapValues(s.gaps, []utils.ByteInterval{
+				{Start: 0, End: 6},
+				{Start: 18, End: protocol.MaxByteCount},
+			})
+		})
+
+		It("inserts an unordered batch", func() {
+			fs := contiguousFrames(0, 3)
+			err := s.PushMany([]*frames.StreamFrame{fs[2], fs[0], fs[1]})
+			Expect(err).ToNot(HaveOccurred())
+			for _, f := range fs {
+				Expect(s.Pop()).To(Equal(f))
+			}
+		})
+
+		It("inserts an ordered batch that doesn't fit into a single gap", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 6, Data: []byte("foobar")})
+			Expect(err).ToNot(HaveOccurred())
+			fs := contiguousFrames(0, 3)
+			err = s.PushMany([]*frames.StreamFrame{fs[0], fs[2]})
+			Expect(err).ToNot(HaveOccurred())
+			compareGapValues(s.gaps, []utils.ByteInterval{{Start: 18, End: protocol.MaxByteCount}})
+		})
+
+		It("stops at the first error", func() {
+			err := s.Push(&frames.StreamFrame{Offset: 8, Data: []byte("foo")})
+			Expect(err).ToNot(HaveOccurred())
+			fs := contiguousFrames(0, 3)
+			err = s.PushMany(fs)
+			Expect(err).To(MatchError(errOverlappingStreamData))
+			Expect(s.queuedFrames).To(HaveKey(protocol.ByteCount(0)))
+			Expect(s.queuedFrames).ToNot(HaveKey(protocol.ByteCount(12)))
+		})
+
+		It("returns duplicate errors", func() {
+			fs := contiguousFrames(0, 2)
+			err := s.PushMany(fs)
+			Expect(err).ToNot(HaveOccurred())
+			err = s.PushMany(fs)
+			Expect(err).To(MatchError(errDuplicateStreamData))
+		})
+
+		It("errors when too many gaps are created", func() {
+			for i := 0; i < protocol.MaxStreamFrameSorterGaps; i++ {
+				err := s.Push(&frames.StreamFrame{Offset: protocol.ByteCount(i * 7), Data: []byte("foobar")})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			err := s.PushMany(contiguousFrames(protocol.ByteCount(protocol.MaxStreamFrameSorterGaps*7)+100, 2))
+			Expect(err).To(MatchError(errTooManyGapsInReceivedStreamData))
+		})
+	})
 })
+
+const benchmarkBatchSize = 32
+
+func benchmarkPush(b *testing.B, many bool) {
+	batch := make([]*frames.StreamFrame, benchmarkBatchSize)
+	data := make([]byte, 1000)
+	for i := 0; i < b.N; i++ {
+		s := newStreamFrameSorter()
+		for j := range batch {
+			batch[j] = &frames.StreamFrame{Offset: protocol.ByteCount(j * len(data)), Data: data}
+		}
+		if many {
+			if err := s.PushMany(batch); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, f := range batch {
+			if err := s.Push(f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPush(b *testing.B)     { benchmarkPush(b, false) }
+func BenchmarkPushMany(b *testing.B) { benchmarkPush(b, true) }
+
+const benchmarkNumGaps = 4096
+
+// BenchmarkPushWithManyGaps receives every other frame, so that every frame opens a new gap at the end of the gap list
+func BenchmarkPushWithManyGaps(b *testing.B) {
+	fs := make([]*frames.StreamFrame, benchmarkNumGaps)
+	for i := range fs {
+		fs[i] = &frames.StreamFrame{Offset: protocol.ByteCount(2 * i * 100), Data: make([]byte, 100)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newStreamFrameSorter()
+		s.maxGaps = benchmarkNumGaps + 1
+		for _, f := range fs {
+			if err := s.Push(f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
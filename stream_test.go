@@ -2,6 +2,7 @@ package quic
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"reflect"
@@ -24,6 +25,10 @@ type mockStreamHandler struct {
 
 	receiveFlowControlWindowCalled          bool
 	receiveFlowControlWindowCalledForStream protocol.StreamID
+
+	flushCalled bool
+
+	rstStreamFrames []*frames.RstStreamFrame
 }
 
 func (m *mockStreamHandler) queueStreamFrame(f *frames.StreamFrame) error {
@@ -31,6 +36,14 @@ func (m *mockStreamHandler) queueStreamFrame(f *frames.StreamFrame) error {
 	return nil
 }
 
+func (m *mockStreamHandler) flush() {
+	m.flushCalled = true
+}
+
+func (m *mockStreamHandler) queueRstStreamFrame(f *frames.RstStreamFrame) {
+	m.rstStreamFrames = append(m.rstStreamFrames, f)
+}
+
 func (m *mockStreamHandler) streamBlocked(streamID protocol.StreamID, byteOffset protocol.ByteCount) {
 	m.receivedBlockedCalled = true
 	m.receivedBlockedForStream = streamID
@@ -231,6 +244,19 @@ var _ = Describe("Stream", func() {
 			Expect(err).To(MatchError(errOverlappingStreamData))
 		})
 
+		It("accepts StreamFrames with an overlapping data range if the data is identical", func() {
+			str.frameQueue.tolerateIdenticalOverlaps = true
+			err := str.AddStreamFrame(&frames.StreamFrame{Offset: 0, Data: []byte("ab")})
+			Expect(err).ToNot(HaveOccurred())
+			err = str.AddStreamFrame(&frames.StreamFrame{Offset: 1, Data: []byte("bc")})
+			Expect(err).ToNot(HaveOccurred())
+			b := make([]byte, 3)
+			n, err := str.Read(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(3))
+			Expect(b).To(Equal([]byte("abc")))
+		})
+
 		Context("flow control", func() {
 			It("consumes bytes in the flow control window", func() {
 				str.contributesToConnectionFlowControl = false
@@ -321,6 +347,43 @@ var _ = Describe("Stream", func() {
 			Expect(err).To(MatchError(testErr))
 		})
 
+		It("cancels the context on errors", func() {
+			Expect(str.Context().Err()).ToNot(HaveOccurred())
+			testErr := errors.New("test")
+			str.RegisterError(testErr)
+			Expect(str.Context().Done()).To(BeClosed())
+			Expect(context.Cause(str.Context())).To(MatchError(testErr))
+		})
+
+		It("flushes", func() {
+			err := str.Flush()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.flushCalled).To(BeTrue())
+		})
+
+		It("returns remote errors when flushing", func() {
+			testErr := errors.New("test")
+			str.RegisterError(testErr)
+			err := str.Flush()
+			Expect(err).To(MatchError(testErr))
+			Expect(handler.flushCalled).To(BeFalse())
+		})
+
+		It("doesn't flush writes by default", func() {
+			str.flowController.UpdateSendWindow(1000)
+			_, err := str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.flushCalled).To(BeFalse())
+		})
+
+		It("flushes every write if no-delay is set", func() {
+			str.flowController.UpdateSendWindow(1000)
+			str.SetNoDelay(true)
+			_, err := str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.flushCalled).To(BeTrue())
+		})
+
 		Context("flow control", func() {
 			It("writes everything if the flow control window is big enough", func() {
 				data := []byte{0xDE, 0xCA, 0xFB, 0xAD}
@@ -591,6 +654,53 @@ var _ = Describe("Stream", func() {
 			Expect(handler.receiveFlowControlWindowCalled).To(BeFalse())
 		})
 
+		It("only extends the flow control window when the application reads", func() {
+			err := str.AddStreamFrame(&frames.StreamFrame{
+				Offset: 0,
+				Data:   bytes.Repeat([]byte{'f'}, int(receiveFlowControlWindow)),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.receiveFlowControlWindowCalled).To(BeFalse())
+			// the peer must not send more until the application has read some data
+			err = str.AddStreamFrame(&frames.StreamFrame{
+				Offset: receiveFlowControlWindow,
+				Data:   []byte{'f'},
+			})
+			Expect(err).To(MatchError(errFlowControlViolation))
+			b := make([]byte, receiveFlowControlWindow)
+			_, err = io.ReadFull(str, b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(handler.receiveFlowControlWindowCalled).To(BeTrue())
+		})
+
+		Context("discarding received data", func() {
+			BeforeEach(func() {
+				// set receiveFlowControlWindow and receiveFlowControlWindowIncrement in the connection-level flow controller
+				*(*protocol.ByteCount)(unsafe.Pointer(reflect.ValueOf(str.connectionFlowController).Elem().FieldByName("receiveFlowControlWindow").UnsafeAddr())) = 300
+				*(*protocol.ByteCount)(unsafe.Pointer(reflect.ValueOf(str.connectionFlowController).Elem().FieldByName("receiveFlowControlWindowIncrement").UnsafeAddr())) = 300
+				err := str.AddStreamFrame(&frames.StreamFrame{Data: make([]byte, 100)})
+				Expect(err).ToNot(HaveOccurred())
+				err = str.AddStreamFrame(&frames.StreamFrame{Offset: 200, Data: make([]byte, 50)})
+				Expect(err).ToNot(HaveOccurred())
+				_, err = str.Read(make([]byte, 40))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(handler.receiveFlowControlWindowCalled).To(BeFalse())
+			})
+
+			It("counts unread data as read by the connection-level flow controller", func() {
+				str.discardReceivedData()
+				Expect(handler.receiveFlowControlWindowCalled).To(BeTrue())
+				Expect(handler.receiveFlowControlWindowCalledForStream).To(Equal(protocol.StreamID(0)))
+				Expect(str.connectionFlowController.ReceiveWindowSize()).To(Equal(protocol.ByteCount(300 + 300 - 250)))
+			})
+
+			It("doesn't count unread data of streams that don't contribute to connection-level flow control", func() {
+				str.contributesToConnectionFlowControl = false
+				str.discardReceivedData()
+				Expect(handler.receiveFlowControlWindowCalled).To(BeFalse())
+			})
+		})
+
 		It("accepts frames that completely fill the flow control window", func() {
 			len := int(receiveFlowControlWindow)
 			frame := frames.StreamFrame{
@@ -683,6 +793,79 @@ var _ = Describe("Stream", func() {
 				Expect(n).To(BeZero())
 				Expect(err).To(MatchError(io.EOF))
 			})
+
+			Context("with a FIN without data at the read position", func() {
+				// expectEOFAfter reads the data, and checks that all following Reads return io.EOF
+				expectEOFAfter := func(data []byte) {
+					b := make([]byte, len(data))
+					n, err := str.Read(b)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(b[:n]).To(Equal(data))
+					// the following Reads don't block
+					for i := 0; i < 3; i++ {
+						n, err = str.Read(b)
+						Expect(n).To(BeZero())
+						Expect(err).To(MatchError(io.EOF))
+					}
+				}
+
+				It("returns io.EOF after the data was read", func() {
+					err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+					Expect(err).ToNot(HaveOccurred())
+					err = str.AddStreamFrame(&frames.StreamFrame{Offset: 2, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					expectEOFAfter([]byte{0xDE, 0xAD})
+				})
+
+				It("returns io.EOF if the FIN arrives before the data", func() {
+					err := str.AddStreamFrame(&frames.StreamFrame{Offset: 4, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					err = str.AddStreamFrame(&frames.StreamFrame{Offset: 2, Data: []byte{0xBE, 0xEF}})
+					Expect(err).ToNot(HaveOccurred())
+					err = str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+					Expect(err).ToNot(HaveOccurred())
+					expectEOFAfter([]byte{0xDE, 0xAD, 0xBE, 0xEF})
+				})
+
+				It("returns io.EOF if the FIN arrives while blocked in Read", func() {
+					err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+					Expect(err).ToNot(HaveOccurred())
+					_, err = str.Read(make([]byte, 2))
+					Expect(err).ToNot(HaveOccurred())
+					readErr := make(chan error, 1)
+					go func() {
+						_, err := str.Read(make([]byte, 2))
+						readErr <- err
+					}()
+					Consistently(readErr).ShouldNot(Receive())
+					err = str.AddStreamFrame(&frames.StreamFrame{Offset: 2, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(readErr).Should(Receive(Equal(io.EOF)))
+					n, err := str.Read(make([]byte, 2))
+					Expect(n).To(BeZero())
+					Expect(err).To(MatchError(io.EOF))
+				})
+
+				It("returns io.EOF if the FinBit arrives with a retransmission of data that was already read", func() {
+					err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+					Expect(err).ToNot(HaveOccurred())
+					_, err = str.Read(make([]byte, 2))
+					Expect(err).ToNot(HaveOccurred())
+					err = str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					n, err := str.Read(make([]byte, 2))
+					Expect(n).To(BeZero())
+					Expect(err).To(MatchError(io.EOF))
+				})
+
+				It("returns io.EOF if the FinBit arrives with a retransmission of data that wasn't read yet", func() {
+					err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+					Expect(err).ToNot(HaveOccurred())
+					err = str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}, FinBit: true})
+					Expect(err).ToNot(HaveOccurred())
+					expectEOFAfter([]byte{0xDE, 0xAD})
+				})
+			})
 		})
 
 		Context("with remote errors", func() {
@@ -726,6 +909,35 @@ var _ = Describe("Stream", func() {
 			})
 		})
 
+		Context("resetting", func() {
+			It("queues a RST_STREAM frame with the write offset", func() {
+				str.Write([]byte("foobar"))
+				str.Reset(42)
+				Expect(handler.rstStreamFrames).To(Equal([]*frames.RstStreamFrame{{
+					StreamID:   1337,
+					ByteOffset: 6,
+					ErrorCode:  42,
+				}}))
+			})
+
+			It("fails reads and writes after a reset", func() {
+				str.Reset(42)
+				_, err := str.Write([]byte("foobar"))
+				Expect(err).To(MatchError(errStreamReset))
+				_, err = str.Read(make([]byte, 4))
+				Expect(err).To(MatchError(errStreamReset))
+				Expect(str.Stats().Reset).To(BeTrue())
+			})
+
+			It("doesn't send a FIN or another RST_STREAM afterwards", func() {
+				str.Reset(42)
+				str.Reset(42)
+				Expect(str.Close()).To(Succeed())
+				Expect(handler.rstStreamFrames).To(HaveLen(1))
+				Expect(handler.frames).To(BeEmpty())
+			})
+		})
+
 		Context("when CloseRemote is called", func() {
 			It("closes", func() {
 				str.CloseRemote(0)
@@ -735,5 +947,120 @@ var _ = Describe("Stream", func() {
 				Expect(err).To(MatchError(io.EOF))
 			})
 		})
+
+		Context("half-closed", func() {
+			It("allows writing after receiving a FIN", func() {
+				err := str.AddStreamFrame(&frames.StreamFrame{
+					Data:   []byte{0xDE, 0xAD},
+					FinBit: true,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				b := make([]byte, 4)
+				n, err := str.Read(b)
+				Expect(err).To(MatchError(io.EOF))
+				Expect(n).To(Equal(2))
+				n, err = str.Write([]byte("foobar"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(6))
+				Expect(handler.frames).To(HaveLen(1))
+				Expect(handler.frames[0].Data).To(Equal([]byte("foobar")))
+				Expect(str.finished()).To(BeFalse())
+			})
+
+			It("allows writing after CloseRemote", func() {
+				str.CloseRemote(0)
+				_, err := str.Read([]byte{0})
+				Expect(err).To(MatchError(io.EOF))
+				n, err := str.Write([]byte("foobar"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(6))
+				err = str.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(handler.frames).To(HaveLen(2))
+				Expect(handler.frames[1].FinBit).To(BeTrue())
+				Expect(handler.frames[1].Offset).To(Equal(protocol.ByteCount(6)))
+				Expect(str.finished()).To(BeTrue())
+			})
+
+			It("allows reading after a local close", func() {
+				err := str.Close()
+				Expect(err).ToNot(HaveOccurred())
+				err = str.AddStreamFrame(&frames.StreamFrame{Data: []byte{0xDE, 0xAD}})
+				Expect(err).ToNot(HaveOccurred())
+				b := make([]byte, 2)
+				n, err := str.Read(b)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(2))
+				Expect(b).To(Equal([]byte{0xDE, 0xAD}))
+			})
+
+			It("refuses writes after a local close", func() {
+				err := str.Close()
+				Expect(err).ToNot(HaveOccurred())
+				n, err := str.Write([]byte("foobar"))
+				Expect(err).To(MatchError(errWriteAfterClose))
+				Expect(n).To(BeZero())
+				Expect(handler.frames).To(HaveLen(1))
+			})
+
+			It("only sends one FinBit when closed multiple times", func() {
+				err := str.Close()
+				Expect(err).ToNot(HaveOccurred())
+				err = str.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(handler.frames).To(HaveLen(1))
+				Expect(handler.frames[0].FinBit).To(BeTrue())
+				Expect(str.Stats().FramesSent).To(Equal(uint64(1)))
+			})
+		})
+	})
+
+	Context("stats", func() {
+		It("counts bytes and frames after a transfer", func() {
+			err := str.AddStreamFrame(&frames.StreamFrame{Data: []byte("foo")})
+			Expect(err).ToNot(HaveOccurred())
+			err = str.AddStreamFrame(&frames.StreamFrame{Offset: 3, Data: []byte("bar"), FinBit: true})
+			Expect(err).ToNot(HaveOccurred())
+			b := make([]byte, 6)
+			_, err = io.ReadFull(str, b)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Read(b)
+			Expect(err).To(MatchError(io.EOF))
+			n, err := str.Write([]byte("foobar1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(7))
+			err = str.Close()
+			Expect(err).ToNot(HaveOccurred())
+			stats := str.Stats()
+			Expect(stats.BytesRead).To(Equal(protocol.ByteCount(6)))
+			Expect(stats.BytesWritten).To(Equal(protocol.ByteCount(7)))
+			Expect(stats.FramesReceived).To(Equal(uint64(2)))
+			Expect(stats.FramesSent).To(Equal(uint64(2)))
+			Expect(stats.FinReceived).To(BeTrue())
+			Expect(stats.FinSent).To(BeTrue())
+			Expect(stats.Reset).To(BeFalse())
+		})
+
+		It("reports the flow control windows", func() {
+			sendWindow := str.Stats().SendWindow
+			receiveWindow := str.Stats().ReceiveWindow
+			Expect(sendWindow).ToNot(BeZero())
+			Expect(receiveWindow).ToNot(BeZero())
+			_, err := str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			err = str.AddStreamFrame(&frames.StreamFrame{Data: []byte("foo")})
+			Expect(err).ToNot(HaveOccurred())
+			stats := str.Stats()
+			Expect(stats.SendWindow).To(Equal(sendWindow - 6))
+			Expect(stats.ReceiveWindow).To(Equal(receiveWindow - 3))
+		})
+
+		It("reports streams that were reset", func() {
+			str.RegisterError(errors.New("test error"))
+			stats := str.Stats()
+			Expect(stats.Reset).To(BeTrue())
+			Expect(stats.FinReceived).To(BeFalse())
+			Expect(stats.FinSent).To(BeFalse())
+		})
 	})
 })
@@ -0,0 +1,41 @@
+package testutil
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+)
+
+// A NonceReuseDetectingAEAD wraps an AEAD and panics if a packet number is sealed twice.
+// The nonce is derived from the packet number, so sealing the same packet number twice reuses the (key, nonce) pair.
+// It remembers every sealed packet number, so it should only be used in tests.
+type NonceReuseDetectingAEAD struct {
+	crypto.AEAD
+
+	mutex  sync.Mutex
+	sealed map[protocol.PacketNumber]struct{}
+}
+
+var _ crypto.AEAD = &NonceReuseDetectingAEAD{}
+
+// NewNonceReuseDetectingAEAD wraps an AEAD
+func NewNonceReuseDetectingAEAD(aead crypto.AEAD) *NonceReuseDetectingAEAD {
+	return &NonceReuseDetectingAEAD{
+		AEAD:   aead,
+		sealed: make(map[protocol.PacketNumber]struct{}),
+	}
+}
+
+// Seal seals a packet, and panics if the packet number was sealed before
+func (a *NonceReuseDetectingAEAD) Seal(packetNumber protocol.PacketNumber, associatedData []byte, plaintext []byte) []byte {
+	a.mutex.Lock()
+	if _, ok := a.sealed[packetNumber]; ok {
+		a.mutex.Unlock()
+		panic(fmt.Sprintf("AEAD nonce reuse: packet number %d sealed twice", packetNumber))
+	}
+	a.sealed[packetNumber] = struct{}{}
+	a.mutex.Unlock()
+	return a.AEAD.Seal(packetNumber, associatedData, plaintext)
+}
@@ -0,0 +1,48 @@
+package testutil
+
+import (
+	"github.com/lucas-clemente/quic-go/crypto"
+	"github.com/lucas-clemente/quic-go/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Nonce reuse detecting AEAD", func() {
+	var (
+		alice *NonceReuseDetectingAEAD
+		bob   crypto.AEAD
+	)
+
+	BeforeEach(func() {
+		keyAlice := make([]byte, 32)
+		keyBob := make([]byte, 32)
+		ivAlice := make([]byte, 4)
+		ivBob := make([]byte, 4)
+		keyBob[0] = 1
+		ivBob[0] = 1
+		aead, err := crypto.NewAEADChacha20Poly1305(keyBob, keyAlice, ivBob, ivAlice)
+		Expect(err).ToNot(HaveOccurred())
+		alice = NewNonceReuseDetectingAEAD(aead)
+		bob, err = crypto.NewAEADChacha20Poly1305(keyAlice, keyBob, ivAlice, ivBob)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("seals and opens", func() {
+		b := alice.Seal(42, []byte("aad"), []byte("foobar"))
+		text, err := bob.Open(42, []byte("aad"), b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(text).To(Equal([]byte("foobar")))
+	})
+
+	It("seals different packet numbers", func() {
+		for pn := 1; pn <= 10; pn++ {
+			alice.Seal(protocol.PacketNumber(pn), []byte("aad"), []byte("foobar"))
+		}
+	})
+
+	It("panics if a packet number is sealed twice", func() {
+		alice.Seal(42, []byte("aad"), []byte("foobar"))
+		Expect(func() { alice.Seal(42, []byte("other aad"), []byte("other data")) }).To(Panic())
+	})
+})
@@ -0,0 +1,85 @@
+// Package testutil contains helpers for testing, e.g. for code paths that depend on network conditions.
+package testutil
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures the network conditions simulated by a PacketConn
+type Config struct {
+	// LossRate is the probability that a packet is dropped, between 0 and 1
+	LossRate float64
+	// Latency is the delay applied to every packet
+	Latency time.Duration
+	// Seed seeds the RNG that decides which packets are dropped.
+	// Using the same seed drops the same packets.
+	Seed int64
+}
+
+// A PacketConn wraps a net.PacketConn and drops and delays the packets written to it.
+// Wrap both ends of a connection to simulate loss and latency in both directions.
+type PacketConn struct {
+	net.PacketConn
+
+	config Config
+
+	rngMutex sync.Mutex
+	rng      *rand.Rand
+
+	numSent    uint64 // atomic
+	numDropped uint64 // atomic
+}
+
+var _ net.PacketConn = &PacketConn{}
+
+// NewPacketConn makes a new PacketConn
+func NewPacketConn(conn net.PacketConn, config Config) *PacketConn {
+	return &PacketConn{
+		PacketConn: conn,
+		config:     config,
+		rng:        rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// WriteTo writes a packet, unless it is dropped.
+// Dropped packets are reported as written, just as the network would.
+// If a latency is configured, the packet is written asynchronously, and write errors are discarded.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	atomic.AddUint64(&c.numSent, 1)
+	if c.shouldDrop() {
+		atomic.AddUint64(&c.numDropped, 1)
+		return len(p), nil
+	}
+	if c.config.Latency == 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	time.AfterFunc(c.config.Latency, func() {
+		c.PacketConn.WriteTo(data, addr)
+	})
+	return len(p), nil
+}
+
+func (c *PacketConn) shouldDrop() bool {
+	if c.config.LossRate <= 0 {
+		return false
+	}
+	c.rngMutex.Lock()
+	defer c.rngMutex.Unlock()
+	return c.rng.Float64() < c.config.LossRate
+}
+
+// NumSent returns the number of packets passed to WriteTo, including the dropped ones
+func (c *PacketConn) NumSent() uint64 {
+	return atomic.LoadUint64(&c.numSent)
+}
+
+// NumDropped returns the number of packets that were dropped
+func (c *PacketConn) NumDropped() uint64 {
+	return atomic.LoadUint64(&c.numDropped)
+}
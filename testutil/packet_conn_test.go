@@ -0,0 +1,77 @@
+package testutil
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PacketConn", func() {
+	var (
+		serverConn, clientConn net.PacketConn
+	)
+
+	BeforeEach(func() {
+		var err error
+		serverConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	It("doesn't drop packets by default", func() {
+		conn := NewPacketConn(clientConn, Config{})
+		for i := 0; i < 100; i++ {
+			_, err := conn.WriteTo([]byte("foobar"), serverConn.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(conn.NumSent()).To(BeEquivalentTo(100))
+		Expect(conn.NumDropped()).To(BeZero())
+	})
+
+	It("drops packets at the configured rate", func() {
+		conn := NewPacketConn(clientConn, Config{LossRate: 0.25, Seed: 42})
+		for i := 0; i < 4000; i++ {
+			_, err := conn.WriteTo([]byte("foobar"), serverConn.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(conn.NumDropped()).To(BeNumerically("~", 1000, 100))
+	})
+
+	It("drops the same packets when using the same seed", func() {
+		droppedPackets := func() []int {
+			conn := NewPacketConn(clientConn, Config{LossRate: 0.5, Seed: 1337})
+			var dropped []int
+			for i := 0; i < 100; i++ {
+				before := conn.NumDropped()
+				conn.WriteTo([]byte("foobar"), serverConn.LocalAddr())
+				if conn.NumDropped() != before {
+					dropped = append(dropped, i)
+				}
+			}
+			return dropped
+		}
+		first := droppedPackets()
+		Expect(first).ToNot(BeEmpty())
+		Expect(droppedPackets()).To(Equal(first))
+	})
+
+	It("delays packets", func() {
+		conn := NewPacketConn(clientConn, Config{Latency: 50 * time.Millisecond})
+		start := time.Now()
+		_, err := conn.WriteTo([]byte("foobar"), serverConn.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 6)
+		n, _, err := serverConn.ReadFrom(b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b[:n]).To(Equal([]byte("foobar")))
+		Expect(time.Now().Sub(start)).To(BeNumerically(">=", 50*time.Millisecond))
+	})
+})
@@ -1,29 +1,93 @@
 package quic
 
-import "net"
+import (
+	"net"
+	"sync"
+)
 
 type connection interface {
 	write([]byte) error
+	writeBatch([][]byte) error
 	setCurrentRemoteAddr(interface{})
 	IP() net.IP
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
 }
 
 type udpConn struct {
-	conn        *net.UDPConn
-	currentAddr *net.UDPAddr
+	mutex sync.RWMutex
+
+	conn        net.PacketConn
+	currentAddr net.Addr
+
+	batchWriter *batchWriter
+
+	// rewrite is applied to every packet before it is written, if set. Packets are dropped if it returns nil.
+	rewrite func([]byte) []byte
 }
 
 var _ connection = &udpConn{}
 
 func (c *udpConn) write(p []byte) error {
-	_, err := c.conn.WriteToUDP(p, c.currentAddr)
+	c.mutex.RLock()
+	addr := c.currentAddr
+	c.mutex.RUnlock()
+	if c.rewrite != nil {
+		if p = c.rewrite(p); p == nil {
+			return nil
+		}
+	}
+	_, err := c.conn.WriteTo(p, addr)
 	return err
 }
 
+// writeBatch writes multiple packets to the current remote address.
+// It must not be called concurrently.
+func (c *udpConn) writeBatch(packets [][]byte) error {
+	c.mutex.RLock()
+	addr := c.currentAddr
+	c.mutex.RUnlock()
+	if c.rewrite != nil {
+		rewritten := make([][]byte, 0, len(packets))
+		for _, p := range packets {
+			if p = c.rewrite(p); p != nil {
+				rewritten = append(rewritten, p)
+			}
+		}
+		packets = rewritten
+	}
+	if len(packets) == 0 {
+		return nil
+	}
+	if c.batchWriter == nil {
+		c.batchWriter = newBatchWriter(c.conn)
+	}
+	return c.batchWriter.writeBatch(packets, addr)
+}
+
 func (c *udpConn) setCurrentRemoteAddr(addr interface{}) {
-	c.currentAddr = addr.(*net.UDPAddr)
+	c.mutex.Lock()
+	c.currentAddr = addr.(net.Addr)
+	c.mutex.Unlock()
 }
 
+// IP returns the IP of the remote address.
+// It returns nil if the connection is not an IP connection.
 func (c *udpConn) IP() net.IP {
-	return c.currentAddr.IP
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if addr, ok := c.currentAddr.(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.currentAddr
 }
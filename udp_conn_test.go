@@ -0,0 +1,111 @@
+package quic
+
+import (
+	"bytes"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UDP connection", func() {
+	var (
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		c          *udpConn
+	)
+
+	BeforeEach(func() {
+		addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err = net.ListenUDP("udp", addr)
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err = net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+		c = &udpConn{conn: serverConn, currentAddr: clientConn.LocalAddr().(*net.UDPAddr)}
+	})
+
+	AfterEach(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+
+	It("reports the address of the dialing socket", func() {
+		Expect(c.RemoteAddr().String()).To(Equal(clientConn.LocalAddr().String()))
+		Expect(c.IP().Equal(net.IPv4(127, 0, 0, 1))).To(BeTrue())
+	})
+
+	It("reports the local address", func() {
+		Expect(c.LocalAddr().String()).To(Equal(serverConn.LocalAddr().String()))
+	})
+
+	It("updates the remote address", func() {
+		addr := &net.UDPAddr{IP: net.IPv4(192, 168, 13, 37), Port: 1337}
+		c.setCurrentRemoteAddr(addr)
+		Expect(c.RemoteAddr()).To(Equal(addr))
+	})
+
+	It("writes to the current remote address", func() {
+		err := c.write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 6)
+		n, err := clientConn.Read(b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b[:n]).To(Equal([]byte("foobar")))
+	})
+
+	It("writes batches of packets to the current remote address", func() {
+		err := c.writeBatch([][]byte{[]byte("foo"), []byte("bar"), []byte("foobar")})
+		Expect(err).ToNot(HaveOccurred())
+		b := make([]byte, 6)
+		for _, expected := range []string{"foo", "bar", "foobar"} {
+			n, err := clientConn.Read(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b[:n])).To(Equal(expected))
+		}
+	})
+
+	Context("rewriting packets", func() {
+		BeforeEach(func() {
+			c.rewrite = func(p []byte) []byte {
+				if string(p) == "drop" {
+					return nil
+				}
+				return bytes.ToUpper(p)
+			}
+		})
+
+		It("rewrites packets", func() {
+			err := c.write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			b := make([]byte, 6)
+			n, err := clientConn.Read(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b[:n]).To(Equal([]byte("FOOBAR")))
+		})
+
+		It("drops packets", func() {
+			err := c.write([]byte("drop"))
+			Expect(err).ToNot(HaveOccurred())
+			err = c.write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			b := make([]byte, 6)
+			n, err := clientConn.Read(b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b[:n]).To(Equal([]byte("FOOBAR")))
+		})
+
+		It("drops packets in batches", func() {
+			err := c.writeBatch([][]byte{[]byte("foo"), []byte("drop"), []byte("bar")})
+			Expect(err).ToNot(HaveOccurred())
+			err = c.writeBatch([][]byte{[]byte("drop")})
+			Expect(err).ToNot(HaveOccurred())
+			b := make([]byte, 6)
+			for _, expected := range []string{"FOO", "BAR"} {
+				n, err := clientConn.Read(b)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(b[:n])).To(Equal(expected))
+			}
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package utils
+
+import "github.com/lucas-clemente/quic-go/protocol"
+
+// The functions in this file treat a ByteIntervalList as a set of bytes.
+// The intervals are sorted, don't overlap and are never empty.
+
+// AddRange adds the range [start, end) to the set.
+// Intervals that overlap with or touch the range are merged.
+func (l *ByteIntervalList) AddRange(start, end protocol.ByteCount) {
+	if start >= end {
+		return
+	}
+	var next *ByteIntervalElement
+	for e := l.Front(); e != nil; e = next {
+		next = e.Next()
+		if e.Value.End < start {
+			continue
+		}
+		if e.Value.Start > end {
+			l.InsertBefore(ByteInterval{Start: start, End: end}, e)
+			return
+		}
+		// merge the interval into the range
+		start = MinByteCount(start, e.Value.Start)
+		end = MaxByteCount(end, e.Value.End)
+		l.Remove(e)
+	}
+	l.PushBack(ByteInterval{Start: start, End: end})
+}
+
+// RemoveRange removes the range [start, end) from the set.
+func (l *ByteIntervalList) RemoveRange(start, end protocol.ByteCount) {
+	var next *ByteIntervalElement
+	for e := l.Front(); e != nil; e = next {
+		next = e.Next()
+		if e.Value.Start >= end {
+			return
+		}
+		if e.Value.End <= start {
+			continue
+		}
+		switch {
+		case start <= e.Value.Start && end >= e.Value.End:
+			l.Remove(e)
+		case start <= e.Value.Start:
+			e.Value.Start = end
+		case end >= e.Value.End:
+			e.Value.End = start
+		default:
+			l.InsertAfter(ByteInterval{Start: end, End: e.Value.End}, e)
+			e.Value.End = start
+		}
+	}
+}
+
+// NextInterval returns the first part of the set at or after offset.
+// It returns false if the set doesn't contain any bytes at or after offset.
+func (l *ByteIntervalList) NextInterval(offset protocol.ByteCount) (ByteInterval, bool) {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.End <= offset {
+			continue
+		}
+		return ByteInterval{Start: MaxByteCount(offset, e.Value.Start), End: e.Value.End}, true
+	}
+	return ByteInterval{}, false
+}
+
+// Intersections returns the parts of the range [start, end) that are contained in the set, in order.
+func (l *ByteIntervalList) Intersections(start, end protocol.ByteCount) []ByteInterval {
+	var intersections []ByteInterval
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.Start >= end {
+			break
+		}
+		lo := MaxByteCount(start, e.Value.Start)
+		hi := MinByteCount(end, e.Value.End)
+		if lo < hi {
+			intersections = append(intersections, ByteInterval{Start: lo, End: hi})
+		}
+	}
+	return intersections
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"github.com/lucas-clemente/quic-go/protocol"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ByteIntervalList ranges", func() {
+	var l *ByteIntervalList
+
+	intervals := func() []ByteInterval {
+		var intvs []ByteInterval
+		for e := l.Front(); e != nil; e = e.Next() {
+			intvs = append(intvs, e.Value)
+		}
+		return intvs
+	}
+
+	BeforeEach(func() {
+		l = NewByteIntervalList()
+	})
+
+	Context("adding ranges", func() {
+		It("adds a range to an empty list", func() {
+			l.AddRange(5, 10)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 5, End: 10}}))
+		})
+
+		It("ignores empty ranges", func() {
+			l.AddRange(5, 5)
+			Expect(l.Len()).To(BeZero())
+		})
+
+		It("keeps the intervals sorted", func() {
+			l.AddRange(20, 30)
+			l.AddRange(0, 5)
+			l.AddRange(10, 15)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 5}, {Start: 10, End: 15}, {Start: 20, End: 30}}))
+		})
+
+		It("merges touching intervals", func() {
+			l.AddRange(0, 5)
+			l.AddRange(10, 15)
+			l.AddRange(5, 10)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 15}}))
+		})
+
+		It("merges overlapping intervals", func() {
+			l.AddRange(0, 5)
+			l.AddRange(10, 15)
+			l.AddRange(20, 25)
+			l.AddRange(3, 12)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 15}, {Start: 20, End: 25}}))
+		})
+
+		It("adds a range that is already contained", func() {
+			l.AddRange(0, 10)
+			l.AddRange(2, 5)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 10}}))
+		})
+	})
+
+	Context("removing ranges", func() {
+		BeforeEach(func() {
+			l.AddRange(0, 10)
+			l.AddRange(20, 30)
+		})
+
+		It("removes the beginning of an interval", func() {
+			l.RemoveRange(0, 5)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 5, End: 10}, {Start: 20, End: 30}}))
+		})
+
+		It("removes the end of an interval", func() {
+			l.RemoveRange(25, 30)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 10}, {Start: 20, End: 25}}))
+		})
+
+		It("splits an interval", func() {
+			l.RemoveRange(3, 5)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 3}, {Start: 5, End: 10}, {Start: 20, End: 30}}))
+		})
+
+		It("removes a range spanning multiple intervals", func() {
+			l.RemoveRange(5, 25)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 5}, {Start: 25, End: 30}}))
+		})
+
+		It("removes whole intervals", func() {
+			l.RemoveRange(0, 30)
+			Expect(l.Len()).To(BeZero())
+		})
+
+		It("doesn't change anything when removing a range that is not contained", func() {
+			l.RemoveRange(12, 18)
+			Expect(intervals()).To(Equal([]ByteInterval{{Start: 0, End: 10}, {Start: 20, End: 30}}))
+		})
+	})
+
+	Context("getting the next interval", func() {
+		BeforeEach(func() {
+			l.AddRange(10, 20)
+			l.AddRange(30, 40)
+		})
+
+		It("returns the next interval", func() {
+			intv, ok := l.NextInterval(0)
+			Expect(ok).To(BeTrue())
+			Expect(intv).To(Equal(ByteInterval{Start: 10, End: 20}))
+		})
+
+		It("cuts off the part of the interval before the offset", func() {
+			intv, ok := l.NextInterval(15)
+			Expect(ok).To(BeTrue())
+			Expect(intv).To(Equal(ByteInterval{Start: 15, End: 20}))
+		})
+
+		It("skips intervals ending at the offset", func() {
+			intv, ok := l.NextInterval(20)
+			Expect(ok).To(BeTrue())
+			Expect(intv).To(Equal(ByteInterval{Start: 30, End: 40}))
+		})
+
+		It("returns false after the last interval", func() {
+			_, ok := l.NextInterval(40)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("intersections", func() {
+		BeforeEach(func() {
+			l.AddRange(10, 20)
+			l.AddRange(30, 40)
+		})
+
+		It("returns the parts of a range contained in the set", func() {
+			Expect(l.Intersections(15, 35)).To(Equal([]ByteInterval{{Start: 15, End: 20}, {Start: 30, End: 35}}))
+		})
+
+		It("returns nothing for a range outside of the set", func() {
+			Expect(l.Intersections(20, 30)).To(BeEmpty())
+			Expect(l.Intersections(40, protocol.MaxByteCount)).To(BeEmpty())
+		})
+	})
+})
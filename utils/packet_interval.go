@@ -0,0 +1,10 @@
+package utils
+
+import "github.com/lucas-clemente/quic-go/protocol"
+
+// PacketInterval is an interval from one PacketNumber to the other, including both ends
+// +gen linkedlist
+type PacketInterval struct {
+	Start protocol.PacketNumber
+	End   protocol.PacketNumber
+}
@@ -22,6 +22,31 @@ type Stream interface {
 	io.Closer
 	StreamID() protocol.StreamID
 	CloseRemote(offset protocol.ByteCount)
+	Stats() StreamStats
+	// Flush makes the data written so far eligible for the next packet, instead of waiting for more data to fill the packet
+	Flush() error
+	// SetNoDelay makes every Write behave as if it was followed by a Flush, trading efficiency for latency
+	SetNoDelay(bool)
+	// Reset aborts the stream with a RST_STREAM carrying the error code, instead of closing it with a FIN
+	Reset(errorCode uint32)
+}
+
+// StreamStats are the counters of a single stream
+type StreamStats struct {
+	BytesRead      protocol.ByteCount
+	BytesWritten   protocol.ByteCount
+	FramesReceived uint64
+	FramesSent     uint64
+	// FinReceived is set once all data up to the peer's FIN was read
+	FinReceived bool
+	// FinSent is set once the stream was closed for writing
+	FinSent bool
+	// Reset is set if the stream was terminated by an error, e.g. a RST_STREAM
+	Reset bool
+	// SendWindow is the number of bytes that can be sent before the stream is blocked by stream-level flow control
+	SendWindow protocol.ByteCount
+	// ReceiveWindow is the number of bytes the peer can send before exceeding the stream-level flow control window
+	ReceiveWindow protocol.ByteCount
 }
 
 // ReadUintN reads N bytes